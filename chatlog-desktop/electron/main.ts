@@ -3,6 +3,7 @@ import { createRequire } from 'node:module'
 import { fileURLToPath } from 'node:url'
 import path from 'node:path'
 import { spawn } from 'node:child_process'
+import { randomBytes } from 'node:crypto'
 import waitOn from 'wait-on'
 import fs from 'node:fs'
 
@@ -29,6 +30,9 @@ process.env.VITE_PUBLIC = VITE_DEV_SERVER_URL ? path.join(process.env.APP_ROOT,
 
 let win: BrowserWindow | null
 let backend: ReturnType<typeof spawn> | null = null
+// Per-launch token for the backend control API. The renderer is loaded from file:// and
+// sends `Origin: null`, which the backend only accepts together with this bearer token.
+const controlToken = randomBytes(32).toString('hex')
 let serverCfg: {
   addr?: string
   dataDir?: string
@@ -234,7 +238,7 @@ async function spawnBackend(cfg?: Partial<typeof serverCfg>) {
   let binPath = candidates.find(p => { try { return require('fs').existsSync(p) } catch { return false } }) || ''
   const addr = serverCfg.addr || process.env.CHATLOG_HTTP_ADDR || '127.0.0.1:5030'
   serverCfg.addr = addr
-  const env = { ...process.env, CHATLOG_HTTP_ADDR: addr }
+  const env = { ...process.env, CHATLOG_HTTP_ADDR: addr, CHATLOG_CONTROL_TOKEN: controlToken }
   // Use a stable cwd in packaged app to avoid path issues
   const cwd = process.resourcesPath || rr
 
@@ -366,7 +370,12 @@ app.whenReady().then(async () => {
 })
 
 // IPC: backend control
-ipcMain.handle('backend:getState', async () => ({ running: !!backend, addr: serverCfg.addr || '127.0.0.1:5030' }))
+ipcMain.handle('backend:getState', async () => ({
+  running: !!backend,
+  addr: serverCfg.addr || '127.0.0.1:5030',
+  // an external backend has its own token, taken from the environment if set
+  controlToken: appConfig.useExternal ? (process.env.CHATLOG_CONTROL_TOKEN || '') : controlToken,
+}))
 ipcMain.handle('backend:start', async (_e, cfg: Partial<typeof serverCfg>) => {
   try {
     if (appConfig.useExternal) {
@@ -1,3 +1,5 @@
+import { IPC } from './ipc'
+
 export interface PagedResp<T> { items: T[] }
 
 export interface Session { userName: string; nickName: string; content: string; nOrder: number; nTime: string }
@@ -13,6 +15,20 @@ export function setBase(url: string) {
 }
 export function getBase() { return baseURL }
 
+// control endpoints require the per-launch token the main process passed to the backend
+let controlToken: string | null = null
+
+export function setControlToken(token: string) {
+  controlToken = token
+}
+
+async function control(url: string, init?: RequestInit): Promise<Response> {
+  if (controlToken === null) controlToken = (await IPC.getState()).controlToken || ''
+  const headers = new Headers(init?.headers)
+  if (controlToken) headers.set('Authorization', `Bearer ${controlToken}`)
+  return fetch(baseURL + url, { ...init, headers })
+}
+
 async function http<T>(url: string, init?: RequestInit): Promise<T> {
   const res = await fetch(baseURL + url, init)
   if (!res.ok) throw new Error(`${res.status} ${res.statusText}`)
@@ -36,27 +52,27 @@ export const Backend = {
     http<Message[]>(`/api/v1/chatlog?format=json&time=${encodeURIComponent(params.time)}${params.talker ? `&talker=${encodeURIComponent(params.talker)}` : ''}${params.sender ? `&sender=${encodeURIComponent(params.sender)}` : ''}${params.keyword ? `&keyword=${encodeURIComponent(params.keyword)}` : ''}${params.limit ? `&limit=${params.limit}` : ''}${params.offset ? `&offset=${params.offset}` : ''}`),
   // control endpoints
   controlAutoDecrypt: async (enable: boolean) => {
-    const res = await fetch(baseURL + '/api/v1/control/autodecrypt', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ enable }) })
+    const res = await control('/api/v1/control/autodecrypt', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ enable }) })
     if (!res.ok) throw new Error('autodecrypt failed')
     return res.json()
   },
   controlDecrypt: async () => {
-    const res = await fetch(baseURL + '/api/v1/control/decrypt', { method: 'POST' })
+    const res = await control('/api/v1/control/decrypt', { method: 'POST' })
     if (!res.ok) throw new Error('decrypt failed')
     return res.json()
   },
   controlConfig: async (payload: Partial<{ addr: string; dataDir: string; dataKey: string; imgKey: string; workDir: string; platform: string; version: number }>) => {
-    const res = await fetch(baseURL + '/api/v1/control/config', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(payload) })
+    const res = await control('/api/v1/control/config', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(payload) })
     if (!res.ok) throw new Error('config failed')
     return res.json()
   },
   controlInstances: async () => {
-    const res = await fetch(baseURL + '/api/v1/control/instances')
+    const res = await control('/api/v1/control/instances')
     if (!res.ok) throw new Error('instances failed')
     return res.json() as Promise<{ items: { pid: number; name: string; full_version: string; data_dir: string }[] }>
   },
   controlState: async () => {
-    const res = await fetch(baseURL + '/api/v1/control/state')
+    const res = await control('/api/v1/control/state')
     if (!res.ok) throw new Error('state failed')
     return res.json() as Promise<any>
   },
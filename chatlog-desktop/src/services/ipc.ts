@@ -10,7 +10,7 @@ export type BackendCfg = Partial<{
 }>
 
 export const IPC = {
-  getState: () => window.ipcRenderer.invoke('backend:getState') as Promise<{ running: boolean; addr: string }>,
+  getState: () => window.ipcRenderer.invoke('backend:getState') as Promise<{ running: boolean; addr: string; controlToken: string }>,
   start: (cfg: BackendCfg) => window.ipcRenderer.invoke('backend:start', cfg) as Promise<{ ok: boolean }>,
   stop: () => window.ipcRenderer.invoke('backend:stop') as Promise<{ ok: boolean }>,
   getDataKey: (p: { pid?: number; force?: boolean; showXorKey?: boolean }) => window.ipcRenderer.invoke('op:getDataKey', p) as Promise<{ ok: boolean; output?: string; error?: string }>,
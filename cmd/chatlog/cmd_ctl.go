@@ -0,0 +1,357 @@
+package chatlog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.PersistentFlags().StringVarP(&ctlSocket, "socket", "s", "", "control socket, defaults to chatlog.sock in the config dir")
+	ctlCmd.AddCommand(ctlStatusCmd, ctlDecryptCmd, ctlAutoDecryptCmd, ctlSwitchCmd, ctlReloadCmd, ctlJobsCmd, ctlRunCmd)
+}
+
+var ctlSocket string
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Manage a running chatlog daemon",
+}
+
+var ctlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show daemon config and database state",
+	Args:  cobra.NoArgs,
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		var state struct {
+			HTTPAddr    string `json:"http_addr"`
+			DataDir     string `json:"data_dir"`
+			WorkDir     string `json:"work_dir"`
+			Platform    string `json:"platform"`
+			Version     int    `json:"version"`
+			AutoDecrypt bool   `json:"auto_decrypt"`
+		}
+		if err := c.do(http.MethodGet, "/api/v1/control/state", nil, &state); err != nil {
+			return err
+		}
+		var health struct {
+			State            string     `json:"state"`
+			Since            time.Time  `json:"since"`
+			Msg              string     `json:"msg"`
+			LastDecrypt      *time.Time `json:"lastDecrypt"`
+			LastDecryptError string     `json:"lastDecryptError"`
+		}
+		if err := c.do(http.MethodGet, "/api/v1/control/health", nil, &health); err != nil {
+			return err
+		}
+
+		fmt.Printf("addr:         %s\n", state.HTTPAddr)
+		fmt.Printf("platform:     %s v%d\n", state.Platform, state.Version)
+		fmt.Printf("data dir:     %s\n", state.DataDir)
+		fmt.Printf("work dir:     %s\n", state.WorkDir)
+		fmt.Printf("auto decrypt: %s\n", onOff(state.AutoDecrypt))
+		fmt.Printf("database:     %s since %s\n", health.State, health.Since.Format(time.RFC3339))
+		if health.Msg != "" {
+			fmt.Printf("              %s\n", health.Msg)
+		}
+		if health.LastDecrypt != nil {
+			fmt.Printf("last decrypt: %s\n", health.LastDecrypt.Format(time.RFC3339))
+			if health.LastDecryptError != "" {
+				fmt.Printf("              %s\n", health.LastDecryptError)
+			}
+		}
+		return nil
+	}),
+}
+
+var ctlDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Decrypt all database files and reload the database",
+	Args:  cobra.NoArgs,
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		err := c.stream(http.MethodPost, "/api/v1/control/decrypt?stream=1", func(event string, data []byte) error {
+			switch event {
+			case "progress":
+				var p struct {
+					FilesDone  int     `json:"filesDone"`
+					FilesTotal int     `json:"filesTotal"`
+					Percent    float64 `json:"percent"`
+				}
+				if err := json.Unmarshal(data, &p); err == nil {
+					fmt.Fprintf(os.Stderr, "\rdecrypting %d/%d files, %.1f%%", p.FilesDone, p.FilesTotal, p.Percent)
+				}
+			case "error":
+				var e struct {
+					Error string `json:"error"`
+				}
+				json.Unmarshal(data, &e)
+				return fmt.Errorf("%s", e.Error)
+			}
+			return nil
+		})
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		fmt.Println("decrypt success")
+		return nil
+	}),
+}
+
+var ctlAutoDecryptCmd = &cobra.Command{
+	Use:       "autodecrypt on|off",
+	Short:     "Turn auto decrypt on or off",
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"on", "off"},
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		enable := args[0] == "on"
+		if err := c.do(http.MethodPost, "/api/v1/control/autodecrypt", map[string]bool{"enable": enable}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("auto decrypt %s\n", onOff(enable))
+		return nil
+	}),
+}
+
+var ctlSwitchCmd = &cobra.Command{
+	Use:   "switch <account>",
+	Short: "Switch to another running WeChat account",
+	Args:  cobra.ExactArgs(1),
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		var resp struct {
+			WorkDir string `json:"work_dir"`
+		}
+		if err := c.do(http.MethodPost, "/api/v1/control/switch", map[string]string{"account": args[0]}, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("switched to %s, work dir %s\n", args[0], resp.WorkDir)
+		return nil
+	}),
+}
+
+var ctlReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reopen the database",
+	Args:  cobra.NoArgs,
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		if err := c.do(http.MethodPost, "/api/v1/control/reload", nil, nil); err != nil {
+			return err
+		}
+		fmt.Println("reload success")
+		return nil
+	}),
+}
+
+// ctlJob 与控制接口返回的任务状态对应
+type ctlJob struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Schedule string      `json:"schedule"`
+	Next     time.Time   `json:"next"`
+	Running  bool        `json:"running"`
+	LastRun  *ctlJobRun  `json:"lastRun"`
+	History  []ctlJobRun `json:"history"`
+}
+
+type ctlJobRun struct {
+	Trigger string    `json:"trigger"`
+	Status  string    `json:"status"`
+	Start   time.Time `json:"start"`
+	Error   string    `json:"error"`
+	Result  string    `json:"result"`
+}
+
+func (r *ctlJobRun) String() string {
+	s := fmt.Sprintf("%s %-7s %s", r.Start.Format(time.RFC3339), r.Status, r.Trigger)
+	if r.Error != "" {
+		s += "  " + r.Error
+	} else if r.Result != "" {
+		s += "  " + strings.ReplaceAll(r.Result, "\n", " ")
+	}
+	return s
+}
+
+var ctlJobsCmd = &cobra.Command{
+	Use:   "jobs [name]",
+	Short: "List scheduled jobs, or show the recent runs of a job",
+	Args:  cobra.MaximumNArgs(1),
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		if len(args) == 1 {
+			var job ctlJob
+			if err := c.do(http.MethodGet, "/api/v1/control/jobs/"+url.PathEscape(args[0]), nil, &job); err != nil {
+				return err
+			}
+			fmt.Printf("%s (%s, %s), next %s\n", job.Name, job.Type, job.Schedule, job.Next.Format(time.RFC3339))
+			for i := range job.History {
+				fmt.Println(job.History[i].String())
+			}
+			return nil
+		}
+
+		var resp struct {
+			Items []ctlJob `json:"items"`
+		}
+		if err := c.do(http.MethodGet, "/api/v1/control/jobs", nil, &resp); err != nil {
+			return err
+		}
+		for _, job := range resp.Items {
+			last := "never run"
+			if job.Running {
+				last = "running"
+			} else if job.LastRun != nil {
+				last = job.LastRun.String()
+			}
+			fmt.Printf("%-20s %-10s %-16s next %s  last %s\n", job.Name, job.Type, job.Schedule, job.Next.Format(time.RFC3339), last)
+		}
+		return nil
+	}),
+}
+
+var ctlRunCmd = &cobra.Command{
+	Use:   "run <job>",
+	Short: "Run a scheduled job now, check the result with chatlog ctl jobs <job>",
+	Args:  cobra.ExactArgs(1),
+	Run: ctlRun(func(c *ctlClient, args []string) error {
+		if err := c.do(http.MethodPost, "/api/v1/control/jobs/"+url.PathEscape(args[0])+"/run", nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("job %s started\n", args[0])
+		return nil
+	}),
+}
+
+// ctlRun 连接控制套接字后执行 fn，出错时输出日志
+func ctlRun(fn func(c *ctlClient, args []string) error) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		_, socket, err := daemonPaths("", ctlSocket)
+		if err != nil {
+			log.Err(err).Msg("failed to locate control socket")
+			return
+		}
+		if err := fn(newCtlClient(socket), args); err != nil {
+			log.Err(err).Msgf("chatlog ctl %s failed", cmd.Name())
+		}
+	}
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// ctlClient 通过 Unix 套接字调用后台服务的控制接口
+type ctlClient struct {
+	socket string
+	client *http.Client
+}
+
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// request 发送请求，非 2xx 响应转换为错误
+func (c *ctlClient) request(method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://chatlog"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("chatlog daemon is not running on %s: %w", c.socket, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// do 发送请求，out 不为 nil 时解析 JSON 响应
+func (c *ctlClient) do(method, path string, body, out any) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream 发送请求并逐个处理 SSE 事件，fn 返回错误时停止
+func (c *ctlClient) stream(method, path string, fn func(event string, data []byte) error) error {
+	resp, err := c.request(method, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if err := fn(event, []byte(strings.TrimPrefix(line, "data:"))); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// responseError 从错误响应中取出错误信息，控制接口的错误是 JSON 字符串或带 error 字段的对象
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	var msg string
+	if json.Unmarshal(b, &msg) == nil && msg != "" {
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	var obj struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(b, &obj) == nil && obj.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, obj.Error)
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
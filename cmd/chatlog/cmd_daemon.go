@@ -0,0 +1,183 @@
+package chatlog
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/v4/process"
+	"github.com/spf13/cobra"
+
+	"github.com/sjzar/chatlog/internal/chatlog"
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	addServerFlags(daemonCmd)
+	daemonCmd.Flags().BoolVarP(&daemonForeground, "foreground", "f", false, "run in the foreground instead of detaching")
+	daemonCmd.Flags().StringVarP(&daemonPIDFile, "pid-file", "", "", "pid file, defaults to chatlog.pid in the config dir")
+	daemonCmd.Flags().StringVarP(&daemonSocket, "socket", "s", "", "control socket, defaults to chatlog.sock in the config dir")
+}
+
+var (
+	daemonForeground bool
+	daemonPIDFile    string
+	daemonSocket     string
+)
+
+// daemonStartTimeout 等待后台服务的控制套接字可用的最长时间
+const daemonStartTimeout = 30 * time.Second
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run HTTP server in the background, managed with chatlog ctl",
+	Run: func(cmd *cobra.Command, args []string) {
+		pidFile, socket, err := daemonPaths(daemonPIDFile, daemonSocket)
+		if err != nil {
+			log.Err(err).Msg("failed to prepare daemon files")
+			return
+		}
+		if pid, ok := runningPID(pidFile); ok {
+			log.Error().Msgf("chatlog daemon is already running, pid %d", pid)
+			return
+		}
+
+		if !daemonForeground {
+			pid, err := startDaemon(socket)
+			if err != nil {
+				log.Err(err).Msg("failed to start daemon")
+				return
+			}
+			fmt.Printf("chatlog daemon started, pid %d, socket %s\n", pid, socket)
+			return
+		}
+
+		unlock, err := lockPIDFile(pidFile)
+		if err != nil {
+			log.Err(err).Msg("failed to lock pid file")
+			return
+		}
+		defer unlock()
+
+		m := chatlog.New()
+		if err := m.CommandDaemon("", resolveServerConfig(), socket); err != nil {
+			log.Err(err).Msg("failed to run daemon")
+		}
+	},
+}
+
+// daemonPaths 返回 pid 文件和控制套接字的路径，未指定时放在配置目录下
+func daemonPaths(pidFile, socket string) (string, string, error) {
+	if pidFile != "" && socket != "" {
+		return pidFile, socket, nil
+	}
+	dir, err := conf.ConfigDir("")
+	if err != nil {
+		return "", "", err
+	}
+	if pidFile == "" {
+		pidFile = filepath.Join(dir, conf.DaemonPIDFile)
+	}
+	if socket == "" {
+		socket = filepath.Join(dir, conf.DaemonSocket)
+	}
+	return pidFile, socket, nil
+}
+
+// runningPID 返回 pid 文件中记录的进程，进程已退出时返回 false
+func runningPID(pidFile string) (int, bool) {
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	exists, err := process.PidExists(int32(pid))
+	return pid, err == nil && exists
+}
+
+// lockPIDFile 以排他锁打开 pid 文件并写入当前进程号，锁在进程退出前一直持有
+// 另一个进程已持有锁时返回错误，进程异常退出后锁由系统释放，不会因残留的文件无法启动
+func lockPIDFile(pidFile string) (func(), error) {
+	f, err := os.OpenFile(pidFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if pid, ok := runningPID(pidFile); ok {
+			return nil, fmt.Errorf("chatlog daemon is already running, pid %d", pid)
+		}
+		return nil, fmt.Errorf("pid file %s is locked by another process: %w", pidFile, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		os.Remove(pidFile)
+		f.Close()
+	}, nil
+}
+
+// startDaemon 以 --foreground 重新启动当前命令并脱离终端，输出写入配置目录下的日志文件
+// 控制套接字可用后返回，启动失败时提示查看日志
+func startDaemon(socket string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	dir, err := conf.ConfigDir("")
+	if err != nil {
+		return 0, err
+	}
+	logPath := filepath.Join(dir, conf.DaemonLogFile)
+	logFD, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer logFD.Close()
+
+	args := append(os.Args[1:], "--foreground")
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = logFD
+	cmd.Stderr = logFD
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	client := newCtlClient(socket)
+	deadline := time.After(daemonStartTimeout)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-exited:
+			return 0, fmt.Errorf("daemon exited (%v), see %s", err, logPath)
+		case <-deadline:
+			return 0, fmt.Errorf("daemon did not open %s in %s, see %s", socket, daemonStartTimeout, logPath)
+		case <-tick.C:
+			if err := client.do("GET", "/health", nil, nil); err == nil {
+				return cmd.Process.Pid, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package chatlog
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLockPIDFile(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "chatlog.pid")
+	// 残留的 pid 文件不影响启动
+	if err := os.WriteFile(pidFile, []byte("999999"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(pidFile); string(b) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("pid file = %q", b)
+	}
+	if _, err := lockPIDFile(pidFile); err == nil {
+		t.Fatal("second lock on the pid file should fail")
+	}
+
+	unlock()
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Fatalf("pid file not removed: %v", err)
+	}
+	unlock, err = lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	unlock()
+}
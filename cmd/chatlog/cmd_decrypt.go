@@ -16,6 +16,7 @@ func init() {
 	decryptCmd.Flags().StringVarP(&decryptDataDir, "data-dir", "d", "", "data dir")
 	decryptCmd.Flags().StringVarP(&decryptDatakey, "data-key", "k", "", "data key")
 	decryptCmd.Flags().StringVarP(&decryptWorkDir, "work-dir", "w", "", "work dir")
+	decryptCmd.Flags().IntVarP(&decryptJobs, "jobs", "j", 0, "number of concurrent decrypt workers, defaults to the number of CPUs")
 }
 
 var (
@@ -24,6 +25,7 @@ var (
 	decryptDataDir  string
 	decryptDatakey  string
 	decryptWorkDir  string
+	decryptJobs     int
 )
 
 var decryptCmd = &cobra.Command{
@@ -59,5 +61,8 @@ func getDecryptConfig() map[string]any {
 	if decryptVer != 0 {
 		cmdConf["version"] = decryptVer
 	}
+	if decryptJobs > 0 {
+		cmdConf["decrypt_jobs"] = decryptJobs
+	}
 	return cmdConf
 }
@@ -14,18 +14,35 @@ func init() {
 	keyCmd.Flags().IntVarP(&keyPID, "pid", "p", 0, "pid")
 	keyCmd.Flags().BoolVarP(&keyForce, "force", "f", false, "force")
 	keyCmd.Flags().BoolVarP(&keyShowXorKey, "xor-key", "x", false, "show xor key")
+	keyCmd.Flags().StringVar(&keyFromDump, "from-dump", "", "memory dump file")
+	keyCmd.Flags().StringVarP(&keyDataDir, "data-dir", "d", "", "data dir")
+	keyCmd.Flags().StringVar(&keyPlatform, "platform", "darwin", "platform")
+	keyCmd.Flags().IntVarP(&keyVersion, "version", "v", 0, "version")
 }
 
 var (
 	keyPID        int
 	keyForce      bool
 	keyShowXorKey bool
+	keyFromDump   string
+	keyDataDir    string
+	keyPlatform   string
+	keyVersion    int
 )
 var keyCmd = &cobra.Command{
 	Use:   "key",
 	Short: "key",
 	Run: func(cmd *cobra.Command, args []string) {
 		m := chatlog.New()
+		if len(keyFromDump) != 0 {
+			ret, err := m.CommandKeyFromDump(keyFromDump, keyDataDir, keyPlatform, keyVersion)
+			if err != nil {
+				log.Err(err).Msg("failed to get key from memory dump")
+				return
+			}
+			fmt.Println(ret)
+			return
+		}
 		ret, err := m.CommandKey("", keyPID, keyForce, keyShowXorKey)
 		if err != nil {
 			log.Err(err).Msg("failed to get key")
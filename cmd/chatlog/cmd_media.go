@@ -0,0 +1,73 @@
+package chatlog
+
+import (
+	"fmt"
+
+	"github.com/sjzar/chatlog/internal/chatlog"
+	"github.com/sjzar/chatlog/pkg/util"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(mediaCmd)
+	mediaCmd.AddCommand(mediaExportCmd)
+	mediaExportCmd.Flags().StringVarP(&mediaPlatform, "platform", "p", "", "platform")
+	mediaExportCmd.Flags().IntVarP(&mediaVer, "version", "v", 0, "version")
+	mediaExportCmd.Flags().StringVarP(&mediaDataDir, "data-dir", "d", "", "data dir")
+	mediaExportCmd.Flags().StringVarP(&mediaImgKey, "img-key", "i", "", "img key")
+	mediaExportCmd.Flags().StringVarP(&mediaWorkDir, "work-dir", "w", "", "work dir")
+	mediaExportCmd.Flags().StringVarP(&mediaTalker, "talker", "t", "", "talker, separated by commas, all sessions if empty")
+	mediaExportCmd.Flags().StringVar(&mediaTime, "time", "", "time range, e.g. 2024-01-01~2024-06-30")
+	mediaExportCmd.Flags().StringVar(&mediaTypes, "types", "", "media types, separated by commas: image,video,voice,file")
+	mediaExportCmd.Flags().StringVarP(&mediaOutput, "output", "o", "", "output dir")
+}
+
+var (
+	mediaPlatform string
+	mediaVer      int
+	mediaDataDir  string
+	mediaImgKey   string
+	mediaWorkDir  string
+	mediaTalker   string
+	mediaTime     string
+	mediaTypes    string
+	mediaOutput   string
+)
+
+var mediaCmd = &cobra.Command{
+	Use:   "media",
+	Short: "media",
+}
+
+var mediaExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export decrypted images, videos, voices and files",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		cmdConf := make(map[string]any)
+		if len(mediaDataDir) != 0 {
+			cmdConf["data_dir"] = mediaDataDir
+		}
+		if len(mediaImgKey) != 0 {
+			cmdConf["img_key"] = mediaImgKey
+		}
+		if len(mediaWorkDir) != 0 {
+			cmdConf["work_dir"] = mediaWorkDir
+		}
+		if len(mediaPlatform) != 0 {
+			cmdConf["platform"] = mediaPlatform
+		}
+		if mediaVer != 0 {
+			cmdConf["version"] = mediaVer
+		}
+
+		m := chatlog.New()
+		if err := m.CommandMediaExport("", cmdConf, mediaTalker, mediaTime, util.Str2List(mediaTypes, ","), mediaOutput); err != nil {
+			log.Err(err).Msg("failed to export media")
+			return
+		}
+		fmt.Println("export success")
+	},
+}
@@ -11,14 +11,19 @@ import (
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
-	serverCmd.Flags().StringVarP(&serverAddr, "addr", "a", "", "server address")
-	serverCmd.Flags().StringVarP(&serverPlatform, "platform", "p", "", "platform")
-	serverCmd.Flags().IntVarP(&serverVer, "version", "v", 0, "version")
-	serverCmd.Flags().StringVarP(&serverDataDir, "data-dir", "d", "", "data dir")
-	serverCmd.Flags().StringVarP(&serverDataKey, "data-key", "k", "", "data key")
-	serverCmd.Flags().StringVarP(&serverImgKey, "img-key", "i", "", "img key")
-	serverCmd.Flags().StringVarP(&serverWorkDir, "work-dir", "w", "", "work dir")
-	serverCmd.Flags().BoolVarP(&serverAutoDecrypt, "auto-decrypt", "", false, "auto decrypt")
+	addServerFlags(serverCmd)
+}
+
+// addServerFlags 注册服务配置的命令行参数，server 和 daemon 命令共用
+func addServerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&serverAddr, "addr", "a", "", "server address")
+	cmd.Flags().StringVarP(&serverPlatform, "platform", "p", "", "platform")
+	cmd.Flags().IntVarP(&serverVer, "version", "v", 0, "version")
+	cmd.Flags().StringVarP(&serverDataDir, "data-dir", "d", "", "data dir")
+	cmd.Flags().StringVarP(&serverDataKey, "data-key", "k", "", "data key")
+	cmd.Flags().StringVarP(&serverImgKey, "img-key", "i", "", "img key")
+	cmd.Flags().StringVarP(&serverWorkDir, "work-dir", "w", "", "work dir")
+	cmd.Flags().BoolVarP(&serverAutoDecrypt, "auto-decrypt", "", false, "auto decrypt")
 }
 
 var (
@@ -37,23 +42,7 @@ var serverCmd = &cobra.Command{
 	Short: "Start HTTP server",
 	Run: func(cmd *cobra.Command, args []string) {
 
-		cmdConf := getServerConfig()
-		log.Info().Msgf("server cmd config: %+v", cmdConf)
-
-		// Auto-acquire dataKey if not provided and auto-decrypt is enabled
-		if (cmdConf["data_key"] == nil || cmdConf["data_key"] == "") &&
-		   (cmdConf["auto_decrypt"] == true || cmdConf["data_key"] == "default-key-for-initial-setup") {
-
-			log.Info().Msg("No dataKey provided, attempting to auto-acquire...")
-
-			// Try to acquire dataKey
-			if dataKey := acquireDataKey(cmdConf); dataKey != "" {
-				cmdConf["data_key"] = dataKey
-				log.Info().Msgf("Auto-acquired dataKey (length: %d)", len(dataKey))
-			} else {
-				log.Warn().Msg("Failed to auto-acquire dataKey, server may not function properly")
-			}
-		}
+		cmdConf := resolveServerConfig()
 
 		m := chatlog.New()
 		if err := m.CommandHTTPServer("", cmdConf); err != nil {
@@ -63,6 +52,28 @@ var serverCmd = &cobra.Command{
 	},
 }
 
+// resolveServerConfig 返回命令行参数中的服务配置，开启自动解密但没有提供密钥时尝试从微信进程获取
+func resolveServerConfig() map[string]any {
+	cmdConf := getServerConfig()
+	log.Info().Msgf("server cmd config: %+v", cmdConf)
+
+	// Auto-acquire dataKey if not provided and auto-decrypt is enabled
+	if (cmdConf["data_key"] == nil || cmdConf["data_key"] == "") &&
+	   (cmdConf["auto_decrypt"] == true || cmdConf["data_key"] == "default-key-for-initial-setup") {
+
+		log.Info().Msg("No dataKey provided, attempting to auto-acquire...")
+
+		// Try to acquire dataKey
+		if dataKey := acquireDataKey(cmdConf); dataKey != "" {
+			cmdConf["data_key"] = dataKey
+			log.Info().Msgf("Auto-acquired dataKey (length: %d)", len(dataKey))
+		} else {
+			log.Warn().Msg("Failed to auto-acquire dataKey, server may not function properly")
+		}
+	}
+	return cmdConf
+}
+
 func getServerConfig() map[string]any {
 	cmdConf := make(map[string]any)
 	if len(serverAddr) != 0 {
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package chatlog
+
+import "syscall"
+
+// detachAttr 在新的会话中启动后台服务，关闭终端时不会收到 SIGHUP
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
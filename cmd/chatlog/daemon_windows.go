@@ -0,0 +1,15 @@
+package chatlog
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// detachAttr 启动不属于当前控制台的后台服务，关闭命令行窗口时不会退出
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+		HideWindow:    true,
+	}
+}
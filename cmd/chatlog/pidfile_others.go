@@ -0,0 +1,13 @@
+//go:build !windows
+
+package chatlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 对 f 加非阻塞的排他锁，进程退出时由系统释放
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
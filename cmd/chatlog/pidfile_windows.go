@@ -0,0 +1,14 @@
+package chatlog
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile 对 f 加非阻塞的排他锁，进程退出时由系统释放
+// Windows 的文件锁会阻止其他进程读取被锁定的区域，因此锁定文件内容之外的字节，pid 仍然可以读取
+func lockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: 1}
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+}
@@ -4,14 +4,17 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/sjzar/chatlog/internal/chatlog/ctx"
+	cwechat "github.com/sjzar/chatlog/internal/chatlog/wechat"
 	"github.com/sjzar/chatlog/internal/ui/footer"
 	"github.com/sjzar/chatlog/internal/ui/form"
 	"github.com/sjzar/chatlog/internal/ui/help"
 	"github.com/sjzar/chatlog/internal/ui/infobar"
 	"github.com/sjzar/chatlog/internal/ui/menu"
+	"github.com/sjzar/chatlog/internal/ui/style"
 	"github.com/sjzar/chatlog/internal/wechat"
 
 	"github.com/gdamore/tcell/v2"
@@ -20,6 +23,9 @@ import (
 
 const (
 	RefreshInterval = 1000 * time.Millisecond
+
+	// ProgressInterval 解密进度的最小刷新间隔
+	ProgressInterval = 100 * time.Millisecond
 )
 
 type App struct {
@@ -251,8 +257,17 @@ func (a *App) initMenu() {
 
 			// 在后台执行解密操作
 			go func() {
-				// 执行解密
-				err := a.m.DecryptDBFiles()
+				// 执行解密，并实时更新进度，回调是串行的，按时间间隔合并重绘
+				var lastDraw time.Time
+				err := a.m.DecryptDBFiles(func(p cwechat.DecryptProgress) {
+					if p.FilesDone < p.FilesTotal && time.Since(lastDraw) < ProgressInterval {
+						return
+					}
+					lastDraw = time.Now()
+					a.QueueUpdateDraw(func() {
+						modal.SetText(decryptProgressText(p))
+					})
+				})
 
 				// 在主线程中更新UI
 				a.QueueUpdateDraw(func() {
@@ -524,8 +539,11 @@ func (a *App) settingHTTPPort() {
 
 	// 添加按钮 - 点击保存时才设置HTTP地址
 	formView.AddButton("保存", func() {
-		a.m.SetHTTPAddr(tempHTTPAddr) // 在这里设置HTTP地址
 		a.mainPages.RemovePage("submenu2")
+		if err := a.m.SetHTTPAddr(tempHTTPAddr); err != nil { // 在这里设置HTTP地址
+			a.showError(err)
+			return
+		}
 		a.showInfo("HTTP 地址已设置为 " + a.ctx.HTTPAddr)
 	})
 
@@ -552,8 +570,11 @@ func (a *App) settingWorkDir() {
 
 	// 添加按钮 - 点击保存时才设置工作目录
 	formView.AddButton("保存", func() {
-		a.ctx.SetWorkDir(tempWorkDir) // 在这里设置工作目录
 		a.mainPages.RemovePage("submenu2")
+		if err := a.m.SetWorkDir(tempWorkDir); err != nil { // 在这里设置工作目录
+			a.showError(err)
+			return
+		}
 		a.showInfo("工作目录已设置为 " + a.ctx.WorkDir)
 	})
 
@@ -580,8 +601,11 @@ func (a *App) settingDataKey() {
 
 	// 添加按钮 - 点击保存时才设置数据密钥
 	formView.AddButton("保存", func() {
-		a.ctx.DataKey = tempDataKey // 设置数据密钥
 		a.mainPages.RemovePage("submenu2")
+		if err := a.m.SetDataKey(tempDataKey); err != nil { // 设置数据密钥
+			a.showError(err)
+			return
+		}
 		a.showInfo("数据密钥已设置")
 	})
 
@@ -608,8 +632,11 @@ func (a *App) settingDataDir() {
 
 	// 添加按钮 - 点击保存时才设置数据目录
 	formView.AddButton("保存", func() {
-		a.ctx.DataDir = tempDataDir // 设置数据目录
 		a.mainPages.RemovePage("submenu2")
+		if err := a.m.SetDataDir(tempDataDir); err != nil { // 设置数据目录
+			a.showError(err)
+			return
+		}
 		a.showInfo("数据目录已设置为 " + a.ctx.DataDir)
 	})
 
@@ -810,3 +837,12 @@ func (a *App) showInfo(text string) {
 		a.mainPages.RemovePage("modal")
 	})
 }
+
+// decryptProgressText 生成解密进度文本
+func decryptProgressText(p cwechat.DecryptProgress) string {
+	const width = 30
+	percent := p.Percent()
+	filled := int(percent * width / 100)
+	bar := strings.Repeat(style.ProgressBarCell, filled) + strings.Repeat(" ", width-filled)
+	return fmt.Sprintf("解密中...\n\n[%s] %.1f%%\n\n文件 %d/%d", bar, percent, p.FilesDone, p.FilesTotal)
+}
@@ -0,0 +1,10 @@
+package conf
+
+// ArchiveConfig 聊天记录归档配置
+// 启用后每次打开或更新数据库时把消息追加到归档库，查询时合并归档的消息，微信中删除的消息仍然可以查询到
+type ArchiveConfig struct {
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+
+	// Path 归档库文件路径，默认为工作目录下的 archive/chatlog_archive.db
+	Path string `mapstructure:"path" json:"path"`
+}
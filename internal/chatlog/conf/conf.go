@@ -88,6 +88,43 @@ func LoadServiceConfig(configPath string, cmdConf map[string]any) (*ServerConfig
 	return conf, scm, nil
 }
 
+// ServerConfigWriter 返回只包含服务配置文件内容的配置管理器，不读取命令行参数和环境变量
+// 运行时修改的配置通过它写回配置文件，避免把命令行参数和环境变量中的口令写入文件
+func ServerConfigWriter(configPath string) (*config.Manager, error) {
+	if configPath == "" {
+		configPath = os.Getenv(EnvConfigDir)
+	}
+
+	cm, err := config.New(AppName, configPath, ServerConfigName, "", true)
+	if err != nil {
+		return nil, err
+	}
+	if err := cm.Read(); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
+
+// 后台服务使用的文件，都放在配置目录下
+const (
+	DaemonPIDFile = "chatlog.pid"
+	DaemonSocket  = "chatlog.sock"
+	DaemonLogFile = "chatlog-daemon.log"
+)
+
+// ConfigDir 返回配置目录，规则与加载配置时一致，目录不存在时创建
+func ConfigDir(configPath string) (string, error) {
+	if configPath == "" {
+		configPath = os.Getenv(EnvConfigDir)
+	}
+
+	cm, err := config.New(AppName, configPath, ServerConfigName, "", false)
+	if err != nil {
+		return "", err
+	}
+	return cm.Path, nil
+}
+
 var DataDirConfigs = map[string]bool{
 	"type":         true,
 	"platform":     true,
@@ -0,0 +1,26 @@
+package conf
+
+// DBConfig 数据库连接配置，数值为 0 时使用默认值
+type DBConfig struct {
+	// QueryTimeout 一次查询的期限，单位为秒，默认为 60，小于 0 表示不限制
+	QueryTimeout int `mapstructure:"query_timeout" json:"query_timeout"`
+
+	// BusyTimeout 数据库被锁定时的等待时间，单位为毫秒，默认为 5000
+	BusyTimeout int `mapstructure:"busy_timeout" json:"busy_timeout"`
+
+	// MaxOpenConns 每个数据库的最大连接数，默认为 4
+	MaxOpenConns int `mapstructure:"max_open_conns" json:"max_open_conns"`
+
+	// MaxIdleConns 每个数据库保留的空闲连接数，默认为 2
+	MaxIdleConns int `mapstructure:"max_idle_conns" json:"max_idle_conns"`
+
+	// CacheSize 每个连接的页缓存大小，单位为 KiB，默认使用 SQLite 的设置
+	CacheSize int `mapstructure:"cache_size" json:"cache_size"`
+
+	// MmapSize 内存映射读取的大小，单位为 MiB，默认不使用
+	MmapSize int `mapstructure:"mmap_size" json:"mmap_size"`
+
+	// MemLimit 工作目录加密时解密到内存的数据库的最大大小，单位为 MiB，默认为 256，
+	// 更大的数据库解密到系统临时目录，小于 0 表示全部解密到内存
+	MemLimit int `mapstructure:"mem_limit" json:"mem_limit"`
+}
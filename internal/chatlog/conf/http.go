@@ -0,0 +1,36 @@
+package conf
+
+import "os"
+
+// EnvControlToken 控制接口令牌的环境变量，设置后 TCP 上的控制请求需要携带 Authorization: Bearer <令牌>
+const EnvControlToken = "CHATLOG_CONTROL_TOKEN"
+
+// HTTPConfig HTTP 服务配置
+type HTTPConfig struct {
+	// ShutdownTimeout 关闭服务或切换地址时等待进行中请求结束的时间，单位为秒，默认为 10
+	ShutdownTimeout int `mapstructure:"shutdown_timeout" json:"shutdown_timeout"`
+
+	// TLS HTTPS 配置
+	TLS TLSConfig `mapstructure:"tls" json:"tls"`
+
+	// SummarizeURL /api/v1/summarize 使用的摘要服务地址，聊天内容会发送到该地址，为空时接口不可用
+	SummarizeURL string `mapstructure:"summarize_url" json:"summarize_url"`
+}
+
+// TLSConfig HTTPS 配置
+type TLSConfig struct {
+	// Enabled 是否启用 HTTPS
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+
+	// CertFile、KeyFile 证书和私钥文件，未配置时生成自签名证书
+	CertFile string `mapstructure:"cert_file" json:"cert_file"`
+	KeyFile  string `mapstructure:"key_file" json:"key_file"`
+
+	// Hosts 自签名证书包含的主机名和 IP，localhost 和 127.0.0.1 总是包含在内
+	Hosts []string `mapstructure:"hosts" json:"hosts"`
+}
+
+// ControlToken 控制接口令牌，只从环境变量读取，不写入配置文件
+func (c *HTTPConfig) ControlToken() string {
+	return os.Getenv(EnvControlToken)
+}
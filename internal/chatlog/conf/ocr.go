@@ -0,0 +1,29 @@
+package conf
+
+const (
+	OCRBackendTesseract = "tesseract"
+	OCRBackendHTTP      = "http"
+)
+
+// OCRConfig 图片文字识别配置，Backend 为空时不进行识别
+type OCRConfig struct {
+	// Backend 识别服务类型，tesseract 为本地 Tesseract 程序，http 为 HTTP 识别服务
+	Backend string `mapstructure:"backend" json:"backend"`
+
+	// Command Tesseract 可执行文件路径，默认从 PATH 中查找
+	Command string `mapstructure:"command" json:"command"`
+
+	// URL HTTP 识别服务地址，接收 multipart 上传的图片，返回 {"text": "..."}
+	URL    string `mapstructure:"url" json:"url"`
+	APIKey string `mapstructure:"api_key" json:"api_key"`
+
+	// Language 识别语言，Tesseract 默认为 chi_sim+eng
+	Language string `mapstructure:"language" json:"language"`
+
+	// Workers 并发识别数，默认为 1
+	Workers int `mapstructure:"workers" json:"workers"`
+}
+
+func (c *OCRConfig) Enabled() bool {
+	return c != nil && len(c.Backend) != 0
+}
@@ -0,0 +1,46 @@
+package conf
+
+const (
+	JobTypeDecrypt   = "decrypt"
+	JobTypeExport    = "export"
+	JobTypeSummarize = "summarize"
+)
+
+// ScheduleConfig 定时任务配置，只在服务模式下生效
+type ScheduleConfig struct {
+	// History 每个任务保留的最近运行记录数，默认为 20
+	History int `mapstructure:"history" json:"history"`
+
+	Jobs []JobConfig `mapstructure:"jobs" json:"jobs"`
+}
+
+// JobConfig 一个定时任务
+type JobConfig struct {
+	// Name 任务名称，在控制接口中引用，不能重复
+	Name string `mapstructure:"name" json:"name"`
+
+	// Type 任务类型：decrypt 解密全部数据库文件，export 导出聊天记录为 Markdown，summarize 生成聊天摘要
+	Type string `mapstructure:"type" json:"type"`
+
+	// Schedule 运行时间，五段 cron 表达式（分 时 日 月 周，本地时间），或 @every 30m、@hourly、@daily
+	Schedule string `mapstructure:"schedule" json:"schedule"`
+
+	// Talker 导出和摘要的聊天对象，多个以逗号分隔
+	Talker string `mapstructure:"talker" json:"talker"`
+
+	// Time 导出和摘要的时间范围，格式与查询接口的 time 参数相同，默认为 yesterday
+	Time string `mapstructure:"time" json:"time"`
+
+	// Output 导出目录，默认为工作目录下的 export
+	Output string `mapstructure:"output" json:"output"`
+
+	// Prompt 摘要提示词，URL 为摘要服务地址，摘要任务必须设置，聊天内容会发送到该地址
+	Prompt string `mapstructure:"prompt" json:"prompt"`
+	URL    string `mapstructure:"url" json:"url"`
+
+	// PostURL 摘要结果以 JSON POST 到该地址，为空时只记录在运行记录中
+	PostURL string `mapstructure:"post_url" json:"post_url"`
+
+	// Timeout 单次运行的超时时间，单位为秒，默认为 3600
+	Timeout int `mapstructure:"timeout" json:"timeout"`
+}
@@ -1,10 +1,23 @@
 package conf
 
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
 const (
 	DefalutHTTPAddr = "0.0.0.0:5030"
+
+	// EnvWorkKey 工作目录加密口令的环境变量，口令只从环境变量读取，不写入配置文件
+	EnvWorkKey = "CHATLOG_WORK_KEY"
 )
 
+// ServerConfig 服务配置
+// 运行时可以修改的配置通过 Update 修改，与各 Get 方法共用读写锁
 type ServerConfig struct {
+	mu sync.RWMutex
+
 	Type        string `mapstructure:"type"`
 	Platform    string `mapstructure:"platform"`
 	Version     int    `mapstructure:"version"`
@@ -15,41 +28,128 @@ type ServerConfig struct {
 	WorkDir     string `mapstructure:"work_dir"`
 	HTTPAddr    string `mapstructure:"http_addr"`
 	AutoDecrypt bool   `mapstructure:"auto_decrypt"`
+	DecryptJobs int    `mapstructure:"decrypt_jobs"`
+
+	Transcribe TranscribeConfig `mapstructure:"transcribe"`
+	OCR        OCRConfig        `mapstructure:"ocr"`
+	DB         DBConfig         `mapstructure:"db"`
+	HTTP       HTTPConfig       `mapstructure:"http"`
+	Schedule   ScheduleConfig   `mapstructure:"schedule"`
+	Archive    ArchiveConfig    `mapstructure:"archive"`
 }
 
 var ServerDefaults = map[string]any{}
 
 func (c *ServerConfig) GetDataDir() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.DataDir
 }
 
 func (c *ServerConfig) GetWorkDir() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.WorkDir
 }
 
+// GetWorkKey 工作目录加密口令，为空表示不加密
+func (c *ServerConfig) GetWorkKey() string {
+	return os.Getenv(EnvWorkKey)
+}
+
 func (c *ServerConfig) GetPlatform() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.Platform
 }
 
 func (c *ServerConfig) GetVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.Version
 }
 
 func (c *ServerConfig) GetDataKey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.DataKey
 }
 
 func (c *ServerConfig) GetImgKey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.ImgKey
 }
 
 func (c *ServerConfig) GetAutoDecrypt() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.AutoDecrypt
 }
 
+// GetDecryptJobs 并发解密的协程数，0 表示使用 CPU 核数
+func (c *ServerConfig) GetDecryptJobs() int {
+	return c.DecryptJobs
+}
+
+// GetTranscribeConfig 语音转文字配置
+func (c *ServerConfig) GetTranscribeConfig() *TranscribeConfig {
+	return &c.Transcribe
+}
+
+// GetOCRConfig 图片文字识别配置
+func (c *ServerConfig) GetOCRConfig() *OCRConfig {
+	return &c.OCR
+}
+
+// GetDBConfig 数据库连接配置
+func (c *ServerConfig) GetDBConfig() *DBConfig {
+	return &c.DB
+}
+
+// GetScheduleConfig 定时任务配置
+func (c *ServerConfig) GetScheduleConfig() *ScheduleConfig {
+	return &c.Schedule
+}
+
+// GetArchiveConfig 聊天记录归档配置
+func (c *ServerConfig) GetArchiveConfig() *ArchiveConfig {
+	return &c.Archive
+}
+
+// GetHTTPConfig HTTP 服务配置
+func (c *ServerConfig) GetHTTPConfig() *HTTPConfig {
+	return &c.HTTP
+}
+
 func (c *ServerConfig) GetHTTPAddr() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if c.HTTPAddr == "" {
-		c.HTTPAddr = DefalutHTTPAddr
+		return DefalutHTTPAddr
 	}
 	return c.HTTPAddr
 }
+
+// Update 在写锁中修改配置，修改期间各 Get 方法等待
+func (c *ServerConfig) Update(fn func(c *ServerConfig)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(c)
+}
+
+// String 配置内容，用于输出日志，不输出 API 密钥
+func (c *ServerConfig) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	transcribe, ocr := c.Transcribe, c.OCR
+	if len(transcribe.APIKey) != 0 {
+		transcribe.APIKey = "******"
+	}
+	if len(ocr.APIKey) != 0 {
+		ocr.APIKey = "******"
+	}
+	return fmt.Sprintf("{Type:%s Platform:%s Version:%d FullVersion:%s DataDir:%s DataKey:%s ImgKey:%s WorkDir:%s HTTPAddr:%s AutoDecrypt:%t DecryptJobs:%d Transcribe:%+v OCR:%+v DB:%+v HTTP:%+v Schedule:%+v Archive:%+v}",
+		c.Type, c.Platform, c.Version, c.FullVersion, c.DataDir, c.DataKey, c.ImgKey, c.WorkDir, c.HTTPAddr, c.AutoDecrypt, c.DecryptJobs,
+		transcribe, ocr, c.DB, c.HTTP, c.Schedule, c.Archive)
+}
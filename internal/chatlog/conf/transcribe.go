@@ -0,0 +1,26 @@
+package conf
+
+const (
+	TranscribeBackendWhisper = "whisper"
+	TranscribeBackendOpenAI  = "openai"
+)
+
+// TranscribeConfig 语音转文字配置，Backend 为空时不进行识别
+type TranscribeConfig struct {
+	// Backend 识别服务类型，whisper 为 whisper.cpp 的 HTTP 服务，openai 为兼容 OpenAI 的接口
+	Backend string `mapstructure:"backend" json:"backend"`
+
+	// URL 服务地址，whisper 为服务根地址，openai 为 /v1 所在的基础地址
+	URL string `mapstructure:"url" json:"url"`
+
+	APIKey   string `mapstructure:"api_key" json:"api_key"`
+	Model    string `mapstructure:"model" json:"model"`
+	Language string `mapstructure:"language" json:"language"`
+
+	// Workers 并发识别数，默认为 1
+	Workers int `mapstructure:"workers" json:"workers"`
+}
+
+func (c *TranscribeConfig) Enabled() bool {
+	return c != nil && len(c.Backend) != 0
+}
@@ -4,6 +4,21 @@ type TUIConfig struct {
 	ConfigDir   string          `mapstructure:"-"`
 	LastAccount string          `mapstructure:"last_account" json:"last_account"`
 	History     []ProcessConfig `mapstructure:"history" json:"history"`
+
+	// Transcribe 语音转文字配置，对所有账号生效
+	Transcribe TranscribeConfig `mapstructure:"transcribe" json:"transcribe"`
+
+	// OCR 图片文字识别配置，对所有账号生效
+	OCR OCRConfig `mapstructure:"ocr" json:"ocr"`
+
+	// DB 数据库连接配置，对所有账号生效
+	DB DBConfig `mapstructure:"db" json:"db"`
+
+	// HTTP HTTP 服务配置，对所有账号生效
+	HTTP HTTPConfig `mapstructure:"http" json:"http"`
+
+	// Archive 聊天记录归档配置，对所有账号生效，归档库默认保存在各账号的工作目录中
+	Archive ArchiveConfig `mapstructure:"archive" json:"archive"`
 }
 
 var TUIDefaults = map[string]any{}
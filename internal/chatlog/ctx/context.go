@@ -9,6 +9,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/settings"
 	"github.com/sjzar/chatlog/internal/wechat"
 	"github.com/sjzar/chatlog/pkg/config"
 	"github.com/sjzar/chatlog/pkg/util"
@@ -162,6 +163,36 @@ func (c *Context) GetWorkDir() string {
 	return c.WorkDir
 }
 
+// GetWorkKey 工作目录加密口令，与服务模式相同只从环境变量读取
+func (c *Context) GetWorkKey() string {
+	return os.Getenv(conf.EnvWorkKey)
+}
+
+// GetTranscribeConfig 语音转文字配置
+func (c *Context) GetTranscribeConfig() *conf.TranscribeConfig {
+	return &c.conf.Transcribe
+}
+
+// GetOCRConfig 图片文字识别配置
+func (c *Context) GetOCRConfig() *conf.OCRConfig {
+	return &c.conf.OCR
+}
+
+// GetDBConfig 数据库连接配置
+func (c *Context) GetDBConfig() *conf.DBConfig {
+	return &c.conf.DB
+}
+
+// GetArchiveConfig 聊天记录归档配置
+func (c *Context) GetArchiveConfig() *conf.ArchiveConfig {
+	return &c.conf.Archive
+}
+
+// GetHTTPConfig HTTP 服务配置
+func (c *Context) GetHTTPConfig() *conf.HTTPConfig {
+	return &c.conf.HTTP
+}
+
 func (c *Context) GetPlatform() string {
 	return c.Platform
 }
@@ -191,50 +222,13 @@ func (c *Context) SetHTTPEnabled(enabled bool) {
 	c.UpdateConfig()
 }
 
-func (c *Context) SetHTTPAddr(addr string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.HTTPAddr == addr {
-		return
-	}
-	c.HTTPAddr = addr
-	c.UpdateConfig()
-}
-
-func (c *Context) SetWorkDir(dir string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.WorkDir == dir {
-		return
-	}
-	c.WorkDir = dir
-	c.UpdateConfig()
-	c.Refresh()
-}
-
-func (c *Context) SetDataDir(dir string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.DataDir == dir {
-		return
-	}
-	c.DataDir = dir
-	c.UpdateConfig()
-	c.Refresh()
-}
-
-func (c *Context) SetAutoDecrypt(enabled bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.AutoDecrypt == enabled {
-		return
-	}
-	c.AutoDecrypt = enabled
-	c.UpdateConfig()
-}
-
 // 更新配置
 func (c *Context) UpdateConfig() {
+	_ = c.saveConfig()
+}
+
+// saveConfig 将当前账号的配置写回配置文件，返回第一个错误
+func (c *Context) saveConfig() error {
 
 	pconf := conf.ProcessConfig{
 		Type:        "wechat",
@@ -271,19 +265,65 @@ func (c *Context) UpdateConfig() {
 
 	if err := c.cm.SetConfig("last_account", c.Account); err != nil {
 		log.Error().Err(err).Msg("set last_account failed")
-		return
+		return err
 	}
 
 	if err := c.cm.SetConfig("history", c.conf.History); err != nil {
 		log.Error().Err(err).Msg("set history failed")
-		return
+		return err
 	}
 
 	if len(pconf.DataDir) != 0 {
 		if b, err := json.Marshal(pconf); err == nil {
 			if err := os.WriteFile(filepath.Join(pconf.DataDir, "chatlog.json"), b, 0644); err != nil {
 				log.Error().Err(err).Msg("save chatlog.json failed")
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+// GetValues 可以在运行时修改的配置，实现 settings.Store
+func (c *Context) GetValues() settings.Values {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	addr := c.HTTPAddr
+	if addr == "" {
+		addr = DefalutHTTPAddr
+	}
+	return settings.Values{
+		HTTPAddr:    addr,
+		DataDir:     c.DataDir,
+		DataKey:     c.DataKey,
+		ImgKey:      c.ImgKey,
+		WorkDir:     c.WorkDir,
+		Platform:    c.Platform,
+		Version:     c.Version,
+		AutoDecrypt: c.AutoDecrypt,
+	}
+}
+
+func (c *Context) SetValues(v settings.Values) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refresh := c.DataDir != v.DataDir || c.WorkDir != v.WorkDir
+	c.HTTPAddr = v.HTTPAddr
+	c.DataDir = v.DataDir
+	c.DataKey = v.DataKey
+	c.ImgKey = v.ImgKey
+	c.WorkDir = v.WorkDir
+	c.Platform = v.Platform
+	c.Version = v.Version
+	c.AutoDecrypt = v.AutoDecrypt
+	if refresh {
+		c.Refresh()
+	}
+}
+
+// SaveValues 当前账号的配置整体写回配置文件
+func (c *Context) SaveValues(_ settings.Values, _ []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveConfig()
 }
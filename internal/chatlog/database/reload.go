@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/settings"
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// ReloadTimeout 重新打开数据库前等待进行中查询结束的最长时间
+var ReloadTimeout = 10 * time.Second
+
+// Acquire 标记一次查询开始，查询结束时调用返回的函数，Reload 会等待进行中的查询结束
+func (s *Service) Acquire() func() {
+	s.inflight.add()
+	var once sync.Once
+	return func() {
+		once.Do(s.inflight.done)
+	}
+}
+
+// Reload 取下当前的数据库使新的查询返回未就绪，等待进行中的查询结束后关闭并重新打开数据库，失败时进入错误状态
+// 重新打开完成前保持在 StateReloading，解密结束后的重新打开期间也不会开始另一次解密
+func (s *Service) Reload() error {
+	db, store := s.detach(StateReloading)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReloadTimeout)
+	defer cancel()
+	if !s.inflight.wait(ctx) {
+		log.Debug().Msg("reload database with queries still in flight")
+	}
+
+	closeDB(db, store)
+	if err := s.Start(); err != nil {
+		s.SetError(err.Error())
+		return err
+	}
+	return nil
+}
+
+// BeginDecrypt 切换到解密中并返回之前的状态，已经在解密或正在重新打开数据库时返回冲突错误
+// 检查和切换在同一次加锁中完成，控制接口和定时任务同时触发时只有一个能开始解密
+func (s *Service) BeginDecrypt() (int, error) {
+	prev, ok := s.state.begin()
+	if !ok {
+		return prev, errors.DBDecrypting()
+	}
+	return prev, nil
+}
+
+// EndDecrypt 结束 BeginDecrypt 开始的解密，解密失败时进入错误状态，成功时重新打开数据库，打开完成后才回到就绪
+func (s *Service) EndDecrypt(err error) error {
+	if err != nil {
+		s.SetError(err.Error())
+		return err
+	}
+	return s.Reload()
+}
+
+// Decrypt 执行 decrypt 解密数据库文件并重新打开数据库，已经在解密时返回冲突错误
+func (s *Service) Decrypt(decrypt func() error) error {
+	if _, err := s.BeginDecrypt(); err != nil {
+		return err
+	}
+	return s.EndDecrypt(decrypt())
+}
+
+// OnConfig 工作目录、平台或版本变化时重新打开数据库
+// 只处理已就绪或出错的数据库，未启动或正在解密时由之后的启动读取新的配置
+func (s *Service) OnConfig(e *settings.Event) error {
+	if !e.Has(settings.KeyWorkDir, settings.KeyPlatform, settings.KeyVersion) {
+		return nil
+	}
+	if state, _ := s.State(); state != StateReady && state != StateError {
+		return nil
+	}
+	return s.Reload()
+}
+
+// inflight 进行中的查询计数，可以等待所有查询结束
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+	f.mu.Unlock()
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+	f.mu.Unlock()
+}
+
+// wait 等待进行中的请求结束，超过 ctx 期限时返回 false
+func (f *inflight) wait(ctx context.Context) bool {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return true
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,101 +1,350 @@
 package database
 
 import (
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb"
-)
-
-const (
-	StateInit = iota
-	StateDecrypting
-	StateReady
-	StateError
+	"github.com/sjzar/chatlog/internal/wechatdb/archive"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 )
 
 type Service struct {
-	State    int
-	StateMsg string
-	conf     Config
-	db       *wechatdb.DB
+	state *stateMachine
+	conf  Config
+
+	// mu 保护 db 和 archive，Start、Stop 与查询并发执行
+	mu sync.RWMutex
+	db *wechatdb.DB
+
+	// 聊天记录归档库，未启用归档时为 nil
+	archive *archive.Store
+
+	// 进行中的查询，重新打开数据库前等待结束
+	inflight inflight
+
+	// 为语音消息填充识别结果，可以为 nil
+	transcriber Transcriber
+
+	// 为图片消息填充识别的文字，可以为 nil
+	ocr OCR
+}
+
+// Transcriber 语音转文字
+type Transcriber interface {
+	// Annotate 在关键词过滤前填充已识别的文字，使语音可以被搜索
+	Annotate(m *model.Message)
+	Fill(messages []*model.Message)
+}
+
+// OCR 图片文字识别
+type OCR interface {
+	// Annotate 在关键词过滤前填充已识别的文字，使图片可以被搜索
+	Annotate(m *model.Message)
+	Fill(messages []*model.Message)
 }
 
 type Config interface {
 	GetWorkDir() string
+	GetWorkKey() string
 	GetPlatform() string
 	GetVersion() int
+	GetDBConfig() *conf.DBConfig
+	GetArchiveConfig() *conf.ArchiveConfig
 }
 
 func NewService(conf Config) *Service {
 	return &Service{
-		conf: conf,
+		state: newStateMachine(),
+		conf:  conf,
 	}
 }
 
 func (s *Service) Start() error {
-	db, err := wechatdb.New(s.conf.GetWorkDir(), s.conf.GetPlatform(), s.conf.GetVersion())
+	store, err := s.openArchive()
+	if err != nil {
+		return err
+	}
+	db, err := wechatdb.New(s.conf.GetWorkDir(), s.conf.GetPlatform(), s.conf.GetVersion(), s.dbOptions(), store)
 	if err != nil {
+		if store != nil {
+			store.Close()
+		}
 		return err
 	}
+	if annotate := s.annotator(); annotate != nil {
+		db.SetAnnotator(annotate)
+	}
+
+	// 先替换数据库再切换为就绪，看到就绪状态的查询一定能取到数据库
+	s.mu.Lock()
+	oldDB, oldStore := s.db, s.archive
+	s.db, s.archive = db, store
 	s.SetReady()
-	s.db = db
+	s.mu.Unlock()
+
+	closeDB(oldDB, oldStore)
 	return nil
 }
 
-func (s *Service) Stop() error {
-	if s.db != nil {
-		s.db.Close()
+// annotator 组合语音和图片的识别结果，未设置识别服务时返回 nil
+func (s *Service) annotator() func(m *model.Message) {
+	t, o := s.transcriber, s.ocr
+	switch {
+	case t == nil && o == nil:
+		return nil
+	case o == nil:
+		return t.Annotate
+	case t == nil:
+		return o.Annotate
+	}
+	return func(m *model.Message) {
+		t.Annotate(m)
+		o.Annotate(m)
+	}
+}
+
+// dbOptions 将配置中的数值转换为数据库打开选项
+func (s *Service) dbOptions() dbm.Options {
+	opts := dbm.Options{WorkKey: s.conf.GetWorkKey()}
+	c := s.conf.GetDBConfig()
+	if c == nil {
+		return opts
+	}
+	opts.QueryTimeout = time.Duration(c.QueryTimeout) * time.Second
+	opts.BusyTimeout = time.Duration(c.BusyTimeout) * time.Millisecond
+	opts.MaxOpenConns = c.MaxOpenConns
+	opts.MaxIdleConns = c.MaxIdleConns
+	opts.CacheSize = c.CacheSize
+	opts.MmapSize = int64(c.MmapSize) << 20
+	opts.MemLimit = int64(c.MemLimit) << 20
+	return opts
+}
+
+// openArchive 打开归档库，未启用归档时返回 nil
+// 归档库是普通的 SQLite 文件，工作目录设置了加密口令时不启用，避免在磁盘上留下明文的聊天记录
+func (s *Service) openArchive() (*archive.Store, error) {
+	c := s.conf.GetArchiveConfig()
+	if c == nil || !c.Enabled {
+		return nil, nil
+	}
+	if len(s.conf.GetWorkKey()) != 0 {
+		log.Warn().Msg("archive is disabled because the work dir is encrypted")
+		return nil, nil
+	}
+	path := c.Path
+	if path == "" {
+		path = filepath.Join(s.conf.GetWorkDir(), archive.DefaultDir, archive.DefaultFile)
 	}
-	s.SetInit()
-	s.db = nil
+	return archive.Open(path)
+}
+
+func (s *Service) Stop() error {
+	db, store := s.detach(StateInit)
+	closeDB(db, store)
 	return nil
 }
 
+// detach 取下当前的数据库并切换到 state，之后的查询返回未就绪，已取得数据库的查询不受影响
+func (s *Service) detach(state int) (*wechatdb.DB, *archive.Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db, store := s.db, s.archive
+	s.db, s.archive = nil, nil
+	s.state.set(state, "")
+	return db, store
+}
+
+func closeDB(db *wechatdb.DB, store *archive.Store) {
+	if db != nil {
+		db.Close()
+	}
+	if store != nil {
+		store.Close()
+	}
+}
+
 func (s *Service) SetInit() {
-	s.State = StateInit
+	s.state.set(StateInit, "")
 }
 
 func (s *Service) SetDecrypting() {
-	s.State = StateDecrypting
+	s.state.set(StateDecrypting, "")
 }
 
 func (s *Service) SetReady() {
-	s.State = StateReady
+	s.state.set(StateReady, "")
 }
 
 func (s *Service) SetError(msg string) {
-	s.State = StateError
-	s.StateMsg = msg
+	s.state.set(StateError, msg)
+}
+
+// State 返回当前状态和错误信息
+func (s *Service) State() (int, string) {
+	return s.state.get()
+}
+
+// Health 返回状态、最近的状态变化和消息数据库的加载状态
+func (s *Service) Health() *Health {
+	s.mu.RLock()
+	h := s.state.health()
+	db := s.db
+	s.mu.RUnlock()
+
+	if h.Ready && db != nil {
+		h.Shards = db.GetShards()
+		h.Archive = db.GetArchiveStatus()
+	}
+	return h
 }
 
 func (s *Service) GetDB() *wechatdb.DB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.db
 }
 
+// use 标记一次查询开始并返回当前的数据库，查询结束时调用返回的函数
+// 所有查询方法都通过这里取数据库，Reload 会等待这些查询结束后再关闭数据库
+func (s *Service) use() (*wechatdb.DB, func(), error) {
+	release := s.Acquire()
+	s.mu.RLock()
+	db := s.db
+	s.mu.RUnlock()
+	if db == nil {
+		release()
+		return nil, nil, errors.DBNotReady()
+	}
+	return db, release, nil
+}
+
+// SetTranscriber 设置语音转文字服务，查询到的语音消息会附带识别结果，需要在 Start 之前调用
+func (s *Service) SetTranscriber(t Transcriber) {
+	s.transcriber = t
+}
+
+// SetOCR 设置图片文字识别服务，需要在 Start 之前调用
+func (s *Service) SetOCR(o OCR) {
+	s.ocr = o
+}
+
 func (s *Service) GetMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
-	return s.db.GetMessages(start, end, talker, sender, keyword, limit, offset)
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	messages, err := db.GetMessages(start, end, talker, sender, keyword, limit, offset)
+	if err != nil {
+		return messages, err
+	}
+	if s.transcriber != nil {
+		s.transcriber.Fill(messages)
+	}
+	if s.ocr != nil {
+		s.ocr.Fill(messages)
+	}
+	return messages, nil
+}
+
+// GetRecalledMessages 返回被撤回或删除的消息，需要启用归档
+func (s *Service) GetRecalledMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	messages, err := db.GetRecalledMessages(start, end, talker, sender, keyword, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	if s.transcriber != nil {
+		s.transcriber.Fill(messages)
+	}
+	if s.ocr != nil {
+		s.ocr.Fill(messages)
+	}
+	return messages, nil
+}
+
+// GetThread 返回消息所在的回复链
+func (s *Service) GetThread(talker string, seq int64) ([]*model.Message, error) {
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	messages, err := db.GetThread(talker, seq)
+	if err != nil {
+		return nil, err
+	}
+	if s.transcriber != nil {
+		s.transcriber.Fill(messages)
+	}
+	if s.ocr != nil {
+		s.ocr.Fill(messages)
+	}
+	return messages, nil
 }
 
 func (s *Service) GetContacts(key string, limit, offset int) (*wechatdb.GetContactsResp, error) {
-	return s.db.GetContacts(key, limit, offset)
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return db.GetContacts(key, limit, offset)
 }
 
 func (s *Service) GetChatRooms(key string, limit, offset int) (*wechatdb.GetChatRoomsResp, error) {
-	return s.db.GetChatRooms(key, limit, offset)
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return db.GetChatRooms(key, limit, offset)
 }
 
 // GetSession retrieves session information
 func (s *Service) GetSessions(key string, limit, offset int) (*wechatdb.GetSessionsResp, error) {
-	return s.db.GetSessions(key, limit, offset)
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return db.GetSessions(key, limit, offset)
 }
 
 func (s *Service) GetMedia(_type string, key string) (*model.Media, error) {
-	return s.db.GetMedia(_type, key)
+	db, release, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return db.GetMedia(_type, key)
+}
+
+// GetDBStats 返回已打开数据库的连接池状态
+func (s *Service) GetDBStats() *dbm.Stats {
+	db, release, err := s.use()
+	if err != nil {
+		return &dbm.Stats{}
+	}
+	defer release()
+	return db.GetDBStats()
 }
 
 // Close closes the database connection
 func (s *Service) Close() {
-	// Add cleanup code if needed
-	s.db.Close()
+	_ = s.Stop()
 }
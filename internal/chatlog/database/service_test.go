@@ -0,0 +1,279 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+type testConfig struct {
+	workDir string
+}
+
+func (c *testConfig) GetWorkDir() string                    { return c.workDir }
+func (c *testConfig) GetWorkKey() string                    { return "" }
+func (c *testConfig) GetPlatform() string                   { return "windows" }
+func (c *testConfig) GetVersion() int                       { return 4 }
+func (c *testConfig) GetDBConfig() *conf.DBConfig           { return nil }
+func (c *testConfig) GetArchiveConfig() *conf.ArchiveConfig { return nil }
+
+// workDir 创建只有联系人和会话数据库的 v4 工作目录
+func workDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, schema := range map[string]string{
+		"contact.db": `CREATE TABLE contact (username TEXT, local_type INTEGER, alias TEXT, remark TEXT, nick_name TEXT);
+			CREATE TABLE chat_room (username TEXT, owner TEXT, ext_buffer BLOB);
+			INSERT INTO contact VALUES ('wxid_a', 1, '', '', 'A');`,
+		"session.db": `CREATE TABLE SessionTable (username TEXT, summary TEXT, last_timestamp INTEGER, last_msg_sender TEXT, last_sender_display_name TEXT, sort_timestamp INTEGER);
+			INSERT INTO SessionTable VALUES ('wxid_a', 'hi', 1700000000, 'wxid_a', 'A', 1700000000);`,
+	} {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	return dir
+}
+
+func TestStateTransitions(t *testing.T) {
+	m := newStateMachine()
+	if state, _ := m.get(); state != StateInit {
+		t.Fatalf("initial state = %d", state)
+	}
+
+	m.set(StateDecrypting, "")
+	m.set(StateError, "boom")
+	since := m.health().Since
+	// 相同的状态和信息不记录变化，也不更新开始时间
+	m.set(StateError, "boom")
+	m.set(StateReady, "")
+
+	h := m.health()
+	if !h.Ready || h.State != "ready" || !h.Since.After(since) && !h.Since.Equal(since) {
+		t.Fatalf("health = %+v", h)
+	}
+	if h.LastError != "boom" || h.LastErrorAt == nil {
+		t.Errorf("last error not kept after recovery: %+v", h)
+	}
+	want := []string{"init>decrypting", "decrypting>error", "error>ready"}
+	if len(h.Transitions) != len(want) {
+		t.Fatalf("transitions = %+v", h.Transitions)
+	}
+	for i, tr := range h.Transitions {
+		if got := tr.From + ">" + tr.To; got != want[i] {
+			t.Errorf("transitions[%d] = %s, want %s", i, got, want[i])
+		}
+	}
+
+	for i := 0; i < MaxTransitions*2; i++ {
+		m.set(i%2+StateDecrypting, "")
+	}
+	if n := len(m.health().Transitions); n != MaxTransitions {
+		t.Errorf("kept %d transitions, want %d", n, MaxTransitions)
+	}
+}
+
+func TestQueryBeforeStart(t *testing.T) {
+	s := NewService(&testConfig{workDir: t.TempDir()})
+	if _, err := s.GetSessions("", 0, 0); errors.GetCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("GetSessions before Start = %v", err)
+	}
+	if _, err := s.GetMessages(time.Time{}, time.Now(), "a", "", "", 0, 0); errors.GetCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("GetMessages before Start = %v", err)
+	}
+	if h := s.Health(); h.Ready || h.Shards != nil {
+		t.Fatalf("health before Start = %+v", h)
+	}
+	// 查询失败后不留下进行中的计数
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !s.inflight.wait(ctx) {
+		t.Fatal("failed query left an in-flight count")
+	}
+}
+
+func TestStartStopReady(t *testing.T) {
+	s := NewService(&testConfig{workDir: workDir(t)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := s.State(); state != StateReady || s.GetDB() == nil {
+		t.Fatalf("after Start: state %d, db %v", state, s.GetDB())
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := s.State(); state != StateInit || s.GetDB() != nil {
+		t.Fatalf("after Stop: state %d, db %v", state, s.GetDB())
+	}
+}
+
+// 看到就绪状态时数据库一定已经可用，Reload 期间的查询只会得到未就绪的错误
+func TestReloadConcurrentQueries(t *testing.T) {
+	s := NewService(&testConfig{workDir: workDir(t)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.mu.RLock()
+				state, _ := s.State()
+				db := s.db
+				s.mu.RUnlock()
+				if state == StateReady && db == nil {
+					t.Error("ready without database")
+					return
+				}
+				if _, err := s.GetSessions("", 1, 0); err != nil {
+					if code := errors.GetCode(err); code != http.StatusServiceUnavailable && code != http.StatusNotFound {
+						t.Errorf("GetSessions during reload = %v", err)
+						return
+					}
+				}
+				s.Health()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadWaitsForAcquire(t *testing.T) {
+	s := NewService(&testConfig{workDir: workDir(t)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	release := s.Acquire()
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(released)
+		release()
+	}()
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-released:
+	default:
+		t.Fatal("Reload did not wait for the in-flight query")
+	}
+	if state, _ := s.State(); state != StateReady {
+		t.Fatalf("state after reload = %d", state)
+	}
+}
+
+func TestDecryptExclusive(t *testing.T) {
+	s := NewService(&testConfig{workDir: workDir(t)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	prev, err := s.BeginDecrypt()
+	if err != nil || prev != StateReady {
+		t.Fatalf("BeginDecrypt = %d, %v", prev, err)
+	}
+	// 已在解密时其他入口返回冲突，且不执行解密
+	called := false
+	if err := s.Decrypt(func() error { called = true; return nil }); errors.GetCode(err) != http.StatusConflict || called {
+		t.Fatalf("concurrent Decrypt = %v, called %v", err, called)
+	}
+	if _, err := s.BeginDecrypt(); errors.GetCode(err) != http.StatusConflict {
+		t.Fatalf("second BeginDecrypt = %v", err)
+	}
+
+	if err := s.EndDecrypt(errors.New(nil, http.StatusInternalServerError, "boom")); err == nil {
+		t.Fatal("EndDecrypt should return the decrypt error")
+	}
+	if state, msg := s.State(); state != StateError || msg != "boom" {
+		t.Fatalf("after failed decrypt: state %d %q", state, msg)
+	}
+
+	if err := s.Decrypt(func() error { called = true; return nil }); err != nil || !called {
+		t.Fatalf("Decrypt = %v, called %v", err, called)
+	}
+	if state, _ := s.State(); state != StateReady || s.GetDB() == nil {
+		t.Fatalf("after Decrypt: state %d", state)
+	}
+}
+
+// 解密结束后重新打开数据库期间，其他入口不能开始解密
+func TestBeginDecryptDuringReload(t *testing.T) {
+	s := NewService(&testConfig{workDir: workDir(t)})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if _, err := s.BeginDecrypt(); err != nil {
+		t.Fatal(err)
+	}
+	// 进行中的查询使 Reload 停在等待阶段
+	release := s.Acquire()
+	done := make(chan error, 1)
+	go func() { done <- s.EndDecrypt(nil) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if state, _ := s.State(); state == StateReloading {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reload did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := s.BeginDecrypt(); errors.GetCode(err) != http.StatusConflict {
+		t.Fatalf("BeginDecrypt during reload = %v", err)
+	}
+	called := false
+	if err := s.Decrypt(func() error { called = true; return nil }); errors.GetCode(err) != http.StatusConflict || called {
+		t.Fatalf("Decrypt during reload = %v, called %v", err, called)
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := s.State(); state != StateReady {
+		t.Fatalf("state after reload = %d", state)
+	}
+	if _, err := s.BeginDecrypt(); err != nil {
+		t.Fatalf("BeginDecrypt after reload = %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/metrics"
+	"github.com/sjzar/chatlog/internal/wechatdb/archive"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+)
+
+const (
+	StateInit = iota
+	StateDecrypting
+	StateReady
+	StateError
+	// StateReloading 正在关闭并重新打开数据库，期间不能开始解密
+	StateReloading
+)
+
+// MaxTransitions 保留的最近状态变化数
+const MaxTransitions = 20
+
+// StateName 返回状态的名称
+func StateName(state int) string {
+	switch state {
+	case StateInit:
+		return "init"
+	case StateDecrypting:
+		return "decrypting"
+	case StateReady:
+		return "ready"
+	case StateError:
+		return "error"
+	case StateReloading:
+		return "reloading"
+	default:
+		return "unknown"
+	}
+}
+
+// Busy 是否正在解密或重新打开数据库，此时不能开始新的解密或重新打开
+func Busy(state int) bool {
+	return state == StateDecrypting || state == StateReloading
+}
+
+// Transition 一次状态变化
+type Transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Msg  string    `json:"msg,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// Health 数据库服务的健康状态
+type Health struct {
+	State string    `json:"state"`
+	Ready bool      `json:"ready"`
+	Since time.Time `json:"since"`
+	Msg   string    `json:"msg,omitempty"`
+
+	// LastError 最近一次进入错误状态的原因，恢复后仍保留
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+
+	// LastDecrypt 最近一次解密数据库文件的时间和错误，由 HTTP 服务从解密服务填充
+	LastDecrypt      *time.Time `json:"lastDecrypt,omitempty"`
+	LastDecryptError string     `json:"lastDecryptError,omitempty"`
+
+	// Transitions 最近的状态变化，按时间顺序
+	Transitions []Transition `json:"transitions"`
+
+	// Shards 消息数据库的加载状态，就绪时才有
+	Shards []*dbm.Shard `json:"shards,omitempty"`
+
+	// Archive 聊天记录归档库的状态，启用归档且就绪时才有
+	Archive *archive.Status `json:"archive,omitempty"`
+}
+
+// stateMachine 数据库服务的状态，HTTP 处理函数和解密协程会并发修改
+type stateMachine struct {
+	mu          sync.RWMutex
+	state       int
+	msg         string
+	since       time.Time
+	lastError   string
+	lastErrorAt time.Time
+	transitions []Transition
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{since: time.Now()}
+}
+
+func (m *stateMachine) set(state int, msg string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setLocked(state, msg)
+}
+
+// begin 切换到解密中并返回之前的状态，已经在解密中或重新打开数据库时不切换，返回 false
+func (m *stateMachine) begin() (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev := m.state
+	if Busy(prev) {
+		return prev, false
+	}
+	m.setLocked(StateDecrypting, "")
+	return prev, true
+}
+
+// setLocked 切换状态并记录变化，调用时需要持有锁
+func (m *stateMachine) setLocked(state int, msg string) {
+	now := time.Now()
+	if state != m.state || msg != m.msg {
+		m.transitions = append(m.transitions, Transition{
+			From: StateName(m.state),
+			To:   StateName(state),
+			Msg:  msg,
+			At:   now,
+		})
+		if len(m.transitions) > MaxTransitions {
+			m.transitions = m.transitions[len(m.transitions)-MaxTransitions:]
+		}
+	}
+	if state != m.state {
+		m.since = now
+	}
+	if state == StateError {
+		m.lastError = msg
+		m.lastErrorAt = now
+	}
+	m.state = state
+	m.msg = msg
+	metrics.SetDatabaseState(state)
+}
+
+func (m *stateMachine) get() (int, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state, m.msg
+}
+
+func (m *stateMachine) health() *Health {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h := &Health{
+		State:       StateName(m.state),
+		Ready:       m.state == StateReady,
+		Since:       m.since,
+		Msg:         m.msg,
+		LastError:   m.lastError,
+		Transitions: append([]Transition(nil), m.transitions...),
+	}
+	if !m.lastErrorAt.IsZero() {
+		at := m.lastErrorAt
+		h.LastErrorAt = &at
+	}
+	return h
+}
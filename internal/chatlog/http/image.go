@@ -0,0 +1,158 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/pkg/filecache"
+	"github.com/sjzar/chatlog/pkg/util/imgconv"
+)
+
+const (
+	// ImageCacheDir 缩略图缓存目录，位于工作目录下
+	ImageCacheDir = ".cache/image"
+
+	// ImageCacheSize 缩略图缓存大小上限
+	ImageCacheSize = 512 * 1024 * 1024
+)
+
+// parseImageOptions 解析缩放参数 w、h、fmt，没有任何参数时返回 false
+func parseImageOptions(c *gin.Context) (imgconv.Options, bool, error) {
+	var opts imgconv.Options
+	w, h, format := c.Query("w"), c.Query("h"), c.Query("fmt")
+	if w == "" && h == "" && format == "" {
+		return opts, false, nil
+	}
+
+	var err error
+	if w != "" {
+		if opts.Width, err = strconv.Atoi(w); err != nil || opts.Width < 0 || opts.Width > imgconv.MaxSize {
+			return opts, true, errors.InvalidArg("w")
+		}
+	}
+	if h != "" {
+		if opts.Height, err = strconv.Atoi(h); err != nil || opts.Height < 0 || opts.Height > imgconv.MaxSize {
+			return opts, true, errors.InvalidArg("h")
+		}
+	}
+	if opts.Format, err = imgconv.ParseFormat(format); err != nil {
+		return opts, true, errors.InvalidArg("fmt")
+	}
+	return opts, true, nil
+}
+
+// HandleImage 返回缩放并重新编码后的图片，结果按源文件路径、大小、修改时间和参数缓存在工作目录中
+// 缓存命中时不读取源文件，无法解码的文件（视频等）按原样返回
+func (s *Service) HandleImage(c *gin.Context, path string, opts imgconv.Options) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	key := imageCacheKey(path, stat, opts)
+	c.Header("ETag", `"`+key+`"`)
+	c.Header("Cache-Control", "private, max-age=86400")
+
+	cache := s.imageCache()
+	if cache != nil {
+		if cached, ok := cache.Get(key); ok {
+			s.serveImageFile(c, cached)
+			return
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	src := data
+	if strings.ToLower(filepath.Ext(path)) == ".dat" {
+		if src, _, err = s.decoder.Decode(data); err != nil {
+			c.File(path)
+			return
+		}
+	}
+
+	// 未指定输出格式时只转换 JPEG 和 PNG，保留 GIF 动画等原始内容
+	contentType := http.DetectContentType(src)
+	if opts.Format == "" && contentType != "image/jpeg" && contentType != "image/png" {
+		c.Header("ETag", "")
+		c.Data(http.StatusOK, contentType, src)
+		return
+	}
+
+	out, _, err := imgconv.Convert(src, opts)
+	if err != nil {
+		log.Debug().Err(err).Msgf("failed to convert image %s", path)
+		c.Header("ETag", "")
+		c.Data(http.StatusOK, contentType, src)
+		return
+	}
+
+	if cache != nil {
+		cached, err := cache.Put(key, out)
+		if err == nil {
+			s.serveImageFile(c, cached)
+			return
+		}
+		log.Debug().Err(err).Msg("failed to write image cache")
+	}
+
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(out))
+}
+
+// imageCacheKey 根据源文件路径、大小、修改时间和转换参数计算缓存键
+// 微信不会原地修改媒体文件，文件变化时大小或修改时间随之变化
+func imageCacheKey(path string, stat os.FileInfo, opts imgconv.Options) string {
+	return filecache.Key(
+		[]byte(path),
+		[]byte(fmt.Sprintf("size=%d&mtime=%d", stat.Size(), stat.ModTime().UnixNano())),
+		[]byte(fmt.Sprintf("w=%d&h=%d&fmt=%s", opts.Width, opts.Height, opts.Format)),
+	)
+}
+
+// serveImageFile 返回缓存文件，由 http.ServeContent 处理 If-None-Match 和 Range 请求
+func (s *Service) serveImageFile(c *gin.Context, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, f)
+}
+
+// imageCache 返回当前工作目录下的缩略图缓存，未设置工作目录时返回 nil
+func (s *Service) imageCache() *filecache.Cache {
+	workDir := s.conf.GetWorkDir()
+	if workDir == "" {
+		return nil
+	}
+	dir := filepath.Join(workDir, filepath.FromSlash(ImageCacheDir))
+
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if s.imgCache != nil && s.imgCache.Dir() == dir {
+		return s.imgCache
+	}
+	cache, err := filecache.New(dir, ImageCacheSize)
+	if err != nil {
+		log.Err(err).Msgf("failed to open image cache %s", dir)
+		return nil
+	}
+	s.imgCache = cache
+	return cache
+}
@@ -1,14 +1,39 @@
 package http
 
 import (
+	"context"
+	"crypto/subtle"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/errors"
 )
 
-func corsMiddleware() gin.HandlerFunc {
+// controlPrefix 控制接口的路径前缀
+const controlPrefix = "/api/v1/control"
+
+// corsMiddleware 跨域访问头
+// 控制接口只在设置了控制令牌时允许跨域，令牌通过 Authorization 头传递，不依赖 Cookie；
+// 预检请求不携带令牌，总是直接应答
+func corsMiddleware(conf Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, controlPrefix) {
+			if hc := conf.GetHTTPConfig(); hc != nil && hc.ControlToken() != "" {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+				c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type")
+			}
+			if c.Request.Method == "OPTIONS" {
+				c.AbortWithStatus(204)
+				return
+			}
+			c.Next()
+			return
+		}
+
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
@@ -23,23 +48,86 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// checkDBStateMiddleware 数据库未就绪时返回 503 和当前的健康状态
 func (s *Service) checkDBStateMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		switch s.db.State {
-		case database.StateInit:
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "database is not ready"})
-			c.Abort()
+		state, msg := s.db.State()
+		if state == database.StateReady {
+			release := s.db.Acquire()
+			defer release()
+			c.Next()
 			return
+		}
+
+		var reason string
+		switch state {
 		case database.StateDecrypting:
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "database is decrypting, please wait"})
-			c.Abort()
-			return
+			reason = "database is decrypting, please wait"
+		case database.StateReloading:
+			reason = "database is reloading, please wait"
 		case database.StateError:
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "database is error: " + s.db.StateMsg})
-			c.Abort()
+			reason = "database is error: " + msg
+		default:
+			reason = "database is not ready"
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"error":  reason,
+			"health": s.health(),
+		})
+	}
+}
+
+// socketConnKey 标记来自控制套接字的连接
+type socketConnKey struct{}
+
+func socketConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, socketConnKey{}, true)
+}
+
+// controlAuthMiddleware 控制接口的访问控制
+// 控制套接字上的请求直接放行；TCP 上设置了控制令牌时校验 Authorization 头，与 Origin 无关，
+// 桌面客户端从 file:// 加载的页面会带 Origin: null，需要启动服务时传入令牌；
+// 未设置时后台服务模式下拒绝，其他模式只接受来自本机回环地址、不带 Origin 头（非浏览器发起）的请求
+func (s *Service) controlAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v, _ := c.Request.Context().Value(socketConnKey{}).(bool); v {
+			c.Next()
+			return
+		}
+
+		var token string
+		if conf := s.conf.GetHTTPConfig(); conf != nil {
+			token = conf.ControlToken()
+		}
+		if token != "" {
+			auth := c.GetHeader("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+				c.Header("WWW-Authenticate", "Bearer")
+				errors.Err(c, errors.ControlUnauthorized())
+				c.Abort()
+				return
+			}
+			c.Next()
 			return
 		}
 
+		s.mu.Lock()
+		daemon := s.sockPath != ""
+		s.mu.Unlock()
+		if daemon || c.GetHeader("Origin") != "" || !isLoopback(c.Request.RemoteAddr) {
+			errors.Err(c, errors.ControlForbidden())
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
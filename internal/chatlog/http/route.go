@@ -1,25 +1,30 @@
 package http
 
 import (
-    "bytes"
+    "context"
     "embed"
-    "encoding/json"
     "fmt"
     "io"
     "io/fs"
     "net/http"
     "os"
     "path/filepath"
+    "strconv"
     "strings"
-    "time"
 
     "github.com/sjzar/chatlog/internal/errors"
-    "github.com/sjzar/chatlog/internal/chatlog/conf"
+    "github.com/sjzar/chatlog/internal/metrics"
+    "github.com/sjzar/chatlog/internal/chatlog/database"
+    "github.com/sjzar/chatlog/internal/chatlog/scheduler"
+    "github.com/sjzar/chatlog/internal/chatlog/settings"
+    "github.com/sjzar/chatlog/internal/chatlog/summarize"
+    "github.com/sjzar/chatlog/internal/chatlog/wechat"
     "github.com/sjzar/chatlog/pkg/util"
-    "github.com/sjzar/chatlog/pkg/util/dat2img"
+    "github.com/sjzar/chatlog/pkg/util/imgconv"
     "github.com/sjzar/chatlog/pkg/util/silk"
 
     "github.com/gin-gonic/gin"
+    "github.com/rs/zerolog/log"
 )
 
 // EFS holds embedded file system data for static assets.
@@ -35,9 +40,9 @@ func (s *Service) initRouter() {
 	router.StaticFS("/static", http.FS(staticDir))
 	router.StaticFileFS("/favicon.ico", "./favicon.ico", http.FS(staticDir))
 	router.StaticFileFS("/", "./index.htm", http.FS(staticDir))
-	router.GET("/health", func(ctx *gin.Context) {
-		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+	router.GET("/health", s.GetHealth)
+	router.GET("/health/ready", s.GetReady)
+	router.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	// Media
 	router.GET("/image/*key", s.GetImage)
@@ -59,112 +64,270 @@ func (s *Service) initRouter() {
 	api := router.Group("/api/v1", s.checkDBStateMiddleware())
 	{
 		api.GET("/chatlog", s.GetChatlog)
+		api.GET("/thread", s.GetThread)
 		api.GET("/contact", s.GetContacts)
 		api.GET("/chatroom", s.GetChatRooms)
 		api.GET("/session", s.GetSessions)
 		api.POST("/summarize", s.PostSummarize)
+		api.GET("/transcript/*key", s.GetTranscript)
+		api.GET("/ocr/*key", s.GetOCR)
+		api.GET("/db/stats", s.GetDBStats)
 	}
 
 	// Control endpoints (runtime operations)
-	ctrl := router.Group("/api/v1/control")
+	ctrl := router.Group(controlPrefix, s.controlAuthMiddleware())
 	{
 		ctrl.POST("/autodecrypt", s.CtrlAutoDecrypt)
 		ctrl.POST("/decrypt", s.CtrlDecrypt)
 		ctrl.POST("/config", s.CtrlConfig)
 		ctrl.GET("/instances", s.CtrlInstances)
 		ctrl.GET("/state", s.CtrlState)
+		ctrl.GET("/health", s.CtrlHealth)
+		ctrl.POST("/switch", s.CtrlSwitch)
+		ctrl.POST("/reload", s.CtrlReload)
+		ctrl.GET("/jobs", s.CtrlJobs)
+		ctrl.GET("/jobs/:name", s.CtrlJob)
+		ctrl.POST("/jobs/:name/run", s.CtrlRunJob)
 	}
 
 	router.NoRoute(s.NoRoute)
 }
 
 // CtrlAutoDecrypt toggles auto decrypt at runtime: {"enable": true|false}
+// The change goes through the settings service and is saved to the config file.
 func (s *Service) CtrlAutoDecrypt(c *gin.Context) {
     body := struct{ Enable bool `json:"enable"` }{}
     if err := c.ShouldBindJSON(&body); err != nil {
         errors.Err(c, errors.InvalidArg("enable"))
         return
     }
+    if _, err := s.st.Apply(settings.Change{AutoDecrypt: &body.Enable}); err != nil {
+        errors.Err(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// CtrlDecrypt triggers full decrypt and reloads DB.
+// With ?stream=1 or Accept: text/event-stream, progress is streamed as SSE events.
+func (s *Service) CtrlDecrypt(c *gin.Context) {
     if s.wx == nil {
         errors.Err(c, errors.New(nil, http.StatusInternalServerError, "wechat service not available"))
         return
     }
-    if body.Enable {
-        if err := s.wx.StartAutoDecrypt(); err != nil {
-            errors.Err(c, err)
-            return
-        }
-    } else {
-        if err := s.wx.StopAutoDecrypt(); err != nil {
-            errors.Err(c, err)
-            return
-        }
+    if c.Query("stream") == "1" || c.Query("stream") == "true" || strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+        s.ctrlDecryptStream(c)
+        return
     }
-    // best-effort update of config if underlying type supports it
-    if sc, ok := s.conf.(*conf.ServerConfig); ok {
-        sc.AutoDecrypt = body.Enable
+    if err := s.decryptAndReload(nil); err != nil {
+        errors.Err(c, err)
+        return
     }
     c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
-// CtrlDecrypt triggers full decrypt and reloads DB
-func (s *Service) CtrlDecrypt(c *gin.Context) {
+// ctrlDecryptStream runs decrypt in background and streams "progress" events,
+// followed by a final "done" or "error" event. The decrypt keeps running if the client disconnects.
+func (s *Service) ctrlDecryptStream(c *gin.Context) {
+    progressCh := make(chan wechat.DecryptProgress, 1)
+    doneCh := make(chan error, 1)
+    go func() {
+        doneCh <- s.decryptAndReload(func(p wechat.DecryptProgress) {
+            // keep only the latest progress if the client is slow
+            select {
+            case <-progressCh:
+            default:
+            }
+            progressCh <- p
+        })
+    }()
+
+    c.Stream(func(w io.Writer) bool {
+        select {
+        case p := <-progressCh:
+            c.SSEvent("progress", gin.H{
+                "filesDone":  p.FilesDone,
+                "filesTotal": p.FilesTotal,
+                "pagesDone":  p.PagesDone,
+                "pagesTotal": p.PagesTotal,
+                "percent":    p.Percent(),
+            })
+            return true
+        case err := <-doneCh:
+            if err != nil {
+                c.SSEvent("error", gin.H{"error": err.Error()})
+            } else {
+                c.SSEvent("done", gin.H{"ok": true})
+            }
+            return false
+        case <-c.Request.Context().Done():
+            return false
+        }
+    })
+}
+
+// decryptAndReload decrypts all db files and restarts the database service.
+// Fails with 409 if a decrypt is already running.
+func (s *Service) decryptAndReload(progress func(wechat.DecryptProgress)) error {
+    return s.db.Decrypt(func() error {
+        return s.wx.DecryptDBFilesWithProgress(context.Background(), progress)
+    })
+}
+
+// CtrlConfig updates runtime config. Accepts any of: addr,dataDir,dataKey,imgKey,workDir,platform,version,autoDecrypt
+// Changes are validated, applied to every service and saved to the config file;
+// if any service rejects the change, the old config is restored.
+func (s *Service) CtrlConfig(c *gin.Context) {
+    var change settings.Change
+    if err := c.ShouldBindJSON(&change); err != nil {
+        errors.Err(c, errors.InvalidArg("config"))
+        return
+    }
+    e, err := s.st.Apply(change)
+    if err != nil {
+        errors.Err(c, err)
+        return
+    }
+    changed := []string{}
+    if e != nil {
+        changed = e.Keys
+    }
+    c.JSON(http.StatusOK, gin.H{"ok": true, "addr": s.Addr(), "changed": changed})
+}
+
+// CtrlSwitch switches to another running WeChat account: {"account": "name"}
+// The key is read from the process when unknown, the account's data is decrypted into
+// its default work dir and the database is reopened. The new config is saved like CtrlConfig.
+func (s *Service) CtrlSwitch(c *gin.Context) {
+    body := struct{ Account string `json:"account"` }{}
+    if err := c.ShouldBindJSON(&body); err != nil || body.Account == "" {
+        errors.Err(c, errors.InvalidArg("account"))
+        return
+    }
     if s.wx == nil {
         errors.Err(c, errors.New(nil, http.StatusInternalServerError, "wechat service not available"))
         return
     }
-    s.db.SetDecrypting()
-    if err := s.wx.DecryptDBFiles(); err != nil {
-        s.db.SetError(err.Error())
+    if state, _ := s.db.State(); database.Busy(state) {
+        errors.Err(c, errors.DBDecrypting())
+        return
+    }
+    change, err := s.switchChange(body.Account)
+    if err != nil {
+        errors.Err(c, err)
+        return
+    }
+
+    // mark as decrypting so the database is not reopened on a work dir that is not decrypted yet
+    state, err := s.db.BeginDecrypt()
+    if err != nil {
         errors.Err(c, err)
         return
     }
-    // reload DB to reflect new data
-    _ = s.db.Stop()
-    if err := s.db.Start(); err != nil {
-        s.db.SetError(err.Error())
+    e, err := s.st.Apply(change)
+    if err != nil && e == nil {
+        s.restoreDB(state)
         errors.Err(c, err)
         return
     }
-    s.db.SetReady()
-    c.JSON(http.StatusOK, gin.H{"ok": true})
+    if err != nil {
+        log.Err(err).Msgf("switched to %s without saving config", body.Account)
+    }
+    if err := s.db.EndDecrypt(s.wx.DecryptDBFilesWithProgress(context.Background(), nil)); err != nil {
+        errors.Err(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"ok": true, "account": body.Account, "work_dir": change.WorkDir})
 }
 
-// CtrlConfig updates runtime config. Accepts any of: addr,dataDir,dataKey,imgKey,workDir,platform,version
-func (s *Service) CtrlConfig(c *gin.Context) {
-    payload := struct {
-        Addr     string `json:"addr"`
-        DataDir  string `json:"dataDir"`
-        DataKey  string `json:"dataKey"`
-        ImgKey   string `json:"imgKey"`
-        WorkDir  string `json:"workDir"`
-        Platform string `json:"platform"`
-        Version  int    `json:"version"`
-    }{}
-    if err := c.ShouldBindJSON(&payload); err != nil {
-        errors.Err(c, errors.InvalidArg("config"))
+// switchChange builds the config change for a running account
+func (s *Service) switchChange(account string) (settings.Change, error) {
+    for _, ins := range s.wx.GetWeChatInstances() {
+        if ins.Name != account {
+            continue
+        }
+        key, err := s.wx.GetDataKey(ins)
+        if err != nil {
+            return settings.Change{}, err
+        }
+        workDir := util.DefaultWorkDir(ins.Name)
+        if err := util.PrepareDir(workDir); err != nil {
+            return settings.Change{}, err
+        }
+        return settings.Change{
+            DataDir:  ins.DataDir,
+            DataKey:  key,
+            ImgKey:   ins.ImgKey,
+            WorkDir:  workDir,
+            Platform: ins.Platform,
+            Version:  ins.Version,
+        }, nil
+    }
+    return settings.Change{}, errors.WeChatAccountNotFound(account)
+}
+
+// restoreDB puts the database back after a failed switch
+func (s *Service) restoreDB(state int) {
+    if state != database.StateReady && state != database.StateError {
+        s.db.SetInit()
         return
     }
-    // Only works when underlying conf is ServerConfig
-    if sc, ok := s.conf.(*conf.ServerConfig); ok {
-        if payload.Addr != "" { sc.HTTPAddr = payload.Addr }
-        if payload.DataDir != "" { sc.DataDir = payload.DataDir }
-        if payload.DataKey != "" { sc.DataKey = payload.DataKey }
-        if payload.ImgKey != "" { sc.ImgKey = payload.ImgKey }
-        if payload.WorkDir != "" { sc.WorkDir = payload.WorkDir }
-        if payload.Platform != "" { sc.Platform = payload.Platform }
-        if payload.Version != 0 { sc.Version = payload.Version }
-    }
-    // reload DB after config change impacting DB
-    _ = s.db.Stop()
-    if err := s.db.Start(); err != nil {
-        s.db.SetError(err.Error())
+    if err := s.db.Reload(); err != nil {
+        log.Err(err).Msg("failed to reopen database")
+    }
+}
+
+// CtrlReload reopens the database, e.g. after the work dir was decrypted by another process
+func (s *Service) CtrlReload(c *gin.Context) {
+    if state, _ := s.db.State(); database.Busy(state) {
+        errors.Err(c, errors.DBDecrypting())
+        return
+    }
+    if err := s.db.Reload(); err != nil {
         errors.Err(c, err)
         return
     }
     c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// CtrlJobs lists scheduled jobs with their next and last run
+func (s *Service) CtrlJobs(c *gin.Context) {
+    items := []*scheduler.JobStatus{}
+    if s.sch != nil {
+        items = s.sch.Jobs()
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// CtrlJob returns a scheduled job with its recent runs, newest first
+func (s *Service) CtrlJob(c *gin.Context) {
+    name := c.Param("name")
+    if s.sch == nil {
+        errors.Err(c, errors.JobNotFound(name))
+        return
+    }
+    job, err := s.sch.Job(name)
+    if err != nil {
+        errors.Err(c, err)
+        return
+    }
+    c.JSON(http.StatusOK, job)
+}
+
+// CtrlRunJob runs a scheduled job now in the background; poll CtrlJob for the result
+func (s *Service) CtrlRunJob(c *gin.Context) {
+    name := c.Param("name")
+    if s.sch == nil {
+        errors.Err(c, errors.JobNotFound(name))
+        return
+    }
+    if err := s.sch.Run(name); err != nil {
+        errors.Err(c, err)
+        return
+    }
+    c.JSON(http.StatusAccepted, gin.H{"ok": true})
+}
+
 // CtrlInstances lists running WeChat processes (PID/name/version/dataDir)
 func (s *Service) CtrlInstances(c *gin.Context) {
     if s.wx == nil {
@@ -184,17 +347,61 @@ func (s *Service) CtrlInstances(c *gin.Context) {
     c.JSON(http.StatusOK, gin.H{"items": items})
 }
 
-// CtrlState returns current basic server state/config (best-effort)
+// CtrlState returns current basic server state/config
 func (s *Service) CtrlState(c *gin.Context) {
-    resp := gin.H{"http_addr": s.conf.GetHTTPAddr()}
-    if sc, ok := s.conf.(*conf.ServerConfig); ok {
-        resp["data_dir"] = sc.DataDir
-        resp["work_dir"] = sc.WorkDir
-        resp["platform"] = sc.Platform
-        resp["version"] = sc.Version
-        resp["auto_decrypt"] = sc.AutoDecrypt
-    }
-    c.JSON(http.StatusOK, resp)
+    v := s.st.Values()
+    c.JSON(http.StatusOK, gin.H{
+        "http_addr":    v.HTTPAddr,
+        "data_dir":     v.DataDir,
+        "work_dir":     v.WorkDir,
+        "platform":     v.Platform,
+        "version":      v.Version,
+        "auto_decrypt": v.AutoDecrypt,
+    })
+}
+
+// GetHealth 存活检查，服务能响应即返回 200，数据库状态只作参考
+func (s *Service) GetHealth(c *gin.Context) {
+	state, _ := s.db.State()
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"state":  database.StateName(state),
+		"ready":  state == database.StateReady,
+	})
+}
+
+// GetReady 就绪检查，数据库就绪时返回 200，否则返回 503
+func (s *Service) GetReady(c *gin.Context) {
+	state, msg := s.db.State()
+	resp := gin.H{"state": database.StateName(state)}
+	if msg != "" {
+		resp["msg"] = msg
+	}
+	if state != database.StateReady {
+		resp["status"] = "unavailable"
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	resp["status"] = "ok"
+	c.JSON(http.StatusOK, resp)
+}
+
+// CtrlHealth 返回数据库状态、最近的状态变化、消息数据库的加载状态和最近一次解密的结果
+func (s *Service) CtrlHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, s.health())
+}
+
+func (s *Service) health() *database.Health {
+	h := s.db.Health()
+	if s.wx != nil {
+		if at, err := s.wx.LastDecrypt(); !at.IsZero() {
+			h.LastDecrypt = &at
+			if err != nil {
+				h.LastDecryptError = err.Error()
+			}
+		}
+	}
+	return h
 }
 
 // NoRoute handles 404 Not Found errors. If the request URL starts with "/api"
@@ -213,13 +420,14 @@ func (s *Service) NoRoute(c *gin.Context) {
 func (s *Service) GetChatlog(c *gin.Context) {
 
 	q := struct {
-		Time    string `form:"time"`
-		Talker  string `form:"talker"`
-		Sender  string `form:"sender"`
-		Keyword string `form:"keyword"`
-		Limit   int    `form:"limit"`
-		Offset  int    `form:"offset"`
-		Format  string `form:"format"`
+		Time     string `form:"time"`
+		Talker   string `form:"talker"`
+		Sender   string `form:"sender"`
+		Keyword  string `form:"keyword"`
+		Recalled bool   `form:"recalled"`
+		Limit    int    `form:"limit"`
+		Offset   int    `form:"offset"`
+		Format   string `form:"format"`
 	}{}
 
 	if err := c.BindQuery(&q); err != nil {
@@ -240,7 +448,11 @@ func (s *Service) GetChatlog(c *gin.Context) {
 		q.Offset = 0
 	}
 
-	messages, err := s.db.GetMessages(start, end, q.Talker, q.Sender, q.Keyword, q.Limit, q.Offset)
+	getMessages := s.db.GetMessages
+	if q.Recalled {
+		getMessages = s.db.GetRecalledMessages
+	}
+	messages, err := getMessages(start, end, q.Talker, q.Sender, q.Keyword, q.Limit, q.Offset)
 	if err != nil {
 		errors.Err(c, err)
 		return
@@ -266,6 +478,46 @@ func (s *Service) GetChatlog(c *gin.Context) {
 	}
 }
 
+// GetThread 返回消息所在的回复链，消息由 talker 和 seq 指定
+func (s *Service) GetThread(c *gin.Context) {
+
+	q := struct {
+		Talker string `form:"talker"`
+		Seq    int64  `form:"seq"`
+		Format string `form:"format"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+	if q.Talker == "" {
+		errors.Err(c, errors.InvalidArg("talker"))
+		return
+	}
+	if q.Seq <= 0 {
+		errors.Err(c, errors.InvalidArg("seq"))
+		return
+	}
+
+	messages, err := s.db.GetThread(q.Talker, q.Seq)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	switch strings.ToLower(q.Format) {
+	case "json":
+		c.JSON(http.StatusOK, messages)
+	default:
+		c.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, m := range messages {
+			c.Writer.WriteString(m.PlainText(false, "2006-01-02 15:04:05", c.Request.Host))
+			c.Writer.WriteString("\n")
+		}
+	}
+}
+
 func (s *Service) GetContacts(c *gin.Context) {
 
 	q := struct {
@@ -403,6 +655,11 @@ func (s *Service) GetSessions(c *gin.Context) {
 	}
 }
 
+// GetDBStats 返回已打开数据库的连接池状态和可用性
+func (s *Service) GetDBStats(c *gin.Context) {
+	c.JSON(http.StatusOK, s.db.GetDBStats())
+}
+
 func (s *Service) GetImage(c *gin.Context) {
 	s.GetMedia(c, "image")
 }
@@ -431,6 +688,17 @@ func (s *Service) GetMedia(c *gin.Context, _type string) {
 		return
 	}
 
+	// 图片支持缩放参数，直接返回缩放后的结果
+	var imgOpts imgconv.Options
+	resize := false
+	if _type == "image" {
+		var err error
+		if imgOpts, resize, err = parseImageOptions(c); err != nil {
+			errors.Err(c, err)
+			return
+		}
+	}
+
 	var _err error
 	for _, k := range keys {
 		if len(k) != 32 {
@@ -438,6 +706,10 @@ func (s *Service) GetMedia(c *gin.Context, _type string) {
 			if _, err := os.Stat(absolutePath); os.IsNotExist(err) {
 				continue
 			}
+			if resize {
+				s.HandleImage(c, absolutePath, imgOpts)
+				return
+			}
 			c.Redirect(http.StatusFound, "/data/"+k)
 			return
 		}
@@ -447,6 +719,11 @@ func (s *Service) GetMedia(c *gin.Context, _type string) {
 			continue
 		}
 		if c.Query("info") != "" {
+			if media.Type == "voice" {
+				if audio, err := silk.Decode(media.Data); err == nil {
+					media.Duration = audio.Duration().Seconds()
+				}
+			}
 			c.JSON(http.StatusOK, media)
 			return
 		}
@@ -454,6 +731,13 @@ func (s *Service) GetMedia(c *gin.Context, _type string) {
 		case "voice":
 			s.HandleVoice(c, media.Data)
 			return
+		case "image":
+			if resize {
+				s.HandleImage(c, filepath.Join(s.conf.GetDataDir(), media.Path), imgOpts)
+				return
+			}
+			c.Redirect(http.StatusFound, "/data/"+media.Path)
+			return
 		default:
 			c.Redirect(http.StatusFound, "/data/"+media.Path)
 			return
@@ -478,6 +762,16 @@ func (s *Service) GetMediaData(c *gin.Context) {
 		return
 	}
 
+	imgOpts, resize, err := parseImageOptions(c)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+	if resize {
+		s.HandleImage(c, absolutePath, imgOpts)
+		return
+	}
+
 	ext := strings.ToLower(filepath.Ext(absolutePath))
 	switch {
 	case ext == ".dat":
@@ -496,7 +790,7 @@ func (s *Service) HandleDatFile(c *gin.Context, path string) {
 		errors.Err(c, err)
 		return
 	}
-	out, ext, err := dat2img.Dat2Image(b)
+	out, ext, err := s.decoder.Decode(b)
 	if err != nil {
 		c.File(path)
 		return
@@ -519,19 +813,78 @@ func (s *Service) HandleDatFile(c *gin.Context, path string) {
 	}
 }
 
+// HandleVoice 把语音转换为浏览器可以播放的格式
+// 格式由 format 参数指定，未指定时根据 Accept 请求头协商，默认为 MP3
 func (s *Service) HandleVoice(c *gin.Context, data []byte) {
-	out, err := silk.Silk2MP3(data)
+	format := strings.ToLower(c.Query("format"))
+	switch format {
+	case silk.FormatMP3, silk.FormatWAV, silk.FormatOgg:
+	case "":
+		format = silk.NegotiateFormat(c.GetHeader("Accept"))
+		c.Header("Vary", "Accept")
+	default:
+		errors.Err(c, errors.InvalidArg("format"))
+		return
+	}
+
+	audio, err := silk.Decode(data)
 	if err != nil {
 		c.Data(http.StatusOK, "audio/silk", data)
 		return
 	}
-	c.Data(http.StatusOK, "audio/mp3", out)
+	out, err := audio.Encode(format)
+	if err != nil {
+		format, out = silk.FormatWAV, audio.WAV()
+	}
+	c.Header("X-Content-Duration", strconv.FormatFloat(audio.Duration().Seconds(), 'f', 2, 64))
+	c.Data(http.StatusOK, silk.ContentType(format), out)
+}
+
+// GetTranscript 识别一条语音消息，结果缓存在工作目录中
+func (s *Service) GetTranscript(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		errors.Err(c, errors.InvalidArg("key"))
+		return
+	}
+
+	text, err := s.ts.Transcribe(c.Request.Context(), key)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "text": text})
+}
+
+// GetOCR 识别一张图片中的文字，key 为图片的 MD5，结果保存在索引中
+func (s *Service) GetOCR(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		errors.Err(c, errors.InvalidArg("key"))
+		return
+	}
+
+	text, err := s.ocr.Recognize(c.Request.Context(), key)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "text": text})
 }
 
 // PostSummarize summarizes a single day's chatlog by calling an external API.
 // Request JSON: {"date":"YYYY-MM-DD", "talker":"...", "prompt":"..."}
 // Response: passthrough of external API response (JSON or text)
+// The chatlog is only sent to the service set in http.summarize_url; without it the endpoint returns 501.
 func (s *Service) PostSummarize(c *gin.Context) {
+    var summaryURL string
+    if hc := s.conf.GetHTTPConfig(); hc != nil {
+        summaryURL = hc.SummarizeURL
+    }
+    if summaryURL == "" {
+        errors.Err(c, errors.SummarizeNotConfigured())
+        return
+    }
     var payload struct {
         Date   string `json:"date"`
         Talker string `json:"talker"`
@@ -565,54 +918,13 @@ func (s *Service) PostSummarize(c *gin.Context) {
         return
     }
 
-    // Build plain text of the day's chat for message body
-    var b strings.Builder
-    isGroup := strings.Contains(payload.Talker, ",")
-    for _, m := range messages {
-        b.WriteString(m.PlainText(isGroup, util.PerfectTimeFormat(start, end), c.Request.Host))
-        b.WriteString("\n")
-    }
-    messageText := b.String()
-
-    // Call external summarize API
-    // NOTE: URL currently provided by user; may be configurable later.
-    reqBody := map[string]any{
-        "prompt":  payload.Prompt,
-        "message": messageText,
-    }
-    bodyBytes, _ := json.Marshal(reqBody)
-
-    httpClient := &http.Client{Timeout: 60 * time.Second}
-    req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost,
-        "https://n8n-preview.beqlee.icu/webhook/b2199135-477f-4fab-b45e-dfd21ef1f86b", bytes.NewReader(bodyBytes))
-    if err != nil {
-        errors.Err(c, err)
-        return
-    }
-    req.Header.Set("Content-Type", "application/json")
-
-    resp, err := httpClient.Do(req)
-    if err != nil {
-        errors.Err(c, err)
-        return
-    }
-    defer resp.Body.Close()
-
-    respBytes, err := io.ReadAll(resp.Body)
+    // Call the summarize service configured in http.summarize_url
+    result, err := summarize.Request(c.Request.Context(), summaryURL, payload.Prompt, summarize.Text(messages, payload.Talker, start, end, c.Request.Host))
     if err != nil {
         errors.Err(c, err)
         return
     }
 
     // Pass through status and best-effort content type
-    ct := resp.Header.Get("Content-Type")
-    if ct == "" {
-        // Try to detect JSON; else fallback to text
-        if json.Valid(respBytes) {
-            ct = "application/json; charset=utf-8"
-        } else {
-            ct = "text/plain; charset=utf-8"
-        }
-    }
-    c.Data(resp.StatusCode, ct, respBytes)
+    c.Data(result.StatusCode, result.ContentType, result.Body)
 }
@@ -2,13 +2,24 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
 	"github.com/sjzar/chatlog/internal/chatlog/database"
 	"github.com/sjzar/chatlog/internal/chatlog/mcp"
+	"github.com/sjzar/chatlog/internal/chatlog/ocr"
+	"github.com/sjzar/chatlog/internal/chatlog/scheduler"
+	"github.com/sjzar/chatlog/internal/chatlog/settings"
+	"github.com/sjzar/chatlog/internal/chatlog/transcribe"
 	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/metrics"
+	"github.com/sjzar/chatlog/pkg/filecache"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -19,17 +30,49 @@ type Service struct {
 	db   *database.Service
 	mcp  *mcp.Service
 	wx   *wechat.Service
+	ts   *transcribe.Service
+	ocr  *ocr.Service
+	st   *settings.Service
+
+	// 定时任务，只在服务模式下设置
+	sch *scheduler.Service
 
 	router *gin.Engine
+
+	// 当前的监听服务，切换地址时替换，done 在 Stop 时关闭
+	mu     sync.Mutex
 	server *http.Server
+	addr   string
+	done   chan struct{}
+
+	// 控制套接字，后台服务模式下供管理命令使用
+	sock     *http.Server
+	sockPath string
+
+	// 自签名证书，主机列表不变时复用
+	cert      *tls.Certificate
+	certHosts string
+	certMu    sync.Mutex
+
+	// 缩略图缓存，随工作目录切换重新打开
+	imgCache *filecache.Cache
+	cacheMu  sync.Mutex
+
+	// dat 图片解码器
+	decoder *dat2img.Decoder
 }
 
 type Config interface {
 	GetHTTPAddr() string
 	GetDataDir() string
+	GetWorkDir() string
+	GetHTTPConfig() *conf.HTTPConfig
 }
 
-func NewService(conf Config, db *database.Service, mcp *mcp.Service, wx *wechat.Service) *Service {
+// DefaultShutdownTimeout 关闭服务时等待进行中请求结束的默认时间
+const DefaultShutdownTimeout = 10 * time.Second
+
+func NewService(conf Config, db *database.Service, mcp *mcp.Service, wx *wechat.Service, ts *transcribe.Service, ocr *ocr.Service, st *settings.Service, decoder *dat2img.Decoder) *Service {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
@@ -42,69 +85,181 @@ func NewService(conf Config, db *database.Service, mcp *mcp.Service, wx *wechat.
 	router.Use(
 		errors.RecoveryMiddleware(),
 		errors.ErrorHandlerMiddleware(),
-		gin.LoggerWithWriter(log.Logger, "/health"),
-		corsMiddleware(),
+		gin.LoggerWithWriter(log.Logger, "/health", "/health/ready", "/metrics"),
+		metrics.Middleware(),
+		corsMiddleware(conf),
 	)
 
 	s := &Service{
-		conf:   conf,
-		db:     db,
-		mcp:    mcp,
-		wx:     wx,
-		router: router,
+		conf:    conf,
+		db:      db,
+		mcp:     mcp,
+		wx:      wx,
+		ts:      ts,
+		ocr:     ocr,
+		st:      st,
+		router:  router,
+		decoder: decoder,
 	}
 
 	s.initRouter()
 	return s
 }
 
+// SetScheduler 设置定时任务服务，控制接口通过它查询和运行任务
+func (s *Service) SetScheduler(sch *scheduler.Service) {
+	s.sch = sch
+}
+
 func (s *Service) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.server != nil {
+		return nil
+	}
 
-	s.server = &http.Server{
-		Addr:    s.conf.GetHTTPAddr(),
-		Handler: s.router,
+	addr := s.conf.GetHTTPAddr()
+	ln, err := s.listen(addr)
+	if err != nil {
+		return err
 	}
+	s.done = make(chan struct{})
+	s.serve(ln, addr)
+	return nil
+}
 
-	go func() {
-		// Handle error from Run
-		if err := s.server.ListenAndServe(); err != nil {
-			log.Err(err).Msg("Failed to start HTTP server")
-		}
-	}()
+// ListenAndServe 启动服务并阻塞到 Stop 被调用，期间可以通过 Rebind 切换地址
+func (s *Service) ListenAndServe() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	<-done
+	return nil
+}
+
+// Stop 停止接受新的连接，等待进行中的请求结束，超过期限后强制关闭
+func (s *Service) Stop() error {
+	s.stopSocket()
 
-	log.Info().Msg("Starting HTTP server on " + s.conf.GetHTTPAddr())
+	s.mu.Lock()
+	srv, done := s.server, s.done
+	s.server, s.done, s.addr = nil, nil, ""
+	s.mu.Unlock()
 
+	if srv == nil {
+		return nil
+	}
+	s.shutdown(srv)
+	close(done)
+
+	log.Info().Msg("HTTP server stopped")
 	return nil
 }
 
-func (s *Service) ListenAndServe() error {
+// Rebind 在新地址上启动服务，旧地址上进行中的请求处理完后再关闭，服务未启动时不做处理
+func (s *Service) Rebind(addr string) error {
+	s.mu.Lock()
+	running, current := s.server != nil, s.addr
+	s.mu.Unlock()
+	if !running || addr == current {
+		return nil
+	}
 
-	s.server = &http.Server{
-		Addr:    s.conf.GetHTTPAddr(),
-		Handler: s.router,
+	ln, err := s.listen(addr)
+	if err != nil {
+		return err
 	}
+	s.swap(ln, addr)
+	return nil
+}
 
-	log.Info().Msg("Starting HTTP server on " + s.conf.GetHTTPAddr())
-	return s.server.ListenAndServe()
+// OnConfig HTTP 地址变化时切换到新地址
+func (s *Service) OnConfig(e *settings.Event) error {
+	if !e.Has(settings.KeyHTTPAddr) {
+		return nil
+	}
+	return s.Rebind(e.New.HTTPAddr)
 }
 
-func (s *Service) Stop() error {
+// Addr 返回当前监听的地址，服务未启动时为空
+func (s *Service) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
 
-	if s.server == nil {
-		return nil
+// listen 监听 addr，启用 HTTPS 时返回 TLS 监听
+func (s *Service) listen(addr string) (net.Listener, error) {
+	tlsConf, err := s.tlsConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.HTTPListenFailed(addr, err)
+	}
+	if tlsConf != nil {
+		ln = tls.NewListener(ln, tlsConf)
+	}
+	return ln, nil
+}
+
+// serve 在 ln 上启动新的服务，调用时需要持有锁
+func (s *Service) serve(ln net.Listener, addr string) {
+	srv := &http.Server{
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.server = srv
+	s.addr = addr
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Err(err).Msgf("HTTP server on %s stopped", addr)
+		}
+	}()
+
+	scheme := "http"
+	if c := s.conf.GetHTTPConfig(); c != nil && c.TLS.Enabled {
+		scheme = "https"
+	}
+	log.Info().Msgf("Starting HTTP server on %s://%s", scheme, addr)
+}
+
+// swap 用已监听的 ln 替换当前服务，旧服务在后台优雅关闭；服务已停止时关闭 ln
+func (s *Service) swap(ln net.Listener, addr string) {
+	s.mu.Lock()
+	old := s.server
+	if old == nil {
+		s.mu.Unlock()
+		ln.Close()
+		return
 	}
+	s.serve(ln, addr)
+	s.mu.Unlock()
 
-	// 使用超时上下文优雅关闭
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	go s.shutdown(old)
+}
+
+// shutdown 优雅关闭 srv，超过期限后强制关闭剩余的连接
+func (s *Service) shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
 	defer cancel()
 
-	if err := s.server.Shutdown(ctx); err != nil {
-		log.Debug().Err(err).Msg("Failed to shutdown HTTP server")
-		return nil
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Debug().Err(err).Msg("Failed to shutdown HTTP server gracefully, closing")
+		srv.Close()
 	}
+}
 
-	log.Info().Msg("HTTP server stopped")
-	return nil
+func (s *Service) shutdownTimeout() time.Duration {
+	if c := s.conf.GetHTTPConfig(); c != nil && c.ShutdownTimeout > 0 {
+		return time.Duration(c.ShutdownTimeout) * time.Second
+	}
+	return DefaultShutdownTimeout
 }
 
 func (s *Service) GetRouter() *gin.Engine {
@@ -0,0 +1,379 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/mcp"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
+)
+
+type testConfig struct {
+	addr string
+	http conf.HTTPConfig
+}
+
+func (c *testConfig) GetHTTPAddr() string                   { return c.addr }
+func (c *testConfig) GetDataDir() string                    { return "" }
+func (c *testConfig) GetWorkDir() string                    { return "" }
+func (c *testConfig) GetWorkKey() string                    { return "" }
+func (c *testConfig) GetPlatform() string                   { return "" }
+func (c *testConfig) GetVersion() int                       { return 0 }
+func (c *testConfig) GetHTTPConfig() *conf.HTTPConfig       { return &c.http }
+func (c *testConfig) GetDBConfig() *conf.DBConfig           { return nil }
+func (c *testConfig) GetArchiveConfig() *conf.ArchiveConfig { return nil }
+
+func newTestService(t *testing.T, c *testConfig) *Service {
+	t.Helper()
+	if c.addr == "" {
+		c.addr = freeAddr(t)
+	}
+	db := database.NewService(c)
+	s := NewService(c, db, mcp.NewService(db), nil, nil, nil, nil, dat2img.NewDecoder(""))
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func get(client *http.Client, url string) (int, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestRebind(t *testing.T) {
+	s := newTestService(t, &testConfig{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Addr()
+	if code, err := get(http.DefaultClient, "http://"+old+"/health"); err != nil || code != http.StatusOK {
+		t.Fatalf("GET old = %d, %v", code, err)
+	}
+
+	addr := freeAddr(t)
+	if err := s.Rebind(addr); err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr() != addr {
+		t.Fatalf("Addr = %s, want %s", s.Addr(), addr)
+	}
+	if code, err := get(http.DefaultClient, "http://"+addr+"/health"); err != nil || code != http.StatusOK {
+		t.Fatalf("GET new = %d, %v", code, err)
+	}
+
+	// 旧地址在后台关闭
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", old)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("old address still accepting connections")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 监听失败时保持原地址
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := s.Rebind(ln.Addr().String()); err == nil {
+		t.Fatal("rebind to an address in use should fail")
+	}
+	if s.Addr() != addr {
+		t.Fatalf("Addr = %s after failed rebind", s.Addr())
+	}
+}
+
+func TestStopDrainsRequests(t *testing.T) {
+	s := newTestService(t, &testConfig{})
+	started := make(chan struct{})
+	s.GetRouter().GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Addr() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("server not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := s.Addr()
+
+	var wg sync.WaitGroup
+	var code int
+	var reqErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		code, reqErr = get(http.DefaultClient, "http://"+addr+"/slow")
+	}()
+	<-started
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if reqErr != nil || code != http.StatusOK {
+		t.Fatalf("in-flight request = %d, %v", code, reqErr)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return after Stop")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("server still accepting connections after Stop")
+	}
+	// 停止后切换地址不启动服务
+	if err := s.Rebind(freeAddr(t)); err != nil || s.Addr() != "" {
+		t.Fatalf("Rebind after Stop = %q, %v", s.Addr(), err)
+	}
+}
+
+func TestSelfSignedTLS(t *testing.T) {
+	c := &testConfig{}
+	c.http.TLS.Enabled = true
+	c.http.TLS.Hosts = []string{"chatlog.local"}
+	s := newTestService(t, c)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + s.Addr() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	cert := resp.TLS.PeerCertificates[0]
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.VerifyHostname("chatlog.local"); err != nil {
+		t.Error(err)
+	}
+	// TLS 监听对明文请求只返回 400
+	if code, _ := get(http.DefaultClient, "http://"+s.Addr()+"/health"); code == http.StatusOK {
+		t.Error("plain HTTP request to the TLS listener should fail")
+	}
+
+	// 主机列表不变时复用证书
+	first := s.cert
+	if _, err := s.tlsConfig(s.Addr()); err != nil || s.cert != first {
+		t.Errorf("certificate regenerated for the same hosts: %v", err)
+	}
+}
+
+func TestTLSCertFileMissing(t *testing.T) {
+	c := &testConfig{}
+	c.http.TLS.Enabled = true
+	c.http.TLS.CertFile = "missing.pem"
+	c.http.TLS.KeyFile = "missing.key"
+	s := newTestService(t, c)
+	if err := s.Start(); err == nil {
+		t.Fatal("Start with missing certificate should fail")
+	}
+}
+
+func TestControlAuth(t *testing.T) {
+	s := newTestService(t, &testConfig{})
+	serve := func(remote, origin, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/control/health", nil)
+		req.RemoteAddr = remote
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 未设置令牌时只接受本机的非浏览器请求
+	for _, tc := range []struct {
+		remote, origin string
+		code           int
+	}{
+		{"127.0.0.1:1234", "", http.StatusOK},
+		{"[::1]:1234", "", http.StatusOK},
+		{"192.168.1.2:1234", "", http.StatusForbidden},
+		{"127.0.0.1:1234", "http://evil.example", http.StatusForbidden},
+		{"127.0.0.1:1234", "null", http.StatusForbidden},
+	} {
+		w := serve(tc.remote, tc.origin, "")
+		if w.Code != tc.code {
+			t.Errorf("%s origin %q: status %d, want %d", tc.remote, tc.origin, w.Code, tc.code)
+		}
+		if w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("control response has CORS headers")
+		}
+	}
+
+	t.Setenv(conf.EnvControlToken, "secret")
+	if w := serve("127.0.0.1:1234", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d", w.Code)
+	}
+	if w := serve("192.168.1.2:1234", "", "Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", w.Code)
+	}
+	if w := serve("192.168.1.2:1234", "", "Bearer secret"); w.Code != http.StatusOK {
+		t.Errorf("with token: status %d", w.Code)
+	}
+}
+
+func TestControlAuthDesktop(t *testing.T) {
+	// 桌面客户端的页面从 file:// 加载，请求带 Origin: null，启动服务时传入令牌
+	t.Setenv(conf.EnvControlToken, "launch-token")
+	s := newTestService(t, &testConfig{})
+	serve := func(method, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/control/health", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Origin", "null")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		}
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 预检请求不带令牌
+	w := serve(http.MethodOptions, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight: status %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("preflight headers = %v", w.Header())
+	}
+
+	w = serve(http.MethodGet, "Bearer launch-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("with token: status %d, body %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("response not readable cross-origin: %v", w.Header())
+	}
+	if w := serve(http.MethodGet, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without token: status %d", w.Code)
+	}
+}
+
+func TestControlSocketOnly(t *testing.T) {
+	s := newTestService(t, &testConfig{})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "chatlog.sock")
+	if err := s.ServeSocket(sock); err != nil {
+		t.Fatal(err)
+	}
+
+	// 后台服务模式下未设置令牌时，控制接口只在套接字上可用
+	if code, err := get(http.DefaultClient, "http://"+s.Addr()+"/api/v1/control/health"); err != nil || code != http.StatusForbidden {
+		t.Fatalf("control over TCP = %d, %v", code, err)
+	}
+	if code, err := get(http.DefaultClient, "http://"+s.Addr()+"/health"); err != nil || code != http.StatusOK {
+		t.Fatalf("health over TCP = %d, %v", code, err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	if code, err := get(client, "http://chatlog/api/v1/control/health"); err != nil || code != http.StatusOK {
+		t.Fatalf("control over socket = %d, %v", code, err)
+	}
+}
+
+func TestServeSocketStale(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "chatlog.sock")
+
+	// 异常退出时留下的套接字文件
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	a := newTestService(t, &testConfig{})
+	if err := a.ServeSocket(sock); err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	// 套接字仍在使用时不删除
+	b := newTestService(t, &testConfig{})
+	if err := b.ServeSocket(sock); err == nil {
+		t.Fatal("second ServeSocket on a live socket should fail")
+	}
+	if code, err := get(&http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}, "http://chatlog/health"); err != nil || code != http.StatusOK {
+		t.Fatalf("first socket not serving: %d, %v", code, err)
+	}
+
+	// 不是套接字的文件不删除
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ServeSocket(plain); err == nil {
+		t.Fatal("ServeSocket replaced a regular file")
+	}
+	if _, err := os.Stat(plain); err != nil {
+		t.Fatal(err)
+	}
+}
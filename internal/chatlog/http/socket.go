@@ -0,0 +1,88 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// ServeSocket 在 Unix 套接字上提供与 HTTP 服务相同的接口，供本机的管理命令调用
+// 套接字文件只允许当前用户访问，Stop 时关闭并删除
+func (s *Service) ServeSocket(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sock != nil {
+		return nil
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return errors.HTTPListenFailed(path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.HTTPListenFailed(path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return errors.HTTPListenFailed(path, err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.router,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext:       socketConnContext,
+	}
+	s.sock = srv
+	s.sockPath = path
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Err(err).Msgf("control socket %s stopped", path)
+		}
+	}()
+	log.Info().Msgf("Serving control API on unix://%s", path)
+	return nil
+}
+
+// removeStaleSocket 删除上次异常退出时留下的套接字文件，否则监听会失败
+// 仍有进程在套接字上监听或路径不是套接字时返回错误，不删除
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// stopSocket 关闭控制套接字，等待进行中的请求结束
+func (s *Service) stopSocket() {
+	s.mu.Lock()
+	srv, path := s.sock, s.sockPath
+	s.sock, s.sockPath = nil, ""
+	s.mu.Unlock()
+
+	if srv == nil {
+		return
+	}
+	s.shutdown(srv)
+	os.Remove(path)
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// SelfSignedValidity 自签名证书的有效期，证书只保存在内存中，重启后重新生成
+const SelfSignedValidity = 365 * 24 * time.Hour
+
+// tlsConfig 返回监听 addr 时使用的 TLS 配置，未启用 HTTPS 时返回 nil
+func (s *Service) tlsConfig(addr string) (*tls.Config, error) {
+	c := s.conf.GetHTTPConfig()
+	if c == nil || !c.TLS.Enabled {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		var err error
+		cert, err = tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.TLSCertFailed(err)
+		}
+	} else {
+		hosts := certHosts(addr, c.TLS.Hosts)
+		key := strings.Join(hosts, ",")
+		s.certMu.Lock()
+		defer s.certMu.Unlock()
+		if s.cert == nil || s.certHosts != key {
+			generated, err := selfSignedCert(hosts)
+			if err != nil {
+				return nil, errors.TLSCertFailed(err)
+			}
+			s.cert, s.certHosts = generated, key
+		}
+		cert = *s.cert
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// certHosts 自签名证书包含的主机名和 IP：本机地址、监听地址和配置的主机
+func certHosts(addr string, extra []string) []string {
+	set := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			set[host] = true
+		}
+	}
+	for _, h := range extra {
+		if h = strings.TrimSpace(h); h != "" {
+			set[h] = true
+		}
+	}
+	hosts := make([]string, 0, len(set))
+	for h := range set {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func selfSignedCert(hosts []string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"chatlog"}, CommonName: "chatlog"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sjzar/chatlog/internal/chatlog/conf"
@@ -12,6 +15,11 @@ import (
 	"github.com/sjzar/chatlog/internal/chatlog/database"
 	"github.com/sjzar/chatlog/internal/chatlog/http"
 	"github.com/sjzar/chatlog/internal/chatlog/mcp"
+	"github.com/sjzar/chatlog/internal/chatlog/media"
+	"github.com/sjzar/chatlog/internal/chatlog/ocr"
+	"github.com/sjzar/chatlog/internal/chatlog/scheduler"
+	"github.com/sjzar/chatlog/internal/chatlog/settings"
+	"github.com/sjzar/chatlog/internal/chatlog/transcribe"
 	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 	iwechat "github.com/sjzar/chatlog/internal/wechat"
 	"github.com/sjzar/chatlog/pkg/config"
@@ -31,6 +39,19 @@ type Manager struct {
 	mcp    *mcp.Service
 	wechat *wechat.Service
 
+	transcribe *transcribe.Service
+	ocr        *ocr.Service
+	scheduler  *scheduler.Service
+
+	// 运行时的配置修改
+	settings *settings.Service
+
+	// dat 图片解码器，由 HTTP 和识别服务共用，切换数据目录时更新密钥
+	decoder *dat2img.Decoder
+
+	// 控制套接字，后台服务模式下使用
+	socket string
+
 	// Terminal UI
 	app *App
 }
@@ -51,9 +72,20 @@ func (m *Manager) Run(configPath string) error {
 
 	m.db = database.NewService(m.ctx)
 
+	m.transcribe = transcribe.NewService(m.ctx, m.db)
+	m.db.SetTranscriber(m.transcribe)
+
+	m.decoder = dat2img.NewDecoder(m.ctx.DataDir)
+	m.ocr = ocr.NewService(m.ctx, m.db, m.decoder)
+	m.db.SetOCR(m.ocr)
+
 	m.mcp = mcp.NewService(m.db)
 
-    m.http = http.NewService(m.ctx, m.db, m.mcp, m.wechat)
+	m.settings = settings.NewService(m.ctx)
+
+    m.http = http.NewService(m.ctx, m.db, m.mcp, m.wechat, m.transcribe, m.ocr, m.settings, m.decoder)
+
+	m.subscribeSettings()
 
 	m.ctx.WeChatInstances = m.wechat.GetWeChatInstances()
 	if len(m.ctx.WeChatInstances) >= 1 {
@@ -106,21 +138,36 @@ func (m *Manager) StartService() error {
 		return err
 	}
 
-	if err := m.mcp.Start(); err != nil {
+	if err := m.transcribe.Start(); err != nil {
 		m.db.Stop() // 回滚已启动的服务
 		return err
 	}
 
+	if err := m.ocr.Start(); err != nil {
+		m.transcribe.Stop() // 回滚已启动的服务
+		m.db.Stop()
+		return err
+	}
+
+	if err := m.mcp.Start(); err != nil {
+		m.ocr.Stop() // 回滚已启动的服务
+		m.transcribe.Stop()
+		m.db.Stop()
+		return err
+	}
+
 	if err := m.http.Start(); err != nil {
 		m.mcp.Stop() // 回滚已启动的服务
+		m.ocr.Stop()
+		m.transcribe.Stop()
 		m.db.Stop()
 		return err
 	}
 
 	// 如果是 4.0 版本，更新下 xorkey
 	if m.ctx.Version == 4 {
-		dat2img.SetAesKey(m.ctx.ImgKey)
-		go dat2img.ScanAndSetXorKey(m.ctx.DataDir)
+		initImageDecoder(m.decoder, m.ctx.DataDir, m.ctx.ImgKey)
+		go scanImageKeys(m.decoder, m.ctx.ImgKey)
 	}
 
 	// 更新状态
@@ -152,6 +199,14 @@ func (m *Manager) stopService() error {
 		errs = append(errs, err)
 	}
 
+	if err := m.ocr.Stop(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := m.transcribe.Stop(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if err := m.db.Stop(); err != nil {
 		errs = append(errs, err)
 	}
@@ -175,8 +230,44 @@ func (m *Manager) SetHTTPAddr(text string) error {
 	} else {
 		addr = text
 	}
-	m.ctx.SetHTTPAddr(addr)
-	return nil
+	// 服务运行中时切换到新地址，旧地址上进行中的请求处理完后关闭
+	_, err := m.settings.Apply(settings.Change{HTTPAddr: addr})
+	return err
+}
+
+// SetWorkDir 修改工作目录，目录不存在时先创建，数据库在新目录上重新打开
+func (m *Manager) SetWorkDir(dir string) error {
+	if err := util.PrepareDir(dir); err != nil {
+		return err
+	}
+	_, err := m.settings.Apply(settings.Change{WorkDir: dir})
+	return err
+}
+
+// SetDataKey 修改数据密钥，自动解密开启时使用新密钥
+func (m *Manager) SetDataKey(key string) error {
+	_, err := m.settings.Apply(settings.Change{DataKey: key})
+	return err
+}
+
+// SetDataDir 修改微信数据目录，自动解密开启时重新监听新目录
+func (m *Manager) SetDataDir(dir string) error {
+	_, err := m.settings.Apply(settings.Change{DataDir: dir})
+	return err
+}
+
+// subscribeSettings 注册各服务对配置修改的处理，地址切换最容易失败，最先处理
+func (m *Manager) subscribeSettings() {
+	m.settings.Subscribe("http", m.http.OnConfig)
+	m.settings.Subscribe("wechat", m.wechat.OnConfig)
+	m.settings.Subscribe("database", m.db.OnConfig)
+	m.settings.Subscribe("image", func(e *settings.Event) error {
+		if e.New.Version == 4 && e.Has(settings.KeyDataDir, settings.KeyImgKey, settings.KeyVersion) {
+			initImageDecoder(m.decoder, e.New.DataDir, e.New.ImgKey)
+			go scanImageKeys(m.decoder, e.New.ImgKey)
+		}
+		return nil
+	})
 }
 
 func (m *Manager) GetDataKey() error {
@@ -191,7 +282,8 @@ func (m *Manager) GetDataKey() error {
 	return nil
 }
 
-func (m *Manager) DecryptDBFiles() error {
+// DecryptDBFiles 解密全部数据库文件，progress 用于报告解密进度，可以为 nil
+func (m *Manager) DecryptDBFiles(progress func(wechat.DecryptProgress)) error {
 	if m.ctx.DataKey == "" {
 		if m.ctx.Current == nil {
 			return fmt.Errorf("未选择任何账号")
@@ -204,7 +296,7 @@ func (m *Manager) DecryptDBFiles() error {
 		m.ctx.WorkDir = util.DefaultWorkDir(m.ctx.Account)
 	}
 
-	if err := m.wechat.DecryptDBFiles(); err != nil {
+	if err := m.wechat.DecryptDBFilesWithProgress(context.Background(), progress); err != nil {
 		return err
 	}
 	m.ctx.Refresh()
@@ -220,21 +312,15 @@ func (m *Manager) StartAutoDecrypt() error {
 		return fmt.Errorf("请先执行解密数据")
 	}
 
-	if err := m.wechat.StartAutoDecrypt(); err != nil {
-		return err
-	}
-
-	m.ctx.SetAutoDecrypt(true)
-	return nil
+	enable := true
+	_, err := m.settings.Apply(settings.Change{AutoDecrypt: &enable})
+	return err
 }
 
 func (m *Manager) StopAutoDecrypt() error {
-	if err := m.wechat.StopAutoDecrypt(); err != nil {
-		return err
-	}
-
-	m.ctx.SetAutoDecrypt(false)
-	return nil
+	enable := false
+	_, err := m.settings.Apply(settings.Change{AutoDecrypt: &enable})
+	return err
 }
 
 func (m *Manager) RefreshSession() error {
@@ -254,6 +340,15 @@ func (m *Manager) RefreshSession() error {
 	return nil
 }
 
+// CommandKeyFromDump 从内存转储文件中离线获取密钥
+func (m *Manager) CommandKeyFromDump(dumpPath string, dataDir string, platform string, version int) (string, error) {
+	key, imgKey, err := wechat.SearchKeyFromDump(context.Background(), dumpPath, dataDir, platform, version)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Data Key: [%s]\nImage Key: [%s]", key, imgKey), nil
+}
+
 func (m *Manager) CommandKey(configPath string, pid int, force bool, showXorKey bool) (string, error) {
 
 	var err error
@@ -282,7 +377,7 @@ func (m *Manager) CommandKey(configPath string, pid int, force bool, showXorKey
 
 		result := fmt.Sprintf("Data Key: [%s]\nImage Key: [%s]", key, imgKey)
 		if m.ctx.Version == 4 && showXorKey {
-			if b, err := dat2img.ScanAndSetXorKey(m.ctx.DataDir); err == nil {
+			if b, err := dat2img.NewDecoder(m.ctx.DataDir).ScanXorKey(); err == nil {
 				result += fmt.Sprintf("\nXor Key: [0x%X]", b)
 			}
 		}
@@ -309,7 +404,7 @@ func (m *Manager) CommandKey(configPath string, pid int, force bool, showXorKey
 			}
 			result := fmt.Sprintf("Data Key: [%s]\nImage Key: [%s]", key, imgKey)
 			if m.ctx.Version == 4 && showXorKey {
-				if b, err := dat2img.ScanAndSetXorKey(m.ctx.DataDir); err == nil {
+				if b, err := dat2img.NewDecoder(m.ctx.DataDir).ScanXorKey(); err == nil {
 					result += fmt.Sprintf("\nXor Key: [0x%X]", b)
 				}
 			}
@@ -338,14 +433,73 @@ func (m *Manager) CommandDecrypt(configPath string, cmdConf map[string]any) erro
 	}
 
 	m.wechat = wechat.NewService(m.sc)
+	m.wechat.SetJobs(m.sc.GetDecryptJobs())
 
-	if err := m.wechat.DecryptDBFiles(); err != nil {
+	if err := m.wechat.DecryptDBFilesWithProgress(context.Background(), func(p wechat.DecryptProgress) {
+		fmt.Fprintf(os.Stderr, "\rdecrypting %d/%d files, %.1f%%", p.FilesDone, p.FilesTotal, p.Percent())
+	}); err != nil {
+		fmt.Fprintln(os.Stderr)
 		return err
 	}
+	fmt.Fprintln(os.Stderr)
 
 	return nil
 }
 
+// CommandMediaExport 批量解密并导出媒体文件
+func (m *Manager) CommandMediaExport(configPath string, cmdConf map[string]any, talker string, timeRange string, types []string, output string) error {
+
+	var err error
+	m.sc, m.scm, err = conf.LoadServiceConfig(configPath, cmdConf)
+	if err != nil {
+		return err
+	}
+
+	dataDir := m.sc.GetDataDir()
+	if len(dataDir) == 0 {
+		return fmt.Errorf("dataDir is required")
+	}
+	if len(m.sc.GetWorkDir()) == 0 {
+		return fmt.Errorf("workDir is required")
+	}
+	if len(output) == 0 {
+		return fmt.Errorf("output is required")
+	}
+
+	opts := media.ExportOptions{
+		Talker: talker,
+		Types:  types,
+		Output: output,
+	}
+	if len(timeRange) != 0 {
+		var ok bool
+		if opts.Start, opts.End, ok = util.TimeRangeOf(timeRange); !ok {
+			return fmt.Errorf("invalid time range: %s", timeRange)
+		}
+	} else {
+		opts.End = time.Now()
+	}
+
+	decoder := dat2img.NewDecoder(dataDir)
+	if m.sc.GetVersion() == 4 {
+		initImageDecoder(decoder, dataDir, m.sc.GetImgKey())
+		scanImageKeys(decoder, m.sc.GetImgKey())
+	}
+
+	m.db = database.NewService(m.sc)
+	if err := m.db.Start(); err != nil {
+		return err
+	}
+	defer m.db.Stop()
+
+	exporter := media.NewExporter(m.db, dataDir, decoder)
+	err = exporter.Export(context.Background(), opts, func(p media.ExportProgress) {
+		fmt.Fprintf(os.Stderr, "\rmessages %d, exported %d, skipped %d, failed %d [%s]", p.Messages, p.Exported, p.Skipped, p.Failed, p.Talker)
+	})
+	fmt.Fprintln(os.Stderr)
+	return err
+}
+
 func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) error {
 
 	var err error
@@ -365,22 +519,41 @@ func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) e
 		return fmt.Errorf("dataKey is required")
 	}
 
-	// 如果是 4.0 版本，处理图片密钥
-	version := m.sc.GetVersion()
-	if version == 4 && len(dataDir) != 0 {
-		dat2img.SetAesKey(m.sc.GetImgKey())
-		go dat2img.ScanAndSetXorKey(dataDir)
-	}
-
-	log.Info().Msgf("server config: %+v", m.sc)
+	log.Info().Msgf("server config: %s", m.sc)
 
 	m.wechat = wechat.NewService(m.sc)
+	m.wechat.SetJobs(m.sc.GetDecryptJobs())
 
 	m.db = database.NewService(m.sc)
 
+	m.transcribe = transcribe.NewService(m.sc, m.db)
+	m.db.SetTranscriber(m.transcribe)
+
+	m.decoder = dat2img.NewDecoder(dataDir)
+	m.ocr = ocr.NewService(m.sc, m.db, m.decoder)
+	m.db.SetOCR(m.ocr)
+
+	// 如果是 4.0 版本，处理图片密钥
+	if m.sc.GetVersion() == 4 && len(dataDir) != 0 {
+		initImageDecoder(m.decoder, dataDir, m.sc.GetImgKey())
+		go scanImageKeys(m.decoder, m.sc.GetImgKey())
+	}
+
 	m.mcp = mcp.NewService(m.db)
 
-    m.http = http.NewService(m.sc, m.db, m.mcp, m.wechat)
+	// 运行时修改的配置写回服务配置文件
+	cm, err := conf.ServerConfigWriter(configPath)
+	if err != nil {
+		return err
+	}
+	m.settings = settings.NewService(settings.NewServerStore(m.sc, cm))
+
+    m.http = http.NewService(m.sc, m.db, m.mcp, m.wechat, m.transcribe, m.ocr, m.settings, m.decoder)
+
+	m.subscribeSettings()
+
+	m.scheduler = scheduler.NewService(m.sc, m.db, m.wechat)
+	m.http.SetScheduler(m.scheduler)
 
 	if m.sc.GetAutoDecrypt() {
 		if err := m.wechat.StartAutoDecrypt(); err != nil {
@@ -419,10 +592,69 @@ func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) e
 		}
 	}()
 
+	if err := m.transcribe.Start(); err != nil {
+		return err
+	}
+	defer m.transcribe.Stop()
+
+	if err := m.ocr.Start(); err != nil {
+		return err
+	}
+	defer m.ocr.Stop()
+
 	if err := m.mcp.Start(); err != nil {
 		return err
 	}
 	defer m.mcp.Stop()
 
+	if err := m.scheduler.Start(); err != nil {
+		return err
+	}
+	defer m.scheduler.Stop()
+
+	if m.socket != "" {
+		if err := m.http.ServeSocket(m.socket); err != nil {
+			return err
+		}
+		defer m.http.Stop()
+	}
+
+	// 收到退出信号时优雅关闭 HTTP 服务，等待进行中的请求结束
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		s := <-sig
+		log.Info().Msgf("received %s, shutting down", s)
+		m.http.Stop()
+	}()
+
 	return m.http.ListenAndServe()
 }
+
+// CommandDaemon 以后台服务方式运行 HTTP 服务，同时在 Unix 套接字上提供控制接口
+func (m *Manager) CommandDaemon(configPath string, cmdConf map[string]any, socket string) error {
+	m.socket = socket
+	return m.CommandHTTPServer(configPath, cmdConf)
+}
+
+// initImageDecoder 把图片解码器切换到数据目录并设置图片密钥
+// 切换需要在扫描之前同步完成，避免旧目录的设置覆盖新目录
+func initImageDecoder(decoder *dat2img.Decoder, dataDir string, imgKey string) {
+	decoder.SetDataDir(dataDir)
+	if err := decoder.SetAesKey(imgKey); err != nil {
+		log.Err(err).Msg("failed to set image key")
+	}
+}
+
+// scanImageKeys 扫描数据目录中的图片计算 XOR 密钥并验证图片密钥，扫描期间切换了目录时结果被丢弃
+func scanImageKeys(decoder *dat2img.Decoder, imgKey string) {
+	if _, err := decoder.ScanXorKey(); err != nil {
+		log.Debug().Err(err).Msg("failed to scan xor key")
+	}
+	if len(imgKey) != 0 {
+		if _, ok := decoder.DetectAesKey(imgKey); !ok {
+			log.Debug().Msgf("image key is not verified by images in %s", decoder.DataDir())
+		}
+	}
+}
@@ -170,6 +170,35 @@ var (
 		},
 	}
 
+	ToolThread = mcp.Tool{
+		Name: "query_thread",
+		Description: `查询一条消息所在的完整回复链（引用消息链），包括它引用的上游消息，以及之后直接或间接引用它的消息，按时间顺序返回。
+当用户想了解某条消息的前因后果、某个引用回复针对的是哪条消息，或者某个话题的讨论串时使用此工具。
+可以直接指定消息序号 seq，也可以通过 time 和 keyword 定位到第一条匹配的消息。`,
+		InputSchema: mcp.ToolSchema{
+			Type: "object",
+			Properties: mcp.M{
+				"talker": mcp.M{
+					"type":        "string",
+					"description": "消息所在的对话方（联系人或群组），可使用ID、昵称或备注名",
+				},
+				"seq": mcp.M{
+					"type":        "integer",
+					"description": "消息序号，即 chatlog 接口 JSON 输出中的 seq 字段",
+				},
+				"time": mcp.M{
+					"type":        "string",
+					"description": "未指定 seq 时用于定位消息的时间范围，格式与 chatlog 工具的 time 参数相同",
+				},
+				"keyword": mcp.M{
+					"type":        "string",
+					"description": "未指定 seq 时用于定位消息的关键词，支持正则表达式",
+				},
+			},
+			Required: []string{"talker"},
+		},
+	}
+
 	ToolCurrentTime = mcp.Tool{
 		Name: "current_time",
 		Description: `获取当前系统时间，返回RFC3339格式的时间字符串（包含用户本地时区信息）。
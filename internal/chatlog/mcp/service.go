@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sjzar/chatlog/internal/chatlog/database"
 	"github.com/sjzar/chatlog/internal/mcp"
+	"github.com/sjzar/chatlog/internal/metrics"
 	"github.com/sjzar/chatlog/pkg/util"
 
 	"github.com/gin-gonic/gin"
@@ -81,6 +83,7 @@ func (s *Service) processMCP(session *mcp.Session, req *mcp.Request) {
 			ToolChatRoom,
 			ToolRecentChat,
 			ToolChatLog,
+			ToolThread,
 			ToolCurrentTime,
 		}})
 	case mcp.MethodToolsCall:
@@ -120,11 +123,15 @@ func (s *Service) initialize(session *mcp.Session, req *mcp.Request) error {
 }
 
 // toolsCall 处理工具调用
-func (s *Service) toolsCall(session *mcp.Session, req *mcp.Request) error {
+func (s *Service) toolsCall(session *mcp.Session, req *mcp.Request) (err error) {
 	callReq, err := parseParams[mcp.ToolsCallRequest](req.Params)
 	if err != nil {
 		return fmt.Errorf("解析工具调用参数失败: %v", err)
 	}
+	tool := callReq.Name
+	defer func() {
+		metrics.ObserveMCPCall(tool, err)
+	}()
 
 	buf := &bytes.Buffer{}
 	switch callReq.Name {
@@ -210,9 +217,42 @@ func (s *Service) toolsCall(session *mcp.Session, req *mcp.Request) error {
 			buf.WriteString(m.PlainText(strings.Contains(talker, ","), util.PerfectTimeFormat(start, end), ""))
 			buf.WriteString("\n")
 		}
+	case "query_thread":
+		talker := ""
+		if v, ok := callReq.Arguments["talker"]; ok {
+			talker = v.(string)
+		}
+		seq := anyToInt64(callReq.Arguments["seq"])
+		if seq == 0 {
+			// 没有指定序号时，用时间和关键词定位第一条匹配的消息
+			_time, _ := callReq.Arguments["time"].(string)
+			keyword, _ := callReq.Arguments["keyword"].(string)
+			start, end, ok := util.TimeRangeOf(_time)
+			if !ok || keyword == "" {
+				return fmt.Errorf("需要指定 seq，或同时指定 time 和 keyword")
+			}
+			messages, err := s.db.GetMessages(start, end, talker, "", keyword, 1, 0)
+			if err != nil {
+				return fmt.Errorf("无法获取聊天记录: %v", err)
+			}
+			if len(messages) == 0 {
+				buf.WriteString("未找到符合查询条件的消息")
+				break
+			}
+			talker, seq = messages[0].Talker, messages[0].Seq
+		}
+		thread, err := s.db.GetThread(talker, seq)
+		if err != nil {
+			return fmt.Errorf("无法获取回复链: %v", err)
+		}
+		for _, m := range thread {
+			buf.WriteString(m.PlainText(false, "2006-01-02 15:04:05", ""))
+			buf.WriteString("\n")
+		}
 	case "current_time":
 		buf.WriteString(time.Now().Local().Format(time.RFC3339))
 	default:
+		tool = "unknown"
 		return fmt.Errorf("未支持的工具: %s", callReq.Name)
 	}
 
@@ -326,3 +366,15 @@ func parseParams[T any](params interface{}) (*T, error) {
 
 	return &result, nil
 }
+
+// anyToInt64 解析 JSON 参数中的整数，较大的数字会被解码为浮点数
+func anyToInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	}
+	return 0
+}
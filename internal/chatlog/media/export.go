@@ -0,0 +1,449 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
+	"github.com/sjzar/chatlog/pkg/util/silk"
+)
+
+const (
+	TypeImage = "image"
+	TypeVideo = "video"
+	TypeVoice = "voice"
+	TypeFile  = "file"
+
+	// ManifestFile 导出清单，每行一条 JSON 记录，同时用于断点续传
+	ManifestFile = "manifest.jsonl"
+
+	// messageBatchSize 每次查询的消息数量
+	messageBatchSize = 1000
+)
+
+// AllTypes 支持导出的全部媒体类型
+var AllTypes = []string{TypeImage, TypeVideo, TypeVoice, TypeFile}
+
+// ExportOptions 导出参数
+type ExportOptions struct {
+	// Talker 聊天对象，多个以英文逗号分隔，为空时导出全部会话
+	Talker string
+
+	// Start, End 消息时间范围
+	Start time.Time
+	End   time.Time
+
+	// Types 导出的媒体类型，为空时导出全部类型
+	Types []string
+
+	// Output 输出目录
+	Output string
+}
+
+// ExportProgress 导出进度
+type ExportProgress struct {
+	Talker   string `json:"talker"`
+	Messages int    `json:"messages"`
+	Exported int    `json:"exported"`
+	Skipped  int    `json:"skipped"`
+	Failed   int    `json:"failed"`
+}
+
+// ManifestEntry 导出清单记录
+type ManifestEntry struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Talker string    `json:"talker"`
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key,omitempty"`
+	Source string    `json:"source,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Exporter 批量解密并导出聊天记录中的媒体文件
+type Exporter struct {
+	db      *database.Service
+	dataDir string
+	decoder *dat2img.Decoder
+
+	mu       sync.Mutex
+	done     map[string]bool
+	manifest *os.File
+}
+
+// NewExporter 创建导出器，dataDir 为微信数据目录，媒体文件从中读取，decoder 用于解码图片
+func NewExporter(db *database.Service, dataDir string, decoder *dat2img.Decoder) *Exporter {
+	return &Exporter{
+		db:      db,
+		dataDir: dataDir,
+		decoder: decoder,
+	}
+}
+
+// Export 按参数导出媒体文件，已记录在清单中的媒体会被跳过，progress 可以为 nil
+func (e *Exporter) Export(ctx context.Context, opts ExportOptions, progress func(ExportProgress)) error {
+	if len(opts.Output) == 0 {
+		return errors.InvalidArg("output")
+	}
+	if err := util.PrepareDir(opts.Output); err != nil {
+		return err
+	}
+	if err := e.openManifest(opts.Output); err != nil {
+		return err
+	}
+	defer e.closeManifest()
+
+	types := make(map[string]bool)
+	if len(opts.Types) == 0 {
+		opts.Types = AllTypes
+	}
+	for _, t := range opts.Types {
+		types[t] = true
+	}
+
+	talkers := util.Str2List(opts.Talker, ",")
+	if len(talkers) == 0 {
+		sessions, err := e.db.GetSessions("", 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions.Items {
+			talkers = append(talkers, session.UserName)
+		}
+	}
+
+	state := ExportProgress{}
+	for _, talker := range talkers {
+		state.Talker = talker
+		for offset := 0; ; offset += messageBatchSize {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			messages, err := e.db.GetMessages(opts.Start, opts.End, talker, "", "", messageBatchSize, offset)
+			if err != nil {
+				// 时间范围内没有消息数据库时视为没有消息，其他错误中止导出，已导出的部分记录在清单中
+				if errors.GetCode(err) == http.StatusNotFound {
+					break
+				}
+				return errors.Wrap(err, fmt.Sprintf("failed to get messages of %s", talker), errors.GetCode(err))
+			}
+
+			for _, msg := range messages {
+				state.Messages++
+				mediaType := messageMediaType(msg)
+				if mediaType == "" || !types[mediaType] {
+					continue
+				}
+				entry := e.exportMessage(opts.Output, mediaType, msg)
+				switch {
+				case entry == nil:
+					state.Skipped++
+				case entry.Error != "":
+					state.Failed++
+				default:
+					state.Exported++
+				}
+			}
+			if progress != nil {
+				progress(state)
+			}
+
+			if len(messages) < messageBatchSize {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// exportMessage 导出单条消息中的媒体，已导出时返回 nil
+func (e *Exporter) exportMessage(output string, mediaType string, msg *model.Message) *ManifestEntry {
+	id := fmt.Sprintf("%s:%d", msg.Talker, msg.Seq)
+	if e.isDone(id) {
+		return nil
+	}
+
+	entry := &ManifestEntry{
+		ID:     id,
+		Type:   mediaType,
+		Talker: msg.Talker,
+		Sender: msg.Sender,
+		Time:   msg.Time,
+	}
+
+	if err := e.export(output, mediaType, msg, entry); err != nil {
+		entry.Error = err.Error()
+		log.Debug().Err(err).Msgf("failed to export %s %s", mediaType, id)
+	}
+
+	e.record(entry)
+	return entry
+}
+
+func (e *Exporter) export(output string, mediaType string, msg *model.Message, entry *ManifestEntry) error {
+	media, err := e.resolve(mediaType, messageMediaKeys(msg))
+	if err != nil {
+		return err
+	}
+	entry.Key = media.Key
+	entry.Source = media.Path
+
+	var data []byte
+	var ext string
+	switch mediaType {
+	case TypeVoice:
+		data, ext = media.Data, "silk"
+		if out, err := silk.Silk2MP3(media.Data); err == nil {
+			data, ext = out, "mp3"
+		}
+	default:
+		source := filepath.Join(e.dataDir, media.Path)
+		if data, err = os.ReadFile(source); err != nil {
+			return errors.ReadFileFailed(source, err)
+		}
+		ext = strings.TrimPrefix(strings.ToLower(filepath.Ext(media.Path)), ".")
+		if ext == "dat" {
+			out, imgExt, err := e.decoder.Decode(data)
+			if err != nil {
+				return err
+			}
+			data, ext = out, imgExt
+		}
+	}
+
+	dir := filepath.Join(sanitize(msg.Talker), msg.Time.Format("2006-01"))
+	if err := util.PrepareDir(filepath.Join(output, dir)); err != nil {
+		return err
+	}
+	var path string
+	if name := fileName(msg); mediaType == TypeFile && name != "" {
+		// 文件保留原始文件名，同名时加序号
+		if filepath.Ext(name) == "" && ext != "" {
+			name += "." + ext
+		}
+		if path, err = writeUnique(output, dir, name, data); err != nil {
+			return err
+		}
+	} else {
+		path = filepath.Join(dir, exportName(msg)+"."+ext)
+		if err := os.WriteFile(filepath.Join(output, path), data, 0644); err != nil {
+			return errors.WriteOutputFailed(err)
+		}
+	}
+
+	entry.Path = filepath.ToSlash(path)
+	entry.Size = int64(len(data))
+	return nil
+}
+
+// resolve 依次尝试媒体键，与 HTTP 接口的查找顺序一致：非 MD5 的键视为数据目录下的相对路径
+func (e *Exporter) resolve(mediaType string, keys []string) (*model.Media, error) {
+	var lastErr error = errors.ErrMediaNotFound
+	for _, key := range keys {
+		// 语音的键是消息的服务端 ID，总是从数据库中查询
+		if len(key) != 32 && mediaType != TypeVoice {
+			if _, err := os.Stat(filepath.Join(e.dataDir, key)); err != nil {
+				continue
+			}
+			return &model.Media{Type: mediaType, Path: key}, nil
+		}
+		media, err := e.db.GetMedia(mediaType, key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if mediaType != TypeVoice {
+			if _, err := os.Stat(filepath.Join(e.dataDir, media.Path)); err != nil {
+				lastErr = errors.ErrMediaNotFound
+				continue
+			}
+		}
+		return media, nil
+	}
+	return nil, lastErr
+}
+
+// messageMediaType 返回消息包含的媒体类型，非媒体消息返回空字符串
+func messageMediaType(msg *model.Message) string {
+	switch {
+	case msg.Type == 3:
+		return TypeImage
+	case msg.Type == 34:
+		return TypeVoice
+	case msg.Type == 43:
+		return TypeVideo
+	case msg.Type == 49 && msg.SubType == 6:
+		return TypeFile
+	}
+	return ""
+}
+
+// messageMediaKeys 返回消息中的媒体键，缩略图排在最后作为兜底
+func messageMediaKeys(msg *model.Message) []string {
+	var names []string
+	switch msg.Type {
+	case 3:
+		names = []string{"md5", "imgfile", "thumb"}
+	case 34:
+		names = []string{"voice"}
+	case 43:
+		names = []string{"md5", "rawmd5", "videofile", "thumb"}
+	case 49:
+		names = []string{"md5"}
+	}
+
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if key, ok := msg.Contents[name].(string); ok && key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// exportName 生成 <时间>_<发送人>_<序号> 格式的文件名，序号在会话内唯一，重新导出时文件名不变
+func exportName(msg *model.Message) string {
+	sender := msg.Sender
+	if msg.IsSelf || sender == "" {
+		sender = "self"
+	}
+	return fmt.Sprintf("%s_%s_%d", msg.Time.Format("20060102_150405"), sanitize(sender), msg.Seq)
+}
+
+// fileName 返回文件消息的原始文件名，没有或无法作为文件名时返回空字符串
+func fileName(msg *model.Message) string {
+	title, _ := msg.Contents["title"].(string)
+	name := strings.TrimSpace(sanitize(title))
+	if name == "" || strings.Trim(name, ".") == "" {
+		return ""
+	}
+	return name
+}
+
+// maxDuplicates 同名文件最多尝试的序号
+const maxDuplicates = 1000
+
+// writeUnique 在 output 下的 dir 中以 name 创建新文件并写入 data，同名文件已存在时依次尝试 name_1.ext、name_2.ext，
+// 返回相对 output 的路径
+func writeUnique(output, dir, name string, data []byte) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < maxDuplicates; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, i, ext))
+		}
+		f, err := os.OpenFile(filepath.Join(output, path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", errors.WriteOutputFailed(err)
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", errors.WriteOutputFailed(err)
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return "", errors.WriteOutputFailed(err)
+		}
+		return path, nil
+	}
+	return "", errors.WriteOutputFailed(fmt.Errorf("too many files named %s", name))
+}
+
+// sanitize 替换文件名中不允许出现的字符
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// openManifest 读取已有清单中成功导出的记录，并以追加方式打开清单
+func (e *Exporter) openManifest(output string) error {
+	path := filepath.Join(output, ManifestFile)
+
+	e.done = make(map[string]bool)
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry ManifestEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			// 失败的记录在下次导出时重试
+			if entry.Error == "" {
+				if _, err := os.Stat(filepath.Join(output, filepath.FromSlash(entry.Path))); err == nil {
+					e.done[entry.ID] = true
+				}
+			}
+		}
+		f.Close()
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.OpenFileFailed(path, err)
+	}
+	e.manifest = f
+	return nil
+}
+
+func (e *Exporter) closeManifest() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.manifest != nil {
+		e.manifest.Close()
+		e.manifest = nil
+	}
+}
+
+func (e *Exporter) isDone(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done[id]
+}
+
+func (e *Exporter) record(entry *ManifestEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry.Error == "" {
+		e.done[entry.ID] = true
+	}
+	if _, err := e.manifest.Write(append(b, '\n')); err != nil {
+		log.Debug().Err(err).Msg("failed to write manifest")
+	}
+}
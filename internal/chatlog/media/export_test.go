@@ -0,0 +1,119 @@
+package media
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+type testConfig struct{}
+
+func (c *testConfig) GetWorkDir() string                    { return "" }
+func (c *testConfig) GetWorkKey() string                    { return "" }
+func (c *testConfig) GetPlatform() string                   { return "windows" }
+func (c *testConfig) GetVersion() int                       { return 4 }
+func (c *testConfig) GetDBConfig() *conf.DBConfig           { return nil }
+func (c *testConfig) GetArchiveConfig() *conf.ArchiveConfig { return nil }
+
+func TestExportName(t *testing.T) {
+	at := time.Date(2024, 3, 5, 9, 7, 1, 0, time.Local)
+	// 同一秒内的消息序号不同，文件名也不同
+	a := exportName(&model.Message{Seq: 1709600821000, Time: at, Sender: "wxid_a"})
+	b := exportName(&model.Message{Seq: 1709600821001, Time: at, Sender: "wxid_a"})
+	if a == b {
+		t.Fatalf("same name %s for different messages", a)
+	}
+	if want := "20240305_090701_wxid_a_1709600821000"; a != want {
+		t.Errorf("exportName = %s, want %s", a, want)
+	}
+	if got := exportName(&model.Message{Seq: 1, Time: at, IsSelf: true, Sender: "wxid_me"}); got != "20240305_090701_self_1" {
+		t.Errorf("exportName of own message = %s", got)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	for title, want := range map[string]string{
+		"report.pdf":   "report.pdf",
+		" 周报/3月.docx ": "周报_3月.docx",
+		"..":           "",
+		"":             "",
+	} {
+		m := &model.Message{Type: 49, SubType: 6, Contents: map[string]interface{}{"title": title}}
+		if got := fileName(m); got != want {
+			t.Errorf("fileName(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestWriteUnique(t *testing.T) {
+	output := t.TempDir()
+	if err := os.Mkdir(filepath.Join(output, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"report.pdf", "report_1.pdf", "report_2.pdf"}
+	for i, name := range want {
+		path, err := writeUnique(output, "dir", "report.pdf", []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join("dir", name) {
+			t.Errorf("write %d: path %s, want %s", i, path, name)
+		}
+	}
+	// 已有的文件不被覆盖
+	for i, name := range want {
+		data, err := os.ReadFile(filepath.Join(output, "dir", name))
+		if err != nil || len(data) != 1 || data[0] != byte(i) {
+			t.Errorf("%s = %v, %v", name, data, err)
+		}
+	}
+}
+
+func TestMessageMediaKeys(t *testing.T) {
+	for _, tc := range []struct {
+		msg       *model.Message
+		mediaType string
+		keys      []string
+	}{
+		{&model.Message{Type: 3, Contents: map[string]interface{}{"md5": "m", "thumb": "t"}}, TypeImage, []string{"m", "t"}},
+		{&model.Message{Type: 34, Contents: map[string]interface{}{"voice": "v"}}, TypeVoice, []string{"v"}},
+		{&model.Message{Type: 43, Contents: map[string]interface{}{"rawmd5": "r", "videofile": "f"}}, TypeVideo, []string{"r", "f"}},
+		{&model.Message{Type: 49, SubType: 6, Contents: map[string]interface{}{"md5": "m"}}, TypeFile, []string{"m"}},
+		{&model.Message{Type: 49, SubType: 5}, "", nil},
+		{&model.Message{Type: 1}, "", nil},
+	} {
+		if got := messageMediaType(tc.msg); got != tc.mediaType {
+			t.Errorf("type %d/%d: media type %q, want %q", tc.msg.Type, tc.msg.SubType, got, tc.mediaType)
+		}
+		if tc.mediaType == "" {
+			continue
+		}
+		keys := messageMediaKeys(tc.msg)
+		if len(keys) != len(tc.keys) {
+			t.Errorf("type %d: keys %v, want %v", tc.msg.Type, keys, tc.keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != tc.keys[i] {
+				t.Errorf("type %d: keys %v, want %v", tc.msg.Type, keys, tc.keys)
+			}
+		}
+	}
+}
+
+func TestExportQueryError(t *testing.T) {
+	// 数据库未就绪时返回错误，而不是静默地导出 0 个文件
+	e := NewExporter(database.NewService(&testConfig{}), t.TempDir(), nil)
+	err := e.Export(context.Background(), ExportOptions{Talker: "wxid_a", End: time.Now(), Output: t.TempDir()}, nil)
+	if errors.GetCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("Export = %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+const (
+	DefaultTesseractCommand  = "tesseract"
+	DefaultTesseractLanguage = "chi_sim+eng"
+
+	// RequestTimeout 单张图片识别的超时时间
+	RequestTimeout = time.Minute
+)
+
+// Backend 图片文字识别服务
+type Backend interface {
+	// Recognize 识别图片中的文字，ext 为图片格式（jpg、png 等）
+	Recognize(ctx context.Context, image []byte, ext string) (string, error)
+}
+
+// NewBackend 根据配置创建识别服务
+func NewBackend(c *conf.OCRConfig) (Backend, error) {
+	switch c.Backend {
+	case conf.OCRBackendTesseract:
+		command := c.Command
+		if len(command) == 0 {
+			command = DefaultTesseractCommand
+		}
+		path, err := exec.LookPath(command)
+		if err != nil {
+			return nil, fmt.Errorf("tesseract not found: %w", err)
+		}
+		language := c.Language
+		if len(language) == 0 {
+			language = DefaultTesseractLanguage
+		}
+		return &tesseractBackend{command: path, language: language}, nil
+	case conf.OCRBackendHTTP:
+		if len(c.URL) == 0 {
+			return nil, fmt.Errorf("ocr url is required")
+		}
+		return &httpBackend{
+			client:   &http.Client{Timeout: RequestTimeout},
+			url:      c.URL,
+			apiKey:   c.APIKey,
+			language: c.Language,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported ocr backend: %s", c.Backend)
+	}
+}
+
+// tesseractBackend 调用本地的 tesseract 程序，图片从标准输入传入，结果从标准输出读取
+type tesseractBackend struct {
+	command  string
+	language string
+}
+
+func (b *tesseractBackend) Recognize(ctx context.Context, image []byte, ext string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.command, "stdin", "stdout", "-l", b.language)
+	cmd.Stdin = bytes.NewReader(image)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tesseract failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return normalize(stdout.String()), nil
+}
+
+// httpBackend 以 multipart/form-data 上传图片的识别服务，返回 {"text": "..."}
+type httpBackend struct {
+	client   *http.Client
+	url      string
+	apiKey   string
+	language string
+}
+
+func (b *httpBackend) Recognize(ctx context.Context, image []byte, ext string) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if len(b.language) != 0 {
+		if err := w.WriteField("language", b.language); err != nil {
+			return "", err
+		}
+	}
+	fw, err := w.CreateFormFile("file", "image."+ext)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(image); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if len(b.apiKey) != 0 {
+		req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ocr failed: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var ret struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return "", fmt.Errorf("invalid ocr response: %w", err)
+	}
+	return normalize(ret.Text), nil
+}
+
+// normalize 去掉空行和行首尾的空白，tesseract 会输出大量空行和换页符
+func normalize(text string) string {
+	lines := strings.Split(text, "\n")
+	out := lines[:0]
+	for _, line := range lines {
+		line = strings.TrimSpace(strings.ReplaceAll(line, "\f", ""))
+		if len(line) != 0 {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,96 @@
+package ocr
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+func TestNewBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conf conf.OCRConfig
+		want string
+	}{
+		{name: "tesseract", conf: conf.OCRConfig{Backend: conf.OCRBackendTesseract, Command: "sh"}, want: "tesseract"},
+		{name: "tesseract not found", conf: conf.OCRConfig{Backend: conf.OCRBackendTesseract, Command: "chatlog-missing-tesseract"}},
+		{name: "http", conf: conf.OCRConfig{Backend: conf.OCRBackendHTTP, URL: "http://127.0.0.1:1/ocr"}, want: "http"},
+		{name: "http without url", conf: conf.OCRConfig{Backend: conf.OCRBackendHTTP}},
+		{name: "unsupported", conf: conf.OCRConfig{Backend: "paddle"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := NewBackend(&tc.conf)
+			var got string
+			switch b := b.(type) {
+			case *tesseractBackend:
+				got = "tesseract"
+				if b.language != DefaultTesseractLanguage {
+					t.Errorf("language = %s", b.language)
+				}
+			case *httpBackend:
+				got = "http"
+			}
+			if got != tc.want {
+				t.Fatalf("NewBackend = %T, %v, want %s", b, err, tc.want)
+			}
+			if (err == nil) != (tc.want != "") {
+				t.Fatalf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		text   string
+		err    string
+	}{
+		{name: "ok", status: http.StatusOK, body: `{"text": " 你好 \n\n 世界 "}`, text: "你好\n世界"},
+		{name: "server error", status: http.StatusInternalServerError, body: "model not loaded", err: "model not loaded"},
+		{name: "invalid response", status: http.StatusOK, body: "<html>", err: "invalid ocr response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer sk-test" {
+					t.Errorf("Authorization = %q", got)
+				}
+				if got := r.FormValue("language"); got != "zh" {
+					t.Errorf("language = %q", got)
+				}
+				f, h, err := r.FormFile("file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, _ := io.ReadAll(f); string(data) != "PNG" || h.Filename != "image.png" {
+					t.Errorf("file = %s %q", h.Filename, data)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			b, err := NewBackend(&conf.OCRConfig{Backend: conf.OCRBackendHTTP, URL: srv.URL, APIKey: "sk-test", Language: "zh"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := b.Recognize(context.Background(), []byte("PNG"), "png")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil || text != tc.text {
+				t.Fatalf("Recognize = %q, %v", text, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package ocr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
+)
+
+const (
+	// IndexFile 工作目录下保存识别结果的索引，每行一条 JSON 记录，后写入的记录覆盖先前的
+	IndexFile = "ocr.jsonl"
+
+	// queueSize 待识别队列长度，队列满时丢弃，下次查询时重新加入
+	queueSize = 1024
+
+	// retryInterval 识别失败后重试的间隔
+	retryInterval = 10 * time.Minute
+)
+
+type Config interface {
+	GetDataDir() string
+	GetWorkDir() string
+	GetOCRConfig() *conf.OCRConfig
+}
+
+// MediaSource 按类型和键读取媒体数据
+type MediaSource interface {
+	GetMedia(_type string, key string) (*model.Media, error)
+}
+
+// Record 索引中的一条识别结果，没有文字的图片也会记录，避免重复识别
+type Record struct {
+	MD5  string `json:"md5"`
+	Text string `json:"text"`
+	Time int64  `json:"time"`
+}
+
+// Service 图片文字识别服务
+// 识别结果按图片 MD5 保存在索引中，查询消息时填充到图片消息的 ocr 字段，未识别的图片在后台排队识别
+type Service struct {
+	conf    Config
+	media   MediaSource
+	decoder *dat2img.Decoder
+
+	backend Backend
+	queue   chan string
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu      sync.RWMutex
+	index   map[string]string
+	pending map[string]bool
+	failed  map[string]time.Time
+}
+
+func NewService(conf Config, media MediaSource, decoder *dat2img.Decoder) *Service {
+	return &Service{
+		conf:    conf,
+		media:   media,
+		decoder: decoder,
+	}
+}
+
+// Start 加载索引，配置了识别服务时启动后台识别
+// 未配置识别服务时已有的识别结果仍然可以搜索
+func (s *Service) Start() error {
+	index, err := loadIndex(s.indexPath())
+	if err != nil {
+		log.Debug().Err(err).Msg("load ocr index failed")
+	}
+	s.mu.Lock()
+	s.index = index
+	s.mu.Unlock()
+
+	c := s.conf.GetOCRConfig()
+	if !c.Enabled() {
+		return nil
+	}
+	backend, err := NewBackend(c)
+	if err != nil {
+		return errors.New(err, http.StatusInternalServerError, "init ocr backend failed")
+	}
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.backend = backend
+	s.queue = make(chan string, queueSize)
+	s.cancel = cancel
+	s.pending = make(map[string]bool)
+	s.failed = make(map[string]time.Time)
+	queue := s.queue
+	s.mu.Unlock()
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker(ctx, queue)
+	}
+	log.Info().Msgf("ocr service started, backend: %s, %d images indexed", c.Backend, len(index))
+	return nil
+}
+
+func (s *Service) Stop() error {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.backend, s.queue, s.cancel = nil, nil, nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		s.wg.Wait()
+	}
+
+	s.mu.Lock()
+	s.index = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// Enabled 是否配置了识别服务并已启动
+func (s *Service) Enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backend != nil
+}
+
+// Annotate 为图片消息填充已识别的文字，只读取索引，可以在关键词过滤前调用
+func (s *Service) Annotate(m *model.Message) {
+	key := imageKey(m)
+	if len(key) == 0 {
+		return
+	}
+	if text, ok := s.Cached(key); ok && len(text) != 0 {
+		m.SetContent("ocr", text)
+	}
+}
+
+// Fill 为图片消息填充识别结果，没有识别过的图片加入后台识别队列
+func (s *Service) Fill(messages []*model.Message) {
+	for _, m := range messages {
+		key := imageKey(m)
+		if len(key) == 0 {
+			continue
+		}
+		if text, ok := s.Cached(key); ok {
+			if len(text) != 0 {
+				m.SetContent("ocr", text)
+			}
+			continue
+		}
+		s.enqueue(key)
+	}
+}
+
+// Recognize 识别一张图片，key 为图片的 MD5，优先使用索引中的结果
+func (s *Service) Recognize(ctx context.Context, key string) (string, error) {
+	key = strings.ToLower(key)
+	if len(key) != 32 {
+		return "", errors.ErrKeyLengthMust32
+	}
+	if text, ok := s.Cached(key); ok {
+		return text, nil
+	}
+
+	s.mu.RLock()
+	backend := s.backend
+	s.mu.RUnlock()
+	if backend == nil {
+		return "", errors.New(nil, http.StatusServiceUnavailable, "ocr backend is not configured")
+	}
+
+	image, ext, err := s.readImage(key)
+	if err != nil {
+		return "", err
+	}
+	text, err := backend.Recognize(ctx, image, ext)
+	if err != nil {
+		return "", errors.New(err, http.StatusBadGateway, "recognize image failed")
+	}
+
+	if err := s.store(key, text); err != nil {
+		log.Debug().Err(err).Msgf("save ocr result %s failed", key)
+	}
+	return text, nil
+}
+
+// Cached 读取索引中的识别结果，第二个返回值表示是否已识别
+func (s *Service) Cached(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	text, ok := s.index[key]
+	return text, ok
+}
+
+// readImage 读取图片文件，加密的 dat 文件先解密
+func (s *Service) readImage(key string) ([]byte, string, error) {
+	media, err := s.media.GetMedia("image", key)
+	if err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(s.conf.GetDataDir(), media.Path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", errors.ReadFileFailed(path, err)
+	}
+
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if ext == "dat" {
+		if data, ext, err = s.decoder.Decode(data); err != nil {
+			return nil, "", errors.New(err, http.StatusInternalServerError, "decode image failed")
+		}
+	}
+	switch ext {
+	case "jpg", "jpeg", "png", "gif", "bmp", "webp", "tif", "tiff":
+		return data, ext, nil
+	default:
+		return nil, "", errors.MediaTypeUnsupported(ext)
+	}
+}
+
+func (s *Service) store(key, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index != nil {
+		s.index[key] = text
+	}
+
+	path := s.indexPath()
+	if len(path) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(Record{MD5: key, Text: text, Time: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *Service) indexPath() string {
+	workDir := s.conf.GetWorkDir()
+	if len(workDir) == 0 {
+		return ""
+	}
+	return filepath.Join(workDir, IndexFile)
+}
+
+// loadIndex 读取索引文件，文件不存在时返回空索引，无法解析的行（如写入中断的最后一行）被忽略
+func loadIndex(path string) (map[string]string, error) {
+	index := make(map[string]string)
+	if len(path) == 0 {
+		return index, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return index, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || len(r.MD5) == 0 {
+			continue
+		}
+		index[r.MD5] = r.Text
+	}
+	return index, scanner.Err()
+}
+
+// imageKey 返回图片消息的 MD5，其他消息返回空字符串
+func imageKey(m *model.Message) string {
+	if m.Type != 3 {
+		return ""
+	}
+	key, _ := m.Contents["md5"].(string)
+	if len(key) != 32 {
+		return ""
+	}
+	return strings.ToLower(key)
+}
+
+func (s *Service) enqueue(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil || s.pending[key] {
+		return
+	}
+	if t, ok := s.failed[key]; ok && time.Since(t) < retryInterval {
+		return
+	}
+	select {
+	case s.queue <- key:
+		s.pending[key] = true
+	default:
+	}
+}
+
+func (s *Service) worker(ctx context.Context, queue chan string) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-queue:
+			_, err := s.Recognize(ctx, key)
+			s.mu.Lock()
+			if s.pending != nil {
+				delete(s.pending, key)
+				if err != nil {
+					s.failed[key] = time.Now()
+				}
+			}
+			s.mu.Unlock()
+			if err != nil && ctx.Err() == nil {
+				log.Debug().Err(err).Msgf("recognize image %s failed", key)
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
+)
+
+type testConfig struct {
+	dataDir string
+	workDir string
+	conf    conf.OCRConfig
+}
+
+func (c *testConfig) GetDataDir() string            { return c.dataDir }
+func (c *testConfig) GetWorkDir() string            { return c.workDir }
+func (c *testConfig) GetOCRConfig() *conf.OCRConfig { return &c.conf }
+
+// testMedia 图片 MD5 对应数据目录下的同名文件
+type testMedia struct {
+	ext string
+}
+
+func (m *testMedia) GetMedia(_type string, key string) (*model.Media, error) {
+	return &model.Media{Type: _type, Key: key, Path: key + "." + m.ext}, nil
+}
+
+// testBackend 记录收到的图片，返回固定的结果
+type testBackend struct {
+	mu     sync.Mutex
+	images [][]byte
+	exts   []string
+	text   string
+	err    error
+}
+
+func (b *testBackend) Recognize(ctx context.Context, image []byte, ext string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.images = append(b.images, image)
+	b.exts = append(b.exts, ext)
+	return b.text, b.err
+}
+
+func (b *testBackend) calls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.images)
+}
+
+func image(key string) *model.Message {
+	return &model.Message{Type: 3, Contents: map[string]interface{}{"md5": key}}
+}
+
+// testJPG 以 JPEG 文件头开始、以 JPEG 文件尾结束的测试数据
+func testJPG() []byte {
+	data := append([]byte{}, dat2img.JPG.Header...)
+	for i := 0; len(data) < 62; i++ {
+		data = append(data, byte(i))
+	}
+	return append(data, dat2img.JpgTail...)
+}
+
+// encodeV4 按微信 v4 的格式加密：开头 16 字节 AES-ECB 加密，末尾 8 字节异或加密
+func encodeV4(t *testing.T, plain []byte, aesKey []byte, xorKey byte) []byte {
+	t.Helper()
+	const aesLen, xorLen = 16, 8
+	header := make([]byte, 15)
+	copy(header, dat2img.V4Format2.Header)
+	binary.LittleEndian.PutUint32(header[6:10], aesLen)
+	binary.LittleEndian.PutUint32(header[10:14], xorLen)
+	header[14] = 1
+
+	block := append(bytes.Clone(plain[:aesLen]), bytes.Repeat([]byte{aes.BlockSize}, aes.BlockSize)...)
+	cipher, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(block); i += aes.BlockSize {
+		cipher.Encrypt(block[i:i+aes.BlockSize], block[i:i+aes.BlockSize])
+	}
+
+	data := append(header, block...)
+	data = append(data, plain[aesLen:len(plain)-xorLen]...)
+	for _, b := range plain[len(plain)-xorLen:] {
+		data = append(data, b^xorKey)
+	}
+	return data
+}
+
+func TestRecognizeCache(t *testing.T) {
+	dir := t.TempDir()
+	key := fmt.Sprintf("%032x", 1)
+	if err := os.WriteFile(filepath.Join(dir, key+".png"), []byte("PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &testConfig{dataDir: dir, workDir: t.TempDir()}
+	s := NewService(c, &testMedia{ext: "png"}, nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Recognize(context.Background(), key); err == nil {
+		t.Fatal("recognized without a backend")
+	}
+
+	backend := &testBackend{text: "你好"}
+	s.backend = backend
+	for i := 0; i < 2; i++ {
+		text, err := s.Recognize(context.Background(), key)
+		if err != nil || text != "你好" {
+			t.Fatalf("Recognize = %q, %v", text, err)
+		}
+	}
+	if n := backend.calls(); n != 1 {
+		t.Fatalf("backend called %d times, want 1", n)
+	}
+	if backend.exts[0] != "png" || string(backend.images[0]) != "PNG" {
+		t.Errorf("backend got %s %q", backend.exts[0], backend.images[0])
+	}
+
+	// 重新启动后从索引文件中读取
+	s.Stop()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m := image(key)
+	s.Annotate(m)
+	if m.Contents["ocr"] != "你好" {
+		t.Errorf("Annotate = %v", m.Contents)
+	}
+}
+
+func TestRecognizeError(t *testing.T) {
+	dir := t.TempDir()
+	key := fmt.Sprintf("%032x", 2)
+	if err := os.WriteFile(filepath.Join(dir, key+".jpg"), testJPG(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(&testConfig{dataDir: dir, workDir: t.TempDir()}, &testMedia{ext: "jpg"}, nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{err: fmt.Errorf("backend down")}
+	s.backend = backend
+
+	_, err := s.Recognize(context.Background(), key)
+	if e, ok := err.(*errors.Error); !ok || e.Code != http.StatusBadGateway {
+		t.Fatalf("err = %v, want 502", err)
+	}
+	if _, ok := s.Cached(key); ok {
+		t.Fatal("failed result cached")
+	}
+
+	// 失败的识别不写入索引，恢复后重新识别
+	backend.err, backend.text = nil, "ok"
+	if text, err := s.Recognize(context.Background(), key); err != nil || text != "ok" {
+		t.Fatalf("Recognize = %q, %v", text, err)
+	}
+	if n := backend.calls(); n != 2 {
+		t.Fatalf("backend called %d times, want 2", n)
+	}
+
+	if _, err := s.Recognize(context.Background(), "short"); err != errors.ErrKeyLengthMust32 {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestRecognizeSharedDecoder(t *testing.T) {
+	dir := t.TempDir()
+	key := fmt.Sprintf("%032x", 3)
+	aesKey := []byte("0123456789abcdef")
+	plain := testJPG()
+	if err := os.WriteFile(filepath.Join(dir, key+".dat"), encodeV4(t, plain, aesKey, 0x5c), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := dat2img.NewDecoder(dir)
+	s := NewService(&testConfig{dataDir: dir, workDir: t.TempDir()}, &testMedia{ext: "dat"}, decoder)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{text: "图片"}
+	s.backend = backend
+
+	if _, err := s.Recognize(context.Background(), key); err == nil {
+		t.Fatal("decoded with the default keys")
+	}
+
+	// 服务使用传入的解码器，之后设置的密钥立即生效
+	if err := decoder.SetAesKey(hex.EncodeToString(aesKey)); err != nil {
+		t.Fatal(err)
+	}
+	decoder.SetXorKey(0x5c)
+	if _, err := s.Recognize(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if backend.calls() != 1 || backend.exts[0] != "jpg" || !bytes.Equal(backend.images[0], plain) {
+		t.Fatalf("backend got %v %v", backend.exts, backend.images)
+	}
+}
+
+func TestFillQueue(t *testing.T) {
+	requests := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		f.Close()
+		requests <- r.URL.Path
+		w.Write([]byte(`{"text": "队列"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	key := fmt.Sprintf("%032x", 4)
+	if err := os.WriteFile(filepath.Join(dir, key+".png"), []byte("PNG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(&testConfig{
+		dataDir: dir,
+		workDir: t.TempDir(),
+		conf:    conf.OCRConfig{Backend: conf.OCRBackendHTTP, URL: srv.URL},
+	}, &testMedia{ext: "png"}, nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if !s.Enabled() {
+		t.Fatal("service not enabled")
+	}
+
+	s.Fill([]*model.Message{image(key)})
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("image not queued")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.Cached(key); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("result not cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m := image(key)
+	s.Fill([]*model.Message{m})
+	if m.Contents["ocr"] != "队列" {
+		t.Errorf("Fill = %v", m.Contents)
+	}
+	select {
+	case <-requests:
+		t.Fatal("cached image recognized again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
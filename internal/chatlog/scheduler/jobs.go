@@ -0,0 +1,227 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/summarize"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// ExportDir 工作目录下默认的导出目录
+const ExportDir = "export"
+
+// maxResult 运行记录中保留的摘要长度
+const maxResult = 2000
+
+var unsafeName = regexp.MustCompile(`[^0-9A-Za-z_@.-]+`)
+
+// decrypt 解密全部数据库文件并重新打开数据库，与控制接口的解密相同
+func (s *Service) decrypt(ctx context.Context) error {
+	return s.db.Decrypt(func() error {
+		return s.wx.DecryptDBFilesWithProgress(ctx, nil)
+	})
+}
+
+// messages 查询任务时间范围内的消息
+func (s *Service) messages(jc conf.JobConfig) ([]*model.Message, time.Time, time.Time, error) {
+	spec := jc.Time
+	if spec == "" {
+		spec = DefaultTime
+	}
+	start, end, ok := util.TimeRangeOf(spec)
+	if !ok {
+		return nil, start, end, errors.InvalidArg("time")
+	}
+
+	if state, _ := s.db.State(); state != database.StateReady {
+		return nil, start, end, errors.DBNotReady()
+	}
+	release := s.db.Acquire()
+	defer release()
+
+	messages, err := s.db.GetMessages(start, end, jc.Talker, "", "", 0, 0)
+	return messages, start, end, err
+}
+
+// export 将聊天记录导出为 Markdown 文件，返回文件路径
+// 工作目录设置了加密口令时，拒绝把明文的聊天记录写入工作目录
+func (s *Service) export(ctx context.Context, jc conf.JobConfig) (string, error) {
+	dir := jc.Output
+	if dir == "" {
+		dir = filepath.Join(s.conf.GetWorkDir(), ExportDir)
+	}
+	if len(s.conf.GetWorkKey()) != 0 && within(s.conf.GetWorkDir(), dir) {
+		return "", errors.ExportInWorkDir(dir)
+	}
+
+	messages, start, end, err := s.messages(jc)
+	if err != nil {
+		return "", err
+	}
+
+	if err := util.PrepareDir(dir); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s_%s.md", unsafeName.ReplaceAllString(jc.Talker, "_"), rangeName(start, end))
+	path := filepath.Join(dir, name)
+
+	// 先写入临时文件，避免读取到写了一半的文件
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, markdown(messages, jc.Talker, start, end), 0644); err != nil {
+		return "", errors.WriteOutputFailed(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", errors.WriteOutputFailed(err)
+	}
+	return path, nil
+}
+
+// summarize 调用摘要服务生成聊天摘要，配置了 PostURL 时将结果 POST 到该地址
+func (s *Service) summarize(ctx context.Context, jc conf.JobConfig) (string, error) {
+	messages, start, end, err := s.messages(jc)
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "no messages", nil
+	}
+
+	text := summarize.Text(messages, jc.Talker, start, end, s.conf.GetHTTPAddr())
+	result, err := summarize.Request(ctx, jc.URL, jc.Prompt, text)
+	if err != nil {
+		return "", err
+	}
+	if result.StatusCode < 200 || result.StatusCode >= 300 {
+		return "", errors.Newf(nil, http.StatusBadGateway, "summarize service returned %d", result.StatusCode)
+	}
+
+	if jc.PostURL != "" {
+		var summary any = string(result.Body)
+		if json.Valid(result.Body) {
+			summary = json.RawMessage(result.Body)
+		}
+		if err := post(ctx, jc.PostURL, map[string]any{
+			"job":      jc.Name,
+			"talker":   jc.Talker,
+			"start":    start,
+			"end":      end,
+			"messages": len(messages),
+			"summary":  summary,
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	out := []rune(string(result.Body))
+	if len(out) > maxResult {
+		out = append(out[:maxResult], []rune("...")...)
+	}
+	return string(out), nil
+}
+
+// post 以 JSON 发送任务结果
+func post(ctx context.Context, url string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: summarize.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Newf(nil, http.StatusBadGateway, "post %s returned %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// within path 是否为 root 或其下的路径
+func within(root, path string) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// rangeName 文件名中的时间范围，同一天时只有日期
+func rangeName(start, end time.Time) string {
+	if start.Format("20060102") == end.Format("20060102") {
+		return start.Format("20060102")
+	}
+	return start.Format("20060102") + "-" + end.Format("20060102")
+}
+
+// markdown 将消息转换为 Markdown，每条消息为发送人、时间和内容
+func markdown(messages []*model.Message, talker string, start, end time.Time) []byte {
+	var b bytes.Buffer
+
+	multi := strings.Contains(talker, ",")
+	title := talker
+	if !multi && len(messages) > 0 && messages[0].TalkerName != "" {
+		title = messages[0].TalkerName
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "%s ~ %s，共 %d 条消息\n\n", start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"), len(messages))
+
+	timeFormat := util.PerfectTimeFormat(start, end)
+	for _, m := range messages {
+		sender := m.Sender
+		if m.IsSelf {
+			sender = "我"
+		}
+		if m.SenderName != "" {
+			sender = m.SenderName
+		}
+		b.WriteString("**")
+		b.WriteString(sender)
+		b.WriteString("** ")
+		if multi {
+			name := m.TalkerName
+			if name == "" {
+				name = m.Talker
+			}
+			b.WriteString("[")
+			b.WriteString(name)
+			b.WriteString("] ")
+		}
+		b.WriteString(m.Time.Format(timeFormat))
+		b.WriteString("\n\n")
+
+		// 行尾两个空格保留消息内的换行
+		content := strings.TrimRight(m.PlainTextContent(), "\n")
+		b.WriteString(strings.ReplaceAll(content, "\n", "  \n"))
+		b.WriteString("\n\n")
+	}
+	return b.Bytes()
+}
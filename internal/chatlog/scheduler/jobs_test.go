@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/summarize"
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+type testConfig struct {
+	workDir string
+	workKey string
+}
+
+func (c *testConfig) GetHTTPAddr() string                     { return "127.0.0.1:5030" }
+func (c *testConfig) GetWorkDir() string                      { return c.workDir }
+func (c *testConfig) GetWorkKey() string                      { return c.workKey }
+func (c *testConfig) GetPlatform() string                     { return "windows" }
+func (c *testConfig) GetVersion() int                         { return 4 }
+func (c *testConfig) GetDBConfig() *conf.DBConfig             { return nil }
+func (c *testConfig) GetArchiveConfig() *conf.ArchiveConfig   { return nil }
+func (c *testConfig) GetScheduleConfig() *conf.ScheduleConfig { return nil }
+
+func TestWithin(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "work")
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{root, true},
+		{filepath.Join(root, "export"), true},
+		{filepath.Join(root, "a", "..", "export"), true},
+		{filepath.Join(root, "..", "work-export"), false},
+		{filepath.Join(root, ".."), false},
+		{filepath.Join(root, "..export"), true},
+	} {
+		if got := within(root, tc.path); got != tc.want {
+			t.Errorf("within(%s) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestExportEncryptedWorkDir(t *testing.T) {
+	c := &testConfig{workDir: t.TempDir(), workKey: "secret"}
+	s := NewService(c, database.NewService(c), nil)
+
+	// 默认目录和工作目录下的目录都拒绝，且不创建目录
+	for _, output := range []string{"", filepath.Join(c.workDir, "out")} {
+		_, err := s.export(context.Background(), conf.JobConfig{Name: "x", Type: conf.JobTypeExport, Talker: "wxid_a", Output: output})
+		if errors.GetCode(err) != http.StatusBadRequest {
+			t.Errorf("export to %q = %v", output, err)
+		}
+	}
+	if entries, _ := os.ReadDir(c.workDir); len(entries) != 0 {
+		t.Errorf("work dir has %d entries", len(entries))
+	}
+
+	// 工作目录之外的目录继续执行，数据库未就绪时返回未就绪
+	_, err := s.export(context.Background(), conf.JobConfig{Name: "x", Type: conf.JobTypeExport, Talker: "wxid_a", Output: t.TempDir()})
+	if errors.GetCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("export outside the work dir = %v", err)
+	}
+
+	// 未加密的工作目录允许默认目录
+	c.workKey = ""
+	_, err = s.export(context.Background(), conf.JobConfig{Name: "x", Type: conf.JobTypeExport, Talker: "wxid_a"})
+	if errors.GetCode(err) != http.StatusServiceUnavailable {
+		t.Errorf("export to plain work dir = %v", err)
+	}
+}
+
+// 摘要任务必须配置 url，不会把聊天内容发送到默认地址
+func TestValidateSummarizeURL(t *testing.T) {
+	jc := conf.JobConfig{Name: "s", Type: conf.JobTypeSummarize, Schedule: "@daily", Talker: "123@chatroom"}
+	if err := validate(jc, map[string]bool{}); errors.GetCode(err) != http.StatusBadRequest {
+		t.Fatalf("summarize without url = %v", err)
+	}
+	jc.URL = "https://example.com/summarize"
+	if err := validate(jc, map[string]bool{}); err != nil {
+		t.Fatalf("summarize with url = %v", err)
+	}
+	if _, err := summarize.Request(context.Background(), "", "", "text"); errors.GetCode(err) != http.StatusNotImplemented {
+		t.Fatalf("Request without url = %v", err)
+	}
+}
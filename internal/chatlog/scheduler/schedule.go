@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// Schedule 计算任务的下一次运行时间
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// macros 常用的运行时间
+var macros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Parse 解析运行时间，支持五段 cron 表达式（分 时 日 月 周）、@every <间隔> 和 @daily 等
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || interval < time.Second {
+			return nil, errors.ScheduleInvalid(spec)
+		}
+		return every(interval), nil
+	}
+	if m, ok := macros[spec]; ok {
+		spec = m
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	c := &cron{}
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, errors.ScheduleInvalid(spec)
+	}
+	// 周日可以写作 0 或 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+// every 固定间隔运行
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cron 每个字段为允许值的位图
+type cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// 日和周都有限制时，满足其一即可，与 cron 的约定一致
+	domAny, dowAny bool
+}
+
+// maxSearch 查找下一次运行时间的范围，超过时认为不会再运行，例如 2 月 30 日
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseField 解析一个字段，支持 *、数字、范围 a-b、列表 a,b 和步长 */n、a-b/n
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, errors.ScheduleInvalid(field)
+			}
+			rng, step = r, n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, errors.ScheduleInvalid(field)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, errors.ScheduleInvalid(field)
+				}
+			} else if step > 1 {
+				// a/n 表示从 a 开始到最大值
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.ScheduleInvalid(field)
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// 2024-03-15 是星期五
+	now := time.Date(2024, 3, 15, 10, 20, 30, 0, time.Local)
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@every 30m", now.Add(30 * time.Minute)},
+		{"*/30 * * * *", time.Date(2024, 3, 15, 10, 30, 0, 0, time.Local)},
+		{"0 1 * * *", time.Date(2024, 3, 16, 1, 0, 0, 0, time.Local)},
+		{"@daily", time.Date(2024, 3, 16, 0, 0, 0, 0, time.Local)},
+		{"15 9-17/4 * * *", time.Date(2024, 3, 15, 13, 15, 0, 0, time.Local)},
+		{"0 8 * * 1", time.Date(2024, 3, 18, 8, 0, 0, 0, time.Local)},
+		{"0 8 * * 7", time.Date(2024, 3, 17, 8, 0, 0, 0, time.Local)},
+		{"0 0 1 */2 *", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		// 日和周都有限制时满足其一即可
+		{"0 0 20 * 6", time.Date(2024, 3, 16, 0, 0, 0, 0, time.Local)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if got := s.Next(now); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next() = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	never, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := never.Next(now); !got.IsZero() {
+		t.Errorf("Feb 30 should never run, got %v", got)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "@every 0s", "@every soon", "a b c d e"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) should fail", spec)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/wechat"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/metrics"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+const (
+	// DefaultHistory 每个任务默认保留的运行记录数
+	DefaultHistory = 20
+
+	// DefaultTimeout 单次运行的默认超时时间
+	DefaultTimeout = time.Hour
+
+	// DefaultTime 导出和摘要默认的时间范围
+	DefaultTime = "yesterday"
+)
+
+// 运行的触发方式和结果
+const (
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+
+	StatusRunning = "running"
+	StatusOK      = "ok"
+	StatusError   = "error"
+	StatusSkipped = "skipped"
+)
+
+type Config interface {
+	GetHTTPAddr() string
+	GetWorkDir() string
+	GetWorkKey() string
+	GetScheduleConfig() *conf.ScheduleConfig
+}
+
+// Run 一次运行的记录
+type Run struct {
+	Trigger string     `json:"trigger"`
+	Status  string     `json:"status"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	Error   string     `json:"error,omitempty"`
+
+	// Result 运行结果，导出为文件路径，摘要为摘要内容
+	Result string `json:"result,omitempty"`
+}
+
+// JobStatus 任务的配置和运行状态
+type JobStatus struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Schedule string    `json:"schedule"`
+	Talker   string    `json:"talker,omitempty"`
+	Next     time.Time `json:"next"`
+	Running  bool      `json:"running"`
+	LastRun  *Run      `json:"lastRun,omitempty"`
+
+	// History 最近的运行记录，按时间倒序，只在查询单个任务时返回
+	History []Run `json:"history,omitempty"`
+}
+
+// Service 定时任务服务，按配置的时间解密数据库、导出聊天记录和生成摘要
+type Service struct {
+	conf Config
+	db   *database.Service
+	wx   *wechat.Service
+
+	jobs   []*job
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type job struct {
+	conf     conf.JobConfig
+	schedule Schedule
+	history  int
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+	runs    []Run
+}
+
+func NewService(conf Config, db *database.Service, wx *wechat.Service) *Service {
+	return &Service{
+		conf: conf,
+		db:   db,
+		wx:   wx,
+	}
+}
+
+// Start 校验任务配置并开始调度，配置有误时不启动任何任务
+func (s *Service) Start() error {
+	c := s.conf.GetScheduleConfig()
+	if c == nil || len(c.Jobs) == 0 {
+		return nil
+	}
+	history := c.History
+	if history <= 0 {
+		history = DefaultHistory
+	}
+
+	jobs := make([]*job, 0, len(c.Jobs))
+	names := make(map[string]bool)
+	for _, jc := range c.Jobs {
+		if err := validate(jc, names); err != nil {
+			return err
+		}
+		schedule, err := Parse(jc.Schedule)
+		if err != nil {
+			return errors.JobInvalid(jc.Name, err.Error())
+		}
+		jobs = append(jobs, &job{conf: jc, schedule: schedule, history: history})
+	}
+
+	s.jobs = jobs
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+	log.Info().Msgf("scheduler started with %d jobs", len(s.jobs))
+	return nil
+}
+
+// Stop 停止调度，取消进行中的运行并等待结束
+func (s *Service) Stop() error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	s.wg.Wait()
+	s.cancel = nil
+	return nil
+}
+
+// Jobs 返回全部任务的状态
+func (s *Service) Jobs() []*JobStatus {
+	items := make([]*JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		items = append(items, j.status(false))
+	}
+	return items
+}
+
+// Job 返回任务的状态和运行记录
+func (s *Service) Job(name string) (*JobStatus, error) {
+	j := s.find(name)
+	if j == nil {
+		return nil, errors.JobNotFound(name)
+	}
+	return j.status(true), nil
+}
+
+// Run 立即在后台运行任务，任务正在运行时返回错误
+func (s *Service) Run(name string) error {
+	j := s.find(name)
+	if j == nil || s.cancel == nil {
+		return errors.JobNotFound(name)
+	}
+	if !j.begin() {
+		return errors.JobRunning(name)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(j, TriggerManual)
+	}()
+	return nil
+}
+
+func (s *Service) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.conf.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// loop 按运行时间调度任务，上一次运行未结束时跳过本次
+func (s *Service) loop(j *job) {
+	defer s.wg.Done()
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warn().Msgf("job %s will never run again", j.conf.Name)
+			return
+		}
+		j.setNext(next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !j.begin() {
+			now := time.Now()
+			j.record(Run{Trigger: TriggerSchedule, Status: StatusSkipped, Start: now, End: &now, Error: "previous run is still running"})
+			metrics.IncJobRun(j.conf.Name, StatusSkipped)
+			continue
+		}
+		s.run(j, TriggerSchedule)
+	}
+}
+
+// run 执行一次任务并记录结果，调用前需要通过 begin 标记为运行中
+func (s *Service) run(j *job, trigger string) {
+	defer j.end()
+
+	timeout := DefaultTimeout
+	if j.conf.Timeout > 0 {
+		timeout = time.Duration(j.conf.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	r := Run{Trigger: trigger, Status: StatusRunning, Start: time.Now()}
+	j.record(r)
+
+	result, err := s.exec(ctx, j.conf)
+
+	end := time.Now()
+	r.End = &end
+	r.Result = result
+	r.Status = StatusOK
+	if err != nil {
+		r.Status = StatusError
+		r.Error = err.Error()
+		log.Err(err).Msgf("job %s failed", j.conf.Name)
+	} else {
+		log.Info().Msgf("job %s finished in %s", j.conf.Name, end.Sub(r.Start).Round(time.Millisecond))
+	}
+	j.finish(r)
+	metrics.IncJobRun(j.conf.Name, r.Status)
+}
+
+func (s *Service) exec(ctx context.Context, jc conf.JobConfig) (string, error) {
+	switch jc.Type {
+	case conf.JobTypeDecrypt:
+		return "", s.decrypt(ctx)
+	case conf.JobTypeExport:
+		return s.export(ctx, jc)
+	case conf.JobTypeSummarize:
+		return s.summarize(ctx, jc)
+	}
+	return "", errors.JobInvalid(jc.Name, "unknown type "+jc.Type)
+}
+
+// validate 校验任务配置，names 记录已出现的任务名称
+func validate(jc conf.JobConfig, names map[string]bool) error {
+	if jc.Name == "" {
+		return errors.JobInvalid(jc.Type, "name is required")
+	}
+	if names[jc.Name] {
+		return errors.JobInvalid(jc.Name, "duplicate name")
+	}
+	names[jc.Name] = true
+
+	switch jc.Type {
+	case conf.JobTypeDecrypt:
+		return nil
+	case conf.JobTypeExport, conf.JobTypeSummarize:
+	default:
+		return errors.JobInvalid(jc.Name, "unknown type "+jc.Type)
+	}
+	if jc.Talker == "" {
+		return errors.JobInvalid(jc.Name, "talker is required")
+	}
+	if jc.Time != "" {
+		if _, _, ok := util.TimeRangeOf(jc.Time); !ok {
+			return errors.JobInvalid(jc.Name, "invalid time "+jc.Time)
+		}
+	}
+	// 摘要任务会把聊天内容发送到 url，不使用默认地址
+	if jc.Type == conf.JobTypeSummarize && jc.URL == "" {
+		return errors.JobInvalid(jc.Name, "url is required")
+	}
+	return nil
+}
+
+// begin 标记任务开始运行，已在运行时返回 false
+func (j *job) begin() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return false
+	}
+	j.running = true
+	return true
+}
+
+func (j *job) end() {
+	j.mu.Lock()
+	j.running = false
+	j.mu.Unlock()
+}
+
+func (j *job) setNext(next time.Time) {
+	j.mu.Lock()
+	j.next = next
+	j.mu.Unlock()
+}
+
+// record 追加一条运行记录，超出保留数时丢弃最早的
+func (j *job) record(r Run) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.runs = append(j.runs, r)
+	if len(j.runs) > j.history {
+		j.runs = j.runs[len(j.runs)-j.history:]
+	}
+}
+
+// finish 用运行结果替换进行中的记录，同一任务同时只有一次运行
+func (j *job) finish(r Run) {
+	j.mu.Lock()
+	for i := len(j.runs) - 1; i >= 0; i-- {
+		if j.runs[i].Status == StatusRunning {
+			j.runs[i] = r
+			j.mu.Unlock()
+			return
+		}
+	}
+	j.mu.Unlock()
+
+	// 运行期间跳过的记录过多，进行中的记录已被丢弃
+	j.record(r)
+}
+
+func (j *job) status(history bool) *JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	st := &JobStatus{
+		Name:     j.conf.Name,
+		Type:     j.conf.Type,
+		Schedule: j.conf.Schedule,
+		Talker:   j.conf.Talker,
+		Next:     j.next,
+		Running:  j.running,
+	}
+	if n := len(j.runs); n > 0 {
+		last := j.runs[n-1]
+		st.LastRun = &last
+	}
+	if history {
+		st.History = make([]Run, 0, len(j.runs))
+		for i := len(j.runs) - 1; i >= 0; i-- {
+			st.History = append(st.History, j.runs[i])
+		}
+	}
+	return st
+}
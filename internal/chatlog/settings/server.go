@@ -0,0 +1,64 @@
+package settings
+
+import (
+	"sync"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/pkg/config"
+)
+
+// ServerStore 服务模式的配置，修改写回服务配置文件
+// SetValues 通过 ServerConfig.Update 修改配置，各服务读取配置时不会与修改竞争；
+// mu 保证 GetValues 读到一次完整的修改
+type ServerStore struct {
+	mu   sync.Mutex
+	conf *conf.ServerConfig
+	cm   *config.Manager
+}
+
+// NewServerStore cm 为 conf.ServerConfigWriter 返回的配置管理器
+func NewServerStore(sc *conf.ServerConfig, cm *config.Manager) *ServerStore {
+	return &ServerStore{conf: sc, cm: cm}
+}
+
+func (s *ServerStore) GetValues() Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Values{
+		HTTPAddr:    s.conf.GetHTTPAddr(),
+		DataDir:     s.conf.DataDir,
+		DataKey:     s.conf.DataKey,
+		ImgKey:      s.conf.ImgKey,
+		WorkDir:     s.conf.WorkDir,
+		Platform:    s.conf.Platform,
+		Version:     s.conf.Version,
+		AutoDecrypt: s.conf.AutoDecrypt,
+	}
+}
+
+func (s *ServerStore) SetValues(v Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conf.Update(func(c *conf.ServerConfig) {
+		c.HTTPAddr = v.HTTPAddr
+		c.DataDir = v.DataDir
+		c.DataKey = v.DataKey
+		c.ImgKey = v.ImgKey
+		c.WorkDir = v.WorkDir
+		c.Platform = v.Platform
+		c.Version = v.Version
+		c.AutoDecrypt = v.AutoDecrypt
+	})
+}
+
+func (s *ServerStore) SaveValues(v Values, keys []string) error {
+	if s.cm == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := s.cm.SetConfig(key, v.get(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
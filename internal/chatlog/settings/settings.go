@@ -0,0 +1,252 @@
+package settings
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource"
+)
+
+// 配置项的名称，与配置文件中的键一致
+const (
+	KeyHTTPAddr    = "http_addr"
+	KeyDataDir     = "data_dir"
+	KeyDataKey     = "data_key"
+	KeyImgKey      = "img_key"
+	KeyWorkDir     = "work_dir"
+	KeyPlatform    = "platform"
+	KeyVersion     = "version"
+	KeyAutoDecrypt = "auto_decrypt"
+)
+
+// Values 可以在运行时修改的配置
+type Values struct {
+	HTTPAddr    string `json:"http_addr"`
+	DataDir     string `json:"data_dir"`
+	DataKey     string `json:"data_key"`
+	ImgKey      string `json:"img_key"`
+	WorkDir     string `json:"work_dir"`
+	Platform    string `json:"platform"`
+	Version     int    `json:"version"`
+	AutoDecrypt bool   `json:"auto_decrypt"`
+}
+
+// get 返回配置项的值，用于写入配置文件
+func (v Values) get(key string) any {
+	switch key {
+	case KeyHTTPAddr:
+		return v.HTTPAddr
+	case KeyDataDir:
+		return v.DataDir
+	case KeyDataKey:
+		return v.DataKey
+	case KeyImgKey:
+		return v.ImgKey
+	case KeyWorkDir:
+		return v.WorkDir
+	case KeyPlatform:
+		return v.Platform
+	case KeyVersion:
+		return v.Version
+	case KeyAutoDecrypt:
+		return v.AutoDecrypt
+	}
+	return nil
+}
+
+// Change 一次配置修改，字符串为空、版本为 0、AutoDecrypt 为 nil 表示不修改
+type Change struct {
+	HTTPAddr    string `json:"addr"`
+	DataDir     string `json:"dataDir"`
+	DataKey     string `json:"dataKey"`
+	ImgKey      string `json:"imgKey"`
+	WorkDir     string `json:"workDir"`
+	Platform    string `json:"platform"`
+	Version     int    `json:"version"`
+	AutoDecrypt *bool  `json:"autoDecrypt"`
+}
+
+// merge 返回修改后的配置和发生变化的配置项
+func (c *Change) merge(old Values) (Values, []string) {
+	v := old
+	var keys []string
+	str := func(key string, dst *string, val string) {
+		if val != "" && val != *dst {
+			*dst = val
+			keys = append(keys, key)
+		}
+	}
+	str(KeyHTTPAddr, &v.HTTPAddr, c.HTTPAddr)
+	str(KeyDataDir, &v.DataDir, c.DataDir)
+	str(KeyDataKey, &v.DataKey, c.DataKey)
+	str(KeyImgKey, &v.ImgKey, c.ImgKey)
+	str(KeyWorkDir, &v.WorkDir, c.WorkDir)
+	str(KeyPlatform, &v.Platform, c.Platform)
+	if c.Version != 0 && c.Version != v.Version {
+		v.Version = c.Version
+		keys = append(keys, KeyVersion)
+	}
+	if c.AutoDecrypt != nil && *c.AutoDecrypt != v.AutoDecrypt {
+		v.AutoDecrypt = *c.AutoDecrypt
+		keys = append(keys, KeyAutoDecrypt)
+	}
+	return v, keys
+}
+
+// Event 配置变化事件，各服务根据变化的配置项做出相应的调整
+type Event struct {
+	Old  Values
+	New  Values
+	Keys []string
+}
+
+// Has 返回 keys 中是否有配置项发生了变化
+func (e *Event) Has(keys ...string) bool {
+	for _, k := range keys {
+		for _, changed := range e.Keys {
+			if k == changed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reverse 返回撤销该变化的事件
+func (e *Event) reverse() *Event {
+	return &Event{Old: e.New, New: e.Old, Keys: e.Keys}
+}
+
+// Handler 处理配置变化，返回错误时本次修改被撤销
+type Handler func(e *Event) error
+
+// Store 配置的读取和保存，服务模式和 TUI 模式各有实现
+type Store interface {
+	GetValues() Values
+
+	// SetValues 修改内存中的配置，立即对读取配置的服务生效
+	SetValues(v Values)
+
+	// SaveValues 将变化的配置项写回配置文件
+	SaveValues(v Values, keys []string) error
+}
+
+// Service 统一处理运行时的配置修改：校验、通知各服务、失败时撤销、成功后写回配置文件
+type Service struct {
+	store Store
+
+	mu       sync.Mutex
+	handlers []subscriber
+}
+
+type subscriber struct {
+	name    string
+	handler Handler
+}
+
+func NewService(store Store) *Service {
+	return &Service{store: store}
+}
+
+// Subscribe 注册配置变化的处理函数，按注册顺序调用，撤销时按相反顺序调用
+func (s *Service) Subscribe(name string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers = append(s.handlers, subscriber{name: name, handler: handler})
+}
+
+// Values 返回当前的配置
+func (s *Service) Values() Values {
+	return s.store.GetValues()
+}
+
+// Apply 校验并应用配置修改，返回发生的变化，没有变化时返回 nil
+// 任一处理函数失败时恢复原配置，已处理的服务按相反顺序收到撤销事件
+func (s *Service) Apply(change Change) (*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.store.GetValues()
+	v, keys := change.merge(old)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := validate(v, keys); err != nil {
+		return nil, err
+	}
+
+	e := &Event{Old: old, New: v, Keys: keys}
+	s.store.SetValues(v)
+	for i, sub := range s.handlers {
+		if err := sub.handler(e); err != nil {
+			log.Err(err).Msgf("config change rejected by %s, rolling back", sub.name)
+			s.rollback(e, i)
+			return nil, errors.ConfigRolledBack(err)
+		}
+	}
+
+	if err := s.store.SaveValues(v, keys); err != nil {
+		return e, errors.ConfigSaveFailed(err)
+	}
+	return e, nil
+}
+
+// rollback 恢复原配置，并通知前 n+1 个处理函数撤销变化
+func (s *Service) rollback(e *Event, n int) {
+	s.store.SetValues(e.Old)
+	r := e.reverse()
+	for i := n; i >= 0; i-- {
+		if err := s.handlers[i].handler(r); err != nil {
+			log.Err(err).Msgf("failed to roll back config change in %s", s.handlers[i].name)
+		}
+	}
+}
+
+// validate 校验修改后的配置，只检查发生变化的配置项及其关联项
+func validate(v Values, keys []string) error {
+	e := &Event{Keys: keys}
+	if e.Has(KeyHTTPAddr) {
+		if _, port, err := net.SplitHostPort(v.HTTPAddr); err != nil || port == "" {
+			return errors.InvalidArg(KeyHTTPAddr)
+		}
+	}
+	// 数据库密钥为 32 字节，图片密钥至少 16 字节，都以十六进制表示
+	if e.Has(KeyDataKey) && hexLen(v.DataKey) != 32 {
+		return errors.InvalidArg(KeyDataKey)
+	}
+	if e.Has(KeyImgKey) && hexLen(v.ImgKey) < 16 {
+		return errors.InvalidArg(KeyImgKey)
+	}
+	if e.Has(KeyDataDir) && !isDir(v.DataDir) {
+		return errors.InvalidArg(KeyDataDir)
+	}
+	if e.Has(KeyWorkDir) && !isDir(v.WorkDir) {
+		return errors.InvalidArg(KeyWorkDir)
+	}
+	if e.Has(KeyPlatform, KeyVersion) && !datasource.Supported(v.Platform, v.Version) {
+		return errors.PlatformUnsupported(v.Platform, v.Version)
+	}
+	if e.Has(KeyAutoDecrypt) && v.AutoDecrypt && (v.DataDir == "" || v.DataKey == "" || v.WorkDir == "") {
+		return errors.InvalidArg(KeyAutoDecrypt)
+	}
+	return nil
+}
+
+// hexLen 返回十六进制字符串解码后的字节数，不是十六进制时返回 -1
+func hexLen(key string) int {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return -1
+	}
+	return len(b)
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
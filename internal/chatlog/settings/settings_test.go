@@ -0,0 +1,106 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+func TestApplyRollback(t *testing.T) {
+	dir := t.TempDir()
+	sc := &conf.ServerConfig{WorkDir: dir, Platform: "windows", Version: 4}
+	cm, err := conf.ServerConfigWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(NewServerStore(sc, cm))
+
+	var calls []string
+	s.Subscribe("a", func(e *Event) error {
+		calls = append(calls, "a:"+e.New.HTTPAddr)
+		return nil
+	})
+	s.Subscribe("b", func(e *Event) error {
+		calls = append(calls, "b:"+e.New.HTTPAddr)
+		if e.New.HTTPAddr == "127.0.0.1:2" {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	})
+
+	if _, err := s.Apply(Change{DataKey: "abc"}); err == nil {
+		t.Error("invalid data key accepted")
+	}
+	if _, err := s.Apply(Change{Platform: "linux"}); err == nil {
+		t.Error("unsupported platform accepted")
+	}
+	if _, err := s.Apply(Change{WorkDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Error("missing work dir accepted")
+	}
+
+	if _, err := s.Apply(Change{HTTPAddr: "127.0.0.1:1"}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, conf.ServerConfigName+".json"))
+	if err != nil || !strings.Contains(string(b), "127.0.0.1:1") {
+		t.Fatalf("config not saved: %s, %v", b, err)
+	}
+
+	calls = nil
+	if _, err := s.Apply(Change{HTTPAddr: "127.0.0.1:2"}); err == nil {
+		t.Fatal("rejected change applied")
+	}
+	if sc.HTTPAddr != "127.0.0.1:1" {
+		t.Errorf("addr = %s after rollback", sc.HTTPAddr)
+	}
+	want := "a:127.0.0.1:2 b:127.0.0.1:2 b:127.0.0.1:1 a:127.0.0.1:1"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestApplyConcurrentRead(t *testing.T) {
+	dir := t.TempDir()
+	sc := &conf.ServerConfig{WorkDir: dir, DataDir: dir, Platform: "windows", Version: 4}
+	s := NewService(NewServerStore(sc, nil))
+
+	done := make(chan struct{})
+	var wg, ready sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_ = sc.GetHTTPAddr() + sc.GetDataDir() + sc.GetWorkDir() + sc.GetDataKey() + sc.GetImgKey() + sc.GetPlatform()
+				_, _ = sc.GetVersion(), sc.GetAutoDecrypt()
+				_ = s.Values()
+			}
+		}()
+	}
+	ready.Wait()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%064x", i+1)
+		if _, err := s.Apply(Change{HTTPAddr: fmt.Sprintf("127.0.0.1:%d", 1000+i), DataKey: key, ImgKey: key[:32]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if got := sc.GetHTTPAddr(); got != "127.0.0.1:1099" {
+		t.Errorf("addr = %s", got)
+	}
+}
@@ -0,0 +1,81 @@
+package summarize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// Timeout 调用摘要服务的超时时间
+const Timeout = 60 * time.Second
+
+// Result 摘要服务的响应
+type Result struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Text 将一段时间内的消息转换为摘要服务的输入，格式与查询接口的纯文本相同
+func Text(messages []*model.Message, talker string, start, end time.Time, host string) string {
+	var b strings.Builder
+	isGroup := strings.Contains(talker, ",")
+	for _, m := range messages {
+		b.WriteString(m.PlainText(isGroup, util.PerfectTimeFormat(start, end), host))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Request 调用摘要服务，服务接收 {"prompt": "...", "message": "..."}
+// 聊天内容会发送到 url，没有默认地址，url 为空时返回错误；
+// 服务返回非 2xx 状态码时不视为错误，由调用方根据 StatusCode 处理
+func Request(ctx context.Context, url, prompt, text string) (*Result, error) {
+	if url == "" {
+		return nil, errors.SummarizeNotConfigured()
+	}
+	body, err := json.Marshal(map[string]any{
+		"prompt":  prompt,
+		"message": text,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 没有 Content-Type 时按内容判断
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		if json.Valid(respBytes) {
+			ct = "application/json; charset=utf-8"
+		} else {
+			ct = "text/plain; charset=utf-8"
+		}
+	}
+	return &Result{StatusCode: resp.StatusCode, ContentType: ct, Body: respBytes}, nil
+}
@@ -0,0 +1,150 @@
+package transcribe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+const (
+	DefaultOpenAIModel = "whisper-1"
+
+	// RequestTimeout 单次识别请求的超时时间
+	RequestTimeout = 2 * time.Minute
+)
+
+// Backend 语音识别服务
+type Backend interface {
+	// Transcribe 识别 WAV 音频，返回文本
+	Transcribe(ctx context.Context, wav []byte) (string, error)
+}
+
+// NewBackend 根据配置创建识别服务
+func NewBackend(c *conf.TranscribeConfig) (Backend, error) {
+	if len(c.URL) == 0 {
+		return nil, fmt.Errorf("transcribe url is required")
+	}
+	client := &http.Client{Timeout: RequestTimeout}
+	base := strings.TrimRight(c.URL, "/")
+
+	switch c.Backend {
+	case conf.TranscribeBackendWhisper:
+		return &whisperBackend{client: client, url: base + "/inference", language: c.Language}, nil
+	case conf.TranscribeBackendOpenAI:
+		model := c.Model
+		if len(model) == 0 {
+			model = DefaultOpenAIModel
+		}
+		return &openAIBackend{
+			client:   client,
+			url:      base + "/audio/transcriptions",
+			apiKey:   c.APIKey,
+			model:    model,
+			language: c.Language,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transcribe backend: %s", c.Backend)
+	}
+}
+
+// whisperBackend whisper.cpp 自带的 HTTP 服务（examples/server）
+type whisperBackend struct {
+	client   *http.Client
+	url      string
+	language string
+}
+
+func (b *whisperBackend) Transcribe(ctx context.Context, wav []byte) (string, error) {
+	fields := map[string]string{
+		"response_format": "json",
+		"temperature":     "0.0",
+	}
+	if len(b.language) != 0 {
+		fields["language"] = b.language
+	}
+	return postAudio(ctx, b.client, b.url, nil, fields, wav)
+}
+
+// openAIBackend 兼容 OpenAI /audio/transcriptions 的接口
+type openAIBackend struct {
+	client   *http.Client
+	url      string
+	apiKey   string
+	model    string
+	language string
+}
+
+func (b *openAIBackend) Transcribe(ctx context.Context, wav []byte) (string, error) {
+	fields := map[string]string{
+		"model":           b.model,
+		"response_format": "json",
+	}
+	if len(b.language) != 0 {
+		fields["language"] = b.language
+	}
+	var header http.Header
+	if len(b.apiKey) != 0 {
+		header = http.Header{"Authorization": []string{"Bearer " + b.apiKey}}
+	}
+	return postAudio(ctx, b.client, b.url, header, fields, wav)
+}
+
+// postAudio 以 multipart/form-data 上传音频，两种服务都返回 {"text": "..."}
+func postAudio(ctx context.Context, client *http.Client, url string, header http.Header, fields map[string]string, wav []byte) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			return "", err
+		}
+	}
+	fw, err := w.CreateFormFile("file", "voice.wav")
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(wav); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("transcribe failed: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var ret struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return "", fmt.Errorf("invalid transcribe response: %w", err)
+	}
+	return strings.TrimSpace(ret.Text), nil
+}
@@ -0,0 +1,101 @@
+package transcribe
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+func TestBackends(t *testing.T) {
+	for _, tc := range []struct {
+		conf   conf.TranscribeConfig
+		path   string
+		fields map[string]string
+		auth   string
+	}{
+		{
+			conf:   conf.TranscribeConfig{Backend: conf.TranscribeBackendWhisper, Language: "zh"},
+			path:   "/inference",
+			fields: map[string]string{"response_format": "json", "language": "zh"},
+		},
+		{
+			conf:   conf.TranscribeConfig{Backend: conf.TranscribeBackendOpenAI, APIKey: "sk-test"},
+			path:   "/v1/audio/transcriptions",
+			fields: map[string]string{"model": DefaultOpenAIModel, "response_format": "json"},
+			auth:   "Bearer sk-test",
+		},
+	} {
+		t.Run(tc.conf.Backend, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tc.path {
+					t.Errorf("path = %s, want %s", r.URL.Path, tc.path)
+				}
+				if got := r.Header.Get("Authorization"); got != tc.auth {
+					t.Errorf("Authorization = %q, want %q", got, tc.auth)
+				}
+				for k, v := range tc.fields {
+					if got := r.FormValue(k); got != v {
+						t.Errorf("field %s = %q, want %q", k, got, v)
+					}
+				}
+				f, _, err := r.FormFile("file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data, _ := io.ReadAll(f); string(data) != "RIFF" {
+					t.Errorf("file = %q", data)
+				}
+				w.Write([]byte(`{"text": " 你好 "}`))
+			}))
+			defer srv.Close()
+
+			c := tc.conf
+			c.URL = srv.URL
+			if c.Backend == conf.TranscribeBackendOpenAI {
+				c.URL += "/v1/"
+			}
+			b, err := NewBackend(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, err := b.Transcribe(context.Background(), []byte("RIFF"))
+			if err != nil || text != "你好" {
+				t.Fatalf("Transcribe = %q, %v", text, err)
+			}
+		})
+	}
+}
+
+func TestBackendErrors(t *testing.T) {
+	if _, err := NewBackend(&conf.TranscribeConfig{Backend: conf.TranscribeBackendWhisper}); err == nil {
+		t.Error("expected error without url")
+	}
+	if _, err := NewBackend(&conf.TranscribeConfig{Backend: "unknown", URL: "http://localhost"}); err == nil {
+		t.Error("expected error for unknown backend")
+	}
+
+	for _, body := range []struct {
+		code int
+		data string
+	}{
+		{http.StatusInternalServerError, `{"error": "model not loaded"}`},
+		{http.StatusOK, `not json`},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(body.code)
+			w.Write([]byte(body.data))
+		}))
+		b, err := NewBackend(&conf.TranscribeConfig{Backend: conf.TranscribeBackendWhisper, URL: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Transcribe(context.Background(), nil); err == nil {
+			t.Errorf("expected error for %d %s", body.code, body.data)
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,289 @@
+package transcribe
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util/silk"
+)
+
+const (
+	// CacheDir 工作目录下保存识别结果的目录，每条语音一个文本文件
+	CacheDir = "transcripts"
+
+	// queueSize 待识别队列长度，队列满时丢弃，下次查询时重新加入
+	queueSize = 1024
+
+	// retryInterval 识别失败后重试的间隔
+	retryInterval = 10 * time.Minute
+
+	// maxFailed 记录的失败语音数上限，超过时先清除已过重试间隔的记录，仍然超过时清空
+	maxFailed = 4096
+)
+
+var safeKey = regexp.MustCompile(`^[0-9A-Za-z_-]{1,64}$`)
+
+type Config interface {
+	GetWorkDir() string
+	GetTranscribeConfig() *conf.TranscribeConfig
+}
+
+// MediaSource 按类型和键读取媒体数据
+type MediaSource interface {
+	GetMedia(_type string, key string) (*model.Media, error)
+}
+
+// Service 语音转文字服务
+// 查询消息时只填充已缓存的识别结果，未识别的语音在后台排队识别
+type Service struct {
+	conf  Config
+	media MediaSource
+
+	backend Backend
+	queue   chan string
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[string]bool
+	failed  map[string]time.Time
+}
+
+func NewService(conf Config, media MediaSource) *Service {
+	return &Service{
+		conf:  conf,
+		media: media,
+	}
+}
+
+func (s *Service) Start() error {
+	c := s.conf.GetTranscribeConfig()
+	if !c.Enabled() {
+		return nil
+	}
+	backend, err := NewBackend(c)
+	if err != nil {
+		return errors.New(err, http.StatusInternalServerError, "init transcribe backend failed")
+	}
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.backend = backend
+	s.queue = make(chan string, queueSize)
+	s.cancel = cancel
+	s.pending = make(map[string]bool)
+	s.failed = make(map[string]time.Time)
+	queue := s.queue
+	s.mu.Unlock()
+
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker(ctx, queue)
+	}
+	log.Info().Msgf("transcribe service started, backend: %s", c.Backend)
+	return nil
+}
+
+func (s *Service) Stop() error {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.backend, s.queue, s.cancel = nil, nil, nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		s.wg.Wait()
+	}
+	return nil
+}
+
+// Enabled 是否配置了识别服务并已启动
+func (s *Service) Enabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backend != nil
+}
+
+// Annotate 为语音消息填充已缓存的识别结果，只读取缓存，可以在关键词过滤前调用
+func (s *Service) Annotate(m *model.Message) {
+	key := voiceKey(m)
+	if len(key) == 0 {
+		return
+	}
+	if text, ok := s.Cached(key); ok && len(text) != 0 {
+		m.SetContent("transcript", text)
+	}
+}
+
+// Fill 为语音消息填充识别结果，没有缓存的语音加入后台识别队列
+func (s *Service) Fill(messages []*model.Message) {
+	for _, m := range messages {
+		key := voiceKey(m)
+		if len(key) == 0 {
+			continue
+		}
+		if text, ok := s.Cached(key); ok {
+			if len(text) != 0 {
+				m.SetContent("transcript", text)
+			}
+			continue
+		}
+		s.enqueue(key)
+	}
+}
+
+func voiceKey(m *model.Message) string {
+	if m.Type != 34 {
+		return ""
+	}
+	key, _ := m.Contents["voice"].(string)
+	return key
+}
+
+// Transcribe 识别一条语音，优先使用缓存
+func (s *Service) Transcribe(ctx context.Context, key string) (string, error) {
+	if text, ok := s.Cached(key); ok {
+		return text, nil
+	}
+
+	s.mu.Lock()
+	backend := s.backend
+	s.mu.Unlock()
+	if backend == nil {
+		return "", errors.New(nil, http.StatusServiceUnavailable, "transcribe backend is not configured")
+	}
+
+	media, err := s.media.GetMedia("voice", key)
+	if err != nil {
+		return "", err
+	}
+	wav, err := silk.Silk2WAV(media.Data)
+	if err != nil {
+		return "", errors.New(err, http.StatusInternalServerError, "decode voice failed")
+	}
+	text, err := backend.Transcribe(ctx, wav)
+	if err != nil {
+		return "", errors.New(err, http.StatusBadGateway, "transcribe voice failed")
+	}
+
+	if err := s.store(key, text); err != nil {
+		log.Debug().Err(err).Msgf("save transcript %s failed", key)
+	}
+	return text, nil
+}
+
+// Cached 读取缓存的识别结果，第二个返回值表示是否已识别
+func (s *Service) Cached(key string) (string, bool) {
+	path := s.cachePath(key)
+	if len(path) == 0 {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (s *Service) store(key, text string) error {
+	path := s.cachePath(key)
+	if len(path) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，避免读到不完整的结果
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(text), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cachePath 返回缓存文件路径，不安全的键使用其 MD5 作为文件名
+func (s *Service) cachePath(key string) string {
+	workDir := s.conf.GetWorkDir()
+	if len(workDir) == 0 {
+		return ""
+	}
+	name := key
+	if !safeKey.MatchString(key) {
+		sum := md5.Sum([]byte(key))
+		name = hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(workDir, CacheDir, name+".txt")
+}
+
+func (s *Service) enqueue(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil || s.pending[key] {
+		return
+	}
+	if t, ok := s.failed[key]; ok && time.Since(t) < retryInterval {
+		return
+	}
+	select {
+	case s.queue <- key:
+		s.pending[key] = true
+	default:
+	}
+}
+
+func (s *Service) worker(ctx context.Context, queue chan string) {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-queue:
+			_, err := s.Transcribe(ctx, key)
+			s.mu.Lock()
+			if s.pending != nil {
+				delete(s.pending, key)
+				if err != nil {
+					s.addFailed(key)
+				} else {
+					delete(s.failed, key)
+				}
+			}
+			s.mu.Unlock()
+			if err != nil && ctx.Err() == nil {
+				log.Debug().Err(err).Msgf("transcribe voice %s failed", key)
+			}
+		}
+	}
+}
+
+// addFailed 记录识别失败的语音，调用时需要持有锁
+func (s *Service) addFailed(key string) {
+	if len(s.failed) >= maxFailed {
+		for k, t := range s.failed {
+			if time.Since(t) >= retryInterval {
+				delete(s.failed, k)
+			}
+		}
+		if len(s.failed) >= maxFailed {
+			s.failed = make(map[string]time.Time)
+		}
+	}
+	s.failed[key] = time.Now()
+}
@@ -0,0 +1,129 @@
+package transcribe
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+type testConfig struct {
+	workDir string
+	conf    conf.TranscribeConfig
+}
+
+func (c *testConfig) GetWorkDir() string                          { return c.workDir }
+func (c *testConfig) GetTranscribeConfig() *conf.TranscribeConfig { return &c.conf }
+
+// testMedia 返回无法解码的语音数据，识别总是失败
+type testMedia struct {
+	requests chan string
+}
+
+func (m *testMedia) GetMedia(_type string, key string) (*model.Media, error) {
+	m.requests <- key
+	return &model.Media{Type: _type, Key: key, Data: []byte("not silk")}, nil
+}
+
+func voice(key string) *model.Message {
+	return &model.Message{Type: 34, Contents: map[string]interface{}{"voice": key}}
+}
+
+func TestAnnotateAndFill(t *testing.T) {
+	s := NewService(&testConfig{workDir: t.TempDir()}, nil)
+	if err := s.store("v1", "你好"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store("../unsafe/key", "路径"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := voice("v1")
+	s.Annotate(m)
+	if m.Contents["transcript"] != "你好" {
+		t.Errorf("Annotate = %v", m.Contents)
+	}
+	text := &model.Message{Type: 1, Content: "v1"}
+	s.Annotate(text)
+	if text.Contents != nil {
+		t.Errorf("Annotate changed a text message: %v", text.Contents)
+	}
+
+	messages := []*model.Message{voice("../unsafe/key"), voice("v2")}
+	// 服务未启动时不排队
+	s.Fill(messages)
+	if messages[0].Contents["transcript"] != "路径" {
+		t.Errorf("Fill = %v", messages[0].Contents)
+	}
+	if _, ok := messages[1].Contents["transcript"]; ok {
+		t.Errorf("uncached voice has transcript")
+	}
+}
+
+func TestFailedRetry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("backend called for undecodable voice")
+	}))
+	defer srv.Close()
+
+	media := &testMedia{requests: make(chan string, 10)}
+	s := NewService(&testConfig{
+		workDir: t.TempDir(),
+		conf:    conf.TranscribeConfig{Backend: conf.TranscribeBackendWhisper, URL: srv.URL},
+	}, media)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	s.Fill([]*model.Message{voice("v1")})
+	select {
+	case <-media.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("voice not queued")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		_, failed := s.failed["v1"]
+		s.mu.Unlock()
+		if failed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failure not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 重试间隔内不再排队
+	s.Fill([]*model.Message{voice("v1")})
+	select {
+	case key := <-media.requests:
+		t.Fatalf("%s queued again before retry interval", key)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFailedBounded(t *testing.T) {
+	s := NewService(&testConfig{}, nil)
+	s.failed = make(map[string]time.Time)
+	for i := 0; i < maxFailed; i++ {
+		s.failed[fmt.Sprint(i)] = time.Now().Add(-2 * retryInterval)
+	}
+	s.addFailed("new")
+	if len(s.failed) != 1 {
+		t.Fatalf("expired failures kept: %d", len(s.failed))
+	}
+
+	for i := 0; i < maxFailed*2; i++ {
+		s.addFailed(fmt.Sprint(i))
+		if len(s.failed) > maxFailed {
+			t.Fatalf("failed map grew to %d", len(s.failed))
+		}
+	}
+}
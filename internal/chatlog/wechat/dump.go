@@ -0,0 +1,71 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/wechat/decrypt"
+	"github.com/sjzar/chatlog/internal/wechat/key"
+)
+
+// dumpNameRegexp 匹配 dumpmemory 命令生成的文件名 wechat_<版本>_<PID>_<时间>.bin
+var dumpNameRegexp = regexp.MustCompile(`wechat_(\d+)\.[\d.]*_\d+_`)
+
+// SearchKeyFromDump 从内存转储文件中离线搜索数据密钥和图片密钥
+// version 为 0 时从转储文件名中识别；dataDir 为空时使用转储 zip 文件中附带的数据库验证数据密钥，此时无法验证图片密钥
+func SearchKeyFromDump(ctx context.Context, dumpPath string, dataDir string, platform string, version int) (string, string, error) {
+	dump, err := key.OpenDump(dumpPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer dump.Close()
+
+	if version == 0 {
+		if m := dumpNameRegexp.FindStringSubmatch(dump.Name); m != nil {
+			version, _ = strconv.Atoi(m[1])
+		}
+		if version == 0 {
+			return "", "", fmt.Errorf("unable to detect wechat version from %s, please specify it", dump.Name)
+		}
+	}
+
+	var validator *decrypt.Validator
+	if len(dataDir) != 0 {
+		validator, err = decrypt.NewValidator(platform, version, dataDir)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		tmpDir, err := os.MkdirTemp("", "chatlog_dump_")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.RemoveAll(tmpDir)
+
+		dbPath, err := dump.ExtractDB(tmpDir)
+		if err != nil {
+			return "", "", err
+		}
+		if len(dbPath) == 0 {
+			return "", "", fmt.Errorf("no database found in %s, please specify the data dir", dumpPath)
+		}
+		validator, err = decrypt.NewValidatorWithDBPath(platform, version, dbPath, "")
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	extractor, err := key.NewExtractor(platform, version)
+	if err != nil {
+		return "", "", err
+	}
+	extractor.SetValidate(validator)
+
+	log.Debug().Msgf("searching key in %s, platform: %s, version: %d", dump.Name, platform, version)
+	return key.SearchDump(ctx, extractor, dump)
+}
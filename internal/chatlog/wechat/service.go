@@ -5,15 +5,22 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 
+	"github.com/sjzar/chatlog/internal/chatlog/settings"
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/metrics"
 	"github.com/sjzar/chatlog/internal/wechat"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 	"github.com/sjzar/chatlog/pkg/filemonitor"
 	"github.com/sjzar/chatlog/pkg/util"
 )
@@ -29,12 +36,43 @@ type Service struct {
 	pendingActions map[string]bool
 	mutex          sync.Mutex
 	fm             *filemonitor.FileMonitor
+	incremental    *decrypt.IncrementalDecryptor
+	jobs           int
+
+	// decrypting 等待中和进行中的解密数，不为 0 时持有工作目录的解密标记
+	decrypting int
+	release    func()
+
+	// 最近一次解密数据库文件的时间和错误
+	lastDecrypt    time.Time
+	lastDecryptErr error
+}
+
+// DecryptProgress 批量解密进度
+type DecryptProgress struct {
+	FilesDone  int    `json:"filesDone"`
+	FilesTotal int    `json:"filesTotal"`
+	PagesDone  int64  `json:"pagesDone"`
+	PagesTotal int64  `json:"pagesTotal"`
+	File       string `json:"file,omitempty"`
+}
+
+// Percent 返回解密进度百分比
+func (p DecryptProgress) Percent() float64 {
+	if p.PagesTotal <= 0 {
+		if p.FilesTotal <= 0 {
+			return 0
+		}
+		return float64(p.FilesDone) * 100 / float64(p.FilesTotal)
+	}
+	return min(float64(p.PagesDone)*100/float64(p.PagesTotal), 100)
 }
 
 type Config interface {
 	GetDataKey() string
 	GetDataDir() string
 	GetWorkDir() string
+	GetWorkKey() string
 	GetPlatform() string
 	GetVersion() int
 }
@@ -44,9 +82,20 @@ func NewService(conf Config) *Service {
 		conf:           conf,
 		lastEvents:     make(map[string]time.Time),
 		pendingActions: make(map[string]bool),
+		jobs:           runtime.NumCPU(),
 	}
 }
 
+// SetJobs 设置并发解密的协程数，小于等于 0 时使用 CPU 核数
+func (s *Service) SetJobs(jobs int) {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	s.mutex.Lock()
+	s.jobs = jobs
+	s.mutex.Unlock()
+}
+
 // GetWeChatInstances returns all running WeChat instances
 func (s *Service) GetWeChatInstances() []*wechat.Account {
 	wechat.Load()
@@ -68,7 +117,8 @@ func (s *Service) GetDataKey(info *wechat.Account) (string, error) {
 }
 
 func (s *Service) StartAutoDecrypt() error {
-	dbGroup, err := filemonitor.NewFileGroup("wechat", s.conf.GetDataDir(), `.*\.db$`, []string{"fts"})
+	// 同时监听 WAL 文件，新消息在 checkpoint 之前只会写入 WAL
+	dbGroup, err := filemonitor.NewFileGroup("wechat", s.conf.GetDataDir(), `.*\.db(-wal)?$`, []string{"fts"})
 	if err != nil {
 		return err
 	}
@@ -93,18 +143,41 @@ func (s *Service) StopAutoDecrypt() error {
 	return nil
 }
 
+// OnConfig 自动解密开关变化时启停文件监听，数据目录变化时重新监听
+func (s *Service) OnConfig(e *settings.Event) error {
+	switch {
+	case e.Has(settings.KeyAutoDecrypt):
+		if e.New.AutoDecrypt {
+			return s.StartAutoDecrypt()
+		}
+		return s.StopAutoDecrypt()
+	case e.New.AutoDecrypt && e.Has(settings.KeyDataDir):
+		if err := s.StopAutoDecrypt(); err != nil {
+			return err
+		}
+		return s.StartAutoDecrypt()
+	}
+	return nil
+}
+
 func (s *Service) DecryptFileCallback(event fsnotify.Event) error {
 	if event.Op.Has(fsnotify.Chmod) || !event.Op.Has(fsnotify.Write) {
 		return nil
 	}
 
+	metrics.IncAutoDecryptEvent()
+
+	// WAL 文件变化时解密对应的数据库文件
+	dbFile := strings.TrimSuffix(event.Name, common.WALSuffix)
+
 	s.mutex.Lock()
-	s.lastEvents[event.Name] = time.Now()
+	s.lastEvents[dbFile] = time.Now()
 
-	if !s.pendingActions[event.Name] {
-		s.pendingActions[event.Name] = true
+	if !s.pendingActions[dbFile] {
+		s.pendingActions[dbFile] = true
 		s.mutex.Unlock()
-		go s.waitAndProcess(event.Name)
+		s.beginDecrypt()
+		go s.waitAndProcess(dbFile)
 	} else {
 		s.mutex.Unlock()
 	}
@@ -128,15 +201,40 @@ func (s *Service) waitAndProcess(dbFile string) {
 
 			log.Debug().Msgf("Processing file: %s", dbFile)
 			s.DecryptDBFile(dbFile)
+			s.endDecrypt()
 			return
 		}
 		s.mutex.Unlock()
 	}
 }
 
+// LastDecrypt 返回最近一次解密数据库文件的时间和错误，没有解密过时返回零值
+func (s *Service) LastDecrypt() (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastDecrypt, s.lastDecryptErr
+}
+
 func (s *Service) DecryptDBFile(dbFile string) error {
+	return s.decryptDBFile(context.Background(), dbFile, 0, nil)
+}
 
-	decryptor, err := decrypt.NewDecryptor(s.conf.GetPlatform(), s.conf.GetVersion())
+// decryptDBFile 使用 jobs 个协程解密单个数据库文件，jobs 小于等于 0 时使用全部并发数
+func (s *Service) decryptDBFile(ctx context.Context, dbFile string, jobs int, progress common.ProgressFunc) (err error) {
+	s.beginDecrypt()
+	defer s.endDecrypt()
+
+	start := time.Now()
+	defer func() {
+		name := strings.TrimLeft(filepath.ToSlash(dbFile[len(s.conf.GetDataDir()):]), "/")
+		metrics.ObserveDecrypt(name, time.Since(start), err)
+		s.mutex.Lock()
+		s.lastDecrypt = time.Now()
+		s.lastDecryptErr = err
+		s.mutex.Unlock()
+	}()
+
+	decryptor, err := s.getIncrementalDecryptor()
 	if err != nil {
 		return err
 	}
@@ -146,35 +244,96 @@ func (s *Service) DecryptDBFile(dbFile string) error {
 		return err
 	}
 
-	outputTemp := output + ".tmp"
-	outputFile, err := os.Create(outputTemp)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+	if jobs <= 0 {
+		s.mutex.Lock()
+		jobs = s.jobs
+		s.mutex.Unlock()
 	}
-	defer func() {
-		outputFile.Close()
-		if err := os.Rename(outputTemp, output); err != nil {
-			log.Debug().Err(err).Msgf("failed to rename %s to %s", outputTemp, output)
-		}
-	}()
-
-	if err := decryptor.Decrypt(context.Background(), dbFile, s.conf.GetDataKey(), outputFile); err != nil {
+	pages, err := decryptor.Decrypt(ctx, dbFile, s.conf.GetDataKey(), output, jobs, progress)
+	if err != nil {
 		if err == errors.ErrAlreadyDecrypted {
-			if data, err := os.ReadFile(dbFile); err == nil {
-				outputFile.Write(data)
+			// 与同一文件的其他解密互斥，避免同时写入 output.tmp
+			unlock := decrypt.LockOutput(output)
+			defer unlock()
+			if len(s.conf.GetWorkKey()) != 0 {
+				return s.encryptPlainDBFile(ctx, dbFile, output)
 			}
-			return nil
+			return copyPlainDBFile(dbFile, output)
 		}
 		log.Err(err).Msgf("failed to decrypt %s", dbFile)
 		return err
 	}
 
-	log.Debug().Msgf("Decrypted %s to %s", dbFile, output)
+	log.Debug().Msgf("Decrypted %s to %s, %d pages updated", dbFile, output, pages)
 
 	return nil
 }
 
+// copyPlainDBFile 将未加密的数据库连同 WAL 文件复制到工作目录，由 SQLite 打开时合并 WAL
+// 文件都先写入临时文件再重命名，快照通过硬链接引用的旧文件内容不变；
+// 先删除旧的 WAL 再替换数据库，任何时刻都不会出现新数据库配旧 WAL 的组合，
+// 源文件没有 WAL 时也不会留下旧的 WAL 被 SQLite 重放
+func copyPlainDBFile(dbFile string, output string) error {
+	walFile, outputWAL := dbFile+common.WALSuffix, output+common.WALSuffix
+	if err := os.Remove(outputWAL); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := util.ReplaceFile(dbFile, output); err != nil {
+		return err
+	}
+	if _, err := os.Stat(walFile); err != nil {
+		return nil
+	}
+	if err := util.ReplaceFile(walFile, outputWAL); err != nil {
+		log.Debug().Err(err).Msgf("failed to copy wal file of %s", dbFile)
+	}
+	return nil
+}
+
+// encryptPlainDBFile 将未加密的数据库用工作目录口令加密后写入工作目录
+// WAL 中尚未 checkpoint 的内容不会包含在内，避免明文 WAL 落入工作目录
+func (s *Service) encryptPlainDBFile(ctx context.Context, dbFile string, output string) error {
+	outputTemp := output + ".tmp"
+	outputFile, err := os.Create(outputTemp)
+	if err != nil {
+		return err
+	}
+	if err := sqlcipher.EncryptFile(ctx, dbFile, s.conf.GetWorkKey(), outputFile); err != nil {
+		outputFile.Close()
+		os.Remove(outputTemp)
+		log.Err(err).Msgf("failed to encrypt %s", dbFile)
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		os.Remove(outputTemp)
+		return err
+	}
+	return os.Rename(outputTemp, output)
+}
+
+// getIncrementalDecryptor 获取增量解密器，平台或版本变化时重新创建
+func (s *Service) getIncrementalDecryptor() (*decrypt.IncrementalDecryptor, error) {
+	decryptor, err := decrypt.NewDecryptor(s.conf.GetPlatform(), s.conf.GetVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.incremental == nil || s.incremental.Decryptor().GetVersion() != decryptor.GetVersion() {
+		s.incremental = decrypt.NewIncrementalDecryptor(decryptor)
+	}
+	s.incremental.SetWorkKey(s.conf.GetWorkKey())
+	return s.incremental, nil
+}
+
 func (s *Service) DecryptDBFiles() error {
+	return s.DecryptDBFilesWithProgress(context.Background(), nil)
+}
+
+// DecryptDBFilesWithProgress 并发解密全部数据库文件，progress 可以为 nil
+// 回调会在多个协程中被串行调用
+func (s *Service) DecryptDBFilesWithProgress(ctx context.Context, progress func(DecryptProgress)) error {
 	dbGroup, err := filemonitor.NewFileGroup("wechat", s.conf.GetDataDir(), `.*\.db$`, []string{"fts"})
 	if err != nil {
 		return err
@@ -185,12 +344,107 @@ func (s *Service) DecryptDBFiles() error {
 		return err
 	}
 
+	// 全部文件解密完成后数据库服务才切换到新的快照
+	s.beginDecrypt()
+	defer s.endDecrypt()
+
+	decryptor, err := s.getIncrementalDecryptor()
+	if err != nil {
+		return err
+	}
+	pageSize := int64(decryptor.Decryptor().GetPageSize())
+
+	// 按文件大小估算总页数
+	filePages := make(map[string]int64, len(dbFiles))
+	state := DecryptProgress{FilesTotal: len(dbFiles)}
+	for _, dbFile := range dbFiles {
+		if stat, err := os.Stat(dbFile); err == nil {
+			filePages[dbFile] = stat.Size() / pageSize
+			state.PagesTotal += filePages[dbFile]
+		}
+	}
+
+	var progressMutex sync.Mutex
+	report := func(dbFile string, pagesDelta int64, fileDone bool) {
+		if progress == nil {
+			return
+		}
+		progressMutex.Lock()
+		defer progressMutex.Unlock()
+		state.PagesDone += pagesDelta
+		if fileDone {
+			state.FilesDone++
+		}
+		state.File = dbFile
+		progress(state)
+	}
+
+	// 并发数在文件之间平分，文件协程数与每个文件的页面协程数之积不超过 jobs
+	s.mutex.Lock()
+	jobs := s.jobs
+	s.mutex.Unlock()
+	workers := max(min(jobs, len(dbFiles)), 1)
+	pageJobs := max(jobs/workers, 1)
+
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dbFile := range files {
+				// 增量解密时只处理变化的页面，按比例折算到文件的总页数
+				total := filePages[dbFile]
+				var reported int64
+				err := s.decryptDBFile(ctx, dbFile, pageJobs, func(done, changed int64) {
+					if changed <= 0 {
+						return
+					}
+					current := min(done*total/changed, total)
+					report(dbFile, current-reported, false)
+					reported = current
+				})
+				if err != nil {
+					log.Debug().Msgf("DecryptDBFile %s failed: %v", dbFile, err)
+				}
+				report(dbFile, total-reported, true)
+			}
+		}()
+	}
+
 	for _, dbFile := range dbFiles {
-		if err := s.DecryptDBFile(dbFile); err != nil {
-			log.Debug().Msgf("DecryptDBFile %s failed: %v", dbFile, err)
-			continue
+		select {
+		case files <- dbFile:
+		case <-ctx.Done():
 		}
 	}
+	close(files)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return errors.ErrDecryptOperationCanceled
+	}
 
 	return nil
 }
+
+// beginDecrypt 标记工作目录正在解密，数据库服务在标记释放前不会切换到新的快照
+func (s *Service) beginDecrypt() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.decrypting++
+	if s.decrypting == 1 {
+		s.release = dbm.Hold(s.conf.GetWorkDir())
+	}
+}
+
+// endDecrypt 所有解密完成后释放解密标记
+func (s *Service) endDecrypt() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.decrypting--
+	if s.decrypting == 0 {
+		s.release()
+		s.release = nil
+	}
+}
@@ -0,0 +1,73 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyPlainDBFile(t *testing.T) {
+	src, work := t.TempDir(), t.TempDir()
+	dbFile, output := filepath.Join(src, "contact.db"), filepath.Join(work, "contact.db")
+	write := func(path, data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	write(dbFile, "db1")
+	write(dbFile+"-wal", "wal1")
+	if err := copyPlainDBFile(dbFile, output); err != nil {
+		t.Fatal(err)
+	}
+	if read(output) != "db1" || read(output+"-wal") != "wal1" {
+		t.Fatalf("output = %q, %q", read(output), read(output+"-wal"))
+	}
+
+	// 快照通过硬链接引用的旧文件内容不变
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+	if err := os.Link(output, snapshot); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+	if err := os.Link(output+"-wal", snapshot+"-wal"); err != nil {
+		t.Fatal(err)
+	}
+	write(dbFile, "db2")
+	write(dbFile+"-wal", "wal2")
+	if err := copyPlainDBFile(dbFile, output); err != nil {
+		t.Fatal(err)
+	}
+	if read(output) != "db2" || read(output+"-wal") != "wal2" {
+		t.Fatalf("output = %q, %q", read(output), read(output+"-wal"))
+	}
+	if read(snapshot) != "db1" || read(snapshot+"-wal") != "wal1" {
+		t.Errorf("snapshot changed: %q, %q", read(snapshot), read(snapshot+"-wal"))
+	}
+
+	// 源文件 checkpoint 后没有 WAL，旧的 WAL 被删除
+	if err := os.Remove(dbFile + "-wal"); err != nil {
+		t.Fatal(err)
+	}
+	write(dbFile, "db3")
+	if err := copyPlainDBFile(dbFile, output); err != nil {
+		t.Fatal(err)
+	}
+	if read(output) != "db3" {
+		t.Errorf("output = %q", read(output))
+	}
+	if _, err := os.Stat(output + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("stale wal kept: %v", err)
+	}
+	if _, err := os.Stat(output + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file left: %v", err)
+	}
+}
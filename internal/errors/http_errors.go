@@ -9,3 +9,31 @@ func InvalidArg(arg string) error {
 func HTTPShutDown(cause error) error {
 	return Newf(cause, http.StatusInternalServerError, "http server shut down")
 }
+
+func HTTPListenFailed(addr string, cause error) error {
+	return Newf(cause, http.StatusBadRequest, "http listen failed: %s", addr)
+}
+
+func TLSCertFailed(cause error) error {
+	return New(cause, http.StatusInternalServerError, "tls certificate unavailable")
+}
+
+func ConfigRolledBack(cause error) error {
+	return New(cause, http.StatusInternalServerError, "config change rolled back")
+}
+
+func ConfigSaveFailed(cause error) error {
+	return New(cause, http.StatusInternalServerError, "config applied but not saved")
+}
+
+func SummarizeNotConfigured() error {
+	return New(nil, http.StatusNotImplemented, "summarize service is not configured, set http.summarize_url")
+}
+
+func ControlUnauthorized() error {
+	return New(nil, http.StatusUnauthorized, "control token required")
+}
+
+func ControlForbidden() error {
+	return New(nil, http.StatusForbidden, "control API is not available here, use the control socket or set CHATLOG_CONTROL_TOKEN")
+}
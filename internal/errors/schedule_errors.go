@@ -0,0 +1,31 @@
+package errors
+
+import "net/http"
+
+func ScheduleInvalid(spec string) *Error {
+	return Newf(nil, http.StatusBadRequest, "invalid schedule: %s", spec)
+}
+
+func JobInvalid(name string, reason string) *Error {
+	return Newf(nil, http.StatusBadRequest, "invalid job %s: %s", name, reason)
+}
+
+func JobNotFound(name string) *Error {
+	return Newf(nil, http.StatusNotFound, "job not found: %s", name)
+}
+
+func JobRunning(name string) *Error {
+	return Newf(nil, http.StatusConflict, "job is running: %s", name)
+}
+
+func ExportInWorkDir(dir string) *Error {
+	return Newf(nil, http.StatusBadRequest, "work dir is encrypted, refusing to export plaintext to %s; set output outside the work dir", dir)
+}
+
+func DBNotReady() *Error {
+	return New(nil, http.StatusServiceUnavailable, "database is not ready")
+}
+
+func DBDecrypting() *Error {
+	return New(nil, http.StatusConflict, "database is decrypting")
+}
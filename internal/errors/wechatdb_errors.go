@@ -1,6 +1,8 @@
 package errors
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"time"
 )
@@ -10,6 +12,7 @@ var (
 	ErrKeyEmpty        = New(nil, http.StatusBadRequest, "key empty").WithStack()
 	ErrMediaNotFound   = New(nil, http.StatusNotFound, "media not found").WithStack()
 	ErrKeyLengthMust32 = New(nil, http.StatusBadRequest, "key length must be 32 bytes").WithStack()
+	ErrMessageNotFound = New(nil, http.StatusNotFound, "message not found").WithStack()
 )
 
 // 数据库初始化相关错误
@@ -33,7 +36,11 @@ func DBCloseFailed(cause error) *Error {
 	return New(cause, http.StatusInternalServerError, "db close failed").WithStack()
 }
 
+// QueryFailed 查询失败，超过查询期限时返回 504
 func QueryFailed(query string, cause error) *Error {
+	if errors.Is(cause, context.DeadlineExceeded) {
+		return Newf(cause, http.StatusGatewayTimeout, "query timeout: %s", query).WithStack()
+	}
 	return Newf(cause, http.StatusInternalServerError, "query failed: %s", query).WithStack()
 }
 
@@ -64,3 +71,14 @@ func InitCacheFailed(cause error) *Error {
 func FileGroupNotFound(name string) *Error {
 	return Newf(nil, http.StatusNotFound, "file group not found: %s", name).WithStack()
 }
+
+// 归档库相关错误
+var ErrArchiveDisabled = New(nil, http.StatusBadRequest, "archive is not enabled").WithStack()
+
+func ArchiveOpenFailed(path string, cause error) *Error {
+	return Newf(cause, http.StatusInternalServerError, "archive open failed: %s", path).WithStack()
+}
+
+func ArchiveWriteFailed(cause error) *Error {
+	return New(cause, http.StatusInternalServerError, "archive write failed").WithStack()
+}
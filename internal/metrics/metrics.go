@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sjzar/chatlog/pkg/filecopy"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chatlog"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP 请求数，按路由、方法和状态码统计",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP 请求耗时，按路由和方法统计",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	mcpCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mcp_tool_calls_total",
+		Help:      "MCP 工具调用次数，按工具和结果统计",
+	}, []string{"tool", "result"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "数据库查询耗时，按数据源和方法统计",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"datasource", "method"})
+
+	autoDecryptEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auto_decrypt_events_total",
+		Help:      "自动解密收到的数据库文件变化事件数",
+	})
+
+	decryptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "decrypt_duration_seconds",
+		Help:      "数据库文件解密耗时，按文件统计",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"file"})
+
+	decryptFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decrypt_failures_total",
+		Help:      "数据库文件解密失败次数，按文件统计",
+	}, []string{"file"})
+
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "定时任务运行次数，按任务和结果统计",
+	}, []string{"job", "status"})
+
+	databaseState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "database_state",
+		Help:      "数据库服务状态：0 未初始化，1 解密中，2 就绪，3 错误，4 重新打开中",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "filecopy_temp_files",
+		Help:      "filecopy 当前维护的临时文件数",
+	}, func() float64 {
+		return float64(filecopy.TempFileCount())
+	})
+)
+
+// Handler 返回 Prometheus 文本格式的指标
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware 是一个 Gin 中间件，统计每个路由的请求数和耗时
+// 未匹配的路由统一记为 unmatched，避免任意路径产生大量标签
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// ObserveMCPCall 记录一次 MCP 工具调用
+func ObserveMCPCall(tool string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	mcpCalls.WithLabelValues(tool, result).Inc()
+}
+
+// ObserveDBQuery 记录一次数据库查询的耗时
+func ObserveDBQuery(datasource, method string, d time.Duration) {
+	if datasource == "" {
+		datasource = "unknown"
+	}
+	dbQueryDuration.WithLabelValues(datasource, method).Observe(d.Seconds())
+}
+
+// IncAutoDecryptEvent 记录一次触发自动解密的文件变化
+func IncAutoDecryptEvent() {
+	autoDecryptEvents.Inc()
+}
+
+// ObserveDecrypt 记录一次数据库文件解密的耗时，失败时同时计数
+// file 为相对数据目录的路径
+func ObserveDecrypt(file string, d time.Duration, err error) {
+	decryptDuration.WithLabelValues(file).Observe(d.Seconds())
+	if err != nil {
+		decryptFailures.WithLabelValues(file).Inc()
+	}
+}
+
+// IncJobRun 记录一次定时任务运行的结果
+func IncJobRun(job, status string) {
+	jobRuns.WithLabelValues(job, status).Inc()
+}
+
+// SetDatabaseState 更新数据库服务状态
+func SetDatabaseState(state int) {
+	databaseState.Set(float64(state))
+}
@@ -4,14 +4,66 @@ import (
 	"encoding/xml"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type MediaMsg struct {
-	XMLName xml.Name `xml:"msg"`
-	Image   Image    `xml:"img,omitempty"`
-	Video   Video    `xml:"videomsg,omitempty"`
-	App     App      `xml:"appmsg,omitempty"`
+	XMLName  xml.Name  `xml:"msg"`
+	Image    Image     `xml:"img,omitempty"`
+	Video    Video     `xml:"videomsg,omitempty"`
+	App      App       `xml:"appmsg,omitempty"`
+	Emoji    *Emoji    `xml:"emoji,omitempty"`    // type 47 表情
+	Location *Location `xml:"location,omitempty"` // type 48 位置
+}
+
+// ContactCard 名片消息，字段都是根节点 msg 的属性
+type ContactCard struct {
+	XMLName   xml.Name `xml:"msg"`
+	UserName  string   `xml:"username,attr"`
+	NickName  string   `xml:"nickname,attr"`
+	Alias     string   `xml:"alias,attr"`
+	Province  string   `xml:"province,attr"`
+	City      string   `xml:"city,attr"`
+	Sign      string   `xml:"sign,attr"`
+	HeadImg   string   `xml:"bigheadimgurl,attr"`
+	CertFlag  int      `xml:"certflag,attr"`   // 非 0 为公众号
+	CertInfo  string   `xml:"certinfo,attr"`   // 公众号认证信息
+	OpenIMTag string   `xml:"openimdesc,attr"` // 企业微信名片的企业名称
+}
+
+// Emoji 表情，CDNURL 为表情图片地址
+type Emoji struct {
+	MD5        string `xml:"md5,attr"`
+	Len        string `xml:"len,attr"`
+	CDNURL     string `xml:"cdnurl,attr"`
+	ThumbURL   string `xml:"thumburl,attr"`
+	EncryptURL string `xml:"encrypturl,attr"`
+	AesKey     string `xml:"aeskey,attr"`
+	ProductID  string `xml:"productid,attr"`
+	Width      string `xml:"width,attr"`
+	Height     string `xml:"height,attr"`
+}
+
+// Location 位置，X 为纬度，Y 为经度
+type Location struct {
+	X       float64 `xml:"x,attr"`
+	Y       float64 `xml:"y,attr"`
+	Scale   int     `xml:"scale,attr"`
+	Label   string  `xml:"label,attr"`   // 详细地址
+	PoiName string  `xml:"poiname,attr"` // 地点名称
+	PoiID   string  `xml:"poiid,attr"`
+}
+
+// VoIPMsg 语音、视频通话消息，根节点为 voipmsg
+type VoIPMsg struct {
+	XMLName xml.Name `xml:"voipmsg"`
+	Type    string   `xml:"type,attr"`
+	Bubble  struct {
+		Msg      string `xml:"msg"`       // 如 "通话时长 00:31"、"已取消"
+		RoomType int    `xml:"room_type"` // 0 视频通话，1 语音通话
+	} `xml:"VoIPBubbleMsg"`
 }
 
 type Image struct {
@@ -70,7 +122,9 @@ type App struct {
 	FinderFeed        *FinderFeed `xml:"finderFeed,omitempty"`        // type 51 视频号
 	ReferMsg          *ReferMsg   `xml:"refermsg,omitempty"`          // type 57 引用
 	PatMsg            *PatMsg     `xml:"patMsg,omitempty"`            // type 62 拍一拍
-	WCPayInfo         *WCPayInfo  `xml:"wcpayinfo,omitempty"`         // type 2000 微信转账
+	FinderLive        *FinderLive `xml:"finderLive,omitempty"`        // type 63 视频号直播
+	WCPayInfo         *WCPayInfo  `xml:"wcpayinfo,omitempty"`         // type 2000 微信转账、2001 红包
+	DataURL           string      `xml:"dataurl,omitempty"`           // type 3 音乐
 }
 
 // ReferMsg 表示引用消息
@@ -133,6 +187,10 @@ type DataItem struct {
 	SourceTime    string `xml:"sourcetime,omitempty"`
 	SourceHeadURL string `xml:"sourceheadurl,omitempty"`
 	DataDesc      string `xml:"datadesc,omitempty"`
+	Link          string `xml:"link,omitempty"`
+
+	// 原消息的发送人，只有部分版本的记录包含
+	DataItemSource *DataItemSource `xml:"dataitemsource,omitempty"`
 
 	// 图片特有字段
 	ThumbSourcePath  string `xml:"thumbsourcepath,omitempty"`
@@ -158,37 +216,128 @@ type DataItem struct {
 	RecordXML *RecordXML `xml:"recordxml,omitempty"`
 }
 
+// DataItemSource 表示数据项的来源
+type DataItemSource struct {
+	FromUsr      string `xml:"fromusr,omitempty"`
+	RealChatName string `xml:"realchatname,omitempty"`
+}
+
 type RecordXML struct {
 	RecordInfo RecordInfo `xml:"recordinfo,omitempty"`
 }
 
+// recordTimeLayouts sourcetime 的常见格式，不同版本的客户端不一致
+var recordTimeLayouts = []string{
+	"2006-1-2 15:04:05",
+	"2006-1-2 15:04",
+	"2006/1/2 15:04:05",
+	"2006/1/2 15:04",
+}
+
+// Messages 把记录中的数据项转换为消息，套娃合并转发的记录保存在子消息的 Contents["records"] 中
+func (r *RecordInfo) Messages() []*Message {
+	messages := make([]*Message, 0, len(r.DataList.DataItems))
+	for i := range r.DataList.DataItems {
+		messages = append(messages, r.DataList.DataItems[i].Message())
+	}
+	return messages
+}
+
+// Message 把数据项转换为消息，媒体的键与普通消息一致，可以通过 /image/、/video/、/file/ 接口访问
+func (d *DataItem) Message() *Message {
+	m := &Message{
+		Time:       d.Time(),
+		SenderName: d.SourceName,
+		Contents:   make(map[string]interface{}),
+	}
+	if d.DataItemSource != nil {
+		m.Sender = d.DataItemSource.FromUsr
+		if m.Sender == "" {
+			m.Sender = d.DataItemSource.RealChatName
+		}
+	}
+
+	md5 := d.FullMD5
+	if md5 == "" {
+		md5 = d.ThumbFullMD5
+	}
+
+	switch d.DataType {
+	case "2":
+		m.Type = 3
+		m.Contents["md5"] = md5
+	case "3":
+		m.Type = 34
+		m.Content = d.DataDesc
+	case "4", "15":
+		m.Type = 43
+		m.Contents["md5"] = md5
+	case "5":
+		m.Type, m.SubType = 49, 5
+		m.Contents["title"] = d.DataTitle
+		m.Contents["url"] = d.Link
+	case "8":
+		m.Type, m.SubType = 49, 6
+		m.Contents["title"] = d.DataTitle
+		m.Contents["md5"] = d.FullMD5
+	case "17":
+		m.Type, m.SubType = 49, 19
+		m.Contents["title"] = d.DataTitle
+		m.Contents["desc"] = d.DataDesc
+		if d.RecordXML != nil {
+			m.Contents["records"] = d.RecordXML.RecordInfo.Messages()
+		}
+	default:
+		// 文本以及暂不支持的类型，保留描述文字
+		m.Type = 1
+		m.Content = d.DataDesc
+		if m.Content == "" {
+			m.Content = d.DataTitle
+		}
+	}
+	return m
+}
+
+// Time 返回原消息的发送时间，优先使用时间戳字段
+func (d *DataItem) Time() time.Time {
+	if ts, err := strconv.ParseInt(d.SrcMsgCreateTime, 10, 64); err == nil && ts > 0 {
+		return time.Unix(ts, 0)
+	}
+	for _, layout := range recordTimeLayouts {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(d.SourceTime), time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
 func (r *RecordInfo) String(title, host string) string {
-	buf := strings.Builder{}
 	if title == "" {
 		title = r.Title
 	}
+	return RecordsString(title, r.Messages(), host)
+}
+
+// RecordsString 按层级输出合并转发的记录，每一层缩进两个空格
+func RecordsString(title string, records []*Message, host string) string {
+	buf := strings.Builder{}
 	buf.WriteString(fmt.Sprintf("[合并转发|%s]\n", title))
-	for _, item := range r.DataList.DataItems {
-		buf.WriteString(fmt.Sprintf("  %s %s\n", item.SourceName, item.SourceTime))
-
-		// 套娃合并转发
-		if item.DataType == "17" && item.RecordXML != nil {
-			content := item.RecordXML.RecordInfo.String(item.DataTitle, host)
-			if content != "" {
-				for _, line := range strings.Split(content, "\n") {
-					buf.WriteString(fmt.Sprintf("  %s\n", line))
-				}
-			}
-			continue
+	for _, item := range records {
+		buf.WriteString("  " + item.SenderName)
+		if !item.Time.IsZero() {
+			buf.WriteString(" " + item.Time.Format("2006-01-02 15:04:05"))
 		}
+		buf.WriteString("\n")
 
-		switch item.DataFmt {
-		case "pic", "jpg":
-			buf.WriteString(fmt.Sprintf("  ![图片](http://%s/image/%s)\n", host, item.FullMD5))
-		default:
-			for _, line := range strings.Split(item.DataDesc, "\n") {
-				buf.WriteString(fmt.Sprintf("  %s\n", line))
-			}
+		// 在副本上设置 host，不修改调用方持有的记录
+		child := *item
+		child.Contents = make(map[string]interface{}, len(item.Contents)+1)
+		for k, v := range item.Contents {
+			child.Contents[k] = v
+		}
+		child.Contents["host"] = host
+		for _, line := range strings.Split(strings.TrimRight(child.PlainTextContent(), "\n"), "\n") {
+			buf.WriteString(fmt.Sprintf("  %s\n", line))
 		}
 		buf.WriteString("\n")
 	}
@@ -229,6 +378,18 @@ type WCPayInfo struct {
 	PayMemo           string `xml:"pay_memo"`          // 支付备注
 	ReceiverUsername  string `xml:"receiver_username"` // 接收方用户名
 	PayerUsername     string `xml:"payer_username"`    // 支付方用户名
+	SenderTitle       string `xml:"sendertitle"`       // 红包祝福语
+	ReceiverTitle     string `xml:"receivertitle"`     // 红包接收方看到的标题
+}
+
+// FinderLive 视频号直播信息
+type FinderLive struct {
+	FinderLiveID   string `xml:"finderLiveID"`
+	FinderUsername string `xml:"finderUsername"`
+	Nickname       string `xml:"nickname"`
+	Desc           string `xml:"desc"`
+	HeadURL        string `xml:"headUrl"`
+	LiveStatus     int    `xml:"liveStatus"` // 1 直播中，2 已结束
 }
 
 // FinderFeed 视频号信息
@@ -287,6 +448,15 @@ type SysMsg struct {
 	Type              string             `xml:"type,attr"`
 	DelChatRoomMember *DelChatRoomMember `xml:"delchatroommember,omitempty"`
 	SysMsgTemplate    *SysMsgTemplate    `xml:"sysmsgtemplate,omitempty"`
+	RevokeMsg         *RevokeMsg         `xml:"revokemsg,omitempty"`
+}
+
+// 撤回消息的提示，NewMsgID 为被撤回消息的服务端 ID
+type RevokeMsg struct {
+	Session    string `xml:"session"`
+	MsgID      string `xml:"msgid"`
+	NewMsgID   string `xml:"newmsgid"`
+	ReplaceMsg string `xml:"replacemsg"`
 }
 
 // 第一种消息类型：删除群成员/二维码邀请
@@ -348,6 +518,9 @@ func (s *SysMsg) String() string {
 	if s.Type == "delchatroommember" {
 		return s.DelChatRoomMemberString()
 	}
+	if s.Type == "revokemsg" && s.RevokeMsg != nil {
+		return s.RevokeMsg.ReplaceMsg
+	}
 	return s.SysMsgTemplateString()
 }
 
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 合并转发中嵌套了另一条合并转发，内层记录使用时间戳字段，外层使用 sourcetime
+const nestedRecordXML = `<msg>
+<appmsg appid="" sdkver="0">
+<title>群聊的聊天记录</title>
+<des>Alice: 你好
+Bob: [图片]</des>
+<type>19</type>
+<recorditem><![CDATA[<recordinfo>
+<title>群聊的聊天记录</title>
+<desc>Alice: 你好</desc>
+<datalist count="3">
+<dataitem datatype="1" dataid="a1">
+<datadesc>你好</datadesc>
+<sourcename>Alice</sourcename>
+<sourcetime>2024-3-5 09:07:01</sourcetime>
+<dataitemsource><fromusr>wxid_alice</fromusr></dataitemsource>
+</dataitem>
+<dataitem datatype="2" dataid="a2">
+<sourcename>Bob</sourcename>
+<sourcetime>2024/3/5 09:08</sourcetime>
+<fullmd5>0123456789abcdef0123456789abcdef</fullmd5>
+<dataitemsource><realchatname>wxid_bob</realchatname></dataitemsource>
+</dataitem>
+<dataitem datatype="17" dataid="a3">
+<datatitle>Carol和Dave的聊天记录</datatitle>
+<datadesc>Carol: 早</datadesc>
+<sourcename>Alice</sourcename>
+<sourcetime>2024-3-5 09:09</sourcetime>
+<recordxml><recordinfo>
+<title>Carol和Dave的聊天记录</title>
+<datalist count="2">
+<dataitem datatype="1">
+<datadesc>早</datadesc>
+<sourcename>Carol</sourcename>
+<srcMsgCreateTime>1709600000</srcMsgCreateTime>
+</dataitem>
+<dataitem datatype="8">
+<datatitle>report.pdf</datatitle>
+<sourcename>Dave</sourcename>
+<fullmd5>fedcba9876543210fedcba9876543210</fullmd5>
+</dataitem>
+</datalist>
+</recordinfo></recordxml>
+</dataitem>
+</datalist>
+</recordinfo>]]></recorditem>
+</appmsg>
+</msg>`
+
+func TestParseNestedRecords(t *testing.T) {
+	m := &Message{Type: 49}
+	if err := m.ParseMediaInfo(nestedRecordXML); err != nil {
+		t.Fatal(err)
+	}
+	if m.SubType != 19 || m.Contents["title"] != "群聊的聊天记录" {
+		t.Fatalf("subtype %d, contents %v", m.SubType, m.Contents)
+	}
+	if _, ok := m.Contents["recordInfo"].(*RecordInfo); !ok {
+		t.Error("recordInfo not kept")
+	}
+
+	records, ok := m.Contents["records"].([]*Message)
+	if !ok || len(records) != 3 {
+		t.Fatalf("records = %v", m.Contents["records"])
+	}
+
+	text := records[0]
+	if text.Type != 1 || text.Content != "你好" || text.Sender != "wxid_alice" || text.SenderName != "Alice" {
+		t.Errorf("text record = %+v", text)
+	}
+	if want := time.Date(2024, 3, 5, 9, 7, 1, 0, time.Local); !text.Time.Equal(want) {
+		t.Errorf("text record time = %v, want %v", text.Time, want)
+	}
+
+	image := records[1]
+	if image.Type != 3 || image.Contents["md5"] != "0123456789abcdef0123456789abcdef" || image.Sender != "wxid_bob" {
+		t.Errorf("image record = %+v", image)
+	}
+	if want := time.Date(2024, 3, 5, 9, 8, 0, 0, time.Local); !image.Time.Equal(want) {
+		t.Errorf("image record time = %v, want %v", image.Time, want)
+	}
+
+	nested := records[2]
+	if nested.Type != 49 || nested.SubType != 19 || nested.Contents["title"] != "Carol和Dave的聊天记录" {
+		t.Fatalf("nested record = %+v", nested)
+	}
+	inner, ok := nested.Contents["records"].([]*Message)
+	if !ok || len(inner) != 2 {
+		t.Fatalf("nested records = %v", nested.Contents["records"])
+	}
+	if inner[0].Content != "早" || !inner[0].Time.Equal(time.Unix(1709600000, 0)) {
+		t.Errorf("inner text record = %+v", inner[0])
+	}
+	if inner[1].Type != 49 || inner[1].SubType != 6 || inner[1].Contents["title"] != "report.pdf" {
+		t.Errorf("inner file record = %+v", inner[1])
+	}
+}
+
+func TestRecordsString(t *testing.T) {
+	m := &Message{Type: 49}
+	if err := m.ParseMediaInfo(nestedRecordXML); err != nil {
+		t.Fatal(err)
+	}
+	m.SetContent("host", "127.0.0.1:5030")
+
+	got := m.PlainTextContent()
+	for _, want := range []string{
+		"[合并转发|群聊的聊天记录]\n",
+		"  Alice 2024-03-05 09:07:01\n  你好\n",
+		"  ![图片](http://127.0.0.1:5030/image/0123456789abcdef0123456789abcdef)\n",
+		// 内层记录再缩进一层
+		"  [合并转发|Carol和Dave的聊天记录]\n    Carol ",
+		"    [文件|report.pdf](http://127.0.0.1:5030/file/fedcba9876543210fedcba9876543210)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("plain text missing %q:\n%s", want, got)
+		}
+	}
+
+	// 输出不修改记录本身
+	records := m.Contents["records"].([]*Message)
+	for _, r := range records {
+		if _, ok := r.Contents["host"]; ok {
+			t.Errorf("record %+v modified", r)
+		}
+	}
+	if got2 := m.PlainTextContent(); got2 != got {
+		t.Errorf("second render differs:\n%s", got2)
+	}
+}
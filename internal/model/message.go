@@ -3,6 +3,8 @@ package model
 import (
 	"encoding/xml"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,19 +20,23 @@ const (
 )
 
 type Message struct {
-	Version    string                 `json:"-"`                  // 消息版本，内部判断
-	Seq        int64                  `json:"seq"`                // 消息序号，10位时间戳 + 3位序号
-	Time       time.Time              `json:"time"`               // 消息创建时间，10位时间戳
-	Talker     string                 `json:"talker"`             // 聊天对象，微信 ID or 群 ID
-	TalkerName string                 `json:"talkerName"`         // 聊天对象名称
-	IsChatRoom bool                   `json:"isChatRoom"`         // 是否为群聊消息
-	Sender     string                 `json:"sender"`             // 发送人，微信 ID
-	SenderName string                 `json:"senderName"`         // 发送人名称
-	IsSelf     bool                   `json:"isSelf"`             // 是否为自己发送的消息
-	Type       int64                  `json:"type"`               // 消息类型
-	SubType    int64                  `json:"subType"`            // 消息子类型
-	Content    string                 `json:"content"`            // 消息内容，文字聊天内容
-	Contents   map[string]interface{} `json:"contents,omitempty"` // 消息内容，多媒体消息，采用更灵活的记录方式
+	Version    string                 `json:"-"`                    // 消息版本，内部判断
+	Seq        int64                  `json:"seq"`                  // 消息序号，10位时间戳 + 3位序号
+	Time       time.Time              `json:"time"`                 // 消息创建时间，10位时间戳
+	Talker     string                 `json:"talker"`               // 聊天对象，微信 ID or 群 ID
+	TalkerName string                 `json:"talkerName"`           // 聊天对象名称
+	IsChatRoom bool                   `json:"isChatRoom"`           // 是否为群聊消息
+	Sender     string                 `json:"sender"`               // 发送人，微信 ID
+	SenderName string                 `json:"senderName"`           // 发送人名称
+	IsSelf     bool                   `json:"isSelf"`               // 是否为自己发送的消息
+	Type       int64                  `json:"type"`                 // 消息类型
+	SubType    int64                  `json:"subType"`              // 消息子类型
+	Content    string                 `json:"content"`              // 消息内容，文字聊天内容
+	Contents   map[string]interface{} `json:"contents,omitempty"`   // 消息内容，多媒体消息，采用更灵活的记录方式
+	ReplyToSeq int64                  `json:"replyToSeq,omitempty"` // 引用消息所引用的原消息序号
+
+	// 服务端消息 ID，用于关联语音和引用消息
+	ServerID int64 `json:"-"`
 
 	// Debug Info
 	MediaMsg *MediaMsg `json:"mediaMsg,omitempty"` // 原始多媒体消息，XML 格式
@@ -58,6 +64,46 @@ func (m *Message) ParseMediaInfo(data string) error {
 		m.Sender = "系统消息"
 		m.SenderName = ""
 		m.Content = sysMsg.String()
+		if sysMsg.Type != "" {
+			m.SetContent("sysmsg", sysMsg.Type)
+		}
+		if sysMsg.RevokeMsg != nil && sysMsg.RevokeMsg.NewMsgID != "" {
+			m.SetContent("revokeid", sysMsg.RevokeMsg.NewMsgID)
+		}
+		return nil
+	}
+
+	if m.Type == 50 {
+		// 通话消息的根节点不是 msg
+		var voip VoIPMsg
+		if err := xml.Unmarshal([]byte(data), &voip); err != nil {
+			return err
+		}
+		m.SetContent("video", voip.Bubble.RoomType == 0)
+		m.SetContent("status", voip.Bubble.Msg)
+		if d, ok := parseCallDuration(voip.Bubble.Msg); ok {
+			m.SetContent("duration", d)
+		}
+		return nil
+	}
+
+	if m.Type == 42 {
+		// 名片的字段都是根节点的属性，直接解析为名片，不再解析为 MediaMsg
+		var card ContactCard
+		if err := xml.Unmarshal([]byte(data), &card); err != nil {
+			return err
+		}
+		m.SetContent("username", card.UserName)
+		m.SetContent("nickname", card.NickName)
+		if card.Alias != "" {
+			m.SetContent("alias", card.Alias)
+		}
+		if card.CertFlag != 0 {
+			m.SetContent("official", true)
+		}
+		if card.OpenIMTag != "" {
+			m.SetContent("corp", card.OpenIMTag)
+		}
 		return nil
 	}
 
@@ -78,6 +124,27 @@ func (m *Message) ParseMediaInfo(data string) error {
 	switch m.Type {
 	case 3:
 		m.Contents["md5"] = msg.Image.MD5
+	case 47:
+		// 表情
+		if msg.Emoji == nil {
+			break
+		}
+		m.Contents["md5"] = msg.Emoji.MD5
+		if msg.Emoji.CDNURL != "" {
+			m.Contents["cdnurl"] = msg.Emoji.CDNURL
+		}
+	case 48:
+		// 位置
+		if msg.Location == nil {
+			break
+		}
+		m.Contents["x"] = msg.Location.X
+		m.Contents["y"] = msg.Location.Y
+		m.Contents["label"] = msg.Location.Label
+		m.Contents["poiname"] = msg.Location.PoiName
+		if msg.Location.PoiID != "" {
+			m.Contents["poiid"] = msg.Location.PoiID
+		}
 	case 43:
 		if msg.Video.Md5 != "" {
 			m.Contents["md5"] = msg.Video.Md5
@@ -88,6 +155,14 @@ func (m *Message) ParseMediaInfo(data string) error {
 	case 49:
 		m.SubType = int64(msg.App.Type)
 		switch m.SubType {
+		case 3:
+			// 音乐
+			m.Contents["title"] = msg.App.Title
+			m.Contents["desc"] = msg.App.Des
+			m.Contents["url"] = msg.App.URL
+			if msg.App.DataURL != "" {
+				m.Contents["dataurl"] = msg.App.DataURL
+			}
 		case 5:
 			// 链接
 			m.Contents["title"] = msg.App.Title
@@ -108,7 +183,9 @@ func (m *Message) ParseMediaInfo(data string) error {
 			if err != nil {
 				return err
 			}
+			// recordInfo 为原始的记录结构，保留给依赖旧字段的调用方
 			m.Contents["recordInfo"] = recordInfo
+			m.Contents["records"] = recordInfo.Messages()
 		case 33, 36:
 			// 小程序
 			m.Contents["title"] = msg.App.SourceDisplayName
@@ -122,6 +199,11 @@ func (m *Message) ParseMediaInfo(data string) error {
 			if len(msg.App.FinderFeed.MediaList.Media) > 0 {
 				m.Contents["url"] = msg.App.FinderFeed.MediaList.Media[0].URL
 			}
+		case 53:
+			// 群接龙，标题中包含完整的接龙内容
+			title, entries := parseSolitaire(msg.App.Title)
+			m.Contents["title"] = title
+			m.Contents["entries"] = entries
 		case 57:
 			// 引用
 			m.Content = msg.App.Title
@@ -134,6 +216,7 @@ func (m *Message) ParseMediaInfo(data string) error {
 				Sender:     msg.App.ReferMsg.ChatUsr,
 				SenderName: msg.App.ReferMsg.DisplayName,
 			}
+			subMsg.ServerID, _ = strconv.ParseInt(msg.App.ReferMsg.SvrID, 10, 64)
 			if subMsg.Sender == "" {
 				subMsg.Sender = msg.App.ReferMsg.FromUsr
 			}
@@ -151,6 +234,14 @@ func (m *Message) ParseMediaInfo(data string) error {
 			}
 			m.Sender = msg.App.PatMsg.Records.Record[0].FromUser
 			m.Content = msg.App.PatMsg.Records.Record[0].Templete
+		case 63:
+			// 视频号直播
+			if msg.App.FinderLive == nil {
+				break
+			}
+			m.Contents["title"] = msg.App.FinderLive.Desc
+			m.Contents["nickname"] = msg.App.FinderLive.Nickname
+			m.Contents["liveid"] = msg.App.FinderLive.FinderLiveID
 		case 2000:
 			// 微信转账
 			if msg.App.WCPayInfo == nil {
@@ -175,12 +266,87 @@ func (m *Message) ParseMediaInfo(data string) error {
 				payMemo = "(" + msg.App.WCPayInfo.PayMemo + ")"
 			}
 			m.Content = fmt.Sprintf("[转账|%s%s]%s", _type, msg.App.WCPayInfo.FeeDesc, payMemo)
+		case 2001:
+			// 红包，只有祝福语，没有金额
+			title := msg.App.Title
+			if msg.App.WCPayInfo != nil && msg.App.WCPayInfo.SenderTitle != "" {
+				title = msg.App.WCPayInfo.SenderTitle
+			}
+			m.Contents["title"] = title
 		}
 	}
 
 	return nil
 }
 
+// callDurationRe 匹配通话时长，格式为 mm:ss 或 hh:mm:ss
+var callDurationRe = regexp.MustCompile(`(\d+):(\d{2})(?::(\d{2}))?`)
+
+// parseCallDuration 从 "通话时长 00:31" 中解析通话秒数，未接通的通话没有时长
+func parseCallDuration(text string) (int, bool) {
+	match := callDurationRe.FindStringSubmatch(text)
+	if match == nil {
+		return 0, false
+	}
+	a, _ := strconv.Atoi(match[1])
+	b, _ := strconv.Atoi(match[2])
+	if match[3] == "" {
+		return a*60 + b, true
+	}
+	c, _ := strconv.Atoi(match[3])
+	return a*3600 + b*60 + c, true
+}
+
+// solitaireEntryRe 匹配接龙条目，如 "1. 张三"
+var solitaireEntryRe = regexp.MustCompile(`^\d+\.\s*(.*)$`)
+
+// parseSolitaire 拆分群接龙的标题和条目，编号之前的内容为标题
+func parseSolitaire(text string) (string, []string) {
+	var header []string
+	entries := make([]string, 0)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if match := solitaireEntryRe.FindStringSubmatch(line); match != nil {
+			entries = append(entries, match[1])
+			continue
+		}
+		if len(entries) == 0 {
+			header = append(header, line)
+		}
+	}
+	return strings.Join(header, " "), entries
+}
+
+// recallNoticeTexts 没有系统消息类型时按提示文字识别撤回提示，覆盖旧版本的纯文本提示
+var recallNoticeTexts = []string{"撤回了一条消息", "recalled a message"}
+
+// IsRecallNotice 是否为撤回消息后留下的系统提示
+// 优先根据系统消息的类型判断，与微信的界面语言无关
+func (m *Message) IsRecallNotice() bool {
+	if m.Type != 10000 {
+		return false
+	}
+	if t, ok := m.Contents["sysmsg"].(string); ok {
+		return t == "revokemsg"
+	}
+	for _, text := range recallNoticeTexts {
+		if strings.Contains(m.Content, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// RevokedServerID 返回撤回提示中被撤回消息的服务端 ID，提示中没有记录时返回 0
+func (m *Message) RevokedServerID() int64 {
+	id, _ := m.Contents["revokeid"].(string)
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
+
 func (m *Message) SetContent(key string, value interface{}) {
 	if m.Contents == nil {
 		m.Contents = make(map[string]interface{})
@@ -226,6 +392,10 @@ func (m *Message) PlainText(showChatRoom bool, timeFormat string, host string) s
 	}
 
 	buf.WriteString(m.Time.Format(timeFormat))
+	if r, ok := m.Contents["recalled"].(*Recall); ok {
+		buf.WriteString(" ")
+		buf.WriteString(r.Label())
+	}
 	buf.WriteString("\n")
 
 	buf.WriteString(m.PlainTextContent())
@@ -255,14 +425,28 @@ func (m *Message) PlainTextContent() string {
 				keylist = append(keylist, thumb)
 			}
 		}
+		if text, ok := m.Contents["ocr"].(string); ok && text != "" {
+			// 识别的文字作为图片说明，多行合并为一行
+			return fmt.Sprintf("![图片|%s](http://%s/image/%s)", strings.Join(strings.Fields(text), " "), m.Contents["host"], strings.Join(keylist, ","))
+		}
 		return fmt.Sprintf("![图片](http://%s/image/%s)", m.Contents["host"], strings.Join(keylist, ","))
 	case 34:
 		if voice, ok := m.Contents["voice"]; ok {
+			if transcript, ok := m.Contents["transcript"].(string); ok && transcript != "" {
+				return fmt.Sprintf("[语音|%s](http://%s/voice/%s)", transcript, m.Contents["host"], voice)
+			}
 			return fmt.Sprintf("[语音](http://%s/voice/%s)", m.Contents["host"], voice)
 		}
 		return "[语音]"
 	case 42:
-		return "[名片]"
+		nickname, _ := m.Contents["nickname"].(string)
+		if nickname == "" {
+			return "[名片]"
+		}
+		if m.Contents["official"] == true {
+			return fmt.Sprintf("[公众号名片|%s](%s)", nickname, m.Contents["username"])
+		}
+		return fmt.Sprintf("[名片|%s](%s)", nickname, m.Contents["username"])
 	case 43:
 		keylist := make([]string, 0)
 		if m.Contents["md5"] != nil {
@@ -287,9 +471,29 @@ func (m *Message) PlainTextContent() string {
 		}
 		return fmt.Sprintf("![视频](http://%s/video/%s)", m.Contents["host"], strings.Join(keylist, ","))
 	case 47:
+		if cdnurl, ok := m.Contents["cdnurl"].(string); ok && cdnurl != "" {
+			return fmt.Sprintf("![动画表情](%s)", cdnurl)
+		}
 		return "[动画表情]"
+	case 48:
+		poiname, _ := m.Contents["poiname"].(string)
+		label, _ := m.Contents["label"].(string)
+		if poiname == "" && label == "" {
+			return "[位置]"
+		}
+		name := strings.TrimSpace(poiname + " " + label)
+		if poiname == label {
+			name = poiname
+		}
+		return fmt.Sprintf("[位置|%s](%v,%v)", name, m.Contents["x"], m.Contents["y"])
 	case 49:
 		switch m.SubType {
+		case 3:
+			title := m.Contents["title"]
+			if desc, ok := m.Contents["desc"].(string); ok && desc != "" {
+				title = fmt.Sprintf("%s - %s", title, desc)
+			}
+			return fmt.Sprintf("[音乐|%s](%s)", title, m.Contents["url"])
 		case 5:
 			return fmt.Sprintf("[链接|%s](%s)", m.Contents["title"], m.Contents["url"])
 		case 6:
@@ -297,19 +501,13 @@ func (m *Message) PlainTextContent() string {
 		case 8:
 			return "[GIF表情]"
 		case 19:
-			_recordInfo, ok := m.Contents["recordInfo"]
+			records, ok := m.Contents["records"].([]*Message)
 			if !ok {
 				return "[合并转发]"
 			}
-			recordInfo, ok := _recordInfo.(*RecordInfo)
-			if !ok {
-				return "[合并转发]"
-			}
-			host := ""
-			if m.Contents["host"] != nil {
-				host = m.Contents["host"].(string)
-			}
-			return recordInfo.String("", host)
+			title, _ := m.Contents["title"].(string)
+			host, _ := m.Contents["host"].(string)
+			return RecordsString(title, records, host)
 		case 33, 36:
 			if m.Contents["title"] == "" {
 				return "[小程序]"
@@ -321,6 +519,14 @@ func (m *Message) PlainTextContent() string {
 			} else {
 				return fmt.Sprintf("[视频号|%s](%s)", m.Contents["title"], m.Contents["url"])
 			}
+		case 53:
+			entries, _ := m.Contents["entries"].([]string)
+			buf := strings.Builder{}
+			buf.WriteString(fmt.Sprintf("[接龙|%s]", m.Contents["title"]))
+			for i, entry := range entries {
+				buf.WriteString(fmt.Sprintf("\n%d. %s", i+1, entry))
+			}
+			return buf.String()
 		case 57:
 			_refer, ok := m.Contents["refer"]
 			if !ok {
@@ -355,12 +561,22 @@ func (m *Message) PlainTextContent() string {
 		case 62:
 			return m.Content
 		case 63:
-			return "[视频号]"
+			nickname, _ := m.Contents["nickname"].(string)
+			if nickname == "" {
+				return "[视频号直播]"
+			}
+			if title, ok := m.Contents["title"].(string); ok && title != "" {
+				return fmt.Sprintf("[视频号直播|%s: %s]", nickname, title)
+			}
+			return fmt.Sprintf("[视频号直播|%s]", nickname)
 		case 87:
 			return "[群公告]"
 		case 2000:
 			return m.Content
 		case 2001:
+			if title, ok := m.Contents["title"].(string); ok && title != "" {
+				return fmt.Sprintf("[红包|%s]", title)
+			}
 			return "[红包]"
 		case 2003:
 			return "[红包封面]"
@@ -368,7 +584,14 @@ func (m *Message) PlainTextContent() string {
 			return "[分享]"
 		}
 	case 50:
-		return "[语音通话]"
+		call := "语音通话"
+		if m.Contents["video"] == true {
+			call = "视频通话"
+		}
+		if status, ok := m.Contents["status"].(string); ok && status != "" {
+			return fmt.Sprintf("[%s|%s]", call, status)
+		}
+		return "[" + call + "]"
 	case 10000:
 		return m.Content
 	default:
@@ -23,6 +23,7 @@ import (
 // ConBlob BLOB
 // )
 type MessageDarwinV3 struct {
+	MesSvrID      int64  `json:"mesSvrID"`
 	MsgCreateTime int64  `json:"msgCreateTime"`
 	MsgContent    string `json:"msgContent"`
 	MessageType   int64  `json:"messageType"`
@@ -38,6 +39,7 @@ func (m *MessageDarwinV3) Wrap(talker string) *Message {
 		IsChatRoom: strings.HasSuffix(talker, "@chatroom"),
 		IsSelf:     m.MesDes == 0,
 		Version:    WeChatDarwinV3,
+		ServerID:   m.MesSvrID,
 	}
 
 	content := m.MsgContent
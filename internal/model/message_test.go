@@ -0,0 +1,189 @@
+package model
+
+import "testing"
+
+// 英文界面下的撤回提示，被撤回消息的服务端 ID 记录在 newmsgid 中
+const revokeXML = `<sysmsg type="revokemsg"><revokemsg><session>wxid_a</session><msgid>1</msgid><newmsgid>123456789</newmsgid><replacemsg><![CDATA["Alice" has retracted a message]]></replacemsg></revokemsg></sysmsg>`
+
+func TestIsRecallNotice(t *testing.T) {
+	m := &Message{Type: 10000}
+	if err := m.ParseMediaInfo(revokeXML); err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsRecallNotice() || m.RevokedServerID() != 123456789 {
+		t.Errorf("revokemsg: notice %v, id %d, content %q", m.IsRecallNotice(), m.RevokedServerID(), m.Content)
+	}
+
+	// 其他系统消息即使提到撤回也不是撤回提示
+	other := &Message{Type: 10000}
+	if err := other.ParseMediaInfo(`<sysmsg type="sysmsgtemplate"><sysmsgtemplate><content_template type="tmpl_type_profile"><plain><![CDATA[]]></plain><template><![CDATA[撤回了一条消息]]></template></content_template></sysmsgtemplate></sysmsg>`); err != nil {
+		t.Fatal(err)
+	}
+	if other.IsRecallNotice() {
+		t.Error("template message recognized as recall notice")
+	}
+
+	// 没有 XML 的旧版本提示按文字判断
+	for content, want := range map[string]bool{
+		"你撤回了一条消息":                   true,
+		`"Alice" recalled a message`: true,
+		"Alice 加入了群聊":                false,
+	} {
+		m := &Message{Type: 10000}
+		if err := m.ParseMediaInfo(content); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.IsRecallNotice(); got != want {
+			t.Errorf("IsRecallNotice(%q) = %v, want %v", content, got, want)
+		}
+	}
+
+	if (&Message{Type: 1, Content: "撤回了一条消息"}).IsRecallNotice() {
+		t.Error("text message recognized as recall notice")
+	}
+}
+
+func TestParseMediaInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		msgType  int64
+		xml      string
+		contents map[string]interface{}
+		text     string
+	}{
+		{
+			name:     "voice call",
+			msgType:  50,
+			xml:      `<voipmsg type="VoIPBubbleMsg"><VoIPBubbleMsg><msg><![CDATA[通话时长 00:31]]></msg><room_type>1</room_type><red_dot>false</red_dot><roomid>1234567890</roomid><roomkey>0</roomkey><inviteid>1709600821</inviteid><msg_type>100</msg_type><timestamp>1709600852</timestamp><identity><![CDATA[]]></identity><duration>0</duration></VoIPBubbleMsg></voipmsg>`,
+			contents: map[string]interface{}{"video": false, "status": "通话时长 00:31", "duration": 31},
+			text:     "[语音通话|通话时长 00:31]",
+		},
+		{
+			name:     "cancelled video call",
+			msgType:  50,
+			xml:      `<voipmsg type="VoIPBubbleMsg"><VoIPBubbleMsg><msg><![CDATA[已取消]]></msg><room_type>0</room_type><red_dot>true</red_dot></VoIPBubbleMsg></voipmsg>`,
+			contents: map[string]interface{}{"video": true, "status": "已取消", "duration": nil},
+			text:     "[视频通话|已取消]",
+		},
+		{
+			name:     "contact card",
+			msgType:  42,
+			xml:      `<?xml version="1.0"?>` + "\n" + `<msg bigheadimgurl="http://wx.qlogo.cn/mmhead/ver_1/abc/0" smallheadimgurl="http://wx.qlogo.cn/mmhead/ver_1/abc/132" username="wxid_zhangsan" nickname="张三" fullpy="zhangsan" shortpy="" alias="zhangsan88" imagestatus="3" scene="17" province="广东" city="深圳" sign="" sex="1" certflag="0" certinfo="" brandIconUrl="" brandHomeUrl="" brandSubscriptConfigUrl="" brandFlags="0" regionCode="CN_Guangdong_Shenzhen" />`,
+			contents: map[string]interface{}{"username": "wxid_zhangsan", "nickname": "张三", "alias": "zhangsan88", "official": nil, "corp": nil},
+			text:     "[名片|张三](wxid_zhangsan)",
+		},
+		{
+			name:     "official account card",
+			msgType:  42,
+			xml:      `<msg bigheadimgurl="" username="gh_0123456789ab" nickname="示例公众号" alias="" certflag="24" certinfo="示例公司" brandFlags="0" />`,
+			contents: map[string]interface{}{"username": "gh_0123456789ab", "official": true, "alias": nil},
+			text:     "[公众号名片|示例公众号](gh_0123456789ab)",
+		},
+		{
+			name:     "work card",
+			msgType:  42,
+			xml:      `<msg username="1688850000000000@openim" nickname="李四" certflag="0" openimdesc="示例科技" openimdescicon="" />`,
+			contents: map[string]interface{}{"username": "1688850000000000@openim", "corp": "示例科技"},
+			text:     "[名片|李四](1688850000000000@openim)",
+		},
+		{
+			name:     "location",
+			msgType:  48,
+			xml:      `<?xml version="1.0"?>` + "\n" + `<msg>` + "\n\t" + `<location x="22.543096" y="114.057865" scale="15" label="广东省深圳市福田区福中三路" maptype="roadmap" poiname="深圳市民中心" poiid="qqmap_1234567890" buildingId="" floorName="" poiCategoryTips="" poiBusinessHour="" poiPhone="" poiPriceTips="0.0" isFromPoiList="true" adcode="440304" cityname="深圳市" fromusername="wxid_zhangsan" />` + "\n" + `</msg>`,
+			contents: map[string]interface{}{"x": 22.543096, "y": 114.057865, "poiname": "深圳市民中心", "poiid": "qqmap_1234567890"},
+			text:     "[位置|深圳市民中心 广东省深圳市福田区福中三路](22.543096,114.057865)",
+		},
+		{
+			name:     "red packet",
+			msgType:  49,
+			xml:      `<msg><appmsg appid="" sdkver="0"><title><![CDATA[微信红包]]></title><des><![CDATA[我给你发了一个红包，赶紧去拆!]]></des><type>2001</type><url><![CDATA[https://wxapp.tenpay.com/mmpayhb/wxhb_personalreceive]]></url><wcpayinfo><templateid><![CDATA[7a2a165d31da7fce6dd77e05c300028a]]></templateid><receivertitle><![CDATA[恭喜发财，大吉大利]]></receivertitle><sendertitle><![CDATA[恭喜发财，大吉大利]]></sendertitle><scenetext><![CDATA[微信红包]]></scenetext><senderdes><![CDATA[查看红包]]></senderdes><receiverdes><![CDATA[领取红包]]></receiverdes><sceneid><![CDATA[1002]]></sceneid><innertype><![CDATA[0]]></innertype><invalidtime><![CDATA[1709686021]]></invalidtime></wcpayinfo></appmsg><fromusername><![CDATA[wxid_zhangsan]]></fromusername></msg>`,
+			contents: map[string]interface{}{"title": "恭喜发财，大吉大利"},
+			text:     "[红包|恭喜发财，大吉大利]",
+		},
+		{
+			name:    "solitaire",
+			msgType: 49,
+			xml: `<msg><appmsg appid="" sdkver="0"><title><![CDATA[#接龙
+周六聚餐
+人均 100
+
+1. 张三
+2. 李四 +1
+3.王五]]></title><des /><type>53</type><extinfo><solitaire_info><![CDATA[<solitaire_info><tt>1</tt></solitaire_info>]]></solitaire_info></extinfo></appmsg></msg>`,
+			contents: map[string]interface{}{"title": "#接龙 周六聚餐 人均 100"},
+			text:     "[接龙|#接龙 周六聚餐 人均 100]\n1. 张三\n2. 李四 +1\n3. 王五",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &Message{Type: tc.msgType}
+			if err := m.ParseMediaInfo(tc.xml); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tc.contents {
+				got, ok := m.Contents[key]
+				if want == nil {
+					if ok {
+						t.Errorf("contents[%s] = %v, want unset", key, got)
+					}
+					continue
+				}
+				if got != want {
+					t.Errorf("contents[%s] = %#v, want %#v", key, got, want)
+				}
+			}
+			if got := m.PlainTextContent(); got != tc.text {
+				t.Errorf("text = %q, want %q", got, tc.text)
+			}
+		})
+	}
+}
+
+func TestParseCallDuration(t *testing.T) {
+	tests := []struct {
+		text     string
+		duration int
+		ok       bool
+	}{
+		{"通话时长 00:31", 31, true},
+		{"通话时长 12:05", 725, true},
+		{"通话时长 01:02:03", 3723, true},
+		{"Duration: 03:20", 200, true},
+		{"已取消", 0, false},
+		{"对方无应答", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range tests {
+		if d, ok := parseCallDuration(tc.text); d != tc.duration || ok != tc.ok {
+			t.Errorf("parseCallDuration(%q) = %d, %v, want %d, %v", tc.text, d, ok, tc.duration, tc.ok)
+		}
+	}
+}
+
+func TestParseSolitaire(t *testing.T) {
+	tests := []struct {
+		text    string
+		title   string
+		entries []string
+	}{
+		{"#接龙\n周六聚餐\n\n1. 张三\n2. 李四", "#接龙 周六聚餐", []string{"张三", "李四"}},
+		// 编号后没有空格，条目之间的说明不计入标题
+		{"报名\r\n1.张三\r\n备注：自带水杯\r\n2.  李四\r\n", "报名", []string{"张三", "李四"}},
+		{"#接龙\n还没有人参加", "#接龙 还没有人参加", []string{}},
+		{"", "", []string{}},
+	}
+	for _, tc := range tests {
+		title, entries := parseSolitaire(tc.text)
+		if title != tc.title || len(entries) != len(tc.entries) {
+			t.Errorf("parseSolitaire(%q) = %q, %q, want %q, %q", tc.text, title, entries, tc.title, tc.entries)
+			continue
+		}
+		for i := range entries {
+			if entries[i] != tc.entries[i] {
+				t.Errorf("parseSolitaire(%q) entries = %q, want %q", tc.text, entries, tc.entries)
+				break
+			}
+		}
+	}
+}
@@ -64,6 +64,7 @@ func (m *MessageV3) Wrap() *Message {
 		SubType:    int64(m.SubType),
 		Content:    m.StrContent,
 		Version:    WeChatV3,
+		ServerID:   m.MsgSvrID,
 	}
 
 	if !_m.IsChatRoom && !_m.IsSelf {
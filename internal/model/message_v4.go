@@ -55,6 +55,7 @@ func (m *MessageV4) Wrap(talker string) *Message {
 		Type:       m.LocalType,
 		Contents:   make(map[string]interface{}),
 		Version:    WeChatV4,
+		ServerID:   m.ServerID,
 	}
 
 	// FIXME 后续通过 UserName 判断是否是自己发送的消息，目前可能不准确
@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+const (
+	RecallKindRecalled = "recalled"
+	RecallKindDeleted  = "deleted"
+)
+
+// Recall 对比前后两次解密的数据库发现的撤回或删除，保存在 Message.Contents["recalled"] 中
+type Recall struct {
+	// Kind recalled 为被撤回，deleted 为从微信的数据库中删除
+	Kind string `json:"kind"`
+
+	// DetectedAt 发现的时间
+	DetectedAt time.Time `json:"detectedAt"`
+
+	// Notice 撤回时的系统提示，如 "张三" 撤回了一条消息
+	Notice string `json:"notice,omitempty"`
+}
+
+// Label 文本输出中的标记
+func (r *Recall) Label() string {
+	if r.Kind == RecallKindDeleted {
+		return "[已删除]"
+	}
+	return "[已撤回]"
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"hash"
@@ -20,6 +21,9 @@ const (
 	AESBlockSize = 16
 	SQLiteHeader = "SQLite format 3\x00"
 	IVSize       = 16
+
+	// FingerprintSize 页面指纹长度
+	FingerprintSize = 16
 )
 
 type DBFile struct {
@@ -97,6 +101,27 @@ func ValidateKey(page1 []byte, key []byte, salt []byte, hashFunc func() hash.Has
 	return hmac.Equal(calculatedMAC, storedMAC)
 }
 
+// PageFingerprint 返回加密页面的指纹
+// 页面内容每次写入都会重新计算 HMAC，因此可以直接使用 HMAC 的前 16 字节判断页面是否发生变化
+func PageFingerprint(pageBuf []byte, reserve int, pageSize int) [FingerprintSize]byte {
+	var fp [FingerprintSize]byte
+	start := pageSize - reserve + IVSize
+	if start+FingerprintSize <= len(pageBuf) {
+		copy(fp[:], pageBuf[start:start+FingerprintSize])
+	}
+	return fp
+}
+
+// IsZeroPage 判断页面是否全为零
+func IsZeroPage(pageBuf []byte) bool {
+	for _, b := range pageBuf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func DecryptPage(pageBuf []byte, encKey []byte, macKey []byte, pageNum int64, hashFunc func() hash.Hash, hmacSize int, reserve int, pageSize int) ([]byte, error) {
 	offset := 0
 	if pageNum == 0 {
@@ -136,3 +161,42 @@ func DecryptPage(pageBuf []byte, encKey []byte, macKey []byte, pageNum int64, ha
 
 	return decryptedPage, nil
 }
+
+// EncryptPage 加密单个页面，是 DecryptPage 的逆过程
+// pageBuf 为完整的明文页面，第 0 页以 SQLite 头开头，加密后替换为盐值
+func EncryptPage(pageBuf []byte, encKey []byte, macKey []byte, salt []byte, pageNum int64, hashFunc func() hash.Hash, hmacSize int, reserve int, pageSize int) ([]byte, error) {
+	if len(pageBuf) < pageSize {
+		return nil, errors.IncompleteRead(fmt.Errorf("page size %d, expected %d", len(pageBuf), pageSize))
+	}
+
+	offset := 0
+	encrypted := make([]byte, pageSize)
+	if pageNum == 0 {
+		offset = SaltSize
+		copy(encrypted, salt)
+	}
+
+	// 保留区域：IV + HMAC，剩余部分填充随机数据
+	if _, err := rand.Read(encrypted[pageSize-reserve : pageSize]); err != nil {
+		return nil, err
+	}
+	iv := encrypted[pageSize-reserve : pageSize-reserve+IVSize]
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, errors.DecryptCreateCipherFailed(err)
+	}
+	mode := cipher.NewCBCEncrypter(block, iv)
+	mode.CryptBlocks(encrypted[offset:pageSize-reserve], pageBuf[offset:pageSize-reserve])
+
+	mac := hmac.New(hashFunc, macKey)
+	mac.Write(encrypted[offset : pageSize-reserve+IVSize])
+
+	pageNoBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pageNoBytes, uint32(pageNum+1))
+	mac.Write(pageNoBytes)
+
+	copy(encrypted[pageSize-reserve+IVSize:pageSize-reserve+IVSize+hmacSize], mac.Sum(nil))
+
+	return encrypted, nil
+}
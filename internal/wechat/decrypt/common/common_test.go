@@ -0,0 +1,61 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"testing"
+)
+
+func TestEncryptPageRoundTrip(t *testing.T) {
+	const pageSize, reserve = 4096, 80
+	encKey := bytes.Repeat([]byte{1}, KeySize)
+	macKey := bytes.Repeat([]byte{2}, KeySize)
+	salt := bytes.Repeat([]byte{3}, SaltSize)
+
+	for _, pageNum := range []int64{0, 1, 7} {
+		plain := make([]byte, pageSize)
+		rand.Read(plain)
+		offset := 0
+		if pageNum == 0 {
+			copy(plain, SQLiteHeader)
+			offset = SaltSize
+		}
+
+		enc, err := EncryptPage(plain, encKey, macKey, salt, pageNum, sha512.New, sha512.Size, reserve, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(enc) != pageSize {
+			t.Fatalf("page %d: encrypted size %d", pageNum, len(enc))
+		}
+		if pageNum == 0 && !bytes.Equal(enc[:SaltSize], salt) {
+			t.Errorf("page 0 does not start with salt")
+		}
+
+		dec, err := DecryptPage(enc, encKey, macKey, pageNum, sha512.New, sha512.Size, reserve, pageSize)
+		if err != nil {
+			t.Fatalf("page %d: %v", pageNum, err)
+		}
+		// 第 0 页解密结果不带 SQLite 头，保留区域是加密时生成的 IV 和 HMAC
+		if !bytes.Equal(dec[:pageSize-reserve-offset], plain[offset:pageSize-reserve]) {
+			t.Errorf("page %d: content mismatch", pageNum)
+		}
+
+		// 页号参与 HMAC，错位的页面和被修改的页面都无法通过校验
+		if _, err := DecryptPage(enc, encKey, macKey, pageNum+1, sha512.New, sha512.Size, reserve, pageSize); err == nil {
+			t.Errorf("page %d: decrypted with wrong page number", pageNum)
+		}
+		enc[offset] ^= 0xff
+		if _, err := DecryptPage(enc, encKey, macKey, pageNum, sha512.New, sha512.Size, reserve, pageSize); err == nil {
+			t.Errorf("page %d: tampered page passed verification", pageNum)
+		}
+	}
+}
+
+func TestEncryptPageShortBuffer(t *testing.T) {
+	key := make([]byte, KeySize)
+	if _, err := EncryptPage(make([]byte, 100), key, key, make([]byte, SaltSize), 1, sha512.New, sha512.Size, 80, 4096); err == nil {
+		t.Error("expected error for short page")
+	}
+}
@@ -0,0 +1,184 @@
+package common
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// PagesPerTask 每个解密任务处理的页面数
+const PagesPerTask = 64
+
+// ProgressFunc 解密进度回调，done 为已处理的页面数，total 为页面总数
+type ProgressFunc func(done, total int64)
+
+// PageDecryptFunc 解密单个页面，pageNum 从 0 开始
+type PageDecryptFunc func(pageBuf []byte, pageNum int64) ([]byte, error)
+
+// PageWriteFunc 写入解密后的页面
+type PageWriteFunc func(pageNum int64, data []byte) error
+
+// DefaultJobs 默认并发数
+func DefaultJobs() int {
+	return runtime.NumCPU()
+}
+
+// pageTask 一组连续页面的解密结果
+type pageTask struct {
+	index int
+	pages []int64
+	data  [][]byte
+	eof   bool
+	err   error
+}
+
+// DecryptPages 使用 jobs 个协程并发解密页面，并按 pages 的顺序调用 write
+// pages 为 nil 时处理全部页面；第 0 页的结果不足一页时补上 SQLite 头，全零页面原样写入，
+// 遇到末尾不完整的页面时停止
+func DecryptPages(ctx context.Context, reader *PageReader, pages []int64, jobs int, decryptPage PageDecryptFunc, write PageWriteFunc, progress ProgressFunc) error {
+	if jobs <= 0 {
+		jobs = DefaultJobs()
+	}
+
+	total := reader.TotalPages
+	if pages != nil {
+		total = int64(len(pages))
+	}
+	pageAt := func(i int64) int64 {
+		if pages != nil {
+			return pages[i]
+		}
+		return i
+	}
+	tasks := int((total + PagesPerTask - 1) / PagesPerTask)
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 限制同时在处理中的任务数，避免写入跟不上时占用过多内存
+	inflight := make(chan struct{}, jobs*2)
+	taskCh := make(chan int)
+	resultCh := make(chan *pageTask, jobs)
+
+	go func() {
+		defer close(taskCh)
+		for i := 0; i < tasks; i++ {
+			select {
+			case inflight <- struct{}{}:
+			case <-workCtx.Done():
+				return
+			}
+			select {
+			case taskCh <- i:
+			case <-workCtx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pageBuf := make([]byte, reader.PageSize())
+			for index := range taskCh {
+				task := &pageTask{index: index}
+				start := int64(index) * PagesPerTask
+				end := min(start+PagesPerTask, total)
+				for i := start; i < end; i++ {
+					pageNum := pageAt(i)
+					data, err := decryptOnePage(reader, pageNum, pageBuf, decryptPage)
+					if err == io.ErrUnexpectedEOF {
+						task.eof = true
+						break
+					}
+					if err != nil {
+						task.err = err
+						break
+					}
+					task.pages = append(task.pages, pageNum)
+					task.data = append(task.data, data)
+				}
+				select {
+				case resultCh <- task:
+				case <-workCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	// 按顺序写入
+	pending := make(map[int]*pageTask)
+	next := 0
+	var processed int64
+	for task := range resultCh {
+		pending[task.index] = task
+		for {
+			task, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-inflight
+
+			for i, data := range task.data {
+				if err := write(task.pages[i], data); err != nil {
+					return err
+				}
+			}
+			processed += int64(len(task.data))
+			if progress != nil {
+				progress(processed, total)
+			}
+
+			if task.err != nil {
+				return task.err
+			}
+			if task.eof {
+				return nil
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return errors.ErrDecryptOperationCanceled
+	}
+
+	return nil
+}
+
+// decryptOnePage 读取并解密单个页面
+func decryptOnePage(reader *PageReader, pageNum int64, pageBuf []byte, decryptPage PageDecryptFunc) ([]byte, error) {
+	if err := reader.ReadPage(pageNum, pageBuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, errors.ReadFileFailed(reader.Path, err)
+	}
+
+	if IsZeroPage(pageBuf) {
+		data := make([]byte, len(pageBuf))
+		copy(data, pageBuf)
+		return data, nil
+	}
+
+	data, err := decryptPage(pageBuf, pageNum)
+	if err != nil {
+		return nil, err
+	}
+	// 第 0 页解密后不含盐值，补上 SQLite 头；重新加密的页面已是完整页面
+	if pageNum == 0 && len(data) < len(pageBuf) {
+		data = append([]byte(SQLiteHeader), data...)
+	}
+	return data, nil
+}
@@ -0,0 +1,221 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// SQLite WAL 文件格式
+// https://www.sqlite.org/fileformat2.html#walformat
+//
+// WAL 头（32 字节，明文）：magic、版本、页面大小、检查点序号、salt-1、salt-2、checksum-1、checksum-2
+// 帧头（24 字节，明文）：页号、提交后数据库页数（非提交帧为 0）、salt-1、salt-2、checksum-1、checksum-2
+// 帧数据：与数据库文件相同方式加密的页面，HMAC 使用帧头中的页号
+const (
+	WALHeaderSize      = 32
+	WALFrameHeaderSize = 24
+	WALMagicLE         = 0x377f0682
+	WALMagicBE         = 0x377f0683
+	WALSuffix          = "-wal"
+)
+
+// WAL 表示 WAL 文件中已提交的页面
+type WAL struct {
+	// Pages 页号（从 1 开始）到最新一次提交的加密页面
+	Pages map[uint32][]byte
+
+	// DBSize 最后一次提交后的数据库页数
+	DBSize uint32
+
+	// Frames 有效帧数
+	Frames int
+}
+
+// ReadWAL 读取 WAL 文件中已提交的帧
+// WAL 文件不存在或为空时返回 nil, nil
+func ReadWAL(walPath string, pageSize int) (*WAL, error) {
+	fp, err := os.Open(walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.OpenFileFailed(walPath, err)
+	}
+	defer fp.Close()
+
+	header := make([]byte, WALHeaderSize)
+	if _, err := io.ReadFull(fp, header); err != nil {
+		// 空 WAL 文件或头部不完整，视为没有可用帧
+		return nil, nil
+	}
+
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != WALMagicLE && magic != WALMagicBE {
+		return nil, errors.ReadFileFailed(walPath, fmt.Errorf("invalid wal magic: %x", magic))
+	}
+	bigEndian := magic == WALMagicBE
+
+	if walPageSize := int(binary.BigEndian.Uint32(header[8:12])); walPageSize != pageSize {
+		return nil, errors.ReadFileFailed(walPath, fmt.Errorf("wal page size %d, expected %d", walPageSize, pageSize))
+	}
+
+	salt1 := binary.BigEndian.Uint32(header[16:20])
+	salt2 := binary.BigEndian.Uint32(header[20:24])
+
+	s1, s2 := walChecksum(bigEndian, header[:24], 0, 0)
+	if s1 != binary.BigEndian.Uint32(header[24:28]) || s2 != binary.BigEndian.Uint32(header[28:32]) {
+		// WAL 头校验失败，说明文件已被重置或尚未写入完成
+		return nil, nil
+	}
+
+	wal := &WAL{
+		Pages: make(map[uint32][]byte),
+	}
+
+	// 未提交的帧先暂存，遇到提交帧后再生效
+	pending := make(map[uint32][]byte)
+	pendingFrames := 0
+
+	frameHeader := make([]byte, WALFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(fp, frameHeader); err != nil {
+			break
+		}
+		page := make([]byte, pageSize)
+		if _, err := io.ReadFull(fp, page); err != nil {
+			break
+		}
+
+		if binary.BigEndian.Uint32(frameHeader[8:12]) != salt1 || binary.BigEndian.Uint32(frameHeader[12:16]) != salt2 {
+			break
+		}
+
+		s1, s2 = walChecksum(bigEndian, frameHeader[:8], s1, s2)
+		s1, s2 = walChecksum(bigEndian, page, s1, s2)
+		if s1 != binary.BigEndian.Uint32(frameHeader[16:20]) || s2 != binary.BigEndian.Uint32(frameHeader[20:24]) {
+			break
+		}
+
+		pageNo := binary.BigEndian.Uint32(frameHeader[0:4])
+		pending[pageNo] = page
+		pendingFrames++
+
+		if commit := binary.BigEndian.Uint32(frameHeader[4:8]); commit != 0 {
+			for no, data := range pending {
+				wal.Pages[no] = data
+			}
+			wal.DBSize = commit
+			wal.Frames += pendingFrames
+			pending = make(map[uint32][]byte)
+			pendingFrames = 0
+		}
+	}
+
+	if wal.Frames == 0 {
+		return nil, nil
+	}
+
+	// 提交后数据库缩小时，超出部分的页面不再有效
+	for no := range wal.Pages {
+		if no > wal.DBSize {
+			delete(wal.Pages, no)
+		}
+	}
+
+	return wal, nil
+}
+
+// walChecksum 计算 WAL 累积校验和
+func walChecksum(bigEndian bool, data []byte, s1, s2 uint32) (uint32, uint32) {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(data); i += 8 {
+		s1 += order.Uint32(data[i:]) + s2
+		s2 += order.Uint32(data[i+4:]) + s1
+	}
+	return s1, s2
+}
+
+// PageReader 按页读取加密数据库，已提交到 WAL 中的页面优先于数据库文件
+type PageReader struct {
+	// Path 数据库文件路径
+	Path string
+
+	file     *os.File
+	wal      *WAL
+	pageSize int
+
+	// TotalPages 合并 WAL 后的页面总数
+	TotalPages int64
+}
+
+// NewPageReader 打开数据库文件及其 WAL 文件
+func NewPageReader(dbInfo *DBFile, pageSize int) (*PageReader, error) {
+	wal, err := ReadWAL(dbInfo.Path+WALSuffix, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(dbInfo.Path)
+	if err != nil {
+		return nil, errors.OpenFileFailed(dbInfo.Path, err)
+	}
+
+	totalPages := dbInfo.TotalPages
+	if wal != nil {
+		totalPages = int64(wal.DBSize)
+	}
+
+	return &PageReader{
+		Path:       dbInfo.Path,
+		file:       file,
+		wal:        wal,
+		pageSize:   pageSize,
+		TotalPages: totalPages,
+	}, nil
+}
+
+// PageSize 返回页面大小
+func (r *PageReader) PageSize() int {
+	return r.pageSize
+}
+
+// WAL 返回已提交的 WAL 帧，没有 WAL 时返回 nil
+func (r *PageReader) WAL() *WAL {
+	return r.wal
+}
+
+// ReadPage 读取指定页面，pageNum 从 0 开始
+// 末尾不完整的页面返回 io.ErrUnexpectedEOF；WAL 扩展出但尚未写入数据库文件的页面以零填充
+func (r *PageReader) ReadPage(pageNum int64, pageBuf []byte) error {
+	if r.wal != nil {
+		if page, ok := r.wal.Pages[uint32(pageNum+1)]; ok {
+			copy(pageBuf, page)
+			return nil
+		}
+	}
+
+	n, err := r.file.ReadAt(pageBuf[:r.pageSize], pageNum*int64(r.pageSize))
+	if n == r.pageSize {
+		return nil
+	}
+	if n == 0 && err == io.EOF {
+		clear(pageBuf[:r.pageSize])
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Close 关闭数据库文件
+func (r *PageReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const walTestPageSize = 512
+
+// walFrame 测试用的 WAL 帧，commit 不为 0 时为提交帧
+type walFrame struct {
+	pgno   uint32
+	commit uint32
+	fill   byte
+}
+
+// buildWAL 按 SQLite 的格式生成小端校验和的 WAL 文件内容
+func buildWAL(salt1, salt2 uint32, frames []walFrame) []byte {
+	header := make([]byte, WALHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], WALMagicLE)
+	binary.BigEndian.PutUint32(header[4:], 3007000)
+	binary.BigEndian.PutUint32(header[8:], walTestPageSize)
+	binary.BigEndian.PutUint32(header[16:], salt1)
+	binary.BigEndian.PutUint32(header[20:], salt2)
+	s1, s2 := walChecksum(false, header[:24], 0, 0)
+	binary.BigEndian.PutUint32(header[24:], s1)
+	binary.BigEndian.PutUint32(header[28:], s2)
+
+	buf := bytes.NewBuffer(header)
+	for _, f := range frames {
+		frameHeader := make([]byte, WALFrameHeaderSize)
+		binary.BigEndian.PutUint32(frameHeader[0:], f.pgno)
+		binary.BigEndian.PutUint32(frameHeader[4:], f.commit)
+		binary.BigEndian.PutUint32(frameHeader[8:], salt1)
+		binary.BigEndian.PutUint32(frameHeader[12:], salt2)
+		page := bytes.Repeat([]byte{f.fill}, walTestPageSize)
+		s1, s2 = walChecksum(false, frameHeader[:8], s1, s2)
+		s1, s2 = walChecksum(false, page, s1, s2)
+		binary.BigEndian.PutUint32(frameHeader[16:], s1)
+		binary.BigEndian.PutUint32(frameHeader[20:], s2)
+		buf.Write(frameHeader)
+		buf.Write(page)
+	}
+	return buf.Bytes()
+}
+
+func writeWAL(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db"+WALSuffix)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadWAL(t *testing.T) {
+	data := buildWAL(1, 2, []walFrame{
+		{pgno: 1, fill: 0x11},
+		{pgno: 3, commit: 3, fill: 0x13},
+		// 后一次提交覆盖第 1 页
+		{pgno: 1, commit: 3, fill: 0x21},
+		// 未提交的帧不生效
+		{pgno: 2, fill: 0x32},
+	})
+	wal, err := ReadWAL(writeWAL(t, data), walTestPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal == nil || wal.Frames != 3 || wal.DBSize != 3 {
+		t.Fatalf("wal = %+v", wal)
+	}
+	if len(wal.Pages) != 2 || wal.Pages[1][0] != 0x21 || wal.Pages[3][0] != 0x13 {
+		t.Errorf("pages = %v", pageFills(wal))
+	}
+	if _, ok := wal.Pages[2]; ok {
+		t.Error("uncommitted frame applied")
+	}
+}
+
+func TestReadWALShrink(t *testing.T) {
+	data := buildWAL(1, 2, []walFrame{
+		{pgno: 4, commit: 4, fill: 0x14},
+		{pgno: 1, commit: 2, fill: 0x11},
+	})
+	wal, err := ReadWAL(writeWAL(t, data), walTestPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wal.DBSize != 2 || len(wal.Pages) != 1 || wal.Pages[1] == nil {
+		t.Errorf("wal after shrink: size %d, pages %v", wal.DBSize, pageFills(wal))
+	}
+}
+
+func TestReadWALInvalid(t *testing.T) {
+	frames := []walFrame{{pgno: 1, commit: 1, fill: 0x11}, {pgno: 2, commit: 2, fill: 0x12}}
+
+	if wal, err := ReadWAL(filepath.Join(t.TempDir(), "missing"+WALSuffix), walTestPageSize); wal != nil || err != nil {
+		t.Errorf("missing wal = %v, %v", wal, err)
+	}
+	if wal, err := ReadWAL(writeWAL(t, nil), walTestPageSize); wal != nil || err != nil {
+		t.Errorf("empty wal = %v, %v", wal, err)
+	}
+	if _, err := ReadWAL(writeWAL(t, buildWAL(1, 2, frames)), walTestPageSize*2); err == nil {
+		t.Error("page size mismatch not reported")
+	}
+
+	bad := buildWAL(1, 2, frames)
+	bad[0] = 0
+	if _, err := ReadWAL(writeWAL(t, bad), walTestPageSize); err == nil {
+		t.Error("bad magic not reported")
+	}
+
+	// 头部校验和错误说明 WAL 已被重置，视为没有帧
+	reset := buildWAL(1, 2, frames)
+	reset[24] ^= 0xff
+	if wal, err := ReadWAL(writeWAL(t, reset), walTestPageSize); wal != nil || err != nil {
+		t.Errorf("reset wal = %v, %v", wal, err)
+	}
+
+	// 第二帧损坏时只保留之前提交的内容
+	frameSize := WALFrameHeaderSize + walTestPageSize
+	corrupt := buildWAL(1, 2, frames)
+	corrupt[WALHeaderSize+frameSize+WALFrameHeaderSize] ^= 0xff
+	wal, err := ReadWAL(writeWAL(t, corrupt), walTestPageSize)
+	if err != nil || wal == nil || wal.Frames != 1 || wal.DBSize != 1 {
+		t.Errorf("corrupt frame: wal %+v, %v", wal, err)
+	}
+
+	// 盐值与头部不一致的帧是上一轮留下的旧帧
+	stale := append(buildWAL(1, 2, frames[:1]), buildWAL(3, 4, frames[1:])[WALHeaderSize:]...)
+	wal, err = ReadWAL(writeWAL(t, stale), walTestPageSize)
+	if err != nil || wal == nil || wal.Frames != 1 {
+		t.Errorf("stale frame: wal %+v, %v", wal, err)
+	}
+
+	// 截断在帧中间时忽略不完整的帧
+	wal, err = ReadWAL(writeWAL(t, buildWAL(1, 2, frames)[:WALHeaderSize+frameSize+100]), walTestPageSize)
+	if err != nil || wal == nil || wal.Frames != 1 {
+		t.Errorf("truncated frame: wal %+v, %v", wal, err)
+	}
+}
+
+func TestPageReaderWAL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "test.db")
+	db := append(bytes.Repeat([]byte{0x01}, walTestPageSize), bytes.Repeat([]byte{0x02}, walTestPageSize)...)
+	if err := os.WriteFile(dbPath, db, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// WAL 覆盖第 2 页，并把数据库扩展到 3 页，第 3 页尚未写入数据库文件
+	wal := buildWAL(1, 2, []walFrame{{pgno: 2, commit: 3, fill: 0x22}})
+	if err := os.WriteFile(dbPath+WALSuffix, wal, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewPageReader(&DBFile{Path: dbPath, TotalPages: 2}, walTestPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.TotalPages != 3 {
+		t.Fatalf("total pages = %d", reader.TotalPages)
+	}
+
+	page := make([]byte, walTestPageSize)
+	for pageNum, want := range []byte{0x01, 0x22, 0x00} {
+		if err := reader.ReadPage(int64(pageNum), page); err != nil {
+			t.Fatalf("page %d: %v", pageNum, err)
+		}
+		if page[0] != want || page[walTestPageSize-1] != want {
+			t.Errorf("page %d = %#x, want %#x", pageNum, page[0], want)
+		}
+	}
+}
+
+func pageFills(wal *WAL) map[uint32]byte {
+	fills := make(map[uint32]byte, len(wal.Pages))
+	for no, page := range wal.Pages {
+		fills[no] = page[0]
+	}
+	return fills
+}
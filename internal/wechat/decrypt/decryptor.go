@@ -5,18 +5,25 @@ import (
 	"io"
 
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt/darwin"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt/windows"
 )
 
 // Decryptor 定义数据库解密的接口
 type Decryptor interface {
-	// Decrypt 解密数据库
-	Decrypt(ctx context.Context, dbfile string, key string, output io.Writer) error
+	// Decrypt 解密数据库，jobs 小于等于 0 时使用 CPU 核数，progress 可以为 nil
+	Decrypt(ctx context.Context, dbfile string, key string, output io.Writer, jobs int, progress common.ProgressFunc) error
 
 	// Validate 验证密钥是否有效
 	Validate(page1 []byte, key []byte) bool
 
+	// DeriveKeys 根据密钥和盐值派生加密密钥和MAC密钥
+	DeriveKeys(key []byte, salt []byte) ([]byte, []byte)
+
+	// DecryptPage 解密单个页面，pageNum 从 0 开始
+	DecryptPage(pageBuf []byte, encKey []byte, macKey []byte, pageNum int64) ([]byte, error)
+
 	// GetPageSize 返回页面大小
 	GetPageSize() int
 
@@ -0,0 +1,471 @@
+package decrypt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+const (
+	// PageStateSuffix 页面状态文件后缀，与解密输出文件放在一起
+	PageStateSuffix = ".pages"
+
+	// SpareSuffix 上一版输出文件的后缀，不再被快照引用后作为下一次解密的基础，只需改写变化的页面
+	SpareSuffix = ".spare"
+
+	pageStateMagic = "CLPG"
+)
+
+// IncrementalDecryptor 增量解密器
+// 记录每个页面的指纹，再次解密时只处理发生变化的页面和新增页面，
+// 并合并 WAL 文件中已提交的帧
+type IncrementalDecryptor struct {
+	decryptor Decryptor
+
+	// workKey 不为空时，输出文件使用该口令重新加密
+	workKey string
+	codecs  *sqlcipher.Cache
+
+	mutex sync.Mutex
+	keys  map[string][2][]byte
+}
+
+// NewIncrementalDecryptor 创建增量解密器
+func NewIncrementalDecryptor(decryptor Decryptor) *IncrementalDecryptor {
+	return &IncrementalDecryptor{
+		decryptor: decryptor,
+		codecs:    sqlcipher.NewCache(),
+		keys:      make(map[string][2][]byte),
+	}
+}
+
+// SetWorkKey 设置工作目录加密口令，为空表示输出明文数据库
+func (d *IncrementalDecryptor) SetWorkKey(workKey string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.workKey = workKey
+}
+
+// Decryptor 返回底层解密器
+func (d *IncrementalDecryptor) Decryptor() Decryptor {
+	return d.decryptor
+}
+
+// outputLocks 按输出路径加的锁，自动解密和全量解密可能同时处理同一个数据库文件，
+// 共用的 output.tmp、output.spare 和页面状态文件必须由一次解密独占
+var (
+	outputLocksMu sync.Mutex
+	outputLocks   = make(map[string]*outputLock)
+)
+
+type outputLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// LockOutput 锁定输出文件，同一输出文件的写入串行执行，返回解锁函数
+// 不同的解密器实例共用同一组锁，平台或版本变化重建解密器时仍然互斥
+func LockOutput(output string) func() {
+	key := filepath.Clean(output)
+	outputLocksMu.Lock()
+	l := outputLocks[key]
+	if l == nil {
+		l = &outputLock{}
+		outputLocks[key] = l
+	}
+	l.refs++
+	outputLocksMu.Unlock()
+
+	l.mu.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Unlock()
+			outputLocksMu.Lock()
+			l.refs--
+			if l.refs == 0 {
+				delete(outputLocks, key)
+			}
+			outputLocksMu.Unlock()
+		})
+	}
+}
+
+// pageState 上一次解密时各页面的指纹
+type pageState struct {
+	pageSize     int
+	salt         []byte
+	fingerprints [][common.FingerprintSize]byte
+}
+
+// Decrypt 使用 jobs 个协程增量解密数据库到 output，返回实际解密的页面数，progress 可以为 nil
+// 解密结果先写入 output.tmp，完成后再重命名为 output，
+// 已打开 output 的连接不会读到不一致的页面，同时会触发文件创建事件通知数据库重新连接。
+// 被替换的 output 保留为 output.spare，下一次解密时如果没有其他硬链接引用它，
+// 直接在其上改写两次解密之间变化的页面，不再复制整个文件。
+// 同一 output 的解密通过 LockOutput 串行执行
+func (d *IncrementalDecryptor) Decrypt(ctx context.Context, dbfile string, hexKey string, output string, jobs int, progress common.ProgressFunc) (int, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return 0, errors.DecodeKeyFailed(err)
+	}
+
+	unlock := LockOutput(output)
+	defer unlock()
+
+	pageSize := d.decryptor.GetPageSize()
+
+	dbInfo, err := common.OpenDBFile(dbfile, pageSize)
+	if err != nil {
+		return 0, err
+	}
+
+	encKey, macKey, err := d.getKeys(key, dbInfo)
+	if err != nil {
+		return 0, err
+	}
+
+	reader, err := common.NewPageReader(dbInfo, pageSize)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	// 计算当前各页面指纹
+	fingerprints, err := d.fingerprints(ctx, dbfile, reader.WAL())
+	if err != nil {
+		return 0, err
+	}
+
+	// 找出需要重新解密的页面
+	prev := loadPageState(output, pageSize, dbInfo.Salt)
+
+	// 输出文件的加密方式与当前设置不一致时，需要完整重建
+	codec, reuse, err := d.outputCodec(output)
+	if err != nil {
+		return 0, err
+	}
+	if !reuse {
+		prev = nil
+	}
+	if prev != nil && len(changedPages(prev, fingerprints)) == 0 && len(prev.fingerprints) == len(fingerprints) {
+		return 0, nil
+	}
+
+	// 临时文件的初始内容优先使用上一版输出，否则复制当前输出
+	outputTemp := output + ".tmp"
+	spare := output + SpareSuffix
+	base := prev
+	if prev != nil {
+		if state := loadSpare(spare, pageSize, dbInfo.Salt, codec); state != nil && os.Rename(spare, outputTemp) == nil {
+			base = state
+		} else if err := util.CopyFile(output, outputTemp); err != nil {
+			return 0, errors.WriteOutputFailed(err)
+		}
+	}
+	os.Remove(spare)
+	os.Remove(spare + PageStateSuffix)
+	changed := changedPages(base, fingerprints)
+
+	outputFile, err := os.OpenFile(outputTemp, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, errors.OpenFileFailed(outputTemp, err)
+	}
+
+	err = common.DecryptPages(ctx, reader, changed, jobs, func(pageBuf []byte, pageNum int64) ([]byte, error) {
+		data, err := d.decryptor.DecryptPage(pageBuf, encKey, macKey, pageNum)
+		if err != nil || codec == nil {
+			return data, err
+		}
+		if pageNum == 0 {
+			data = append([]byte(common.SQLiteHeader), data...)
+		}
+		return codec.EncryptPage(data, pageNum)
+	}, func(pageNum int64, data []byte) error {
+		if _, err := outputFile.WriteAt(data, pageNum*int64(pageSize)); err != nil {
+			return errors.WriteOutputFailed(err)
+		}
+		return nil
+	}, progress)
+	if err != nil {
+		outputFile.Close()
+		os.Remove(outputTemp)
+		return 0, err
+	}
+
+	if err := outputFile.Truncate(int64(len(fingerprints)) * int64(pageSize)); err != nil {
+		outputFile.Close()
+		os.Remove(outputTemp)
+		return 0, errors.WriteOutputFailed(err)
+	}
+	if err := outputFile.Close(); err != nil {
+		os.Remove(outputTemp)
+		return 0, errors.WriteOutputFailed(err)
+	}
+
+	// 被替换的输出连同其状态保留为下一次的基础，其余情况删除旧状态，
+	// 避免重命名成功但状态未更新时误判页面未变化
+	keepSpare := prev != nil && os.Link(output, spare) == nil
+	if keepSpare && os.Rename(output+PageStateSuffix, spare+PageStateSuffix) != nil {
+		os.Remove(spare)
+		keepSpare = false
+	}
+	if !keepSpare {
+		os.Remove(output + PageStateSuffix)
+	}
+	if err := os.Rename(outputTemp, output); err != nil {
+		return 0, errors.WriteOutputFailed(err)
+	}
+
+	state := &pageState{
+		pageSize:     pageSize,
+		salt:         dbInfo.Salt,
+		fingerprints: fingerprints,
+	}
+	if err := state.save(output); err != nil {
+		return len(changed), errors.WriteOutputFailed(err)
+	}
+
+	return len(changed), nil
+}
+
+// changedPages 返回与 base 相比内容变化的页面和新增的页面，base 为 nil 时返回全部页面
+func changedPages(base *pageState, fingerprints [][common.FingerprintSize]byte) []int64 {
+	changed := make([]int64, 0)
+	for i, fp := range fingerprints {
+		if base != nil && i < len(base.fingerprints) && base.fingerprints[i] == fp {
+			continue
+		}
+		changed = append(changed, int64(i))
+	}
+	return changed
+}
+
+// loadSpare 读取上一版输出的页面状态，仍被其他硬链接引用（如数据库快照）
+// 或加密方式与当前输出不一致时返回 nil
+func loadSpare(spare string, pageSize int, salt []byte, codec *sqlcipher.Codec) *pageState {
+	if links, err := util.LinkCount(spare); err != nil || links != 1 {
+		return nil
+	}
+
+	fp, err := os.Open(spare)
+	if err != nil {
+		return nil
+	}
+	page := make([]byte, pageSize)
+	_, err = io.ReadFull(fp, page)
+	fp.Close()
+	if err != nil {
+		return nil
+	}
+	if codec == nil && !bytes.HasPrefix(page, []byte(common.SQLiteHeader)) ||
+		codec != nil && !codec.Verify(page) {
+		return nil
+	}
+
+	return loadPageState(spare, pageSize, salt)
+}
+
+// outputCodec 返回输出文件使用的编解码器，未设置口令时返回 nil
+// reuse 表示已有的输出文件与当前设置一致，可以增量更新
+func (d *IncrementalDecryptor) outputCodec(output string) (*sqlcipher.Codec, bool, error) {
+	d.mutex.Lock()
+	workKey := d.workKey
+	d.mutex.Unlock()
+
+	page := make([]byte, d.decryptor.GetPageSize())
+	existing := false
+	if fp, err := os.Open(output); err == nil {
+		_, err = io.ReadFull(fp, page)
+		fp.Close()
+		existing = err == nil
+	}
+	plain := existing && bytes.HasPrefix(page, []byte(common.SQLiteHeader))
+
+	if len(workKey) == 0 {
+		return nil, plain, nil
+	}
+
+	if existing && !plain {
+		salt := page[:common.SaltSize]
+		codec := d.codecs.Get(workKey, salt)
+		if codec == nil {
+			profile, err := sqlcipher.ProfileFor(d.decryptor.GetPageSize(), d.decryptor.GetReserve())
+			if err != nil {
+				return nil, false, err
+			}
+			if codec, err = sqlcipher.NewCodec(profile, workKey, salt); err != nil {
+				return nil, false, err
+			}
+		}
+		if codec.Verify(page) {
+			d.codecs.Put(codec)
+			return codec, true, nil
+		}
+	}
+
+	// 新建输出文件或口令已变化，使用新的盐值
+	profile, err := sqlcipher.ProfileFor(d.decryptor.GetPageSize(), d.decryptor.GetReserve())
+	if err != nil {
+		return nil, false, err
+	}
+	codec, err := sqlcipher.NewCodec(profile, workKey, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	d.codecs.Put(codec)
+	return codec, false, nil
+}
+
+// getKeys 获取派生密钥，同一数据库的密钥会被缓存，避免重复执行 PBKDF2
+func (d *IncrementalDecryptor) getKeys(key []byte, dbInfo *common.DBFile) ([]byte, []byte, error) {
+	cacheKey := hex.EncodeToString(key) + hex.EncodeToString(dbInfo.Salt)
+
+	d.mutex.Lock()
+	keys, ok := d.keys[cacheKey]
+	d.mutex.Unlock()
+	if ok {
+		return keys[0], keys[1], nil
+	}
+
+	encKey, macKey := d.decryptor.DeriveKeys(key, dbInfo.Salt)
+	if _, err := d.decryptor.DecryptPage(dbInfo.FirstPage, encKey, macKey, 0); err != nil {
+		return nil, nil, errors.ErrDecryptIncorrectKey
+	}
+
+	d.mutex.Lock()
+	d.keys[cacheKey] = [2][]byte{encKey, macKey}
+	d.mutex.Unlock()
+
+	return encKey, macKey, nil
+}
+
+// fingerprints 计算合并 WAL 后各页面的指纹
+func (d *IncrementalDecryptor) fingerprints(ctx context.Context, dbfile string, wal *common.WAL) ([][common.FingerprintSize]byte, error) {
+	pageSize := d.decryptor.GetPageSize()
+	reserve := d.decryptor.GetReserve()
+
+	fp, err := os.Open(dbfile)
+	if err != nil {
+		return nil, errors.OpenFileFailed(dbfile, err)
+	}
+	defer fp.Close()
+
+	result := make([][common.FingerprintSize]byte, 0)
+	reader := bufio.NewReaderSize(fp, pageSize*64)
+	pageBuf := make([]byte, pageSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.ErrDecryptOperationCanceled
+		default:
+		}
+
+		if _, err := io.ReadFull(reader, pageBuf); err != nil {
+			// 忽略末尾不完整的页面，与完整解密保持一致
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, errors.ReadFileFailed(dbfile, err)
+		}
+		result = append(result, common.PageFingerprint(pageBuf, reserve, pageSize))
+	}
+
+	if wal == nil {
+		return result, nil
+	}
+
+	// WAL 中记录了提交后的数据库页数，据此扩展或截断
+	total := int(wal.DBSize)
+	for len(result) < total {
+		result = append(result, [common.FingerprintSize]byte{})
+	}
+	result = result[:total]
+	for pgno, page := range wal.Pages {
+		result[pgno-1] = common.PageFingerprint(page, reserve, pageSize)
+	}
+
+	return result, nil
+}
+
+// loadPageState 读取页面状态，状态无效或与当前数据库不匹配时返回 nil
+func loadPageState(output string, pageSize int, salt []byte) *pageState {
+	stat, err := os.Stat(output)
+	if err != nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(output + PageStateSuffix)
+	if err != nil {
+		return nil
+	}
+
+	headerSize := len(pageStateMagic) + 4 + common.SaltSize + 4
+	if len(data) < headerSize || string(data[:len(pageStateMagic)]) != pageStateMagic {
+		return nil
+	}
+	offset := len(pageStateMagic)
+
+	if int(binary.LittleEndian.Uint32(data[offset:])) != pageSize {
+		return nil
+	}
+	offset += 4
+
+	if !bytes.Equal(data[offset:offset+common.SaltSize], salt) {
+		return nil
+	}
+	offset += common.SaltSize
+
+	count := int(binary.LittleEndian.Uint32(data[offset:]))
+	offset += 4
+	if len(data) != offset+count*common.FingerprintSize {
+		return nil
+	}
+
+	// 输出文件被外部修改过，无法增量更新
+	if stat.Size() != int64(count)*int64(pageSize) {
+		return nil
+	}
+
+	state := &pageState{
+		pageSize:     pageSize,
+		salt:         salt,
+		fingerprints: make([][common.FingerprintSize]byte, count),
+	}
+	for i := range state.fingerprints {
+		copy(state.fingerprints[i][:], data[offset:])
+		offset += common.FingerprintSize
+	}
+
+	return state
+}
+
+// save 保存页面状态
+func (s *pageState) save(output string) error {
+	buf := bytes.NewBuffer(make([]byte, 0, len(pageStateMagic)+4+common.SaltSize+4+len(s.fingerprints)*common.FingerprintSize))
+	buf.WriteString(pageStateMagic)
+	binary.Write(buf, binary.LittleEndian, uint32(s.pageSize))
+	buf.Write(s.salt)
+	binary.Write(buf, binary.LittleEndian, uint32(len(s.fingerprints)))
+	for _, fp := range s.fingerprints {
+		buf.Write(fp[:])
+	}
+
+	statePath := output + PageStateSuffix
+	if err := os.WriteFile(statePath+".tmp", buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write page state failed: %w", err)
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
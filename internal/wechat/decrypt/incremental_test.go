@@ -0,0 +1,293 @@
+package decrypt
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/windows"
+)
+
+// 微信 v4 数据库与 SQLCipher 4 的密钥派生方式相同，以原始密钥作为口令即可生成测试数据
+var testKey = bytes.Repeat([]byte{0x5a}, common.KeySize)
+
+// testSource 模拟微信的加密数据库，每次写入后使用相同的盐值重新加密变化的页面
+type testSource struct {
+	t     *testing.T
+	plain string
+	path  string
+	conn  *sqlite3.SQLiteConn
+	codec *sqlcipher.Codec
+
+	// 上一次的明文和密文，未变化的页面沿用原来的密文
+	last []byte
+	enc  []byte
+}
+
+func newTestSource(t *testing.T) *testSource {
+	t.Helper()
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain.db")
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.SetFileControlInt("main", sqlite3.SQLITE_FCNTL_RESERVE_BYTES, 80)
+		},
+	}
+	conn, err := drv.Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	codec, err := sqlcipher.NewCodec(sqlcipher.ProfileV4(), string(testKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSource{t: t, plain: plain, path: filepath.Join(dir, "message_0.db"), conn: conn.(*sqlite3.SQLiteConn), codec: codec}
+	s.exec("PRAGMA journal_mode = DELETE; CREATE TABLE t (x INTEGER, s BLOB)")
+	s.insert(0, 500)
+	return s
+}
+
+func (s *testSource) exec(query string, args ...driver.Value) {
+	s.t.Helper()
+	if _, err := s.conn.Exec(query, args); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// insert 插入 [from, to) 的行并重新生成加密文件
+func (s *testSource) insert(from, to int) {
+	s.t.Helper()
+	for i := from; i < to; i++ {
+		s.exec("INSERT INTO t VALUES (?, randomblob(300))", int64(i))
+	}
+
+	data, err := os.ReadFile(s.plain)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	pageSize := s.codec.Profile().PageSize
+	out := make([]byte, 0, len(data))
+	for off := 0; off+pageSize <= len(data); off += pageSize {
+		if off+pageSize <= len(s.last) && bytes.Equal(data[off:off+pageSize], s.last[off:off+pageSize]) {
+			out = append(out, s.enc[off:off+pageSize]...)
+			continue
+		}
+		page, err := s.codec.EncryptPage(bytes.Clone(data[off:off+pageSize]), int64(off/pageSize))
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		out = append(out, page...)
+	}
+	if err := os.WriteFile(s.path, out, 0600); err != nil {
+		s.t.Fatal(err)
+	}
+	s.last, s.enc = data, out
+}
+
+func (s *testSource) pages() int {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return int(stat.Size()) / s.codec.Profile().PageSize
+}
+
+func countRows(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM t").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIncrementalDecrypt(t *testing.T) {
+	src := newTestSource(t)
+	output := filepath.Join(t.TempDir(), "message_0.db")
+	d := NewIncrementalDecryptor(windows.NewV4Decryptor())
+	hexKey := hex.EncodeToString(testKey)
+	decrypt := func() int {
+		t.Helper()
+		pages, err := d.Decrypt(context.Background(), src.path, hexKey, output, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pages
+	}
+
+	if pages := decrypt(); pages != src.pages() {
+		t.Fatalf("first decrypt: %d pages, want %d", pages, src.pages())
+	}
+	if n := countRows(t, output); n != 500 {
+		t.Fatalf("rows = %d", n)
+	}
+	if pages := decrypt(); pages != 0 {
+		t.Fatalf("unchanged source: %d pages decrypted", pages)
+	}
+
+	// 追加数据后只解密变化的页面，被替换的输出保留为备用文件
+	src.insert(500, 510)
+	first, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := decrypt(); pages == 0 || pages >= src.pages() {
+		t.Fatalf("second decrypt: %d of %d pages", pages, src.pages())
+	}
+	if n := countRows(t, output); n != 510 {
+		t.Fatalf("rows = %d", n)
+	}
+	spare := output + SpareSuffix
+	if stat, err := os.Stat(spare); err != nil || !os.SameFile(first, stat) {
+		t.Fatalf("previous output not kept as spare: %v", err)
+	}
+
+	// 备用文件没有其他引用时直接在其上改写，变化的页面包括上一次的改动
+	src.insert(510, 520)
+	second, err := os.Stat(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := decrypt(); pages == 0 || pages >= src.pages() {
+		t.Fatalf("third decrypt: %d of %d pages", pages, src.pages())
+	}
+	if stat, err := os.Stat(output); err != nil || !os.SameFile(first, stat) {
+		t.Fatalf("spare not reused: %v", err)
+	}
+	if n := countRows(t, output); n != 520 {
+		t.Fatalf("rows = %d", n)
+	}
+	if stat, err := os.Stat(spare); err != nil || !os.SameFile(second, stat) {
+		t.Fatalf("second output not kept as spare: %v", err)
+	}
+
+	// 备用文件仍被快照引用时复制当前输出，快照的内容不变
+	snapshot := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := os.Link(spare, snapshot); err != nil {
+		t.Skipf("hard links not supported: %v", err)
+	}
+	src.insert(520, 530)
+	if pages := decrypt(); pages == 0 {
+		t.Fatal("fourth decrypt: no pages")
+	}
+	if stat, err := os.Stat(output); err != nil || os.SameFile(second, stat) {
+		t.Fatalf("linked spare reused: %v", err)
+	}
+	if n := countRows(t, output); n != 530 {
+		t.Fatalf("rows = %d", n)
+	}
+	if n := countRows(t, snapshot); n != 510 {
+		t.Fatalf("snapshot rows = %d", n)
+	}
+}
+
+func TestIncrementalDecryptWorkKey(t *testing.T) {
+	src := newTestSource(t)
+	output := filepath.Join(t.TempDir(), "message_0.db")
+	d := NewIncrementalDecryptor(windows.NewV4Decryptor())
+	d.SetWorkKey("work")
+	hexKey := hex.EncodeToString(testKey)
+
+	for i, rows := range []int{500, 510, 520} {
+		if i > 0 {
+			src.insert(rows-10, rows)
+		}
+		if _, err := d.Decrypt(context.Background(), src.path, hexKey, output, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if encrypted, err := sqlcipher.IsEncrypted(output); err != nil || !encrypted {
+			t.Fatalf("output not encrypted: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := sqlcipher.DecryptFile(context.Background(), output, "work", sqlcipher.NewCache(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		plain := filepath.Join(t.TempDir(), "plain.db")
+		if err := os.WriteFile(plain, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if n := countRows(t, plain); n != rows {
+			t.Fatalf("pass %d: rows = %d, want %d", i, n, rows)
+		}
+	}
+
+	// 口令变化后完整重建，不复用旧口令加密的备用文件
+	d.SetWorkKey("other")
+	src.insert(520, 521)
+	if pages, err := d.Decrypt(context.Background(), src.path, hexKey, output, 0, nil); err != nil || pages != src.pages() {
+		t.Fatalf("after work key change: %d pages, %v", pages, err)
+	}
+	if _, err := os.Stat(output + SpareSuffix); !os.IsNotExist(err) {
+		t.Errorf("spare kept after rebuild: %v", err)
+	}
+}
+
+// 自动解密和全量解密可能同时处理同一个文件，输出和页面状态必须保持一致
+func TestIncrementalDecryptConcurrent(t *testing.T) {
+	src := newTestSource(t)
+	output := filepath.Join(t.TempDir(), "message_0.db")
+	hexKey := hex.EncodeToString(testKey)
+	// 两个解密器实例模拟版本变化时重建的解密器
+	decryptors := []*IncrementalDecryptor{
+		NewIncrementalDecryptor(windows.NewV4Decryptor()),
+		NewIncrementalDecryptor(windows.NewV4Decryptor()),
+	}
+
+	for i, rows := range []int{500, 510, 520} {
+		if i > 0 {
+			src.insert(rows-10, rows)
+		}
+		var wg sync.WaitGroup
+		pages := make([]int, len(decryptors))
+		errs := make([]error, len(decryptors))
+		for j, d := range decryptors {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pages[j], errs[j] = d.Decrypt(context.Background(), src.path, hexKey, output, 2, nil)
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatalf("pass %d: %v", i, err)
+			}
+		}
+		// 后一次解密看到前一次的结果，没有需要改写的页面
+		if pages[0] != 0 && pages[1] != 0 {
+			t.Errorf("pass %d: both decrypts wrote pages: %v", i, pages)
+		}
+		if n := countRows(t, output); n != rows {
+			t.Fatalf("pass %d: rows = %d, want %d", i, n, rows)
+		}
+		if _, err := os.Stat(output + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("pass %d: temp file left: %v", i, err)
+		}
+		if pages, err := decryptors[0].Decrypt(context.Background(), src.path, hexKey, output, 2, nil); err != nil || pages != 0 {
+			t.Fatalf("pass %d: page state out of sync: %d pages, %v", i, pages, err)
+		}
+	}
+
+	outputLocksMu.Lock()
+	n := len(outputLocks)
+	outputLocksMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d output locks left", n)
+	}
+}
@@ -0,0 +1,46 @@
+package sqlcipher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Cache 按口令和盐值缓存编解码器，避免重复执行 PBKDF2
+type Cache struct {
+	mutex  sync.Mutex
+	codecs map[string]*Codec
+}
+
+// NewCache 创建编解码器缓存
+func NewCache() *Cache {
+	return &Cache{
+		codecs: make(map[string]*Codec),
+	}
+}
+
+// Get 获取口令和盐值对应的编解码器，cache 为 nil 时返回 nil
+func (c *Cache) Get(passphrase string, salt []byte) *Codec {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.codecs[cacheKey(passphrase, salt)]
+}
+
+// Put 缓存编解码器，cache 为 nil 时忽略
+func (c *Cache) Put(codec *Codec) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.codecs[cacheKey(codec.passphrase, codec.salt)] = codec
+}
+
+// cacheKey 缓存键，不直接保存口令
+func cacheKey(passphrase string, salt []byte) string {
+	sum := sha256.Sum256(append([]byte(passphrase), salt...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,309 @@
+package sqlcipher
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 工作目录加密
+// 使用口令按 SQLCipher 的方式重新加密解密后的数据库，输出文件可以直接由 SQLCipher 打开：
+//   - 保留区域为 80 字节的数据库使用 SQLCipher 4 默认参数（PRAGMA cipher_compatibility = 4）
+//   - 保留区域为 48 字节的数据库使用 SQLCipher 3 默认参数（PRAGMA cipher_compatibility = 3），
+//     页面大小不是 1024 时需要额外设置 PRAGMA cipher_page_size
+//
+// 解密后的数据库保留了原始的保留区域，因此可以逐页原地加密，无需重建数据库
+
+// Profile 加密参数
+type Profile struct {
+	Name      string
+	PageSize  int
+	Reserve   int
+	HMACSize  int
+	IterCount int
+	HashFunc  func() hash.Hash
+}
+
+// ProfileV4 SQLCipher 4 默认参数
+func ProfileV4() Profile {
+	return Profile{
+		Name:      "sqlcipher4",
+		PageSize:  4096,
+		Reserve:   80,
+		HMACSize:  sha512.Size,
+		IterCount: 256000,
+		HashFunc:  sha512.New,
+	}
+}
+
+// ProfileV3 SQLCipher 3 默认参数
+func ProfileV3(pageSize int) Profile {
+	return Profile{
+		Name:      "sqlcipher3",
+		PageSize:  pageSize,
+		Reserve:   48,
+		HMACSize:  sha1.Size,
+		IterCount: 64000,
+		HashFunc:  sha1.New,
+	}
+}
+
+// ProfileFor 根据明文数据库的页面大小和保留字节数选择加密参数
+func ProfileFor(pageSize int, reserve int) (Profile, error) {
+	switch {
+	case pageSize == 4096 && reserve == 80:
+		return ProfileV4(), nil
+	case reserve == 48:
+		return ProfileV3(pageSize), nil
+	default:
+		return Profile{}, fmt.Errorf("unsupported page layout for sqlcipher: page size %d, reserve %d", pageSize, reserve)
+	}
+}
+
+// Codec 使用同一口令和盐值加解密页面
+type Codec struct {
+	profile    Profile
+	passphrase string
+	salt       []byte
+	encKey     []byte
+	macKey     []byte
+}
+
+// NewCodec 根据口令和盐值派生密钥，salt 为 nil 时生成随机盐值
+func NewCodec(profile Profile, passphrase string, salt []byte) (*Codec, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	if salt == nil {
+		salt = make([]byte, common.SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+
+	encKey := pbkdf2.Key([]byte(passphrase), salt, profile.IterCount, common.KeySize, profile.HashFunc)
+	macSalt := common.XorBytes(salt, 0x3a)
+	macKey := pbkdf2.Key(encKey, macSalt, 2, common.KeySize, profile.HashFunc)
+
+	return &Codec{
+		profile:    profile,
+		passphrase: passphrase,
+		salt:       bytes.Clone(salt[:common.SaltSize]),
+		encKey:     encKey,
+		macKey:     macKey,
+	}, nil
+}
+
+// Profile 返回加密参数
+func (c *Codec) Profile() Profile {
+	return c.profile
+}
+
+// Salt 返回盐值
+func (c *Codec) Salt() []byte {
+	return c.salt
+}
+
+// EncryptPage 加密页面，pageNum 从 0 开始，全零页面保持不变
+func (c *Codec) EncryptPage(pageBuf []byte, pageNum int64) ([]byte, error) {
+	if common.IsZeroPage(pageBuf) {
+		return pageBuf, nil
+	}
+	return common.EncryptPage(pageBuf, c.encKey, c.macKey, c.salt, pageNum, c.profile.HashFunc, c.profile.HMACSize, c.profile.Reserve, c.profile.PageSize)
+}
+
+// DecryptPage 解密页面，pageNum 从 0 开始，第 0 页的结果带有 SQLite 头
+func (c *Codec) DecryptPage(pageBuf []byte, pageNum int64) ([]byte, error) {
+	if common.IsZeroPage(pageBuf) {
+		return pageBuf, nil
+	}
+	data, err := common.DecryptPage(pageBuf, c.encKey, c.macKey, pageNum, c.profile.HashFunc, c.profile.HMACSize, c.profile.Reserve, c.profile.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	if pageNum == 0 {
+		data = append([]byte(common.SQLiteHeader), data...)
+	}
+	return data, nil
+}
+
+// Verify 验证第一页是否由当前口令和盐值加密
+func (c *Codec) Verify(page1 []byte) bool {
+	if len(page1) < c.profile.PageSize || !bytes.Equal(page1[:common.SaltSize], c.salt) {
+		return false
+	}
+	_, err := common.DecryptPage(page1, c.encKey, c.macKey, 0, c.profile.HashFunc, c.profile.HMACSize, c.profile.Reserve, c.profile.PageSize)
+	return err == nil
+}
+
+// IsEncrypted 判断文件是否不是明文 SQLite 数据库
+func IsEncrypted(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, errors.OpenFileFailed(path, err)
+	}
+	defer fp.Close()
+
+	header := make([]byte, len(common.SQLiteHeader))
+	if _, err := io.ReadFull(fp, header); err != nil {
+		return false, errors.ReadFileFailed(path, err)
+	}
+	return !bytes.Equal(header, []byte(common.SQLiteHeader)), nil
+}
+
+// PlainLayout 读取明文数据库头中的页面大小和保留字节数
+func PlainLayout(header []byte) (pageSize int, reserve int, err error) {
+	if len(header) < 21 || !bytes.Equal(header[:len(common.SQLiteHeader)], []byte(common.SQLiteHeader)) {
+		return 0, 0, fmt.Errorf("invalid sqlite header")
+	}
+	pageSize = int(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	return pageSize, int(header[20]), nil
+}
+
+// OpenCodec 读取加密数据库的盐值，依次尝试各组加密参数，返回能验证第一页的编解码器
+// cache 用于复用已派生的密钥，可以为 nil
+func OpenCodec(path string, passphrase string, cache *Cache) (*Codec, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, errors.OpenFileFailed(path, err)
+	}
+	defer fp.Close()
+
+	page := make([]byte, 4096)
+	n, err := io.ReadFull(fp, page)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.ReadFileFailed(path, err)
+	}
+	page = page[:n]
+	if n < common.SaltSize {
+		return nil, errors.ReadFileFailed(path, io.ErrUnexpectedEOF)
+	}
+	salt := page[:common.SaltSize]
+
+	if codec := cache.Get(passphrase, salt); codec != nil && codec.Verify(page) {
+		return codec, nil
+	}
+
+	for _, profile := range []Profile{ProfileV4(), ProfileV3(4096), ProfileV3(1024)} {
+		if n < profile.PageSize {
+			continue
+		}
+		codec, err := NewCodec(profile, passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if codec.Verify(page) {
+			cache.Put(codec)
+			return codec, nil
+		}
+	}
+
+	return nil, errors.ErrDecryptIncorrectKey
+}
+
+// DecryptFile 使用口令解密工作目录中的数据库
+func DecryptFile(ctx context.Context, path string, passphrase string, cache *Cache, output io.Writer) error {
+	codec, err := OpenCodec(path, passphrase, cache)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return errors.OpenFileFailed(path, err)
+	}
+	defer fp.Close()
+
+	pageBuf := make([]byte, codec.profile.PageSize)
+	for pageNum := int64(0); ; pageNum++ {
+		select {
+		case <-ctx.Done():
+			return errors.ErrDecryptOperationCanceled
+		default:
+		}
+
+		if _, err := io.ReadFull(fp, pageBuf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errors.ReadFileFailed(path, err)
+		}
+
+		data, err := codec.DecryptPage(pageBuf, pageNum)
+		if err != nil {
+			return err
+		}
+		if _, err := output.Write(data); err != nil {
+			return errors.WriteOutputFailed(err)
+		}
+	}
+}
+
+// EncryptFile 使用口令和随机盐值加密明文数据库
+func EncryptFile(ctx context.Context, path string, passphrase string, output io.Writer) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return errors.OpenFileFailed(path, err)
+	}
+	defer fp.Close()
+
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(fp, header); err != nil {
+		return errors.ReadFileFailed(path, err)
+	}
+	pageSize, reserve, err := PlainLayout(header)
+	if err != nil {
+		return errors.ReadFileFailed(path, err)
+	}
+	profile, err := ProfileFor(pageSize, reserve)
+	if err != nil {
+		return err
+	}
+	codec, err := NewCodec(profile, passphrase, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return errors.ReadFileFailed(path, err)
+	}
+
+	pageBuf := make([]byte, pageSize)
+	for pageNum := int64(0); ; pageNum++ {
+		select {
+		case <-ctx.Done():
+			return errors.ErrDecryptOperationCanceled
+		default:
+		}
+
+		if _, err := io.ReadFull(fp, pageBuf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return errors.ReadFileFailed(path, err)
+		}
+
+		data, err := codec.EncryptPage(pageBuf, pageNum)
+		if err != nil {
+			return err
+		}
+		if _, err := output.Write(data); err != nil {
+			return errors.WriteOutputFailed(err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package sqlcipher
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// createPlainDB 创建保留区域为 reserve 字节的明文数据库，与解密后的微信数据库布局相同
+func createPlainDB(t *testing.T, path string, reserve int, rows int) {
+	t.Helper()
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.SetFileControlInt("main", sqlite3.SQLITE_FCNTL_RESERVE_BYTES, reserve)
+		},
+	}
+	conn, err := drv.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*sqlite3.SQLiteConn)
+	if _, err := c.Exec("PRAGMA journal_mode = DELETE; CREATE TABLE t (x INTEGER, s TEXT)", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < rows; i++ {
+		if _, err := c.Exec("INSERT INTO t VALUES (?, randomblob(200))", []driver.Value{int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncryptDecryptFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		reserve int
+		profile string
+	}{
+		{"v4", 80, "sqlcipher4"},
+		{"v3", 48, "sqlcipher3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			plain := filepath.Join(dir, "plain.db")
+			createPlainDB(t, plain, tc.reserve, 100)
+			want, err := os.ReadFile(plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var enc bytes.Buffer
+			if err := EncryptFile(context.Background(), plain, "secret", &enc); err != nil {
+				t.Fatal(err)
+			}
+			if enc.Len() != len(want) {
+				t.Fatalf("encrypted size %d, want %d", enc.Len(), len(want))
+			}
+			encPath := filepath.Join(dir, "enc.db")
+			if err := os.WriteFile(encPath, enc.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if encrypted, err := IsEncrypted(encPath); err != nil || !encrypted {
+				t.Fatalf("IsEncrypted = %v, %v", encrypted, err)
+			}
+
+			cache := NewCache()
+			if _, err := OpenCodec(encPath, "wrong", cache); err == nil {
+				t.Fatal("opened with wrong passphrase")
+			}
+			codec, err := OpenCodec(encPath, "secret", cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.Profile().Name != tc.profile {
+				t.Errorf("profile = %s, want %s", codec.Profile().Name, tc.profile)
+			}
+
+			var dec bytes.Buffer
+			if err := DecryptFile(context.Background(), encPath, "secret", cache, &dec); err != nil {
+				t.Fatal(err)
+			}
+			// 保留区域在加密时被 IV 和 HMAC 覆盖，其余内容与原文件相同
+			got := dec.Bytes()
+			if len(got) != len(want) {
+				t.Fatalf("decrypted size %d, want %d", len(got), len(want))
+			}
+			pageSize := codec.Profile().PageSize
+			for off := 0; off < len(want); off += pageSize {
+				end := off + pageSize - tc.reserve
+				if !bytes.Equal(got[off:end], want[off:end]) {
+					t.Fatalf("page %d differs", off/pageSize)
+				}
+			}
+
+			decPath := filepath.Join(dir, "dec.db")
+			if err := os.WriteFile(decPath, got, 0600); err != nil {
+				t.Fatal(err)
+			}
+			db, err := sql.Open("sqlite3", decPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var n int
+			if err := db.QueryRow("SELECT count(*) FROM t").Scan(&n); err != nil || n != 100 {
+				t.Fatalf("count = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestEncryptFileUnsupportedLayout(t *testing.T) {
+	plain := filepath.Join(t.TempDir(), "plain.db")
+	createPlainDB(t, plain, 0, 1)
+	if err := EncryptFile(context.Background(), plain, "secret", &bytes.Buffer{}); err == nil {
+		t.Error("expected error for database without reserve bytes")
+	}
+}
@@ -24,6 +24,12 @@ func NewValidator(platform string, version int, dataDir string) (*Validator, err
 func NewValidatorWithFile(platform string, version int, dataDir string) (*Validator, error) {
 	dbFile := GetSimpleDBFile(platform, version)
 	dbPath := filepath.Join(dataDir, dbFile)
+	return NewValidatorWithDBPath(platform, version, dbPath, dataDir)
+}
+
+// NewValidatorWithDBPath 使用指定的加密数据库创建验证器
+// dataDir 仅用于验证图片密钥，为空时不验证图片密钥
+func NewValidatorWithDBPath(platform string, version int, dbPath string, dataDir string) (*Validator, error) {
 	decryptor, err := NewDecryptor(platform, version)
 	if err != nil {
 		return nil, err
@@ -41,7 +47,7 @@ func NewValidatorWithFile(platform string, version int, dataDir string) (*Valida
 		dbFile:    d,
 	}
 
-	if version == 4 {
+	if version == 4 && len(dataDir) != 0 {
 		validator.imgKeyValidator = dat2img.NewImgKeyValidator(dataDir)
 	}
 
@@ -59,6 +65,11 @@ func (v *Validator) ValidateImgKey(key []byte) bool {
 	return v.imgKeyValidator.Validate(key)
 }
 
+// CanValidateImgKey 是否可以验证图片密钥，未指定数据目录或数据目录中没有可用于验证的图片时返回 false
+func (v *Validator) CanValidateImgKey() bool {
+	return v != nil && v.imgKeyValidator != nil && len(v.imgKeyValidator.EncryptedData) != 0
+}
+
 func GetSimpleDBFile(platform string, version int) string {
 	switch {
 	case platform == "windows" && version == 3:
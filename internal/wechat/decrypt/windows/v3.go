@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"hash"
 	"io"
-	"os"
 
 	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
@@ -74,7 +73,7 @@ func (d *V3Decryptor) Validate(page1 []byte, key []byte) bool {
 }
 
 // Decrypt 解密数据库
-func (d *V3Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string, output io.Writer) error {
+func (d *V3Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string, output io.Writer, jobs int, progress common.ProgressFunc) error {
 	// 解码密钥
 	key, err := hex.DecodeString(hexKey)
 	if err != nil {
@@ -95,75 +94,32 @@ func (d *V3Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string,
 	// 计算密钥
 	encKey, macKey := d.deriveKeys(key, dbInfo.Salt)
 
-	// 打开数据库文件
-	dbFile, err := os.Open(dbfile)
+	// 打开数据库文件，合并 WAL 中已提交的页面
+	reader, err := common.NewPageReader(dbInfo, d.pageSize)
 	if err != nil {
-		return errors.OpenFileFailed(dbfile, err)
-	}
-	defer dbFile.Close()
-
-	// 写入SQLite头
-	_, err = output.Write([]byte(common.SQLiteHeader))
-	if err != nil {
-		return errors.WriteOutputFailed(err)
+		return err
 	}
+	defer reader.Close()
 
-	// 处理每一页
-	pageBuf := make([]byte, d.pageSize)
-
-	for curPage := int64(0); curPage < dbInfo.TotalPages; curPage++ {
-		// 检查是否取消
-		select {
-		case <-ctx.Done():
-			return errors.ErrDecryptOperationCanceled
-		default:
-			// 继续处理
-		}
-
-		// 读取一页
-		n, err := io.ReadFull(dbFile, pageBuf)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				// 处理最后一部分页面
-				if n > 0 {
-					break
-				}
-			}
-			return errors.ReadFileFailed(dbfile, err)
-		}
-
-		// 检查页面是否全为零
-		allZeros := true
-		for _, b := range pageBuf {
-			if b != 0 {
-				allZeros = false
-				break
-			}
-		}
-
-		if allZeros {
-			// 写入零页面
-			_, err = output.Write(pageBuf)
-			if err != nil {
-				return errors.WriteOutputFailed(err)
-			}
-			continue
-		}
-
-		// 解密页面
-		decryptedData, err := common.DecryptPage(pageBuf, encKey, macKey, curPage, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
-		if err != nil {
-			return err
-		}
-
-		// 写入解密后的页面
-		_, err = output.Write(decryptedData)
-		if err != nil {
+	// 并发解密各页面并按顺序写入
+	return common.DecryptPages(ctx, reader, nil, jobs, func(pageBuf []byte, pageNum int64) ([]byte, error) {
+		return common.DecryptPage(pageBuf, encKey, macKey, pageNum, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
+	}, func(_ int64, data []byte) error {
+		if _, err := output.Write(data); err != nil {
 			return errors.WriteOutputFailed(err)
 		}
-	}
+		return nil
+	}, progress)
+}
+
+// DeriveKeys 派生加密密钥和MAC密钥
+func (d *V3Decryptor) DeriveKeys(key []byte, salt []byte) ([]byte, []byte) {
+	return d.deriveKeys(key, salt)
+}
 
-	return nil
+// DecryptPage 解密单个页面，pageNum 从 0 开始
+func (d *V3Decryptor) DecryptPage(pageBuf []byte, encKey []byte, macKey []byte, pageNum int64) ([]byte, error) {
+	return common.DecryptPage(pageBuf, encKey, macKey, pageNum, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
 }
 
 // GetPageSize 返回页面大小
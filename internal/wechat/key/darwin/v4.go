@@ -412,6 +412,11 @@ func (e *V4Extractor) SearchImgKey(ctx context.Context, memory []byte) (string,
 	return "", false
 }
 
+// CanSearchImgKey 验证器可以验证图片密钥时才搜索图片密钥
+func (e *V4Extractor) CanSearchImgKey() bool {
+	return e.validator.CanValidateImgKey()
+}
+
 func (e *V4Extractor) SetValidate(validator *decrypt.Validator) {
 	e.validator = validator
 }
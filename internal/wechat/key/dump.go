@@ -0,0 +1,174 @@
+package key
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+const (
+	// DumpChunkSize 每次从内存转储中读取的大小
+	DumpChunkSize = 64 * 1024 * 1024
+
+	// DumpChunkOverlap 相邻分块的重叠大小，需大于所有密钥特征的偏移量
+	DumpChunkOverlap = 4096
+)
+
+// dumpChunkSize 实际使用的分块大小，测试中调小以覆盖跨分块的情况
+var dumpChunkSize = DumpChunkSize
+
+// ImgKeySearcher 支持在内存中搜索图片密钥的提取器
+type ImgKeySearcher interface {
+	SearchImgKey(ctx context.Context, memory []byte) (string, bool)
+
+	// CanSearchImgKey 是否设置了可以验证图片密钥的验证器
+	CanSearchImgKey() bool
+}
+
+// SearchDump 分块读取内存转储并搜索数据密钥和图片密钥
+// 提取器需要先通过 SetValidate 设置验证器；不支持图片密钥或验证器无法验证图片密钥时只搜索数据密钥，找到后立即返回
+func SearchDump(ctx context.Context, e Extractor, r io.Reader) (string, string, error) {
+	imgSearcher, searchImg := e.(ImgKeySearcher)
+	searchImg = searchImg && imgSearcher.CanSearchImgKey()
+
+	var dataKey, imgKey string
+	buf := make([]byte, dumpChunkSize+DumpChunkOverlap)
+	carry := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return dataKey, imgKey, ctx.Err()
+		default:
+		}
+
+		n, err := io.ReadFull(r, buf[carry:])
+		if n == 0 && err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return dataKey, imgKey, errors.ReadFileFailed("memory dump", err)
+		}
+		chunk := buf[:carry+n]
+
+		if dataKey == "" {
+			if key, ok := e.SearchKey(ctx, chunk); ok {
+				dataKey = key
+				log.Debug().Msg("Data key found: " + key)
+			}
+		}
+		if searchImg && imgKey == "" {
+			if key, ok := imgSearcher.SearchImgKey(ctx, chunk); ok {
+				imgKey = key
+				log.Debug().Msg("Image key found: " + key)
+			}
+		}
+		if dataKey != "" && (imgKey != "" || !searchImg) {
+			break
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		// 保留末尾部分，避免密钥特征跨越分块边界
+		carry = min(DumpChunkOverlap, len(chunk))
+		copy(buf, chunk[len(chunk)-carry:])
+	}
+
+	if dataKey == "" {
+		return "", imgKey, errors.ErrNoValidKey
+	}
+	return dataKey, imgKey, nil
+}
+
+// Dump 内存转储文件，支持 dumpmemory 命令生成的 zip 文件和原始 .bin 文件
+type Dump struct {
+	// Name 内存转储文件名
+	Name string
+
+	io.ReadCloser
+
+	zr *zip.ReadCloser
+
+	// sessionDB zip 文件中附带的加密数据库
+	sessionDB *zip.File
+}
+
+// OpenDump 打开内存转储文件
+func OpenDump(path string) (*Dump, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".zip") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.OpenFileFailed(path, err)
+		}
+		return &Dump{Name: filepath.Base(path), ReadCloser: f}, nil
+	}
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errors.OpenFileFailed(path, err)
+	}
+
+	dump := &Dump{zr: zr}
+	for _, f := range zr.File {
+		switch {
+		case strings.HasSuffix(f.Name, ".bin") && dump.ReadCloser == nil:
+			rc, err := f.Open()
+			if err != nil {
+				zr.Close()
+				return nil, errors.ReadFileFailed(path, err)
+			}
+			dump.Name = f.Name
+			dump.ReadCloser = rc
+		case strings.HasSuffix(f.Name, ".db"):
+			dump.sessionDB = f
+		}
+	}
+	if dump.ReadCloser == nil {
+		zr.Close()
+		return nil, errors.ReadFileFailed(path, os.ErrNotExist)
+	}
+
+	return dump, nil
+}
+
+// ExtractDB 将 zip 文件中附带的加密数据库解压到 dir，没有附带数据库时返回空字符串
+func (d *Dump) ExtractDB(dir string) (string, error) {
+	if d.sessionDB == nil {
+		return "", nil
+	}
+
+	rc, err := d.sessionDB.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	path := filepath.Join(dir, filepath.Base(d.sessionDB.Name))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, rc); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Close 关闭内存转储文件
+func (d *Dump) Close() error {
+	err := d.ReadCloser.Close()
+	if d.zr != nil {
+		d.zr.Close()
+	}
+	return err
+}
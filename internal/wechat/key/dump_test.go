@@ -0,0 +1,266 @@
+package key
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt"
+	"github.com/sjzar/chatlog/internal/wechat/model"
+)
+
+var (
+	fakeDataKey = regexp.MustCompile(`DATA\[([0-9a-f]{8})\]`)
+	fakeImgKey  = regexp.MustCompile(`IMG\[([0-9a-f]{8})\]`)
+)
+
+// fakeExtractor 在内存中按标记查找数据密钥
+type fakeExtractor struct{}
+
+func (e *fakeExtractor) Extract(ctx context.Context, proc *model.Process) (string, string, error) {
+	return "", "", nil
+}
+
+func (e *fakeExtractor) SearchKey(ctx context.Context, memory []byte) (string, bool) {
+	if m := fakeDataKey.FindSubmatch(memory); m != nil {
+		return string(m[1]), true
+	}
+	return "", false
+}
+
+func (e *fakeExtractor) SetValidate(validator *decrypt.Validator) {}
+
+// fakeImgExtractor 同时支持搜索图片密钥的提取器
+type fakeImgExtractor struct {
+	fakeExtractor
+	canImg   bool
+	imgCalls int
+}
+
+func (e *fakeImgExtractor) SearchImgKey(ctx context.Context, memory []byte) (string, bool) {
+	e.imgCalls++
+	if m := fakeImgKey.FindSubmatch(memory); m != nil {
+		return string(m[1]), true
+	}
+	return "", false
+}
+
+func (e *fakeImgExtractor) CanSearchImgKey() bool {
+	return e.canImg
+}
+
+// countReader 记录已读取的字节数
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// synthDump 生成指定大小的内存转储，在给定偏移处写入标记
+func synthDump(size int, marks map[int]string) []byte {
+	dump := bytes.Repeat([]byte{0xAA}, size)
+	for off, mark := range marks {
+		copy(dump[off:], mark)
+	}
+	return dump
+}
+
+func TestSearchDump(t *testing.T) {
+	old := dumpChunkSize
+	dumpChunkSize = 8192
+	defer func() { dumpChunkSize = old }()
+
+	const size = 64 * 1024
+	// 第一次读取 dumpChunkSize+DumpChunkOverlap 字节，之后每次读取 dumpChunkSize 字节
+	first := dumpChunkSize + DumpChunkOverlap
+	boundary := first - 6
+
+	tests := []struct {
+		name      string
+		extractor Extractor
+		marks     map[int]string
+		dataKey   string
+		imgKey    string
+		err       error
+		maxRead   int
+	}{
+		{
+			name:      "no image searcher stops at data key",
+			extractor: &fakeExtractor{},
+			marks:     map[int]string{100: "DATA[0123abcd]", 40000: "IMG[89abcdef]"},
+			dataKey:   "0123abcd",
+			maxRead:   first,
+		},
+		{
+			name:      "image searcher without validator stops at data key",
+			extractor: &fakeImgExtractor{},
+			marks:     map[int]string{100: "DATA[0123abcd]", 40000: "IMG[89abcdef]"},
+			dataKey:   "0123abcd",
+			maxRead:   first,
+		},
+		{
+			name:      "image searcher with validator reads until image key",
+			extractor: &fakeImgExtractor{canImg: true},
+			marks:     map[int]string{100: "DATA[0123abcd]", 40000: "IMG[89abcdef]"},
+			dataKey:   "0123abcd",
+			imgKey:    "89abcdef",
+			maxRead:   40000 + dumpChunkSize,
+		},
+		{
+			name:      "key across chunk boundary",
+			extractor: &fakeExtractor{},
+			marks:     map[int]string{boundary: "DATA[0123abcd]"},
+			dataKey:   "0123abcd",
+			maxRead:   first + dumpChunkSize,
+		},
+		{
+			name:      "image key without data key",
+			extractor: &fakeImgExtractor{canImg: true},
+			marks:     map[int]string{100: "IMG[89abcdef]"},
+			imgKey:    "89abcdef",
+			err:       errors.ErrNoValidKey,
+			maxRead:   size,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &countReader{r: bytes.NewReader(synthDump(size, tt.marks))}
+			dataKey, imgKey, err := SearchDump(context.Background(), tt.extractor, r)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if dataKey != tt.dataKey || imgKey != tt.imgKey {
+				t.Fatalf("keys = %q, %q, want %q, %q", dataKey, imgKey, tt.dataKey, tt.imgKey)
+			}
+			if r.n > tt.maxRead {
+				t.Fatalf("read %d bytes, want at most %d", r.n, tt.maxRead)
+			}
+			if e, ok := tt.extractor.(*fakeImgExtractor); ok && !e.canImg && e.imgCalls != 0 {
+				t.Fatalf("SearchImgKey called %d times without validator", e.imgCalls)
+			}
+		})
+	}
+}
+
+func TestSearchDumpCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := SearchDump(ctx, &fakeExtractor{}, bytes.NewReader(synthDump(1024, nil)))
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenDump(t *testing.T) {
+	dir := t.TempDir()
+	mem := synthDump(1024, map[int]string{10: "DATA[0123abcd]"})
+	db := []byte("encrypted session db")
+
+	raw := filepath.Join(dir, "wechat_4.0.5_123_20250101.bin")
+	if err := os.WriteFile(raw, mem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	withDB := filepath.Join(dir, "with_db.zip")
+	writeZip(t, withDB, map[string][]byte{"wechat_4.0.5_123_20250101.bin": mem, "session/session.db": db})
+	noDB := filepath.Join(dir, "no_db.zip")
+	writeZip(t, noDB, map[string][]byte{"wechat_4.0.5_123_20250101.bin": mem})
+	noBin := filepath.Join(dir, "no_bin.zip")
+	writeZip(t, noBin, map[string][]byte{"session.db": db})
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+		db      []byte
+	}{
+		{name: "raw bin", path: raw},
+		{name: "zip with db", path: withDB, db: db},
+		{name: "zip without db", path: noDB},
+		{name: "zip without bin", path: noBin, wantErr: true},
+		{name: "missing file", path: filepath.Join(dir, "missing.bin"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dump, err := OpenDump(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					dump.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dump.Close()
+
+			if dump.Name != "wechat_4.0.5_123_20250101.bin" {
+				t.Fatalf("name = %q", dump.Name)
+			}
+			got, err := io.ReadAll(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, mem) {
+				t.Fatal("dump content mismatch")
+			}
+
+			out := t.TempDir()
+			dbPath, err := dump.ExtractDB(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.db == nil {
+				if dbPath != "" {
+					t.Fatalf("ExtractDB = %q, want empty", dbPath)
+				}
+				return
+			}
+			if dbPath != filepath.Join(out, "session.db") {
+				t.Fatalf("ExtractDB = %q", dbPath)
+			}
+			data, err := os.ReadFile(dbPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.db) {
+				t.Fatal("extracted db mismatch")
+			}
+		})
+	}
+}
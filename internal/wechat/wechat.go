@@ -137,5 +137,5 @@ func (a *Account) DecryptDatabase(ctx context.Context, dbPath, outputPath string
 	defer output.Close()
 
 	// 解密数据库
-	return decryptor.Decrypt(ctx, dbPath, hexKey, output)
+	return decryptor.Decrypt(ctx, dbPath, hexKey, output, 0, nil)
 }
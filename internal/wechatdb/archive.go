@@ -0,0 +1,227 @@
+package wechatdb
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechatdb/archive"
+)
+
+var (
+	// ArchiveDelay 消息数据库变化后等待的时间，连续的变化只同步一次
+	ArchiveDelay = 10 * time.Second
+
+	// ArchiveOverlap 增量同步向前重叠的时间，解密时才写入的较早消息也能被归档
+	ArchiveOverlap = 24 * time.Hour
+
+	// RecallWindow 增量同步时检查撤回和删除的时间范围
+	RecallWindow = 7 * 24 * time.Hour
+)
+
+// archiver 后台同步归档的协程
+type archiver struct {
+	cancel context.CancelFunc
+	wake   chan struct{}
+	wg     sync.WaitGroup
+
+	// 同步串行执行
+	mu sync.Mutex
+}
+
+// startArchive 打开数据库后同步一次，之后在消息数据库变化时同步
+func (w *DB) startArchive() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.archive.cancel = cancel
+	w.archive.wake = make(chan struct{}, 1)
+
+	w.archive.wg.Add(1)
+	go w.archiveLoop(ctx)
+
+	wake := w.archive.wake
+	w.ds.SetCallback("message", func(event fsnotify.Event) error {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+}
+
+func (w *DB) stopArchive() {
+	if w.archive.cancel == nil {
+		return
+	}
+	w.archive.cancel()
+	w.archive.wg.Wait()
+	w.archive.cancel = nil
+}
+
+func (w *DB) archiveLoop(ctx context.Context) {
+	defer w.archive.wg.Done()
+
+	w.syncArchive(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.archive.wake:
+		}
+
+		timer := time.NewTimer(ArchiveDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		select {
+		case <-w.archive.wake:
+		default:
+		}
+
+		w.syncArchive(ctx)
+	}
+}
+
+func (w *DB) syncArchive(ctx context.Context) {
+	n, err := w.SyncArchive(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Err(err).Msg("sync archive failed")
+		}
+		return
+	}
+	if n > 0 {
+		log.Info().Msgf("archived %d new messages to %s", n, w.store.Path())
+	}
+}
+
+// SyncArchive 将数据源中的消息追加到归档库，返回新增的消息数
+// 第一次同步归档所有联系人、群聊和会话的全部消息，之后只同步最近 RecallWindow 内有消息的会话，
+// 并对比这些会话在这段时间内的消息，记录被撤回和删除的消息
+// 撤回和删除不一定更新会话时间，所以不只对比上次同步后有新消息的会话
+func (w *DB) SyncArchive(ctx context.Context) (int, error) {
+	if w.store == nil {
+		return 0, nil
+	}
+
+	w.archive.mu.Lock()
+	defer w.archive.mu.Unlock()
+
+	now := time.Now()
+	since, err := w.store.SyncedAt(ctx)
+	if err != nil {
+		return 0, err
+	}
+	full := since.IsZero()
+	start := time.Unix(0, 0)
+	if !full {
+		start = since.Add(-ArchiveOverlap)
+		if t := now.Add(-RecallWindow); t.Before(start) {
+			start = t
+		}
+	}
+	// 有消息数据库未加载时，数据源中缺少的消息不一定是被删除了
+	checkDeleted := !full && w.shardsLoaded(ctx)
+
+	added, recalled := 0, 0
+	for _, talker := range w.archiveTalkers(ctx, full, start) {
+		if err := ctx.Err(); err != nil {
+			return added, err
+		}
+		messages, err := w.ds.GetMessages(ctx, start, now, talker, "", "", 0, 0)
+		if err != nil {
+			if errors.GetCode(err) == http.StatusNotFound {
+				continue
+			}
+			return added, err
+		}
+		// 先对比上次解密时归档的消息，再追加这次的消息
+		if !full {
+			n, err := w.store.Diff(ctx, talker, start, now, messages, checkDeleted)
+			if err != nil {
+				return added, err
+			}
+			recalled += n
+		}
+		// 保存归档时的名称，联系人被删除后仍然可以显示
+		w.repo.EnrichMessages(ctx, messages)
+		n, err := w.store.Append(ctx, messages)
+		if err != nil {
+			return added, err
+		}
+		added += n
+	}
+
+	if recalled > 0 {
+		log.Info().Msgf("found %d recalled or deleted messages", recalled)
+	}
+	return added, w.store.SetSyncedAt(ctx, now)
+}
+
+// shardsLoaded 所有消息数据库是否都已加载
+func (w *DB) shardsLoaded(ctx context.Context) bool {
+	for _, shard := range w.ds.Shards(ctx) {
+		if !shard.Loaded {
+			return false
+		}
+	}
+	return true
+}
+
+// archiveTalkers 返回需要同步的聊天对象，full 为 false 时只返回 since 之后有消息的会话
+func (w *DB) archiveTalkers(ctx context.Context, full bool, since time.Time) []string {
+	talkers := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name == "" || seen[name] {
+			return
+		}
+		seen[name] = true
+		talkers = append(talkers, name)
+	}
+
+	sessions, err := w.ds.GetSessions(ctx, "", 0, 0)
+	if err != nil {
+		log.Debug().Err(err).Msg("get sessions for archive failed")
+	}
+	for _, s := range sessions {
+		if full || !s.NTime.Before(since) {
+			add(s.UserName)
+		}
+	}
+	if !full {
+		return talkers
+	}
+
+	if contacts, err := w.ds.GetContacts(ctx, "", 0, 0); err == nil {
+		for _, c := range contacts {
+			add(c.UserName)
+		}
+	}
+	if chatRooms, err := w.ds.GetChatRooms(ctx, "", 0, 0); err == nil {
+		for _, c := range chatRooms {
+			add(c.Name)
+		}
+	}
+	return talkers
+}
+
+// GetArchiveStatus 返回归档库的状态，未启用归档时返回 nil
+func (w *DB) GetArchiveStatus() *archive.Status {
+	if w.store == nil {
+		return nil
+	}
+	status, err := w.store.Status(context.Background())
+	if err != nil {
+		log.Debug().Err(err).Msg("get archive status failed")
+		return nil
+	}
+	return status
+}
@@ -0,0 +1,312 @@
+package archive
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), DefaultDir, DefaultFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func msg(seq, serverID int64, content string) *model.Message {
+	return &model.Message{
+		Seq:      seq,
+		ServerID: serverID,
+		Time:     time.Unix(seq/1000, 0),
+		Talker:   "wxid_a",
+		Sender:   "wxid_a",
+		Type:     1,
+		Content:  content,
+	}
+}
+
+func TestAppendKeepsFirstCopy(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+
+	first := msg(1700000000000, 11, "hello")
+	refer := msg(1690000000000, 7, "quoted")
+	first.SetContent("refer", refer)
+	first.SetContent("entries", []string{"a", "b"})
+	first.SetContent("host", "127.0.0.1:5030")
+	local := msg(1700000001000, 0, "local only")
+
+	if n, err := s.Append(ctx, []*model.Message{first, local}); err != nil || n != 2 {
+		t.Fatalf("Append = %d, %v", n, err)
+	}
+
+	// 重新安装后序号变化、内容被撤回，仍按服务端 ID 去重并保留第一次的内容
+	again := msg(1700000005000, 11, "revoked")
+	if n, err := s.Append(ctx, []*model.Message{again, local}); err != nil || n != 0 {
+		t.Fatalf("Append again = %d, %v", n, err)
+	}
+
+	got, err := s.Messages(ctx, time.Unix(0, 0), time.Now(), []string{"wxid_a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	if got[0].Content != "hello" || got[0].ServerID != 11 {
+		t.Errorf("first = %+v", got[0])
+	}
+	r, ok := got[0].Contents["refer"].(*model.Message)
+	if !ok || r.Content != "quoted" || r.ServerID != 7 {
+		t.Errorf("refer = %#v", got[0].Contents["refer"])
+	}
+	if e, ok := got[0].Contents["entries"].([]string); !ok || len(e) != 2 {
+		t.Errorf("entries = %#v", got[0].Contents["entries"])
+	}
+	if _, ok := got[0].Contents["host"]; ok {
+		t.Error("host should not be archived")
+	}
+}
+
+// liveDS 只实现 GetMessages 的数据源
+type liveDS struct {
+	datasource.DataSource
+	messages []*model.Message
+}
+
+func (ds *liveDS) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	if ds.messages == nil {
+		return nil, errors.TimeRangeNotFound(startTime, endTime)
+	}
+	messages := make([]*model.Message, 0)
+	for _, m := range ds.messages {
+		if strings.Contains(m.Content, keyword) {
+			messages = append(messages, m)
+		}
+	}
+	if limit > 0 && limit < len(messages) {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func TestWrapMerge(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+
+	deleted := msg(1700000000000, 1, "deleted in wechat")
+	kept := msg(1700000002000, 2, "kept")
+	if _, err := s.Append(ctx, []*model.Message{deleted, kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	live := &liveDS{messages: []*model.Message{msg(1700000002000, 2, "kept"), msg(1700000003000, 3, "new")}}
+	ds := Wrap(live, s)
+
+	got, err := ds.GetMessages(ctx, time.Unix(0, 0), time.Now(), "wxid_a", "", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"deleted in wechat", "kept", "new"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i, m := range got {
+		if m.Content != want[i] {
+			t.Errorf("messages[%d] = %q, want %q", i, m.Content, want[i])
+		}
+	}
+
+	got, err = ds.GetMessages(ctx, time.Unix(0, 0), time.Now(), "wxid_a", "", "", 1, 1)
+	if err != nil || len(got) != 1 || got[0].Content != "kept" {
+		t.Fatalf("page = %v, %v", got, err)
+	}
+
+	got, err = ds.GetMessages(ctx, time.Unix(0, 0), time.Now(), "wxid_a", "", "deleted", 0, 0)
+	if err != nil || len(got) != 1 || got[0].ServerID != 1 {
+		t.Fatalf("keyword = %v, %v", got, err)
+	}
+
+	// 工作目录中已经没有这段时间的数据库时只返回归档的消息
+	live.messages = nil
+	got, err = ds.GetMessages(ctx, time.Unix(0, 0), time.Now(), "wxid_a", "", "", 0, 0)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("archive only = %v, %v", got, err)
+	}
+}
+
+func TestWrapMergeOrder(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+
+	// 两个聊天对象的序号范围重叠，合并结果按时间排序
+	at := func(talker string, seq, serverID, ts int64, content string) *model.Message {
+		m := msg(seq, serverID, content)
+		m.Talker, m.Sender, m.Time = talker, talker, time.Unix(ts, 0)
+		return m
+	}
+	if _, err := s.Append(ctx, []*model.Message{
+		at("wxid_a", 5, 1, 100, "a1"),
+		at("wxid_b", 1, 2, 300, "b1"),
+		at("wxid_b", 3, 3, 300, "b2"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	live := &liveDS{messages: []*model.Message{
+		at("wxid_a", 6, 4, 200, "a2"),
+		at("wxid_b", 4, 5, 400, "b3"),
+	}}
+	ds := Wrap(live, s)
+
+	for _, tc := range []struct {
+		limit, offset int
+		want          string
+	}{
+		{0, 0, "a1 a2 b1 b2 b3"},
+		{2, 0, "a1 a2"},
+		{2, 2, "b1 b2"},
+	} {
+		got, err := ds.GetMessages(ctx, time.Unix(0, 0), time.Now(), "wxid_a,wxid_b", "", "", tc.limit, tc.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents := make([]string, len(got))
+		for i, m := range got {
+			contents[i] = m.Content
+		}
+		if s := strings.Join(contents, " "); s != tc.want {
+			t.Errorf("limit %d offset %d = %s, want %s", tc.limit, tc.offset, s, tc.want)
+		}
+	}
+}
+
+func TestDiffRecalledAndDeleted(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+	start, end := time.Unix(0, 0), time.Now()
+
+	recalled := msg(1700000000000, 1, "secret")
+	deleted := msg(1700000001000, 2, "gone")
+	kept := msg(1700000002000, 3, "kept")
+	if _, err := s.Append(ctx, []*model.Message{recalled, deleted, kept}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 下一次解密时第一条变成了撤回提示，第二条被删除
+	notice := msg(1700000000000, 1, "\"A\" 撤回了一条消息")
+	notice.Type = 10000
+	live := []*model.Message{notice, msg(1700000002000, 3, "kept")}
+	n, err := s.Diff(ctx, "wxid_a", start, end, live, true)
+	if err != nil || n != 2 {
+		t.Fatalf("Diff = %d, %v", n, err)
+	}
+	// 再次对比不会重复记录
+	if n, err := s.Diff(ctx, "wxid_a", start, end, live, true); err != nil || n != 0 {
+		t.Fatalf("Diff again = %d, %v", n, err)
+	}
+
+	ds := Wrap(&liveDS{messages: live}, s)
+	got, err := ds.GetMessages(ctx, start, end, "wxid_a", "", "", 0, 0)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("GetMessages = %v, %v", got, err)
+	}
+	wantKind := []string{model.RecallKindRecalled, model.RecallKindDeleted, ""}
+	wantContent := []string{"secret", "gone", "kept"}
+	for i, m := range got {
+		r, _ := m.Contents["recalled"].(*model.Recall)
+		kind := ""
+		if r != nil {
+			kind = r.Kind
+		}
+		if m.Content != wantContent[i] || kind != wantKind[i] {
+			t.Errorf("messages[%d] = %q %q, want %q %q", i, m.Content, kind, wantContent[i], wantKind[i])
+		}
+	}
+
+	// 被删除的消息重新出现时删除记录
+	live = append(live, msg(1700000001000, 2, "gone"))
+	if _, err := s.Diff(ctx, "wxid_a", start, end, live, true); err != nil {
+		t.Fatal(err)
+	}
+	recalls, err := s.Recalls(ctx, start, end, []string{"wxid_a"})
+	if err != nil || len(recalls) != 1 {
+		t.Fatalf("Recalls = %v, %v", recalls, err)
+	}
+}
+
+func TestRecalled(t *testing.T) {
+	s := openStore(t)
+	ctx := context.Background()
+	start, end := time.Unix(0, 0), time.Now()
+
+	var archived []*model.Message
+	for i := int64(0); i < 5; i++ {
+		archived = append(archived, msg(1700000000000+i*1000, 10+i, "message "+string(rune('a'+i))))
+	}
+	other := msg(1700000009000, 20, "other chat")
+	other.Talker, other.Sender = "wxid_b", "wxid_b"
+	archived = append(archived, other)
+	if _, err := s.Append(ctx, archived); err != nil {
+		t.Fatal(err)
+	}
+
+	// 撤回提示的类型来自系统消息，与界面语言无关
+	notice := msg(1700000000000, 10, "Alice a retiré un message")
+	notice.Type = 10000
+	notice.SetContent("sysmsg", "revokemsg")
+	live := []*model.Message{notice, archived[1], archived[3]}
+	if n, err := s.Diff(ctx, "wxid_a", start, end, live, true); err != nil || n != 3 {
+		t.Fatalf("Diff = %d, %v", n, err)
+	}
+	if n, err := s.Diff(ctx, "wxid_b", start, end, nil, true); err != nil || n != 0 {
+		t.Fatalf("Diff without live messages = %d, %v", n, err)
+	}
+	if err := s.Mark(ctx, []Mark{{Key: Key(other), Kind: model.RecallKindDeleted}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Recalled(ctx, start, end, []string{"wxid_a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{10, 12, 14}
+	if len(got) != len(want) {
+		t.Fatalf("Recalled = %d messages, want %d", len(got), len(want))
+	}
+	for i, m := range got {
+		r, ok := m.Contents["recalled"].(*model.Recall)
+		if m.ServerID != want[i] || !ok {
+			t.Errorf("recalled[%d] = %d %v", i, m.ServerID, r)
+		}
+	}
+	if r := got[0].Contents["recalled"].(*model.Recall); r.Kind != model.RecallKindRecalled || got[0].Content != "message a" || r.Notice != notice.Content {
+		t.Errorf("recalled message = %q %+v", got[0].Content, r)
+	}
+
+	// 不指定聊天对象时查询全部
+	if got, err := s.Recalled(ctx, start, end, nil, nil); err != nil || len(got) != 4 {
+		t.Fatalf("all recalled = %d, %v", len(got), err)
+	}
+
+	ds := Wrap(&liveDS{messages: live}, s)
+	got, err = ds.GetRecalledMessages(ctx, start, end, "wxid_a", "", "", 1, 1)
+	if err != nil || len(got) != 1 || got[0].ServerID != 12 {
+		t.Fatalf("page = %v, %v", got, err)
+	}
+	got, err = ds.GetRecalledMessages(ctx, start, end, "wxid_a", "", "message [ae]", 0, 0)
+	if err != nil || len(got) != 2 || got[1].ServerID != 14 {
+		t.Fatalf("keyword = %v, %v", got, err)
+	}
+	if _, err := ds.GetRecalledMessages(ctx, start, end, "wxid_a", "", "(", 0, 0); err == nil {
+		t.Error("invalid keyword accepted")
+	}
+}
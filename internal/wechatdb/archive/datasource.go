@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// DataSource 在数据源的查询结果中补充归档的消息，其他方法直接使用原数据源
+type DataSource struct {
+	datasource.DataSource
+	store    *Store
+	annotate func(msg *model.Message)
+}
+
+// Wrap 返回读取归档库的数据源，已从微信中删除的消息仍然可以查询到
+func Wrap(ds datasource.DataSource, store *Store) *DataSource {
+	return &DataSource{
+		DataSource: ds,
+		store:      store,
+	}
+}
+
+// SetAnnotator 设置消息补充函数，归档的消息在关键词过滤前同样调用
+func (ds *DataSource) SetAnnotator(annotate func(msg *model.Message)) {
+	ds.annotate = annotate
+	ds.DataSource.SetAnnotator(annotate)
+}
+
+// GetMessages 合并数据源和归档库中的消息，同一条消息只保留数据源中的版本，被撤回的消息除外
+// 有撤回或删除记录的消息在 Contents["recalled"] 中附带记录
+// 按时间和序号排序后合并结果的前 offset+limit 条只可能来自两边各自的前 offset+limit 条，所以两边都只需要查询这么多；
+// 多个聊天对象的序号范围互相重叠，只按序号排序会打乱时间顺序
+func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	n := 0
+	if limit > 0 {
+		n = offset + limit
+	}
+
+	messages, err := ds.DataSource.GetMessages(ctx, startTime, endTime, talker, sender, keyword, n, 0)
+	if err != nil && errors.GetCode(err) != http.StatusNotFound {
+		return nil, err
+	}
+	// 时间范围内没有数据库文件时只返回归档的消息
+	notFound := err
+
+	archived, err := ds.archived(ctx, startTime, endTime, talker, sender, keyword, n)
+	if err != nil {
+		log.Err(err).Msg("query archived messages failed")
+		if notFound != nil {
+			return nil, notFound
+		}
+		return page(messages, limit, offset), nil
+	}
+	if notFound != nil && len(archived) == 0 {
+		return nil, notFound
+	}
+
+	recalls, err := ds.store.Recalls(ctx, startTime, endTime, util.Str2List(talker, ","))
+	if err != nil {
+		log.Err(err).Msg("query recalled messages failed")
+	}
+
+	// 被撤回的消息在数据源中已经变成撤回提示，使用归档库中撤回前的内容
+	index := make(map[MessageKey]int, len(messages)+len(archived))
+	for i, m := range messages {
+		index[Key(m)] = i
+	}
+	for _, m := range archived {
+		k := Key(m)
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(messages)
+			messages = append(messages, m)
+			continue
+		}
+		if r := recalls[k]; r != nil && r.Kind == model.RecallKindRecalled && messages[i].IsRecallNotice() && !m.IsRecallNotice() {
+			messages[i] = m
+		}
+	}
+	for _, m := range messages {
+		if r := recalls[Key(m)]; r != nil {
+			m.SetContent("recalled", r)
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return before(messages[i], messages[j])
+	})
+	return page(messages, limit, offset), nil
+}
+
+// before 消息排序，先按时间（秒，与归档库的精度一致）再按序号
+func before(a, b *model.Message) bool {
+	if ta, tb := a.Time.Unix(), b.Time.Unix(); ta != tb {
+		return ta < tb
+	}
+	return a.Seq < b.Seq
+}
+
+// GetRecalledMessages 查询被撤回或删除的消息，内容为归档库中撤回或删除前的版本
+// 撤回记录在归档库中与消息关联查询，不需要读取时间范围内的全部消息
+func (ds *DataSource) GetRecalledMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	regex, err := compileKeyword(keyword)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ds.store.Recalled(ctx, startTime, endTime, util.Str2List(talker, ","), util.Str2List(sender, ","))
+	if err != nil {
+		return nil, err
+	}
+	return page(ds.filter(messages, regex, 0), limit, offset), nil
+}
+
+// archived 查询归档库中符合条件的前 n 条消息，n 为 0 时不限制
+func (ds *DataSource) archived(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, n int) ([]*model.Message, error) {
+	regex, err := compileKeyword(keyword)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ds.store.Messages(ctx, startTime, endTime, util.Str2List(talker, ","), util.Str2List(sender, ","))
+	if err != nil {
+		return nil, err
+	}
+	return ds.filter(messages, regex, n), nil
+}
+
+// filter 返回匹配关键词的前 n 条消息，regex 为 nil 时不过滤，n 为 0 时不限制
+func (ds *DataSource) filter(messages []*model.Message, regex *regexp.Regexp, n int) []*model.Message {
+	filtered := messages[:0]
+	for _, m := range messages {
+		if regex != nil {
+			if ds.annotate != nil {
+				ds.annotate(m)
+			}
+			if !regex.MatchString(m.PlainTextContent()) {
+				continue
+			}
+		}
+		filtered = append(filtered, m)
+		if n > 0 && len(filtered) >= n {
+			break
+		}
+	}
+	return filtered
+}
+
+func compileKeyword(keyword string) (*regexp.Regexp, error) {
+	if keyword == "" {
+		return nil, nil
+	}
+	regex, err := regexp.Compile(keyword)
+	if err != nil {
+		return nil, errors.QueryFailed("invalid regex pattern", err)
+	}
+	return regex, nil
+}
+
+func page(messages []*model.Message, limit, offset int) []*model.Message {
+	if offset >= len(messages) {
+		return []*model.Message{}
+	}
+	messages = messages[offset:]
+	if limit > 0 && limit < len(messages) {
+		messages = messages[:limit]
+	}
+	return messages
+}
@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"context"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+// Mark 一条撤回或删除记录
+type Mark struct {
+	Key    MessageKey
+	Kind   string
+	Notice string
+}
+
+// Recalls 返回时间范围内已归档消息的撤回和删除记录
+func (s *Store) Recalls(ctx context.Context, start, end time.Time, talkers []string) (map[MessageKey]*model.Recall, error) {
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	where, args := messageFilter(start, end, talkers, nil)
+	rows, err := s.db.QueryContext(ctx, `SELECT talker, local, msg_key, kind, notice, detected_at
+		FROM message JOIN recall USING (talker, local, msg_key) WHERE `+where, args...)
+	if err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	defer rows.Close()
+
+	recalls := make(map[MessageKey]*model.Recall)
+	for rows.Next() {
+		var (
+			k  MessageKey
+			r  model.Recall
+			ts int64
+		)
+		if err := rows.Scan(&k.Talker, &k.Local, &k.ID, &r.Kind, &r.Notice, &ts); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		r.DetectedAt = time.Unix(ts, 0)
+		recalls[k] = &r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	return recalls, nil
+}
+
+// Recalled 查询时间范围内被撤回或删除的消息，按序号排序，内容为归档库中撤回或删除前的版本
+// 撤回记录在 Contents["recalled"] 中，talkers 或 senders 为空时不过滤
+func (s *Store) Recalled(ctx context.Context, start, end time.Time, talkers []string, senders []string) ([]*model.Message, error) {
+	where, args := messageFilter(start, end, talkers, senders)
+	rows, err := s.db.QueryContext(ctx, "SELECT "+columns+`, kind, notice, detected_at
+		FROM message JOIN recall USING (talker, local, msg_key) WHERE `+where+" ORDER BY seq ASC", args...)
+	if err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	defer rows.Close()
+
+	messages := []*model.Message{}
+	for rows.Next() {
+		var (
+			r  model.Recall
+			ts int64
+		)
+		m, err := scanMessage(rows, &r.Kind, &r.Notice, &ts)
+		if err != nil {
+			return nil, err
+		}
+		r.DetectedAt = time.Unix(ts, 0)
+		m.SetContent("recalled", &r)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	return messages, nil
+}
+
+// Mark 记录撤回和删除，已有记录的消息保持第一次发现时的记录，被删除的消息之后被发现撤回时改为撤回
+// restore 中的消息重新出现在微信的数据库中，删除它们的删除记录
+func (s *Store) Mark(ctx context.Context, marks []Mark, restore []MessageKey) error {
+	if len(marks) == 0 && len(restore) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.ArchiveWriteFailed(err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	for _, m := range marks {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recall (talker, local, msg_key, kind, notice, detected_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (talker, local, msg_key) DO UPDATE SET kind = excluded.kind, notice = excluded.notice, detected_at = excluded.detected_at
+			WHERE recall.kind = ? AND excluded.kind = ?`,
+			m.Key.Talker, m.Key.Local, m.Key.ID, m.Kind, m.Notice, now, model.RecallKindDeleted, model.RecallKindRecalled); err != nil {
+			return errors.ArchiveWriteFailed(err)
+		}
+	}
+	for _, k := range restore {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM recall WHERE talker = ? AND local = ? AND msg_key = ? AND kind = ?",
+			k.Talker, k.Local, k.ID, model.RecallKindDeleted); err != nil {
+			return errors.ArchiveWriteFailed(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.ArchiveWriteFailed(err)
+	}
+	return nil
+}
+
+// Diff 对比一个聊天对象在时间范围内的归档消息和数据源中的消息，记录新发现的撤回和删除，返回新增的记录数
+// 需要在追加这次的消息之前调用，此时归档库中保存的是之前解密时见过的消息
+//   - 撤回：数据源中的消息变成了撤回提示，或者撤回提示记录了被撤回消息的服务端 ID，归档库中保留了撤回前的内容
+//   - 删除：checkDeleted 为 true 时，归档库中有服务端 ID 但数据源中已经没有的消息
+//
+// 数据源在时间范围内没有任何消息时无法区分删除和数据库未加载，不检查删除
+func (s *Store) Diff(ctx context.Context, talker string, start, end time.Time, live []*model.Message, checkDeleted bool) (int, error) {
+	archived, err := s.Messages(ctx, start, end, []string{talker}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(archived) == 0 {
+		return 0, nil
+	}
+	known, err := s.Recalls(ctx, start, end, []string{talker})
+	if err != nil {
+		return 0, err
+	}
+
+	byKey := make(map[MessageKey]*model.Message, len(archived))
+	for _, m := range archived {
+		byKey[Key(m)] = m
+	}
+
+	marks := make([]Mark, 0)
+	restore := make([]MessageKey, 0)
+	present := make(map[MessageKey]bool, len(live))
+	for _, m := range live {
+		k := Key(m)
+		present[k] = true
+		if r, ok := known[k]; ok && r.Kind == model.RecallKindDeleted {
+			restore = append(restore, k)
+			delete(known, k)
+		}
+		if !m.IsRecallNotice() {
+			continue
+		}
+		// 撤回提示可能替换了原消息，也可能是一条新的消息
+		target := k
+		if id := m.RevokedServerID(); id != 0 {
+			target = MessageKey{Talker: m.Talker, ID: id}
+		}
+		orig, ok := byKey[target]
+		if !ok || orig.IsRecallNotice() {
+			continue
+		}
+		if r, ok := known[target]; ok && r.Kind == model.RecallKindRecalled {
+			continue
+		}
+		marks = append(marks, Mark{Key: target, Kind: model.RecallKindRecalled, Notice: m.Content})
+		known[target] = &model.Recall{Kind: model.RecallKindRecalled}
+	}
+
+	if checkDeleted && len(live) > 0 {
+		for k, m := range byKey {
+			if k.Local != 0 || present[k] || known[k] != nil || m.IsRecallNotice() {
+				continue
+			}
+			marks = append(marks, Mark{Key: k, Kind: model.RecallKindDeleted})
+		}
+	}
+
+	if err := s.Mark(ctx, marks, restore); err != nil {
+		return 0, err
+	}
+	return len(marks), nil
+}
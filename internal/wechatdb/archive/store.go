@@ -0,0 +1,377 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// DefaultDir 默认的归档目录，位于工作目录下
+	DefaultDir = "archive"
+
+	// DefaultFile 默认的归档库文件名，不与任何平台的数据库文件名规则冲突
+	DefaultFile = "chatlog_archive.db"
+
+	metaSyncedAt = "synced_at"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS message (
+	talker       TEXT    NOT NULL,
+	local        INTEGER NOT NULL,
+	msg_key      INTEGER NOT NULL,
+	server_id    INTEGER NOT NULL DEFAULT 0,
+	seq          INTEGER NOT NULL,
+	time         INTEGER NOT NULL,
+	talker_name  TEXT    NOT NULL DEFAULT '',
+	is_chatroom  INTEGER NOT NULL DEFAULT 0,
+	sender       TEXT    NOT NULL DEFAULT '',
+	sender_name  TEXT    NOT NULL DEFAULT '',
+	is_self      INTEGER NOT NULL DEFAULT 0,
+	type         INTEGER NOT NULL DEFAULT 0,
+	sub_type     INTEGER NOT NULL DEFAULT 0,
+	content      TEXT    NOT NULL DEFAULT '',
+	contents     TEXT    NOT NULL DEFAULT '',
+	reply_to_seq INTEGER NOT NULL DEFAULT 0,
+	version      TEXT    NOT NULL DEFAULT '',
+	archived_at  INTEGER NOT NULL,
+	PRIMARY KEY (talker, local, msg_key)
+);
+CREATE INDEX IF NOT EXISTS message_talker_time ON message (talker, time);
+CREATE TABLE IF NOT EXISTS recall (
+	talker      TEXT    NOT NULL,
+	local       INTEGER NOT NULL,
+	msg_key     INTEGER NOT NULL,
+	kind        TEXT    NOT NULL,
+	notice      TEXT    NOT NULL DEFAULT '',
+	detected_at INTEGER NOT NULL,
+	PRIMARY KEY (talker, local, msg_key)
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+const columns = `seq, server_id, time, talker, talker_name, is_chatroom, sender, sender_name, is_self,
+	type, sub_type, content, contents, reply_to_seq, version`
+
+// Store 聊天记录归档库，保存解密过程中见过的所有消息
+// 消息按 (talker, server_id) 去重，没有服务端 ID 的消息按 (talker, seq) 去重
+// 已归档的消息不会被覆盖，微信中撤回或删除的消息仍保留第一次归档时的内容
+type Store struct {
+	path string
+	db   *sql.DB
+
+	// 写入串行执行，避免同步和关闭同时操作数据库
+	mu sync.Mutex
+}
+
+// Open 打开归档库，文件不存在时创建
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.ArchiveOpenFailed(path, err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, errors.ArchiveOpenFailed(path, err)
+	}
+	// 只有一个写入者，单个连接即可，同时避免 SQLite 的写锁竞争
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, errors.ArchiveOpenFailed(path, err)
+	}
+	return &Store{path: path, db: db}, nil
+}
+
+// Path 归档库文件路径
+func (s *Store) Path() string {
+	return s.path
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Close()
+}
+
+// Append 归档消息，已归档的消息保持不变，返回新增的消息数
+func (s *Store) Append(ctx context.Context, messages []*model.Message) (int, error) {
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.ArchiveWriteFailed(err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO message (talker, local, msg_key, seq, server_id, time,
+		talker_name, is_chatroom, sender, sender_name, is_self, type, sub_type, content, contents, reply_to_seq, version, archived_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, errors.ArchiveWriteFailed(err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	added := 0
+	for _, m := range messages {
+		if m.Talker == "" {
+			continue
+		}
+		k := Key(m)
+		contents, err := encodeContents(m.Contents)
+		if err != nil {
+			return 0, errors.ArchiveWriteFailed(err)
+		}
+		res, err := stmt.ExecContext(ctx, k.Talker, k.Local, k.ID,
+			m.Seq, m.ServerID, m.Time.Unix(), m.TalkerName, m.IsChatRoom, m.Sender, m.SenderName, m.IsSelf,
+			m.Type, m.SubType, m.Content, contents, m.ReplyToSeq, m.Version, now)
+		if err != nil {
+			return 0, errors.ArchiveWriteFailed(err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.ArchiveWriteFailed(err)
+	}
+	return added, nil
+}
+
+// Messages 查询时间范围内的归档消息，按时间和序号排序，senders 为空时不过滤发送人
+func (s *Store) Messages(ctx context.Context, start, end time.Time, talkers []string, senders []string) ([]*model.Message, error) {
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	where, args := messageFilter(start, end, talkers, senders)
+	rows, err := s.db.QueryContext(ctx, "SELECT "+columns+" FROM message WHERE "+where+" ORDER BY time ASC, seq ASC", args...)
+	if err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	defer rows.Close()
+
+	messages := []*model.Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed("", err)
+	}
+	return messages, nil
+}
+
+// messageFilter 生成按时间、聊天对象和发送人过滤消息的条件，talkers 或 senders 为空时不过滤
+func messageFilter(start, end time.Time, talkers []string, senders []string) (string, []interface{}) {
+	conditions := []string{"time >= ? AND time <= ?"}
+	args := []interface{}{start.Unix(), end.Unix()}
+	if len(talkers) > 0 {
+		conditions = append(conditions, "talker IN ("+placeholders(len(talkers))+")")
+		for _, t := range talkers {
+			args = append(args, t)
+		}
+	}
+	if len(senders) > 0 {
+		conditions = append(conditions, "sender IN ("+placeholders(len(senders))+")")
+		for _, sender := range senders {
+			args = append(args, sender)
+		}
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// scanMessage 读取 columns 对应的一行消息，extra 接收 columns 之后的列
+func scanMessage(rows *sql.Rows, extra ...interface{}) (*model.Message, error) {
+	var (
+		m        model.Message
+		ts       int64
+		contents string
+	)
+	dest := append([]interface{}{&m.Seq, &m.ServerID, &ts, &m.Talker, &m.TalkerName, &m.IsChatRoom, &m.Sender, &m.SenderName, &m.IsSelf,
+		&m.Type, &m.SubType, &m.Content, &contents, &m.ReplyToSeq, &m.Version}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return nil, errors.ScanRowFailed(err)
+	}
+	m.Time = time.Unix(ts, 0)
+	var err error
+	if m.Contents, err = decodeContents(contents); err != nil {
+		return nil, errors.ScanRowFailed(err)
+	}
+	return &m, nil
+}
+
+// Count 返回已归档的消息数
+func (s *Store) Count(ctx context.Context) (int64, error) {
+	var n int64
+	if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM message").Scan(&n); err != nil {
+		return 0, errors.QueryFailed("", err)
+	}
+	return n, nil
+}
+
+// SyncedAt 返回最近一次完成同步的时间，从未同步时返回零值
+func (s *Store) SyncedAt(ctx context.Context) (time.Time, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM meta WHERE key = ?", metaSyncedAt).Scan(&value)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.QueryFailed("", err)
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return time.Unix(ts, 0), nil
+}
+
+// SetSyncedAt 记录同步完成的时间，下次同步从这个时间附近开始
+func (s *Store) SetSyncedAt(ctx context.Context, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)",
+		metaSyncedAt, strconv.FormatInt(t.Unix(), 10))
+	if err != nil {
+		return errors.ArchiveWriteFailed(err)
+	}
+	return nil
+}
+
+// MessageKey 消息的去重键
+type MessageKey struct {
+	Talker string
+	Local  int
+	ID     int64
+}
+
+// Key 返回消息的去重键，有服务端 ID 时使用服务端 ID，否则使用本地序号
+// 重新安装微信后本地序号可能变化，服务端 ID 保持不变
+func Key(m *model.Message) MessageKey {
+	if m.ServerID != 0 {
+		return MessageKey{Talker: m.Talker, ID: m.ServerID}
+	}
+	return MessageKey{Talker: m.Talker, Local: 1, ID: m.Seq}
+}
+
+// encodeContents 将多媒体内容序列化为 JSON，引用的原消息额外保存服务端 ID
+// host 在输出文本时才设置，recalled 在查询时根据撤回记录设置，都不需要归档
+func encodeContents(contents map[string]interface{}) (string, error) {
+	if len(contents) == 0 {
+		return "", nil
+	}
+	c := make(map[string]interface{}, len(contents))
+	for k, v := range contents {
+		switch k {
+		case "host", "recalled":
+			continue
+		case "refer":
+			if refer, ok := v.(*model.Message); ok {
+				v = referJSON{Message: refer, ServerID: refer.ServerID}
+			}
+		}
+		c[k] = v
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// decodeContents 还原 encodeContents 的结果，读取时需要类型断言的内容恢复为原来的类型
+func decodeContents(data string) (map[string]interface{}, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	contents := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		var err error
+		switch k {
+		case "refer":
+			var refer referJSON
+			if err = json.Unmarshal(v, &refer); err == nil && refer.Message != nil {
+				refer.Message.ServerID = refer.ServerID
+				contents[k] = refer.Message
+			}
+		case "records":
+			var records []*model.Message
+			if err = json.Unmarshal(v, &records); err == nil {
+				contents[k] = records
+			}
+		case "entries":
+			var entries []string
+			if err = json.Unmarshal(v, &entries); err == nil {
+				contents[k] = entries
+			}
+		default:
+			var value interface{}
+			if err = json.Unmarshal(v, &value); err == nil {
+				contents[k] = value
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// referJSON 引用的原消息，model.Message 序列化时不包含服务端 ID
+type referJSON struct {
+	*model.Message
+	ServerID int64 `json:"serverId,omitempty"`
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// Status 归档库的状态
+type Status struct {
+	Path     string     `json:"path"`
+	Messages int64      `json:"messages"`
+	SyncedAt *time.Time `json:"syncedAt,omitempty"`
+}
+
+// Status 返回归档库的路径、消息数和最近一次同步的时间
+func (s *Store) Status(ctx context.Context) (*Status, error) {
+	n, err := s.Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Path: s.path, Messages: n}
+	if t, err := s.SyncedAt(ctx); err == nil && !t.IsZero() {
+		status.SyncedAt = &t
+	}
+	return status, nil
+}
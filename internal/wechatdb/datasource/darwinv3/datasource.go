@@ -62,12 +62,15 @@ type DataSource struct {
 
 	talkerDBMap      map[string]string
 	user2DisplayName map[string]string
+
+	// 关键词过滤前补充消息内容，可以为 nil
+	annotate func(msg *model.Message)
 }
 
-func New(path string) (*DataSource, error) {
+func New(path string, opts dbm.Options) (*DataSource, error) {
 	ds := &DataSource{
 		path:             path,
-		dbm:              dbm.NewDBManager(path),
+		dbm:              dbm.NewDBManager(path, opts),
 		talkerDBMap:      make(map[string]string),
 		user2DisplayName: make(map[string]string),
 	}
@@ -109,13 +112,20 @@ func New(path string) (*DataSource, error) {
 	return ds, nil
 }
 
+// SetAnnotator 设置消息补充函数，在关键词过滤前调用，使外部补充的内容（如图片文字）也能被搜索
+func (ds *DataSource) SetAnnotator(annotate func(msg *model.Message)) {
+	ds.annotate = annotate
+}
+
 func (ds *DataSource) SetCallback(name string, callback func(event fsnotify.Event) error) error {
 	return ds.dbm.AddCallback(name, callback)
 }
 
 func (ds *DataSource) initMessageDbs() error {
+	ctx, release := ds.dbm.Begin(context.Background(), "initMessageDbs")
+	defer release()
 
-	dbPaths, err := ds.dbm.GetDBPath(Message)
+	dbPaths, err := ds.dbm.GetDBPath(ctx, Message)
 	if err != nil {
 		if strings.Contains(err.Error(), "db file not found") {
 			ds.talkerDBMap = make(map[string]string)
@@ -126,14 +136,14 @@ func (ds *DataSource) initMessageDbs() error {
 	// 处理每个数据库文件
 	talkerDBMap := make(map[string]string)
 	for _, filePath := range dbPaths {
-		db, err := ds.dbm.OpenDB(filePath)
+		db, err := ds.dbm.OpenDB(ctx, filePath)
 		if err != nil {
 			log.Err(err).Msgf("获取数据库 %s 失败", filePath)
 			continue
 		}
 
 		// 获取所有表名
-		rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name LIKE 'Chat_%'")
+		rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table' AND name LIKE 'Chat_%'")
 		if err != nil {
 			log.Err(err).Msgf("数据库 %s 中没有 Chat 表", filePath)
 			continue
@@ -160,7 +170,10 @@ func (ds *DataSource) initMessageDbs() error {
 }
 
 func (ds *DataSource) initChatRoomDb() error {
-	db, err := ds.dbm.GetDB(ChatRoom)
+	ctx, release := ds.dbm.Begin(context.Background(), "initChatRoomDb")
+	defer release()
+
+	db, err := ds.dbm.GetDB(ctx, ChatRoom)
 	if err != nil {
 		if strings.Contains(err.Error(), "db file not found") {
 			ds.user2DisplayName = make(map[string]string)
@@ -169,7 +182,7 @@ func (ds *DataSource) initChatRoomDb() error {
 		return err
 	}
 
-	rows, err := db.Query("SELECT m_nsUsrName, IFNULL(nickname,\"\") FROM GroupMember")
+	rows, err := db.QueryContext(ctx, "SELECT m_nsUsrName, IFNULL(nickname,\"\") FROM GroupMember")
 	if err != nil {
 		log.Err(err).Msg("获取群聊成员失败")
 		return nil
@@ -192,6 +205,9 @@ func (ds *DataSource) initChatRoomDb() error {
 }
 
 func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetMessages")
+	defer release()
+
 	if talker == "" {
 		return nil, errors.ErrTalkerEmpty
 	}
@@ -222,7 +238,7 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 	for _, talkerItem := range talkers {
 		// 检查上下文是否已取消
 		if err := ctx.Err(); err != nil {
-			return nil, err
+			return nil, errors.QueryFailed("", err)
 		}
 
 		// 在 darwinv3 中，需要先找到对应的数据库
@@ -234,7 +250,7 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 			continue
 		}
 
-		db, err := ds.dbm.OpenDB(dbPath)
+		db, err := ds.dbm.OpenDB(ctx, dbPath)
 		if err != nil {
 			log.Error().Msgf("数据库 %s 未打开", dbPath)
 			continue
@@ -244,7 +260,7 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 		// 构建查询条件
 		query := fmt.Sprintf(`
-			SELECT msgCreateTime, msgContent, messageType, mesDes
+			SELECT IFNULL(mesSvrID, 0), msgCreateTime, msgContent, messageType, mesDes
 			FROM %s 
 			WHERE msgCreateTime >= ? AND msgCreateTime <= ? 
 			ORDER BY msgCreateTime ASC
@@ -265,6 +281,7 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		for rows.Next() {
 			var msg model.MessageDarwinV3
 			err := rows.Scan(
+				&msg.MesSvrID,
 				&msg.MsgCreateTime,
 				&msg.MsgContent,
 				&msg.MessageType,
@@ -295,6 +312,9 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 			// 应用keyword过滤
 			if regex != nil {
+				if ds.annotate != nil {
+					ds.annotate(message)
+				}
 				plainText := message.PlainTextContent()
 				if !regex.MatchString(plainText) {
 					continue // 不匹配keyword，跳过此消息
@@ -325,6 +345,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 				return filteredMessages[offset:end], nil
 			}
 		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, errors.QueryFailed("", err)
+		}
 		rows.Close()
 	}
 
@@ -365,6 +389,9 @@ func extractTalkerFromTableName(tableName string) string {
 
 // GetContacts 实现获取联系人信息的方法
 func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetContacts")
+	defer release()
+
 	var query string
 	var args []interface{}
 
@@ -390,7 +417,7 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 	}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Contact)
+	db, err := ds.dbm.GetDB(ctx, Contact)
 	if err != nil {
 		return nil, err
 	}
@@ -423,6 +450,9 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 
 // GetChatRooms 实现获取群聊信息的方法
 func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offset int) ([]*model.ChatRoom, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetChatRooms")
+	defer release()
+
 	var query string
 	var args []interface{}
 
@@ -448,7 +478,7 @@ func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offse
 	}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(ChatRoom)
+	db, err := ds.dbm.GetDB(ctx, ChatRoom)
 	if err != nil {
 		return nil, err
 	}
@@ -524,6 +554,9 @@ func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offse
 
 // GetSessions 实现获取会话信息的方法
 func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset int) ([]*model.Session, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetSessions")
+	defer release()
+
 	var query string
 	var args []interface{}
 
@@ -550,7 +583,7 @@ func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset
 	}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Session)
+	db, err := ds.dbm.GetDB(ctx, Session)
 	if err != nil {
 		return nil, err
 	}
@@ -594,6 +627,9 @@ func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset
 }
 
 func (ds *DataSource) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetMedia")
+	defer release()
+
 	if key == "" {
 		return nil, errors.ErrKeyEmpty
 	}
@@ -612,7 +648,7 @@ WHERE
     r.mediaMd5 = ?`
 	args := []interface{}{key}
 	// 执行查询
-	db, err := ds.dbm.GetDB(Media)
+	db, err := ds.dbm.GetDB(ctx, Media)
 	if err != nil {
 		return nil, err
 	}
@@ -650,6 +686,33 @@ WHERE
 }
 
 // Close 实现关闭数据库连接的方法
+// Pin 固定当前的数据库快照，使一个请求中的多次查询读取同一组数据库文件
+func (ds *DataSource) Pin(ctx context.Context) (context.Context, func()) {
+	return ds.dbm.Pin(ctx)
+}
+
+// Stats 返回已打开数据库的连接池状态
+func (ds *DataSource) Stats(ctx context.Context) *dbm.Stats {
+	return ds.dbm.Stats(ctx)
+}
+
+// Shards 返回消息数据库的加载状态，darwinv3 按聊天对象拆分数据库，没有时间范围
+func (ds *DataSource) Shards(ctx context.Context) []*dbm.Shard {
+	ctx, release := ds.dbm.Begin(ctx, "Shards")
+	defer release()
+
+	paths, _ := ds.dbm.GetDBPath(ctx, Message)
+	loaded := make(map[string]bool)
+	for _, path := range ds.talkerDBMap {
+		loaded[path] = true
+	}
+	shards := make([]*dbm.Shard, 0, len(paths))
+	for _, path := range paths {
+		shards = append(shards, &dbm.Shard{Path: path, Loaded: loaded[path]})
+	}
+	return shards
+}
+
 func (ds *DataSource) Close() error {
 	return ds.dbm.Close()
 }
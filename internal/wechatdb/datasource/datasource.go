@@ -9,6 +9,7 @@ import (
 	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource/darwinv3"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 	v4 "github.com/sjzar/chatlog/internal/wechatdb/datasource/v4"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource/windowsv3"
 )
@@ -33,19 +34,47 @@ type DataSource interface {
 	// 设置回调函数
 	SetCallback(name string, callback func(event fsnotify.Event) error) error
 
+	// 设置消息补充函数，在关键词过滤前调用
+	SetAnnotator(annotate func(msg *model.Message))
+
+	// 固定当前的数据库快照，返回的函数在请求结束时调用
+	Pin(ctx context.Context) (context.Context, func())
+
+	// 数据库连接状态
+	Stats(ctx context.Context) *dbm.Stats
+
+	// 消息数据库的加载状态
+	Shards(ctx context.Context) []*dbm.Shard
+
 	Close() error
 }
 
-func New(path string, platform string, version int) (DataSource, error) {
+// Supported 返回是否支持该平台和版本的数据库
+func Supported(platform string, version int) bool {
+	switch {
+	case platform == "windows" && (version == 3 || version == 4):
+		return true
+	case platform == "darwin" && (version == 3 || version == 4):
+		return true
+	default:
+		return false
+	}
+}
+
+func New(path string, platform string, version int, opts dbm.Options) (DataSource, error) {
 	switch {
 	case platform == "windows" && version == 3:
-		return windowsv3.New(path)
+		opts.Name = "windowsv3"
+		return windowsv3.New(path, opts)
 	case platform == "windows" && version == 4:
-		return v4.New(path)
+		opts.Name = "v4"
+		return v4.New(path, opts)
 	case platform == "darwin" && version == 3:
-		return darwinv3.New(path)
+		opts.Name = "darwinv3"
+		return darwinv3.New(path, opts)
 	case platform == "darwin" && version == 4:
-		return v4.New(path)
+		opts.Name = "v4"
+		return v4.New(path, opts)
 	default:
 		return nil, errors.PlatformUnsupported(platform, version)
 	}
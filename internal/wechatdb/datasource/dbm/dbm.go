@@ -1,37 +1,165 @@
 package dbm
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog/log"
+	"github.com/shirou/gopsutil/v4/process"
 
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/metrics"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
 	"github.com/sjzar/chatlog/pkg/filecopy"
 	"github.com/sjzar/chatlog/pkg/filemonitor"
 )
 
+const (
+	// LinkDir 工作目录中存放快照硬链接的目录
+	LinkDir = ".snapshot"
+
+	DefaultQueryTimeout = time.Minute
+	DefaultBusyTimeout  = 5 * time.Second
+	DefaultMaxOpenConns = 4
+	DefaultMaxIdleConns = 2
+)
+
+// Options 数据库打开选项，数值为 0 时使用默认值
+type Options struct {
+	// WorkKey 工作目录加密口令，为空表示工作目录中是明文数据库
+	WorkKey string
+
+	// QueryTimeout 一次数据源调用中所有查询的期限，小于 0 表示不限制
+	QueryTimeout time.Duration
+
+	// BusyTimeout 数据库被锁定时的等待时间
+	BusyTimeout time.Duration
+
+	// MaxOpenConns、MaxIdleConns 每个数据库的连接池大小
+	MaxOpenConns int
+	MaxIdleConns int
+
+	// CacheSize 每个连接的页缓存大小，单位为 KiB，0 使用 SQLite 默认值
+	CacheSize int
+
+	// MmapSize 内存映射读取的大小，单位为字节，0 表示不使用
+	MmapSize int64
+
+	// MemLimit 加密数据库解密到内存的最大大小，单位为字节，更大的数据库解密到临时文件，小于 0 表示不限制
+	MemLimit int64
+
+	// Name 数据源名称，用于区分查询耗时指标
+	Name string
+}
+
+// Stat 单个数据库的连接状态
+type Stat struct {
+	Path     string    `json:"path"`
+	Healthy  bool      `json:"healthy"`
+	Error    string    `json:"error,omitempty"`
+	OpenedAt time.Time `json:"openedAt,omitempty"`
+
+	// Copy 是否通过硬链接或临时副本打开，解密的数据库和 Windows 下的数据库使用副本
+	Copy bool `json:"copy"`
+
+	OpenConnections int           `json:"openConnections"`
+	InUse           int           `json:"inUse"`
+	Idle            int           `json:"idle"`
+	WaitCount       int64         `json:"waitCount"`
+	WaitDuration    time.Duration `json:"waitDuration"`
+}
+
+// Stats 数据库句柄统计
+type Stats struct {
+	// Generation 当前快照的编号，每次数据库文件被替换后递增
+	Generation uint64 `json:"generation"`
+
+	// Handles 打开的数据库句柄数，包括旧快照中尚未关闭的句柄
+	Handles int `json:"handles"`
+
+	// Retired 仍被请求引用的旧快照数
+	Retired int `json:"retired"`
+
+	// Pending 已被替换、等待生成新快照的文件数
+	Pending int `json:"pending"`
+
+	// DBs 当前快照中的数据库
+	DBs []Stat `json:"dbs"`
+}
+
+// Shard 一个消息数据库的加载状态
+type Shard struct {
+	Path string `json:"path"`
+
+	// Loaded 是否已读取数据库信息并参与查询，打开或读取失败的数据库不参与查询
+	Loaded bool `json:"loaded"`
+
+	// StartTime、EndTime 数据库覆盖的消息时间范围，数据源不按时间拆分数据库时为空
+	StartTime time.Time `json:"startTime,omitempty"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+}
+
 type DBManager struct {
-	path    string
-	fm      *filemonitor.FileMonitor
-	fgs     map[string]*filemonitor.FileGroup
-	dbs     map[string]*sql.DB
-	dbPaths map[string][]string
-	mutex   sync.RWMutex
+	path  string
+	opts  Options
+	fm    *filemonitor.FileMonitor
+	fgs   map[string]*filemonitor.FileGroup
+	mutex sync.RWMutex
+
+	// 当前快照和仍被引用的旧快照
+	current *Snapshot
+	retired map[*Snapshot]struct{}
+	handles int32
+
+	// 被替换的文件及其所属的分组，稳定后生成新的快照
+	pending   map[string]string
+	timer     *time.Timer
+	callbacks map[string][]func(event fsnotify.Event) error
+	publishMu sync.Mutex
+	closed    bool
+
+	// 最近一次打开失败的原因，用于状态统计
+	openErrs map[string]error
+
+	// 加密数据库的口令派生密钥
+	codecs *sqlcipher.Cache
+
+	// 快照中数据库文件的硬链接
+	linkDir string
+	links   int64
+
+	// 超过 MemLimit 的加密数据库解密到的临时目录
+	plainDir string
 }
 
-func NewDBManager(path string) *DBManager {
-	return &DBManager{
-		path:    path,
-		fm:      filemonitor.NewFileMonitor(),
-		fgs:     make(map[string]*filemonitor.FileGroup),
-		dbs:     make(map[string]*sql.DB),
-		dbPaths: make(map[string][]string),
+func NewDBManager(path string, opts Options) *DBManager {
+	d := &DBManager{
+		path:      path,
+		opts:      opts,
+		fm:        filemonitor.NewFileMonitor(),
+		fgs:       make(map[string]*filemonitor.FileGroup),
+		retired:   make(map[*Snapshot]struct{}),
+		pending:   make(map[string]string),
+		callbacks: make(map[string][]func(event fsnotify.Event) error),
+		openErrs:  make(map[string]error),
+		codecs:    sqlcipher.NewCache(),
 	}
+	d.current = newSnapshot(d, 1)
+	return d
 }
 
 func (d *DBManager) AddGroup(g *Group) error {
@@ -39,7 +167,10 @@ func (d *DBManager) AddGroup(g *Group) error {
 	if err != nil {
 		return err
 	}
-	fg.AddCallback(d.Callback)
+	name := g.Name
+	fg.AddCallback(func(event fsnotify.Event) error {
+		return d.Callback(name, event)
+	})
 	d.fm.AddGroup(fg)
 	d.mutex.Lock()
 	d.fgs[g.Name] = fg
@@ -47,33 +178,34 @@ func (d *DBManager) AddGroup(g *Group) error {
 	return nil
 }
 
+// AddCallback 添加分组的回调，在包含该分组变化文件的新快照生效后调用
 func (d *DBManager) AddCallback(name string, callback func(event fsnotify.Event) error) error {
-	d.mutex.RLock()
-	fg, ok := d.fgs[name]
-	d.mutex.RUnlock()
-	if !ok {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.fgs[name]; !ok {
 		return errors.FileGroupNotFound(name)
 	}
-	fg.AddCallback(callback)
+	d.callbacks[name] = append(d.callbacks[name], callback)
 	return nil
 }
 
-func (d *DBManager) GetDB(name string) (*sql.DB, error) {
-	dbPaths, err := d.GetDBPath(name)
+// GetDB 返回 ctx 固定的快照中分组的第一个数据库
+func (d *DBManager) GetDB(ctx context.Context, name string) (*sql.DB, error) {
+	dbPaths, err := d.GetDBPath(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	return d.OpenDB(dbPaths[0])
+	return d.OpenDB(ctx, dbPaths[0])
 }
 
-func (d *DBManager) GetDBs(name string) ([]*sql.DB, error) {
-	dbPaths, err := d.GetDBPath(name)
+func (d *DBManager) GetDBs(ctx context.Context, name string) ([]*sql.DB, error) {
+	dbPaths, err := d.GetDBPath(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 	dbs := make([]*sql.DB, 0)
 	for _, file := range dbPaths {
-		db, err := d.OpenDB(file)
+		db, err := d.OpenDB(ctx, file)
 		if err != nil {
 			return nil, err
 		}
@@ -82,79 +214,242 @@ func (d *DBManager) GetDBs(name string) ([]*sql.DB, error) {
 	return dbs, nil
 }
 
-func (d *DBManager) GetDBPath(name string) ([]string, error) {
+// GetDBPath 返回 ctx 固定的快照中分组的数据库文件
+func (d *DBManager) GetDBPath(ctx context.Context, name string) ([]string, error) {
+	s := d.snapshot(ctx)
 	d.mutex.RLock()
-	dbPaths, ok := d.dbPaths[name]
+	dbPaths, ok := s.paths[name]
+	fg, found := d.fgs[name]
+	d.mutex.RUnlock()
+	if ok {
+		return dbPaths, nil
+	}
+	if !found {
+		return nil, errors.FileGroupNotFound(name)
+	}
+	list, err := fg.List()
+	if err != nil {
+		return nil, errors.DBFileNotFound(d.path, fg.PatternStr, err)
+	}
+	if len(list) == 0 {
+		return nil, errors.DBFileNotFound(d.path, fg.PatternStr, nil)
+	}
+	d.mutex.Lock()
+	s.paths[name] = list
+	d.mutex.Unlock()
+	return list, nil
+}
+
+// OpenDB 返回 ctx 固定的快照中的数据库句柄，第一次使用时打开
+func (d *DBManager) OpenDB(ctx context.Context, path string) (*sql.DB, error) {
+	s := d.snapshot(ctx)
+	d.mutex.RLock()
+	h, ok := s.files[path]
 	d.mutex.RUnlock()
 	if !ok {
-		d.mutex.RLock()
-		fg, ok := d.fgs[name]
-		d.mutex.RUnlock()
-		if !ok {
-			return nil, errors.FileGroupNotFound(name)
+		// 快照生成后新出现的文件，在第一次使用时链接
+		h = d.freeze(path)
+		d.mutex.Lock()
+		if frozen, ok := s.files[path]; ok {
+			d.mutex.Unlock()
+			d.closeHandle(h)
+			h = frozen
+		} else {
+			s.files[path] = h
+			d.mutex.Unlock()
 		}
-		list, err := fg.List()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.db != nil {
+		return h.db, nil
+	}
+	db, mem, err := d.open(h)
+	d.mutex.Lock()
+	if err != nil {
+		d.openErrs[path] = err
+	} else {
+		delete(d.openErrs, path)
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	h.db, h.mem, h.openedAt = db, mem, time.Now()
+	atomic.AddInt32(&d.handles, 1)
+	return db, nil
+}
+
+// open 打开快照中的数据库文件，加密的数据库同时返回解密到内存中的数据库，关闭连接后需要释放
+func (d *DBManager) open(h *handle) (*sql.DB, *memDB, error) {
+	encrypted, err := sqlcipher.IsEncrypted(h.link)
+	if err != nil {
+		return nil, nil, err
+	}
+	if encrypted {
+		mem, err := d.decryptMem(h.link)
 		if err != nil {
-			return nil, errors.DBFileNotFound(d.path, fg.PatternStr, err)
+			log.Err(err).Msgf("解密数据库 %s 失败", h.path)
+			return nil, nil, err
 		}
-		if len(list) == 0 {
-			return nil, errors.DBFileNotFound(d.path, fg.PatternStr, nil)
+		db := sql.OpenDB(&connector{
+			dsn:    mem.dsn(d.opts),
+			driver: d.opts.driver(),
+		})
+		db.SetMaxOpenConns(d.opts.maxOpenConns())
+		db.SetMaxIdleConns(d.opts.maxIdleConns())
+		return db, mem, nil
+	}
+
+	tempPath := h.link
+	if runtime.GOOS == "windows" {
+		tempPath, err = filecopy.GetTempCopy(h.link)
+		if err != nil {
+			log.Err(err).Msgf("获取临时拷贝文件 %s 失败", h.path)
+			return nil, nil, err
 		}
-		dbPaths = list
-		d.mutex.Lock()
-		d.dbPaths[name] = dbPaths
-		d.mutex.Unlock()
 	}
-	return dbPaths, nil
+
+	// 临时副本和硬链接不会再被修改，没有 WAL 时可以按 immutable 打开，跳过文件锁和变更检查
+	// 不支持硬链接时直接打开原始文件，文件仍可能被微信或自动解密更新，只按只读打开
+	_, err = os.Stat(tempPath + "-wal")
+	immutable := tempPath != h.path && os.IsNotExist(err)
+	db := sql.OpenDB(&connector{
+		dsn:    d.opts.dsn(tempPath, immutable),
+		driver: d.opts.driver(),
+	})
+	db.SetMaxOpenConns(d.opts.maxOpenConns())
+	db.SetMaxIdleConns(d.opts.maxIdleConns())
+	return db, nil, nil
 }
 
-func (d *DBManager) OpenDB(path string) (*sql.DB, error) {
+// WithTimeout 为一次数据源调用设置查询期限，调用中的 QueryContext 都应使用返回的 ctx
+func (d *DBManager) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := d.opts.QueryTimeout
+	if timeout == 0 {
+		timeout = DefaultQueryTimeout
+	}
+	if timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Begin 固定当前快照并设置查询期限，数据源的每次调用都从这里开始，结束时调用返回的函数
+// method 为数据源方法名，调用结束时记录耗时
+func (d *DBManager) Begin(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, release := d.Pin(ctx)
+	ctx, cancel := d.WithTimeout(ctx)
+	return ctx, func() {
+		cancel()
+		release()
+		metrics.ObserveDBQuery(d.opts.Name, method, time.Since(start))
+	}
+}
+
+// Stats 返回当前快照中数据库的连接池状态，并逐个检查连接是否可用
+func (d *DBManager) Stats(ctx context.Context) *Stats {
+	ctx, release := d.Begin(ctx, "Stats")
+	defer release()
+	s := d.snapshot(ctx)
+
 	d.mutex.RLock()
-	db, ok := d.dbs[path]
-	d.mutex.RUnlock()
-	if ok {
-		return db, nil
+	stats := &Stats{
+		Generation: s.gen,
+		Handles:    int(atomic.LoadInt32(&d.handles)),
+		Retired:    len(d.retired),
+		Pending:    len(d.pending),
+		DBs:        make([]Stat, 0, len(s.files)+len(d.openErrs)),
 	}
-	var err error
-	tempPath := path
-	if runtime.GOOS == "windows" {
-		tempPath, err = filecopy.GetTempCopy(path)
-		if err != nil {
-			log.Err(err).Msgf("获取临时拷贝文件 %s 失败", path)
-			return nil, err
+	dbs := make(map[string]*sql.DB, len(s.files))
+	for path, h := range s.files {
+		h.mu.Lock()
+		if h.db != nil {
+			dbs[path] = h.db
+			stats.DBs = append(stats.DBs, Stat{
+				Path:     path,
+				OpenedAt: h.openedAt,
+				Copy:     h.mem != nil || h.link != path || runtime.GOOS == "windows",
+			})
 		}
+		h.mu.Unlock()
 	}
-	db, err = sql.Open("sqlite3", tempPath)
-	if err != nil {
-		log.Err(err).Msgf("连接数据库 %s 失败", path)
-		return nil, err
+	for path, err := range d.openErrs {
+		if _, ok := dbs[path]; !ok {
+			stats.DBs = append(stats.DBs, Stat{Path: path, Error: err.Error()})
+		}
 	}
-	d.mutex.Lock()
-	d.dbs[path] = db
-	d.mutex.Unlock()
-	return db, nil
+	d.mutex.RUnlock()
+
+	for i := range stats.DBs {
+		st := &stats.DBs[i]
+		db, ok := dbs[st.Path]
+		if !ok {
+			continue
+		}
+		if err := db.PingContext(ctx); err != nil {
+			st.Error = err.Error()
+		} else {
+			st.Healthy = true
+		}
+		s := db.Stats()
+		st.OpenConnections = s.OpenConnections
+		st.InUse = s.InUse
+		st.Idle = s.Idle
+		st.WaitCount = s.WaitCount
+		st.WaitDuration = s.WaitDuration
+	}
+	sort.Slice(stats.DBs, func(i, j int) bool {
+		return stats.DBs[i].Path < stats.DBs[j].Path
+	})
+	return stats
 }
 
-func (d *DBManager) Callback(event fsnotify.Event) error {
+// Callback 记录被替换的数据库文件，文件稳定后生成新的快照
+func (d *DBManager) Callback(group string, event fsnotify.Event) error {
 	if !event.Op.Has(fsnotify.Create) {
 		return nil
 	}
 
 	d.mutex.Lock()
-	db, ok := d.dbs[event.Name]
-	if ok {
-		delete(d.dbs, event.Name)
-		go func(db *sql.DB) {
-			time.Sleep(time.Second * 5)
-			db.Close()
-		}(db)
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.pending[event.Name] = group
+	if d.timer == nil {
+		d.timer = time.AfterFunc(SettleTime, d.settle)
+	} else {
+		d.timer.Reset(SettleTime)
 	}
-	d.mutex.Unlock()
-
 	return nil
 }
 
+// Start 为所有分组的文件生成第一个快照并开始监控文件替换
 func (d *DBManager) Start() error {
+	d.mutex.RLock()
+	groups := make([]string, 0, len(d.fgs))
+	for name := range d.fgs {
+		groups = append(groups, name)
+	}
+	d.mutex.RUnlock()
+
+	d.sweepLinks()
+	files, paths := d.freezeGroups(groups, nil)
+	d.mutex.Lock()
+	for path, h := range files {
+		if _, ok := d.current.files[path]; ok {
+			d.closeHandle(h)
+			continue
+		}
+		d.current.files[path] = h
+	}
+	for name, list := range paths {
+		d.current.paths[name] = list
+	}
+	d.mutex.Unlock()
 	return d.fm.Start()
 }
 
@@ -162,9 +457,189 @@ func (d *DBManager) Stop() error {
 	return d.fm.Stop()
 }
 
+// Close 停止监控并关闭所有快照中的句柄
 func (d *DBManager) Close() error {
-	for _, db := range d.dbs {
-		db.Close()
+	d.mutex.Lock()
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	closing := make(map[*handle]struct{})
+	for _, s := range append(d.retiredList(), d.current) {
+		for _, h := range s.files {
+			closing[h] = struct{}{}
+		}
+		s.files = make(map[string]*handle)
+	}
+	d.retired = make(map[*Snapshot]struct{})
+	d.mutex.Unlock()
+
+	for h := range closing {
+		d.closeHandle(h)
+	}
+	if d.linkDir != "" {
+		os.RemoveAll(d.linkDir)
+	}
+	if d.plainDir != "" {
+		os.RemoveAll(d.plainDir)
 	}
 	return d.fm.Stop()
 }
+
+// linkTemp 在工作目录的 LinkDir 中为数据库文件创建硬链接，同时链接 WAL 文件
+// 文件被替换后链接仍指向旧文件，旧快照打开数据库或新建连接时读取的都是替换前的内容
+// 文件系统不支持硬链接时返回空字符串
+func (d *DBManager) linkTemp(path string) string {
+	d.mutex.Lock()
+	if d.linkDir == "" {
+		root := filepath.Join(d.path, LinkDir)
+		if err := os.MkdirAll(root, 0755); err != nil {
+			d.mutex.Unlock()
+			return ""
+		}
+		dir, err := os.MkdirTemp(root, strconv.Itoa(os.Getpid())+"-")
+		if err != nil {
+			d.mutex.Unlock()
+			return ""
+		}
+		d.linkDir = dir
+	}
+	d.links++
+	link := filepath.Join(d.linkDir, fmt.Sprintf("%s.%d", filepath.Base(path), d.links))
+	d.mutex.Unlock()
+
+	if err := os.Link(path, link); err != nil {
+		log.Debug().Err(err).Msgf("创建数据库 %s 的硬链接失败", path)
+		return ""
+	}
+	if _, err := os.Stat(path + "-wal"); err == nil {
+		if err := os.Link(path+"-wal", link+"-wal"); err != nil {
+			removeTemp(link)
+			return ""
+		}
+	}
+	return link
+}
+
+// sweepLinks 删除 LinkDir 中已退出的进程留下的硬链接目录
+func (d *DBManager) sweepLinks() {
+	sweepDirs(filepath.Join(d.path, LinkDir))
+}
+
+// sweepDirs 删除 root 中已退出的进程留下的目录
+// 目录名以创建它的进程号开头，进程异常退出时 Close 没有机会删除
+func sweepDirs(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		pid, _, _ := strings.Cut(entry.Name(), "-")
+		if n, err := strconv.Atoi(pid); err == nil && n > 0 {
+			if n == os.Getpid() {
+				continue
+			}
+			if exists, err := process.PidExists(int32(n)); err != nil || exists {
+				continue
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			log.Debug().Err(err).Msgf("删除残留的目录 %s 失败", entry.Name())
+		}
+	}
+}
+
+// removeTemp 删除硬链接及 SQLite 生成的附属文件
+func removeTemp(tempPath string) {
+	if tempPath == "" {
+		return
+	}
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		os.Remove(tempPath + suffix)
+	}
+}
+
+// dsn 生成只读的 SQLite URI，go-sqlite3 的连接参数以下划线开头
+func (o Options) dsn(path string, immutable bool) string {
+	busyTimeout := o.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = DefaultBusyTimeout
+	}
+	params := url.Values{}
+	params.Set("mode", "ro")
+	if immutable {
+		params.Set("immutable", "1")
+	}
+	params.Set("_busy_timeout", strconv.FormatInt(busyTimeout.Milliseconds(), 10))
+	params.Set("_query_only", "1")
+	if o.CacheSize > 0 {
+		// 负数表示以 KiB 为单位
+		params.Set("_cache_size", strconv.Itoa(-o.CacheSize))
+	}
+	return fileURI(path) + "?" + params.Encode()
+}
+
+// memDSN 生成打开内存数据库的 URI，连接共享 keeper 连接中的页面
+func (o Options) memDSN(name string) string {
+	return o.dsn(name, false) + "&vfs=memdb"
+}
+
+// driver go-sqlite3 没有设置 mmap_size 的连接参数，在建立连接时执行 PRAGMA
+func (o Options) driver() *sqlite3.SQLiteDriver {
+	drv := &sqlite3.SQLiteDriver{}
+	if o.MmapSize > 0 {
+		pragma := fmt.Sprintf("PRAGMA mmap_size = %d", o.MmapSize)
+		drv.ConnectHook = func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec(pragma, nil)
+			return err
+		}
+	}
+	return drv
+}
+
+func (o Options) memLimit() int64 {
+	if o.MemLimit == 0 {
+		return DefaultMemLimit
+	}
+	return o.MemLimit
+}
+
+func (o Options) maxOpenConns() int {
+	if o.MaxOpenConns > 0 {
+		return o.MaxOpenConns
+	}
+	return DefaultMaxOpenConns
+}
+
+func (o Options) maxIdleConns() int {
+	if o.MaxIdleConns > 0 {
+		return o.MaxIdleConns
+	}
+	return DefaultMaxIdleConns
+}
+
+// fileURI 将文件路径转换为 SQLite URI，Windows 盘符前需要加 /
+func fileURI(path string) string {
+	p := filepath.ToSlash(path)
+	if len(p) > 1 && p[1] == ':' {
+		p = "/" + p
+	}
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(p)
+}
+
+// connector 使用独立的驱动实例，使每个 DBManager 的连接参数互不影响
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
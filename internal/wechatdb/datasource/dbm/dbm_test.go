@@ -1,6 +1,7 @@
 package dbm
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -15,13 +16,13 @@ func TestXxx(t *testing.T) {
 		BlackList: []string{},
 	}
 
-	d := NewDBManager(path)
+	d := NewDBManager(path, Options{})
 	d.AddGroup(g)
 	d.Start()
 
 	i := 0
 	for {
-		db, err := d.GetDB("session")
+		db, err := d.GetDB(context.Background(), "session")
 		if err != nil {
 			fmt.Println(err)
 			break
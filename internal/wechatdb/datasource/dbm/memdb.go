@@ -0,0 +1,196 @@
+package dbm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
+)
+
+const (
+	// DefaultMemLimit 解密到内存的加密数据库的最大大小，更大的数据库解密到临时文件
+	DefaultMemLimit = 256 << 20
+
+	// PlainDir 系统临时目录中存放解密后数据库的目录
+	PlainDir = "chatlog-plain"
+)
+
+// memSeq 进程内内存数据库的编号
+var memSeq uint64
+
+// memDB 解密后的数据库
+// go-sqlite3 不支持 SQLCipher，加密的工作目录数据库不超过 MemLimit 时解密到 memdb VFS 中，明文不落盘；
+// keeper 连接存活期间，同名的 memdb 连接共享同一份页面，关闭 keeper 后内存被释放。
+// 更大的数据库全部放在内存中会占用数倍于文件大小的内存，解密到系统临时目录中只有当前用户可以访问的文件，
+// 由页缓存按需读取，关闭后删除
+type memDB struct {
+	name   string
+	keeper *sqlite3.SQLiteConn
+
+	// file 解密到的临时文件，为空表示在内存中
+	file string
+}
+
+// decryptMem 使用工作目录口令解密加密数据库，按大小选择放在内存中或临时文件中
+func (d *DBManager) decryptMem(path string) (*memDB, error) {
+	if len(d.opts.WorkKey) == 0 {
+		return nil, errors.DBConnectFailed(path, fmt.Errorf("database is encrypted, work key is required"))
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if limit := d.opts.memLimit(); limit >= 0 && stat.Size() > limit {
+		return d.decryptFile(path)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(int(stat.Size()))
+	if err := sqlcipher.DecryptFile(context.Background(), path, d.opts.WorkKey, d.codecs, &buf); err != nil {
+		return nil, err
+	}
+	return loadMem(&buf)
+}
+
+// decryptFile 将加密数据库解密到临时文件
+func (d *DBManager) decryptFile(path string) (*memDB, error) {
+	dir, err := d.plainTemp()
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	m := &memDB{file: fp.Name()}
+	log.Debug().Msgf("数据库 %s 超过内存解密的大小上限，解密到临时文件", path)
+
+	err = sqlcipher.DecryptFile(context.Background(), path, d.opts.WorkKey, d.codecs, fp)
+	if err == nil {
+		err = rollbackHeader(fp)
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// plainTemp 返回本进程存放解密数据库的临时目录，第一次调用时创建并清理已退出进程留下的目录
+func (d *DBManager) plainTemp() (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.plainDir != "" {
+		return d.plainDir, nil
+	}
+	root := filepath.Join(os.TempDir(), PlainDir)
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return "", err
+	}
+	sweepDirs(root)
+	dir, err := os.MkdirTemp(root, strconv.Itoa(os.Getpid())+"-")
+	if err != nil {
+		return "", err
+	}
+	d.plainDir = dir
+	return dir, nil
+}
+
+// rollbackHeader 文件头中的读写版本改回回滚日志模式，按 immutable 打开时不查找 WAL 文件
+func rollbackHeader(fp *os.File) error {
+	version := make([]byte, 2)
+	if _, err := fp.ReadAt(version, 18); err != nil {
+		return err
+	}
+	if version[0] != 2 {
+		return nil
+	}
+	_, err := fp.WriteAt([]byte{1, 1}, 18)
+	return err
+}
+
+// loadMem 将明文数据库内容载入新的 memdb 数据库
+// Deserialize 得到的数据库只属于一个连接，通过备份复制到可以共享的 memdb 数据库中；
+// Deserialize 会复制一份内容，复制后清空 buf，备份期间不再同时持有三份数据
+func loadMem(buf *bytes.Buffer) (*memDB, error) {
+	plain := buf.Bytes()
+	size := int64(len(plain))
+	// memdb 不支持 WAL，文件头中的读写版本改回回滚日志模式
+	if len(plain) > 19 && plain[18] == 2 {
+		plain[18], plain[19] = 1, 1
+	}
+
+	drv := &sqlite3.SQLiteDriver{}
+	conn, err := drv.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	src := conn.(*sqlite3.SQLiteConn)
+	defer src.Close()
+	err = src.Deserialize(plain, "main")
+	plain = nil
+	*buf = bytes.Buffer{}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &memDB{name: fmt.Sprintf("/chatlog_%d_%d", os.Getpid(), atomic.AddUint64(&memSeq, 1))}
+	conn, err = drv.Open("file:" + m.name + "?vfs=memdb")
+	if err != nil {
+		return nil, err
+	}
+	m.keeper = conn.(*sqlite3.SQLiteConn)
+
+	// memdb 默认最大 1 GiB，只读的数据库不会再增长，上限设为数据库大小
+	if err := m.keeper.SetFileControlInt64("main", sqlite3.SQLITE_FCNTL_SIZE_LIMIT, size); err != nil {
+		m.close()
+		return nil, err
+	}
+	backup, err := m.keeper.Backup("main", src, "main")
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	_, err = backup.Step(-1)
+	if ferr := backup.Finish(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		m.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// dsn 生成打开解密后数据库的 URI，临时文件不会再被修改，按 immutable 打开
+func (m *memDB) dsn(o Options) string {
+	if m.file != "" {
+		return o.dsn(m.file, true)
+	}
+	return o.memDSN(m.name)
+}
+
+func (m *memDB) close() {
+	if m == nil {
+		return
+	}
+	if m.keeper != nil {
+		m.keeper.Close()
+	}
+	if m.file != "" {
+		removeTemp(m.file)
+	}
+}
@@ -0,0 +1,171 @@
+package dbm
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/sqlcipher"
+)
+
+// writeEncryptedDB 创建 WAL 模式、保留区域为 80 字节的数据库，并使用口令加密到 path
+func writeEncryptedDB(t *testing.T, path string, key string, value int) {
+	t.Helper()
+	plain := filepath.Join(t.TempDir(), "plain.db")
+	drv := &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.SetFileControlInt("main", sqlite3.SQLITE_FCNTL_RESERVE_BYTES, 80)
+		},
+	}
+	conn, err := drv.Open(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*sqlite3.SQLiteConn)
+	if _, err := c.Exec("PRAGMA journal_mode = WAL; CREATE TABLE t (x INTEGER)", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Exec("INSERT INTO t VALUES (?)", []driver.Value{int64(value)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Exec("PRAGMA wal_checkpoint(TRUNCATE)", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := sqlcipher.EncryptFile(context.Background(), plain, key, fp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeEncryptedDB(t, a, "secret", 7)
+
+	d := NewDBManager(dir, Options{WorkKey: "secret"})
+	if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, release := d.Pin(context.Background())
+	// 多个连接共享同一份解密后的页面
+	if readDB(t, ctx, d, a) != 7 || readDB(t, ctx, d, a) != 7 {
+		t.Fatal("unexpected value")
+	}
+	release()
+	stats := d.Stats(context.Background())
+	if len(stats.DBs) != 1 || !stats.DBs[0].Healthy || !stats.DBs[0].Copy {
+		t.Fatalf("stats = %+v", stats.DBs)
+	}
+
+	// 明文不写入工作目录
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path == a {
+			return nil
+		}
+		if encrypted, err := sqlcipher.IsEncrypted(path); err == nil && !encrypted {
+			t.Errorf("plaintext file %s in work dir", path)
+		}
+		return nil
+	})
+
+	d.Close()
+}
+
+func TestOpenEncryptedWithoutKey(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeEncryptedDB(t, a, "secret", 1)
+
+	for _, key := range []string{"", "wrong"} {
+		d := NewDBManager(dir, Options{WorkKey: key})
+		if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.OpenDB(context.Background(), a); err == nil {
+			t.Errorf("opened with key %q", key)
+		}
+		d.Close()
+	}
+}
+
+// 超过内存上限的数据库解密到系统临时目录，关闭后删除
+func TestOpenEncryptedLarge(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeEncryptedDB(t, a, "secret", 9)
+
+	d := NewDBManager(dir, Options{WorkKey: "secret", MemLimit: 1})
+	if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, release := d.Pin(context.Background())
+	if readDB(t, ctx, d, a) != 9 || readDB(t, ctx, d, a) != 9 {
+		t.Fatal("unexpected value")
+	}
+	release()
+
+	h := d.current.files[a]
+	if h == nil || h.mem == nil || h.mem.file == "" || h.mem.keeper != nil {
+		t.Fatalf("not decrypted to a file: %+v", h)
+	}
+	file := h.mem.file
+	if rel, err := filepath.Rel(filepath.Join(tmp, PlainDir), file); err != nil || filepath.IsAbs(rel) || rel[0] == '.' {
+		t.Errorf("plain file %s outside the temp dir", file)
+	}
+	if encrypted, err := sqlcipher.IsEncrypted(file); err != nil || encrypted {
+		t.Errorf("temp file encrypted %v, %v", encrypted, err)
+	}
+	if stat, err := os.Stat(filepath.Dir(file)); err != nil || stat.Mode().Perm() != 0700 {
+		t.Errorf("temp dir mode %v, %v", stat.Mode(), err)
+	}
+
+	d.Close()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("temp file kept after close: %v", err)
+	}
+}
+
+func TestLoadMemReleasesBuffer(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeEncryptedDB(t, a, "secret", 3)
+
+	var buf bytes.Buffer
+	if err := sqlcipher.DecryptFile(context.Background(), a, "secret", sqlcipher.NewCache(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadMem(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	if buf.Cap() != 0 {
+		t.Errorf("plain buffer kept: %d bytes", buf.Cap())
+	}
+	if m.file != "" || m.keeper == nil {
+		t.Errorf("not loaded into memory: %+v", m)
+	}
+}
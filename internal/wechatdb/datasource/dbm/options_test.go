@@ -0,0 +1,71 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenDBReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a #1.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE t (x INTEGER); INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	d := NewDBManager(dir, Options{QueryTimeout: time.Second, MmapSize: 1 << 20, CacheSize: 1024})
+	defer d.Close()
+	if err := d.AddGroup(&Group{Name: "t", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	db, err = d.GetDB(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := d.WithTimeout(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("query deadline not set")
+	}
+	var x int
+	if err := db.QueryRowContext(ctx, "SELECT x FROM t").Scan(&x); err != nil || x != 1 {
+		t.Fatalf("query = %d, %v", x, err)
+	}
+	var mmap int64
+	if err := db.QueryRowContext(ctx, "PRAGMA mmap_size").Scan(&mmap); err != nil || mmap != 1<<20 {
+		t.Errorf("mmap_size = %d, %v", mmap, err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (2)"); err == nil {
+		t.Error("write to read-only database succeeded")
+	}
+
+	stats := d.Stats(context.Background())
+	if stats.Handles != 1 || len(stats.DBs) != 1 || !stats.DBs[0].Healthy {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestFileURI(t *testing.T) {
+	tests := map[string]string{
+		"/tmp/a #1?.db":    "file:/tmp/a %231%3f.db",
+		`C:\Users\a\b.db`:  "file:/C:/Users/a/b.db",
+		"/tmp/100%/msg.db": "file:/tmp/100%25/msg.db",
+	}
+	for path, want := range tests {
+		if filepath.Separator == '/' && strings.Contains(path, `\`) {
+			continue
+		}
+		if got := fileURI(path); got != want {
+			t.Errorf("fileURI(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
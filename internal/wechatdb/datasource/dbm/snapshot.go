@@ -0,0 +1,322 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// SettleTime 最后一个文件被替换后等待的时间，期间的替换合并到同一个快照
+var SettleTime = time.Second
+
+// holds 正在解密的工作目录及其未结束的解密数
+var (
+	holds  = make(map[string]int)
+	holdMu sync.Mutex
+)
+
+// Snapshot 一组一致的数据库文件
+// 快照生成时为每个文件创建硬链接，文件被替换后快照读取的仍是替换前的内容；
+// 所有变化的文件都解密完成后才生成新的快照，未变化的文件沿用旧快照中的句柄。
+// 请求开始时固定当前快照，旧快照不再被引用后关闭独占的句柄
+type Snapshot struct {
+	d     *DBManager
+	gen   uint64
+	files map[string]*handle
+	paths map[string][]string
+	pins  int
+}
+
+// handle 快照中的一个数据库文件，可以被多个快照共享，没有快照引用时关闭并删除链接
+type handle struct {
+	path string
+	link string
+	refs int
+
+	// 第一次使用时打开
+	mu       sync.Mutex
+	db       *sql.DB
+	mem      *memDB
+	openedAt time.Time
+}
+
+type snapshotKey struct{}
+
+func newSnapshot(d *DBManager, gen uint64) *Snapshot {
+	return &Snapshot{
+		d:     d,
+		gen:   gen,
+		files: make(map[string]*handle),
+		paths: make(map[string][]string),
+	}
+}
+
+// Pin 固定当前快照并放入 ctx，ctx 中已固定快照时沿用，请求结束时调用返回的函数
+func (d *DBManager) Pin(ctx context.Context) (context.Context, func()) {
+	if s, ok := ctx.Value(snapshotKey{}).(*Snapshot); ok && s.d == d {
+		return ctx, func() {}
+	}
+	d.mutex.Lock()
+	s := d.current
+	s.pins++
+	d.mutex.Unlock()
+
+	var once sync.Once
+	return context.WithValue(ctx, snapshotKey{}, s), func() {
+		once.Do(s.release)
+	}
+}
+
+// snapshot 返回 ctx 固定的快照，没有固定时返回当前快照，此时返回的句柄可能在快照切换后被关闭
+func (d *DBManager) snapshot(ctx context.Context) *Snapshot {
+	if s, ok := ctx.Value(snapshotKey{}).(*Snapshot); ok && s.d == d {
+		return s
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.current
+}
+
+func (s *Snapshot) release() {
+	d := s.d
+	d.mutex.Lock()
+	s.pins--
+	var closing []*handle
+	if s.pins == 0 && s != d.current {
+		closing = d.retire(s)
+	}
+	d.mutex.Unlock()
+
+	for _, h := range closing {
+		d.closeHandle(h)
+	}
+}
+
+// retire 释放快照对句柄的引用，返回不再被任何快照引用的句柄，调用时需要持有锁
+func (d *DBManager) retire(s *Snapshot) []*handle {
+	delete(d.retired, s)
+	var closing []*handle
+	for _, h := range s.files {
+		h.refs--
+		if h.refs == 0 {
+			closing = append(closing, h)
+		}
+	}
+	s.files = make(map[string]*handle)
+	return closing
+}
+
+func (d *DBManager) retiredList() []*Snapshot {
+	list := make([]*Snapshot, 0, len(d.retired))
+	for s := range d.retired {
+		list = append(list, s)
+	}
+	return list
+}
+
+// freeze 为文件创建硬链接，不支持硬链接时使用原始路径
+func (d *DBManager) freeze(path string) *handle {
+	link := d.linkTemp(path)
+	if link == "" {
+		link = path
+	}
+	return &handle{path: path, link: link, refs: 1}
+}
+
+// freezeGroups 读取分组的文件列表，为其中不在 keep 中的文件创建硬链接
+func (d *DBManager) freezeGroups(groups []string, keep map[string]*handle) (map[string]*handle, map[string][]string) {
+	files := make(map[string]*handle)
+	paths := make(map[string][]string)
+	for _, name := range groups {
+		d.mutex.RLock()
+		fg, ok := d.fgs[name]
+		d.mutex.RUnlock()
+		if !ok {
+			continue
+		}
+		list, err := fg.List()
+		if err != nil || len(list) == 0 {
+			continue
+		}
+		paths[name] = list
+		for _, path := range list {
+			if _, ok := keep[path]; !ok {
+				files[path] = d.freeze(path)
+			}
+		}
+	}
+	return files, paths
+}
+
+func (d *DBManager) closeHandle(h *handle) {
+	h.mu.Lock()
+	if h.db != nil {
+		h.db.Close()
+		h.mem.close()
+		h.mem = nil
+		atomic.AddInt32(&d.handles, -1)
+		h.db = nil
+	}
+	h.mu.Unlock()
+	if h.link != h.path {
+		removeTemp(h.link)
+	}
+}
+
+// settle 被替换的文件稳定后生成新的快照，仍有文件在解密时继续等待
+func (d *DBManager) settle() {
+	if d.decrypting() {
+		d.mutex.Lock()
+		if !d.closed {
+			d.timer.Reset(SettleTime)
+		}
+		d.mutex.Unlock()
+		return
+	}
+	d.publish()
+}
+
+// Hold 标记工作目录 dir 正在解密，使用该目录的 DBManager 在所有解密结束前不会切换到新的快照
+// 解密结束时调用返回的函数，多次调用只生效一次
+func Hold(dir string) func() {
+	key := holdKey(dir)
+	holdMu.Lock()
+	holds[key]++
+	holdMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			holdMu.Lock()
+			if holds[key]--; holds[key] <= 0 {
+				delete(holds, key)
+			}
+			holdMu.Unlock()
+		})
+	}
+}
+
+func holdKey(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
+
+// decrypting 工作目录是否有未结束的解密
+func (d *DBManager) decrypting() bool {
+	holdMu.Lock()
+	defer holdMu.Unlock()
+	return holds[holdKey(d.path)] > 0
+}
+
+// publish 生成新的快照，被替换的文件重新链接，其所属分组的文件列表重新读取
+func (d *DBManager) publish() {
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+
+	d.mutex.Lock()
+	if d.closed || len(d.pending) == 0 {
+		d.mutex.Unlock()
+		return
+	}
+	changed := d.pending
+	d.pending = make(map[string]string)
+
+	groupSet := make(map[string]bool)
+	for path, group := range changed {
+		groupSet[group] = true
+		delete(d.openErrs, path)
+	}
+	groups := make([]string, 0, len(groupSet))
+	for group := range groupSet {
+		groups = append(groups, group)
+	}
+
+	// 未被替换的文件沿用当前快照中的句柄
+	keep := make(map[string]*handle, len(d.current.files))
+	for path, h := range d.current.files {
+		if _, ok := changed[path]; !ok {
+			keep[path] = h
+		}
+	}
+	d.mutex.Unlock()
+
+	files, paths := d.freezeGroups(groups, keep)
+	for path := range changed {
+		if _, ok := files[path]; !ok {
+			if _, err := os.Stat(path); err == nil {
+				files[path] = d.freeze(path)
+			}
+		}
+	}
+
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		for _, h := range files {
+			d.closeHandle(h)
+		}
+		return
+	}
+	old := d.current
+	next := newSnapshot(d, old.gen+1)
+	for path, h := range old.files {
+		if _, ok := changed[path]; ok {
+			continue
+		}
+		h.refs++
+		next.files[path] = h
+	}
+	var closing []*handle
+	for path, h := range files {
+		if _, ok := next.files[path]; ok {
+			// 快照生成期间被旧快照按需链接的文件
+			closing = append(closing, h)
+			continue
+		}
+		next.files[path] = h
+	}
+	for name, list := range old.paths {
+		if !groupSet[name] {
+			next.paths[name] = list
+		}
+	}
+	for name, list := range paths {
+		next.paths[name] = list
+	}
+	d.current = next
+
+	if old.pins == 0 {
+		closing = append(closing, d.retire(old)...)
+	} else {
+		d.retired[old] = struct{}{}
+	}
+
+	callbacks := make(map[string][]func(event fsnotify.Event) error, len(groups))
+	for _, group := range groups {
+		callbacks[group] = d.callbacks[group]
+	}
+	d.mutex.Unlock()
+
+	for _, h := range closing {
+		d.closeHandle(h)
+	}
+	log.Debug().Msgf("数据库快照 %d 生效，%d 个文件被替换", next.gen, len(changed))
+
+	for path, group := range changed {
+		event := fsnotify.Event{Name: path, Op: fsnotify.Create}
+		for _, callback := range callbacks[group] {
+			if err := callback(event); err != nil {
+				log.Debug().Err(err).Msgf("数据库 %s 的回调失败", path)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func writeDB(t *testing.T, path string, value int) {
+	t.Helper()
+	tmp := path + ".tmp"
+	db, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE t (x INTEGER); INSERT INTO t VALUES (?)", value); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readDB(t *testing.T, ctx context.Context, d *DBManager, path string) int {
+	t.Helper()
+	db, err := d.OpenDB(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 使用独立的连接，确认旧快照新建的连接也读取替换前的文件
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var x int
+	if err := conn.QueryRowContext(ctx, "SELECT x FROM t").Scan(&x); err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func TestSnapshotSwap(t *testing.T) {
+	settle := SettleTime
+	SettleTime = 20 * time.Millisecond
+	defer func() { SettleTime = settle }()
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.db"), filepath.Join(dir, "b.db")
+	writeDB(t, a, 1)
+	writeDB(t, b, 1)
+
+	d := NewDBManager(dir, Options{})
+	defer d.Close()
+	if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan string, 2)
+	d.AddCallback("g", func(event fsnotify.Event) error {
+		notified <- event.Name
+		return nil
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	old, release := d.Pin(context.Background())
+	if readDB(t, old, d, a) != 1 {
+		t.Fatal("unexpected initial value")
+	}
+
+	// 解密未结束时不切换快照
+	unhold := Hold(dir)
+	writeDB(t, a, 2)
+	d.Callback("g", fsnotify.Event{Name: a, Op: fsnotify.Create})
+	time.Sleep(5 * SettleTime)
+	if gen := d.Stats(context.Background()).Generation; gen != 1 {
+		t.Fatalf("generation = %d while decrypting", gen)
+	}
+
+	writeDB(t, b, 2)
+	d.Callback("g", fsnotify.Event{Name: b, Op: fsnotify.Create})
+	unhold()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatal("new snapshot not published")
+		}
+	}
+	if gen := d.Stats(context.Background()).Generation; gen != 2 {
+		t.Fatalf("generation = %d, want 2", gen)
+	}
+
+	// 旧快照仍读取替换前的两个文件，新快照读取替换后的两个文件
+	if x, y := readDB(t, old, d, a), readDB(t, old, d, b); x != 1 || y != 1 {
+		t.Errorf("old snapshot = %d, %d", x, y)
+	}
+	ctx, release2 := d.Pin(context.Background())
+	defer release2()
+	if x, y := readDB(t, ctx, d, a), readDB(t, ctx, d, b); x != 2 || y != 2 {
+		t.Errorf("new snapshot = %d, %d", x, y)
+	}
+
+	stats := d.Stats(context.Background())
+	if stats.Retired != 1 || stats.Handles != 4 {
+		t.Errorf("before release: retired %d, handles %d", stats.Retired, stats.Handles)
+	}
+	release()
+	stats = d.Stats(context.Background())
+	if stats.Retired != 0 || stats.Handles != 2 {
+		t.Errorf("after release: retired %d, handles %d", stats.Retired, stats.Handles)
+	}
+}
+
+func TestSweepLinks(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeDB(t, a, 1)
+
+	// 异常退出的进程留下的硬链接目录，以及仍在运行的进程的目录
+	root := filepath.Join(dir, LinkDir)
+	stale := filepath.Join(root, "999999999-1")
+	live := filepath.Join(root, strconv.Itoa(os.Getppid())+"-1")
+	for _, p := range []string{stale, live} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(a, filepath.Join(p, "a.db.1")); err != nil {
+			t.Skipf("hard links not supported: %v", err)
+		}
+	}
+
+	d := NewDBManager(dir, Options{})
+	defer d.Close()
+	if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale link dir not removed: %v", err)
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("link dir of a running process removed: %v", err)
+	}
+}
+
+// 不支持硬链接时快照直接使用原始文件
+func TestFreezeWithoutLinks(t *testing.T) {
+	settle := SettleTime
+	SettleTime = 20 * time.Millisecond
+	defer func() { SettleTime = settle }()
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.db")
+	writeDB(t, a, 1)
+	// LinkDir 无法创建时 linkTemp 失败
+	if err := os.WriteFile(filepath.Join(dir, LinkDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDBManager(dir, Options{})
+	defer d.Close()
+	if err := d.AddGroup(&Group{Name: "g", Pattern: `\.db$`}); err != nil {
+		t.Fatal(err)
+	}
+	notified := make(chan string, 1)
+	d.AddCallback("g", func(event fsnotify.Event) error {
+		notified <- event.Name
+		return nil
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if x := readDB(t, context.Background(), d, a); x != 1 {
+		t.Fatalf("value = %d", x)
+	}
+	if stats := d.Stats(context.Background()); len(stats.DBs) != 1 || stats.DBs[0].Copy {
+		t.Fatalf("stats = %+v", stats.DBs)
+	}
+
+	writeDB(t, a, 2)
+	d.Callback("g", fsnotify.Event{Name: a, Op: fsnotify.Create})
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("new snapshot not published")
+	}
+	if x := readDB(t, context.Background(), d, a); x != 2 {
+		t.Fatalf("value after swap = %d", x)
+	}
+}
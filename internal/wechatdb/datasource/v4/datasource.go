@@ -70,13 +70,16 @@ type DataSource struct {
 
 	// 消息数据库信息
 	messageInfos []MessageDBInfo
+
+	// 关键词过滤前补充消息内容，可以为 nil
+	annotate func(msg *model.Message)
 }
 
-func New(path string) (*DataSource, error) {
+func New(path string, opts dbm.Options) (*DataSource, error) {
 
 	ds := &DataSource{
 		path:         path,
-		dbm:          dbm.NewDBManager(path),
+		dbm:          dbm.NewDBManager(path, opts),
 		messageInfos: make([]MessageDBInfo, 0),
 	}
 
@@ -105,6 +108,11 @@ func New(path string) (*DataSource, error) {
 	return ds, nil
 }
 
+// SetAnnotator 设置消息补充函数，在关键词过滤前调用，使外部补充的内容（如图片文字）也能被搜索
+func (ds *DataSource) SetAnnotator(annotate func(msg *model.Message)) {
+	ds.annotate = annotate
+}
+
 func (ds *DataSource) SetCallback(name string, callback func(event fsnotify.Event) error) error {
 	if name == "chatroom" {
 		name = Contact
@@ -113,7 +121,10 @@ func (ds *DataSource) SetCallback(name string, callback func(event fsnotify.Even
 }
 
 func (ds *DataSource) initMessageDbs() error {
-	dbPaths, err := ds.dbm.GetDBPath(Message)
+	ctx, release := ds.dbm.Begin(context.Background(), "initMessageDbs")
+	defer release()
+
+	dbPaths, err := ds.dbm.GetDBPath(ctx, Message)
 	if err != nil {
 		if strings.Contains(err.Error(), "db file not found") {
 			ds.messageInfos = make([]MessageDBInfo, 0)
@@ -125,7 +136,7 @@ func (ds *DataSource) initMessageDbs() error {
 	// 处理每个数据库文件
 	infos := make([]MessageDBInfo, 0)
 	for _, filePath := range dbPaths {
-		db, err := ds.dbm.OpenDB(filePath)
+		db, err := ds.dbm.OpenDB(ctx, filePath)
 		if err != nil {
 			log.Err(err).Msgf("获取数据库 %s 失败", filePath)
 			continue
@@ -135,7 +146,7 @@ func (ds *DataSource) initMessageDbs() error {
 		var startTime time.Time
 		var timestamp int64
 
-		row := db.QueryRow("SELECT timestamp FROM Timestamp LIMIT 1")
+		row := db.QueryRowContext(ctx, "SELECT timestamp FROM Timestamp LIMIT 1")
 		if err := row.Scan(&timestamp); err != nil {
 			log.Err(err).Msgf("获取数据库 %s 的时间戳失败", filePath)
 			continue
@@ -178,6 +189,9 @@ func (ds *DataSource) getDBInfosForTimeRange(startTime, endTime time.Time) []Mes
 }
 
 func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetMessages")
+	defer release()
+
 	if talker == "" {
 		return nil, errors.ErrTalkerEmpty
 	}
@@ -213,10 +227,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 	for _, dbInfo := range dbInfos {
 		// 检查上下文是否已取消
 		if err := ctx.Err(); err != nil {
-			return nil, err
+			return nil, errors.QueryFailed("", err)
 		}
 
-		db, err := ds.dbm.OpenDB(dbInfo.FilePath)
+		db, err := ds.dbm.OpenDB(ctx, dbInfo.FilePath)
 		if err != nil {
 			log.Error().Msgf("数据库 %s 未打开", dbInfo.FilePath)
 			continue
@@ -305,6 +319,9 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 				// 应用keyword过滤
 				if regex != nil {
+					if ds.annotate != nil {
+						ds.annotate(message)
+					}
 					plainText := message.PlainTextContent()
 					if !regex.MatchString(plainText) {
 						continue // 不匹配keyword，跳过此消息
@@ -335,6 +352,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 					return filteredMessages[offset:end], nil
 				}
 			}
+			if err := rows.Err(); err != nil {
+				rows.Close()
+				return nil, errors.QueryFailed("", err)
+			}
 			rows.Close()
 		}
 	}
@@ -361,6 +382,9 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 // 联系人
 func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetContacts")
+	defer release()
+
 	var query string
 	var args []interface{}
 
@@ -385,7 +409,7 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 	}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Contact)
+	db, err := ds.dbm.GetDB(ctx, Contact)
 	if err != nil {
 		return nil, err
 	}
@@ -418,11 +442,14 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 
 // 群聊
 func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offset int) ([]*model.ChatRoom, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetChatRooms")
+	defer release()
+
 	var query string
 	var args []interface{}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Contact)
+	db, err := ds.dbm.GetDB(ctx, Contact)
 	if err != nil {
 		return nil, err
 	}
@@ -537,6 +564,9 @@ func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offse
 
 // 最近会话
 func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset int) ([]*model.Session, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetSessions")
+	defer release()
+
 	var query string
 	var args []interface{}
 
@@ -564,7 +594,7 @@ func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset
 	}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Session)
+	db, err := ds.dbm.GetDB(ctx, Session)
 	if err != nil {
 		return nil, err
 	}
@@ -596,6 +626,9 @@ func (ds *DataSource) GetSessions(ctx context.Context, key string, limit, offset
 }
 
 func (ds *DataSource) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetMedia")
+	defer release()
+
 	if key == "" {
 		return nil, errors.ErrKeyEmpty
 	}
@@ -633,7 +666,7 @@ func (ds *DataSource) GetMedia(ctx context.Context, _type string, key string) (*
 	args := []interface{}{key, key}
 
 	// 执行查询
-	db, err := ds.dbm.GetDB(Media)
+	db, err := ds.dbm.GetDB(ctx, Media)
 	if err != nil {
 		return nil, err
 	}
@@ -674,6 +707,9 @@ func (ds *DataSource) GetMedia(ctx context.Context, _type string, key string) (*
 }
 
 func (ds *DataSource) GetVoice(ctx context.Context, key string) (*model.Media, error) {
+	ctx, release := ds.dbm.Begin(ctx, "GetVoice")
+	defer release()
+
 	if key == "" {
 		return nil, errors.ErrKeyEmpty
 	}
@@ -685,7 +721,7 @@ func (ds *DataSource) GetVoice(ctx context.Context, key string) (*model.Media, e
 	`
 	args := []interface{}{key}
 
-	dbs, err := ds.dbm.GetDBs(Voice)
+	dbs, err := ds.dbm.GetDBs(ctx, Voice)
 	if err != nil {
 		return nil, errors.DBConnectFailed("", err)
 	}
@@ -718,6 +754,39 @@ func (ds *DataSource) GetVoice(ctx context.Context, key string) (*model.Media, e
 	return nil, errors.ErrMediaNotFound
 }
 
+// Pin 固定当前的数据库快照，使一个请求中的多次查询读取同一组数据库文件
+func (ds *DataSource) Pin(ctx context.Context) (context.Context, func()) {
+	return ds.dbm.Pin(ctx)
+}
+
+// Stats 返回已打开数据库的连接池状态
+func (ds *DataSource) Stats(ctx context.Context) *dbm.Stats {
+	return ds.dbm.Stats(ctx)
+}
+
+// Shards 返回消息数据库的加载状态和覆盖的时间范围
+func (ds *DataSource) Shards(ctx context.Context) []*dbm.Shard {
+	ctx, release := ds.dbm.Begin(ctx, "Shards")
+	defer release()
+
+	paths, _ := ds.dbm.GetDBPath(ctx, Message)
+	loaded := make(map[string]MessageDBInfo, len(ds.messageInfos))
+	for _, info := range ds.messageInfos {
+		loaded[info.FilePath] = info
+	}
+	shards := make([]*dbm.Shard, 0, len(paths))
+	for _, path := range paths {
+		shard := &dbm.Shard{Path: path}
+		if info, ok := loaded[path]; ok {
+			shard.Loaded = true
+			shard.StartTime = info.StartTime
+			shard.EndTime = info.EndTime
+		}
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
 func (ds *DataSource) Close() error {
 	return ds.dbm.Close()
 }
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/pkg/util"
 
@@ -25,6 +26,35 @@ func (r *Repository) GetMessages(ctx context.Context, startTime, endTime time.Ti
 		log.Debug().Msgf("EnrichMessages failed: %v", err)
 	}
 
+	// 关联引用消息的原消息
+	r.resolveReplies(ctx, messages, time.Time{})
+
+	return messages, nil
+}
+
+// recalledSource 能查询被撤回或删除的消息的数据源，启用归档时由归档数据源实现
+type recalledSource interface {
+	GetRecalledMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error)
+}
+
+// GetRecalledMessages 查询被撤回或删除的消息，数据源不支持时返回 ErrArchiveDisabled
+func (r *Repository) GetRecalledMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	ds, ok := r.ds.(recalledSource)
+	if !ok {
+		return nil, errors.ErrArchiveDisabled
+	}
+
+	talker, sender = r.parseTalkerAndSender(ctx, talker, sender)
+	messages, err := ds.GetRecalledMessages(ctx, startTime, endTime, talker, sender, keyword, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.EnrichMessages(ctx, messages); err != nil {
+		log.Debug().Msgf("EnrichMessages failed: %v", err)
+	}
+	r.resolveReplies(ctx, messages, time.Time{})
+
 	return messages, nil
 }
 
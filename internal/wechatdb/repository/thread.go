@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+const (
+	// ThreadReplyWindow 查找回复链时，从目标消息开始向后查找回复的时间范围
+	ThreadReplyWindow = 7 * 24 * time.Hour
+
+	// referBatchGap 查找被引用的消息时，发送时间相差不超过该间隔的引用合并为一次查询
+	referBatchGap = 10 * time.Minute
+)
+
+// GetThread 返回消息所在的完整回复链，按消息序号排序
+// 包含目标消息引用的上游消息，以及时间窗口内直接或间接回复目标消息的引用消息
+func (r *Repository) GetThread(ctx context.Context, talker string, seq int64) ([]*model.Message, error) {
+	talker, _ = r.parseTalkerAndSender(ctx, talker, "")
+
+	target, err := r.getMessageBySeq(ctx, talker, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	// 向上查找被引用的消息，查找时已查询到的原消息直接使用
+	res := r.newReplyResolver()
+	res.add([]*model.Message{target})
+	thread := []*model.Message{target}
+	inThread := map[int64]bool{target.Seq: true}
+	for cur := target; ; {
+		res.resolve(ctx, []*model.Message{cur}, time.Time{})
+		if cur.ReplyToSeq == 0 || inThread[cur.ReplyToSeq] {
+			break
+		}
+		parent := res.message(cur.Talker, cur.ReplyToSeq)
+		if parent == nil {
+			if parent, err = r.getMessageBySeq(ctx, talker, cur.ReplyToSeq); err != nil {
+				break
+			}
+			res.add([]*model.Message{parent})
+		}
+		inThread[parent.Seq] = true
+		thread = append([]*model.Message{parent}, thread...)
+		cur = parent
+	}
+
+	// 向下查找回复，消息按序号排列，回复一定在被回复的消息之后
+	later, err := r.ds.GetMessages(ctx, target.Time, target.Time.Add(ThreadReplyWindow), talker, "", "", 0, 0)
+	if err == nil {
+		res.add(later)
+		res.resolve(ctx, later, target.Time)
+		for _, m := range later {
+			if m.Seq > target.Seq && m.ReplyToSeq != 0 && inThread[m.ReplyToSeq] {
+				inThread[m.Seq] = true
+				thread = append(thread, m)
+			}
+		}
+	}
+
+	if err := r.EnrichMessages(ctx, thread); err != nil {
+		return nil, err
+	}
+	return thread, nil
+}
+
+// getMessageBySeq 按序号查找消息，序号的前 10 位是消息的发送时间
+func (r *Repository) getMessageBySeq(ctx context.Context, talker string, seq int64) (*model.Message, error) {
+	t := time.Unix(seq/1000, 0)
+	messages, err := r.ds.GetMessages(ctx, t, t, talker, "", "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if m.Seq == seq {
+			return m, nil
+		}
+	}
+	return nil, errors.ErrMessageNotFound
+}
+
+// resolveReplies 为引用消息设置 ReplyToSeq
+func (r *Repository) resolveReplies(ctx context.Context, messages []*model.Message, since time.Time) {
+	res := r.newReplyResolver()
+	res.add(messages)
+	res.resolve(ctx, messages, since)
+}
+
+// replyResolver 为一个请求中的引用消息查找原消息
+// 查询过的时间段按会话缓存，发送时间相近的引用合并为一次查询，避免每条引用消息单独查询数据源
+type replyResolver struct {
+	r *Repository
+
+	// 会话 -> 服务端 ID -> 消息
+	byServerID map[string]map[int64]*model.Message
+	// 会话 -> 序号 -> 消息
+	bySeq map[string]map[int64]*model.Message
+	// 会话 -> 发送时间（秒）-> 消息，只包含已查询的时间段
+	bySecond map[string]map[int64][]*model.Message
+	// 会话 -> 已查询的时间段
+	loaded map[string][][2]int64
+}
+
+func (r *Repository) newReplyResolver() *replyResolver {
+	return &replyResolver{
+		r:          r,
+		byServerID: make(map[string]map[int64]*model.Message),
+		bySeq:      make(map[string]map[int64]*model.Message),
+		bySecond:   make(map[string]map[int64][]*model.Message),
+		loaded:     make(map[string][][2]int64),
+	}
+}
+
+// add 记录已知的消息，引用它们的消息不再查询数据源
+func (res *replyResolver) add(messages []*model.Message) {
+	for _, m := range messages {
+		if res.bySeq[m.Talker] == nil {
+			res.bySeq[m.Talker] = make(map[int64]*model.Message)
+			res.byServerID[m.Talker] = make(map[int64]*model.Message)
+		}
+		res.bySeq[m.Talker][m.Seq] = m
+		if m.ServerID != 0 {
+			res.byServerID[m.Talker][m.ServerID] = m
+		}
+	}
+}
+
+// message 返回已知的消息，没有时返回 nil
+func (res *replyResolver) message(talker string, seq int64) *model.Message {
+	return res.bySeq[talker][seq]
+}
+
+// resolve 为引用消息设置 ReplyToSeq
+// 先在已知的消息中按服务端 ID 查找原消息，找不到时按被引用消息的发送时间批量查询
+// since 不为零时，跳过引用了 since 之前消息的引用消息
+func (res *replyResolver) resolve(ctx context.Context, messages []*model.Message, since time.Time) {
+	pending := make([]*model.Message, 0)
+	times := make(map[string][]int64)
+	for _, m := range messages {
+		refer := referOf(m)
+		if refer == nil || m.ReplyToSeq != 0 {
+			continue
+		}
+		if !since.IsZero() && refer.Time.Before(since) {
+			continue
+		}
+		if refer.ServerID != 0 {
+			if orig, ok := res.byServerID[m.Talker][refer.ServerID]; ok {
+				m.ReplyToSeq = orig.Seq
+				continue
+			}
+		}
+		if refer.Time.Unix() <= 0 {
+			continue
+		}
+		pending = append(pending, m)
+		times[m.Talker] = append(times[m.Talker], refer.Time.Unix())
+	}
+
+	for talker, ts := range times {
+		res.load(ctx, talker, ts)
+	}
+
+	for _, m := range pending {
+		refer := referOf(m)
+		if orig := matchRefer(res.bySecond[m.Talker][refer.Time.Unix()], refer); orig != nil {
+			m.ReplyToSeq = orig.Seq
+		}
+	}
+}
+
+// load 查询会话中尚未查询过的发送时间，间隔不超过 referBatchGap 的时间合并为一次查询
+func (res *replyResolver) load(ctx context.Context, talker string, times []int64) {
+	missing := make([]int64, 0, len(times))
+	for _, t := range times {
+		if !res.covered(talker, t) {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+
+	gap := int64(referBatchGap / time.Second)
+	for i := 0; i < len(missing); {
+		start, end := missing[i], missing[i]
+		for i++; i < len(missing) && missing[i]-end <= gap; i++ {
+			end = missing[i]
+		}
+		messages, err := res.r.ds.GetMessages(ctx, time.Unix(start, 0), time.Unix(end, 0), talker, "", "", 0, 0)
+		if err != nil {
+			continue
+		}
+		res.loaded[talker] = append(res.loaded[talker], [2]int64{start, end})
+		if res.bySecond[talker] == nil {
+			res.bySecond[talker] = make(map[int64][]*model.Message)
+		}
+		for _, m := range messages {
+			res.bySecond[talker][m.Time.Unix()] = append(res.bySecond[talker][m.Time.Unix()], m)
+		}
+		res.add(messages)
+	}
+}
+
+// covered 发送时间 t 是否在已查询的时间段内
+func (res *replyResolver) covered(talker string, t int64) bool {
+	for _, span := range res.loaded[talker] {
+		if t >= span[0] && t <= span[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRefer 在被引用消息发送时间的所有消息中查找原消息，优先按服务端 ID 匹配
+// 数据源没有服务端 ID 时按发送人匹配
+func matchRefer(candidates []*model.Message, refer *model.Message) *model.Message {
+	var bySender *model.Message
+	hasServerID := false
+	for _, c := range candidates {
+		if c.ServerID != 0 {
+			hasServerID = true
+			if c.ServerID == refer.ServerID {
+				return c
+			}
+		}
+		if bySender == nil && refer.Sender != "" && c.Sender == refer.Sender {
+			bySender = c
+		}
+	}
+	if refer.ServerID != 0 && hasServerID {
+		return nil
+	}
+	return bySender
+}
+
+// referOf 返回引用消息中被引用的消息，其他消息返回 nil
+func referOf(m *model.Message) *model.Message {
+	if m.Type != 49 || m.SubType != 57 {
+		return nil
+	}
+	refer, _ := m.Contents["refer"].(*model.Message)
+	return refer
+}
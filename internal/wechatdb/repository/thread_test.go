@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+)
+
+// fakeDataSource 只提供消息查询的数据源，记录查询次数
+type fakeDataSource struct {
+	messages []*model.Message
+	queries  int
+}
+
+func (ds *fakeDataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	ds.queries++
+	result := make([]*model.Message, 0)
+	for _, m := range ds.messages {
+		if m.Talker == talker && m.Time.Unix() >= startTime.Unix() && m.Time.Unix() <= endTime.Unix() {
+			// 与真实数据源一样每次返回新的消息对象
+			c := *m
+			result = append(result, &c)
+		}
+	}
+	return result, nil
+}
+
+func (ds *fakeDataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
+	return nil, nil
+}
+
+func (ds *fakeDataSource) GetChatRooms(ctx context.Context, key string, limit, offset int) ([]*model.ChatRoom, error) {
+	return nil, nil
+}
+
+func (ds *fakeDataSource) GetSessions(ctx context.Context, key string, limit, offset int) ([]*model.Session, error) {
+	return nil, nil
+}
+
+func (ds *fakeDataSource) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	return nil, nil
+}
+
+func (ds *fakeDataSource) SetCallback(name string, callback func(event fsnotify.Event) error) error {
+	return nil
+}
+
+func (ds *fakeDataSource) SetAnnotator(annotate func(msg *model.Message)) {}
+
+func (ds *fakeDataSource) Pin(ctx context.Context) (context.Context, func()) {
+	return ctx, func() {}
+}
+
+func (ds *fakeDataSource) Stats(ctx context.Context) *dbm.Stats    { return nil }
+func (ds *fakeDataSource) Shards(ctx context.Context) []*dbm.Shard { return nil }
+func (ds *fakeDataSource) Close() error                            { return nil }
+
+const threadTalker = "wxid_a"
+
+var threadBase = time.Unix(1700000000, 0)
+
+// textMessage 创建 offset 秒时发送的文本消息，序号的前 10 位是发送时间
+func textMessage(offset int64, serverID int64, sender string) *model.Message {
+	t := threadBase.Add(time.Duration(offset) * time.Second)
+	return &model.Message{
+		Seq:      t.Unix()*1000 + serverID%1000,
+		ServerID: serverID,
+		Time:     t,
+		Talker:   threadTalker,
+		Sender:   sender,
+		Type:     1,
+		Content:  "text",
+	}
+}
+
+// replyMessage 创建引用 orig 的消息
+func replyMessage(offset int64, serverID int64, sender string, orig *model.Message) *model.Message {
+	m := textMessage(offset, serverID, sender)
+	m.Type, m.SubType = 49, 57
+	m.Contents = map[string]interface{}{
+		"refer": &model.Message{
+			ServerID: orig.ServerID,
+			Time:     orig.Time,
+			Sender:   orig.Sender,
+		},
+	}
+	return m
+}
+
+func newThreadRepository(t *testing.T, messages ...*model.Message) (*Repository, *fakeDataSource) {
+	t.Helper()
+	ds := &fakeDataSource{messages: messages}
+	r, err := New(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.queries = 0
+	return r, ds
+}
+
+func TestGetThread(t *testing.T) {
+	root := textMessage(0, 101, "alice")
+	reply := replyMessage(60, 102, "bob", root)
+	nested := replyMessage(120, 103, "alice", reply)
+	other := textMessage(130, 104, "carol")
+	unrelated := replyMessage(140, 105, "carol", other)
+	// 超出时间窗口的回复不在回复链中
+	late := replyMessage(int64(ThreadReplyWindow/time.Second)+3600, 106, "bob", reply)
+	r, _ := newThreadRepository(t, root, reply, nested, other, unrelated, late)
+
+	thread, err := r.GetThread(context.Background(), threadTalker, reply.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{root.Seq, reply.Seq, nested.Seq}
+	if len(thread) != len(want) {
+		t.Fatalf("thread = %v", seqsOf(thread))
+	}
+	for i, m := range thread {
+		if m.Seq != want[i] {
+			t.Errorf("thread[%d] = %d, want %d", i, m.Seq, want[i])
+		}
+	}
+	if thread[1].ReplyToSeq != root.Seq || thread[2].ReplyToSeq != reply.Seq {
+		t.Errorf("reply links = %d, %d", thread[1].ReplyToSeq, thread[2].ReplyToSeq)
+	}
+
+	if _, err := r.GetThread(context.Background(), threadTalker, root.Seq+999); err == nil {
+		t.Error("thread of a missing message should fail")
+	}
+}
+
+func TestResolveRepliesBatched(t *testing.T) {
+	// 一天之后的 20 条消息分别引用 20 条相隔一分钟的旧消息，另一条引用一周前的消息
+	var messages, replies []*model.Message
+	for i := int64(0); i < 20; i++ {
+		orig := textMessage(i*60, 200+i, "alice")
+		messages = append(messages, orig)
+		replies = append(replies, replyMessage(86400+i, 300+i, "bob", orig))
+	}
+	old := textMessage(-7*86400, 400, "carol")
+	messages = append(messages, old)
+	replies = append(replies, replyMessage(86400+30, 401, "bob", old))
+	// 引用同一批中的消息时不查询
+	replies = append(replies, replyMessage(86400+40, 402, "alice", replies[0]))
+
+	r, ds := newThreadRepository(t, append(messages, replies...)...)
+	r.resolveReplies(context.Background(), replies, time.Time{})
+	if ds.queries != 2 {
+		t.Errorf("%d queries, want 2", ds.queries)
+	}
+	for i, m := range replies[:20] {
+		if m.ReplyToSeq != messages[i].Seq {
+			t.Errorf("reply %d resolved to %d, want %d", i, m.ReplyToSeq, messages[i].Seq)
+		}
+	}
+	if replies[20].ReplyToSeq != old.Seq || replies[21].ReplyToSeq != replies[0].Seq {
+		t.Errorf("replies resolved to %d, %d", replies[20].ReplyToSeq, replies[21].ReplyToSeq)
+	}
+}
+
+func TestMatchRefer(t *testing.T) {
+	a := textMessage(0, 0, "alice")
+	b := textMessage(0, 0, "bob")
+	// 数据源没有服务端 ID 时按发送人匹配
+	if got := matchRefer([]*model.Message{a, b}, &model.Message{ServerID: 7, Sender: "bob"}); got != b {
+		t.Errorf("match by sender = %v", got)
+	}
+
+	c := textMessage(0, 501, "alice")
+	d := textMessage(0, 502, "bob")
+	if got := matchRefer([]*model.Message{c, d}, &model.Message{ServerID: 502, Sender: "alice"}); got != d {
+		t.Errorf("match by server id = %v", got)
+	}
+	// 有服务端 ID 但不匹配时不退回按发送人匹配
+	if got := matchRefer([]*model.Message{c, d}, &model.Message{ServerID: 503, Sender: "alice"}); got != nil {
+		t.Errorf("mismatched server id matched %v", got)
+	}
+}
+
+func seqsOf(messages []*model.Message) []int64 {
+	seqs := make([]int64, len(messages))
+	for i, m := range messages {
+		seqs[i] = m.Seq
+	}
+	return seqs
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"time"
 
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/archive"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 	"github.com/sjzar/chatlog/internal/wechatdb/repository"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -15,16 +18,25 @@ type DB struct {
 	path     string
 	platform string
 	version  int
+	opts     dbm.Options
 	ds       datasource.DataSource
+	view     datasource.DataSource
 	repo     *repository.Repository
+
+	// 归档库，为 nil 时不归档，查询也只读取数据源
+	store   *archive.Store
+	archive archiver
 }
 
-func New(path string, platform string, version int) (*DB, error) {
+// New 打开工作目录中的数据库，store 不为 nil 时同步消息到归档库并在查询时合并归档的消息
+func New(path string, platform string, version int, opts dbm.Options, store *archive.Store) (*DB, error) {
 
 	w := &DB{
 		path:     path,
 		platform: platform,
 		version:  version,
+		opts:     opts,
+		store:    store,
 	}
 
 	// 初始化，加载数据库文件信息
@@ -36,6 +48,7 @@ func New(path string, platform string, version int) (*DB, error) {
 }
 
 func (w *DB) Close() error {
+	w.stopArchive()
 	if w.repo != nil {
 		return w.repo.Close()
 	}
@@ -44,21 +57,38 @@ func (w *DB) Close() error {
 
 func (w *DB) Initialize() error {
 	var err error
-	w.ds, err = datasource.New(w.path, w.platform, w.version)
+	w.ds, err = datasource.New(w.path, w.platform, w.version, w.opts)
 	if err != nil {
 		return err
 	}
 
-	w.repo, err = repository.New(w.ds)
+	// 仓库通过归档数据源查询消息，同步归档时直接读取原数据源
+	w.view = w.ds
+	if w.store != nil {
+		w.view = archive.Wrap(w.ds, w.store)
+	}
+
+	w.repo, err = repository.New(w.view)
 	if err != nil {
 		return err
 	}
 
+	if w.store != nil {
+		w.startArchive()
+	}
+
 	return nil
 }
 
+// SetAnnotator 设置消息补充函数，查询消息时在关键词过滤前调用
+func (w *DB) SetAnnotator(annotate func(msg *model.Message)) {
+	w.view.SetAnnotator(annotate)
+}
+
 func (w *DB) GetMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
-	ctx := context.Background()
+	// 查询消息后还要查找引用的原消息，固定快照使两次查询读取同一组数据库文件
+	ctx, release := w.ds.Pin(context.Background())
+	defer release()
 
 	// 使用 repository 获取消息
 	messages, err := w.repo.GetMessages(ctx, start, end, talker, sender, keyword, limit, offset)
@@ -69,6 +99,23 @@ func (w *DB) GetMessages(start, end time.Time, talker string, sender string, key
 	return messages, nil
 }
 
+// GetRecalledMessages 返回时间范围内被撤回或删除的消息，需要启用归档
+func (w *DB) GetRecalledMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	if w.store == nil {
+		return nil, errors.ErrArchiveDisabled
+	}
+	ctx, release := w.ds.Pin(context.Background())
+	defer release()
+	return w.repo.GetRecalledMessages(ctx, start, end, talker, sender, keyword, limit, offset)
+}
+
+// GetThread 返回消息所在的回复链
+func (w *DB) GetThread(talker string, seq int64) ([]*model.Message, error) {
+	ctx, release := w.ds.Pin(context.Background())
+	defer release()
+	return w.repo.GetThread(ctx, talker, seq)
+}
+
 type GetContactsResp struct {
 	Items []*model.Contact `json:"items"`
 }
@@ -124,3 +171,13 @@ func (w *DB) GetSessions(key string, limit, offset int) (*GetSessionsResp, error
 func (w *DB) GetMedia(_type string, key string) (*model.Media, error) {
 	return w.repo.GetMedia(context.Background(), _type, key)
 }
+
+// GetDBStats 返回已打开数据库的连接池状态和可用性
+func (w *DB) GetDBStats() *dbm.Stats {
+	return w.ds.Stats(context.Background())
+}
+
+// GetShards 返回消息数据库的加载状态和覆盖的时间范围
+func (w *DB) GetShards() []*dbm.Shard {
+	return w.ds.Shards(context.Background())
+}
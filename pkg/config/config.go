@@ -83,11 +83,12 @@ func New(app, path, name, envPrefix string, writeConfig bool) (*Manager, error)
 	}
 
 	return &Manager{
-		App:       app,
-		EnvPrefix: envPrefix,
-		Path:      path,
-		Name:      name,
-		Viper:     v,
+		App:         app,
+		EnvPrefix:   envPrefix,
+		Path:        path,
+		Name:        name,
+		WriteConfig: writeConfig,
+		Viper:       v,
 	}, nil
 }
 
@@ -107,6 +108,17 @@ func (c *Manager) Load(conf interface{}) error {
 	return nil
 }
 
+// Read reads the configuration file if it exists.
+// A missing file is not an error and is not created.
+func (c *Manager) Read() error {
+	if err := c.Viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
 // LoadFile loads the configuration from a specified file.
 // It unmarshals the configuration into the provided conf interface.
 func (c *Manager) LoadFile(file string, conf interface{}) error {
@@ -125,7 +137,12 @@ func (c *Manager) LoadFile(file string, conf interface{}) error {
 func (c *Manager) SetConfig(key string, value interface{}) error {
 	c.Viper.Set(key, value)
 	if c.WriteConfig {
-		if err := c.Viper.WriteConfig(); err != nil {
+		err := c.Viper.WriteConfig()
+		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+			// The config file does not exist yet, create it
+			err = c.Viper.SafeWriteConfig()
+		}
+		if err != nil {
 			return err
 		}
 	}
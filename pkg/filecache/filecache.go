@@ -0,0 +1,197 @@
+package filecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache 按键名寻址的磁盘缓存，总大小超出限制时按最近最少使用的顺序淘汰
+// 缓存文件以键名保存在两级目录下，进程重启后根据修改时间恢复访问顺序
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// Key 根据若干字段计算缓存键，字段之间以 0 分隔
+func Key(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// New 打开缓存目录并加载已有的缓存文件，maxSize 为缓存总大小上限（字节）
+func New(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	type cached struct {
+		entry
+		modTime time.Time
+	}
+	var files []cached
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		// 清理写入中断留下的临时文件
+		if strings.HasSuffix(path, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, cached{entry: entry{key: d.Name(), size: info.Size()}, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushBack(&entry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Dir 返回缓存目录
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Size 返回当前缓存总大小
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Path 返回缓存键对应的文件路径
+func (c *Cache) Path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(c.dir, key)
+	}
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Get 查询缓存，命中时返回缓存文件路径并更新访问顺序
+func (c *Cache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	path := c.Path(key)
+	if _, err := os.Stat(path); err != nil {
+		// 缓存文件被外部删除
+		c.remove(elem)
+		return "", false
+	}
+
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return path, true
+}
+
+// Put 写入缓存并返回缓存文件路径，超出大小上限时淘汰最久未使用的文件
+func (c *Cache) Put(key string, data []byte) (string, error) {
+	path := c.Path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	// 先写临时文件再重命名，避免读到不完整的缓存
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry)
+		c.size += int64(len(data)) - e.size
+		e.size = int64(len(data))
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.lru.PushFront(&entry{key: key, size: int64(len(data))})
+		c.size += int64(len(data))
+	}
+	c.evict()
+
+	return path, nil
+}
+
+// evict 淘汰缓存直到总大小不超过上限，最近写入的文件总是保留
+func (c *Cache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	e := elem.Value.(*entry)
+	os.Remove(c.Path(e.key))
+	c.lru.Remove(elem)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
@@ -0,0 +1,147 @@
+package filecache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	if Key([]byte("a"), []byte("bc")) == Key([]byte("ab"), []byte("c")) {
+		t.Error("fields are not separated")
+	}
+	if Key([]byte("a")) != Key([]byte("a")) {
+		t.Error("key is not stable")
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	c, err := New(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("missing"); ok {
+		t.Error("missing key hit")
+	}
+
+	key := Key([]byte("image"))
+	path, err := c.Put(key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != c.Path(key) || filepath.Base(filepath.Dir(path)) != key[:2] {
+		t.Errorf("path = %s", path)
+	}
+	got, ok := c.Get(key)
+	if !ok || got != path {
+		t.Fatalf("Get = %s, %v", got, ok)
+	}
+	if data, err := os.ReadFile(got); err != nil || string(data) != "data" {
+		t.Errorf("cached data = %q, %v", data, err)
+	}
+
+	// 覆盖写入时更新大小
+	if _, err := c.Put(key, []byte("longer data")); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != int64(len("longer data")) {
+		t.Errorf("size = %d", c.Size())
+	}
+
+	// 缓存文件被外部删除后视为未命中
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(key); ok || c.Size() != 0 {
+		t.Errorf("removed file hit, size %d", c.Size())
+	}
+}
+
+func TestEvict(t *testing.T) {
+	c, err := New(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{1}, 10)
+	for _, key := range []string{"aa1", "bb2"} {
+		if _, err := c.Put(key, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 访问 aa1 后 bb2 成为最久未使用的文件
+	if _, ok := c.Get("aa1"); !ok {
+		t.Fatal("aa1 missing")
+	}
+	if _, err := c.Put("cc3", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("bb2"); ok {
+		t.Error("bb2 not evicted")
+	}
+	if _, err := os.Stat(c.Path("bb2")); !os.IsNotExist(err) {
+		t.Errorf("evicted file kept: %v", err)
+	}
+	for _, key := range []string{"aa1", "cc3"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s evicted", key)
+		}
+	}
+	if c.Size() != 20 {
+		t.Errorf("size = %d", c.Size())
+	}
+
+	// 超出上限的单个文件仍然保留
+	if _, err := c.Put("dd4", bytes.Repeat([]byte{1}, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("dd4"); !ok || c.Size() != 30 {
+		t.Errorf("large entry: size %d", c.Size())
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte{1}, 10)
+	now := time.Now()
+	for i, key := range []string{"aa1", "bb2", "cc3"} {
+		path, err := c.Put(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 写入中断留下的临时文件
+	tmp := filepath.Join(dir, "aa", "aa9.123.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开时按修改时间恢复访问顺序，淘汰最早的文件
+	c, err = New(dir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temp file kept: %v", err)
+	}
+	if _, ok := c.Get("aa1"); ok {
+		t.Error("oldest entry not evicted")
+	}
+	for _, key := range []string{"bb2", "cc3"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s missing after reopen", key)
+		}
+	}
+	if c.Size() != 20 {
+		t.Errorf("size = %d", c.Size())
+	}
+}
@@ -388,6 +388,13 @@ func GetTempCopy(originalPath string) (string, error) {
 	return tempPath, nil
 }
 
+// TempFileCount returns the number of temporary copies currently in use
+func TempFileCount() int {
+	mapMutex.RLock()
+	defer mapMutex.RUnlock()
+	return len(pathToTempFile)
+}
+
 // Immediately clean up other temp files related to the specified original file
 func cleanupRelatedTempFiles(originalPath, currentTempPath, knownOldPath string) {
 	// Extract hash prefix of original file to match related files
@@ -8,13 +8,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
-
-	"github.com/rs/zerolog/log"
 )
 
 // Format defines the header and extension for different image types
@@ -43,22 +37,19 @@ var (
 	JpgTail       = []byte{0xFF, 0xD9} // JPG file tail marker
 )
 
-// Dat2Image converts WeChat dat file data to image data
+// Dat2Image converts WeChat dat file data to image data using the default keys
+// Use a Decoder to decode files of a specific account
 // Returns the decoded image data, file extension, and any error encountered
 func Dat2Image(data []byte) ([]byte, string, error) {
+	return NewDecoder("").Decode(data)
+}
+
+// decodeXor decodes dat files of older WeChat versions, which are XOR encrypted with a single byte
+func decodeXor(data []byte) ([]byte, string, error) {
 	if len(data) < 4 {
 		return nil, "", fmt.Errorf("data length is too short: %d", len(data))
 	}
 
-	// Check if this is a WeChat v4 dat file
-	if len(data) >= 6 {
-		for _, format := range V4Formats {
-			if bytes.Equal(data[:4], format.Header) {
-				return Dat2ImageV4(data, format.AesKey)
-			}
-		}
-	}
-
 	// For older WeChat versions, use XOR decryption
 	findFormat := func(data []byte, header []byte) bool {
 		xorBit := data[0] ^ header[0]
@@ -119,91 +110,14 @@ func calculateXorKeyV4(data []byte) (byte, error) {
 	return xorKeys[0], fmt.Errorf("inconsistent XOR key, using first byte: 0x%x", xorKeys[0])
 }
 
-// ScanAndSetXorKey scans a directory for "_t.dat" files to calculate and set
-// the global XOR key for WeChat v4 dat files
-// Returns the found key and any error encountered
-func ScanAndSetXorKey(dirPath string) (byte, error) {
-	// Walk the directory recursively
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip directories
-		if info.IsDir() {
-			return nil
-		}
-
-		// Only process "_t.dat" files (thumbnail files)
-		if !strings.HasSuffix(info.Name(), "_t.dat") {
-			return nil
-		}
-
-		// Read file content
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-
-		// Check if it's a WeChat v4 dat file
-		if len(data) < 6 || (!bytes.Equal(data[:4], V4Format1.Header) && !bytes.Equal(data[:4], V4Format2.Header)) {
-			return nil
-		}
-
-		// Parse file header
-		if len(data) < 15 {
-			return nil
-		}
-
-		// Get XOR encryption length
-		xorEncryptLen := binary.LittleEndian.Uint32(data[10:14])
-
-		// Get data after header
-		fileData := data[15:]
-
-		// Skip if there's no XOR-encrypted part
-		if xorEncryptLen == 0 || uint32(len(fileData)) <= uint32(len(fileData))-xorEncryptLen {
-			return nil
-		}
-
-		// Get XOR-encrypted part
-		xorData := fileData[uint32(len(fileData))-xorEncryptLen:]
-
-		// Calculate XOR key
-		key, err := calculateXorKeyV4(xorData)
-		if err != nil {
-			return nil
-		}
-
-		// Set global XOR key
-		V4XorKey = key
-
-		// Stop traversal after finding a valid key
-		return filepath.SkipAll
-	})
-
-	if err != nil && err != filepath.SkipAll {
-		return V4XorKey, fmt.Errorf("error scanning directory: %v", err)
-	}
-
-	return V4XorKey, nil
-}
-
-func SetAesKey(key string) {
-	if key == "" {
-		return
-	}
-	decoded, err := hex.DecodeString(key)
-	if err != nil {
-		log.Error().Err(err).Msg("invalid aes key")
-		return
-	}
-	V4Format2.AesKey = decoded
-}
-
 // Dat2ImageV4 processes WeChat v4 dat image files
 // WeChat v4 uses a combination of AES-ECB and XOR encryption
 func Dat2ImageV4(data []byte, aeskey []byte) ([]byte, string, error) {
+	return decodeV4(data, aeskey, V4XorKey)
+}
+
+// decodeV4 decodes WeChat v4 dat files with the given AES and XOR keys
+func decodeV4(data []byte, aeskey []byte, xorKey byte) ([]byte, string, error) {
 	if len(data) < 15 {
 		return nil, "", fmt.Errorf("data length is too short for WeChat v4 format: %d", len(data))
 	}
@@ -256,10 +170,10 @@ func Dat2ImageV4(data []byte, aeskey []byte) ([]byte, string, error) {
 	if xorEncryptLen > 0 && middleEnd < uint32(len(fileData)) {
 		xorData := fileData[middleEnd:]
 
-		// Apply XOR decryption using global key
+		// Apply XOR decryption
 		xorDecrypted := make([]byte, len(xorData))
 		for i := range xorData {
-			xorDecrypted[i] = xorData[i] ^ V4XorKey
+			xorDecrypted[i] = xorData[i] ^ xorKey
 		}
 
 		result = append(result, xorDecrypted...)
@@ -0,0 +1,196 @@
+package dat2img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Decoder 携带图片密钥的 dat 文件解码器
+// 由使用它的服务持有，切换数据目录时恢复默认密钥，不同账号的密钥互不影响
+type Decoder struct {
+	mu      sync.RWMutex
+	dataDir string
+	aesKey  []byte
+	xorKey  byte
+
+	validatorMu sync.Mutex
+	validator   *AesKeyValidator
+}
+
+// NewDecoder 创建解码器，使用默认的 XOR 密钥和 AES 密钥
+// dataDir 用于扫描 XOR 密钥和验证 AES 密钥，可以为空
+func NewDecoder(dataDir string) *Decoder {
+	return &Decoder{
+		dataDir: dataDir,
+		aesKey:  bytes.Clone(V4Format2.AesKey),
+		xorKey:  V4XorKey,
+	}
+}
+
+// DataDir 返回解码器对应的数据目录
+func (d *Decoder) DataDir() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dataDir
+}
+
+// SetDataDir 切换数据目录，目录变化时恢复默认密钥并丢弃已扫描的验证数据
+func (d *Decoder) SetDataDir(dataDir string) {
+	d.mu.Lock()
+	if filepath.Clean(dataDir) == filepath.Clean(d.dataDir) {
+		d.mu.Unlock()
+		return
+	}
+	d.dataDir = dataDir
+	d.aesKey = bytes.Clone(V4Format2.AesKey)
+	d.xorKey = V4XorKey
+	d.mu.Unlock()
+
+	d.validatorMu.Lock()
+	d.validator = nil
+	d.validatorMu.Unlock()
+}
+
+// SetAesKey 设置十六进制格式的图片 AES 密钥，空字符串表示保持不变
+func (d *Decoder) SetAesKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid aes key: %v", err)
+	}
+	if len(decoded) < 16 {
+		return fmt.Errorf("invalid aes key length: %d", len(decoded))
+	}
+
+	d.mu.Lock()
+	d.aesKey = decoded[:16]
+	d.mu.Unlock()
+	return nil
+}
+
+// SetXorKey 设置 XOR 密钥
+func (d *Decoder) SetXorKey(key byte) {
+	d.mu.Lock()
+	d.xorKey = key
+	d.mu.Unlock()
+}
+
+// XorKey 返回当前的 XOR 密钥
+func (d *Decoder) XorKey() byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.xorKey
+}
+
+// Validator 返回数据目录的图片密钥验证器
+// 首次调用时扫描数据目录，之前没有找到可用于验证的图片时重新扫描
+func (d *Decoder) Validator() *AesKeyValidator {
+	d.validatorMu.Lock()
+	defer d.validatorMu.Unlock()
+	if d.validator == nil || len(d.validator.EncryptedData) == 0 {
+		d.validator = NewImgKeyValidator(d.DataDir())
+	}
+	return d.validator
+}
+
+// DetectAesKey 依次验证十六进制格式的候选密钥，使用第一个能解密数据目录中图片的密钥
+// 数据目录中没有可用于验证的图片时返回 false
+func (d *Decoder) DetectAesKey(candidates ...string) (string, bool) {
+	dataDir := d.DataDir()
+	validator := d.Validator()
+	if len(validator.EncryptedData) == 0 {
+		return "", false
+	}
+	for _, key := range candidates {
+		decoded, err := hex.DecodeString(key)
+		if err != nil || !validator.Validate(decoded) {
+			continue
+		}
+		d.setKey(dataDir, func() { d.aesKey = decoded[:16] })
+		return key, true
+	}
+	return "", false
+}
+
+// ScanXorKey 扫描数据目录中的缩略图计算 XOR 密钥
+func (d *Decoder) ScanXorKey() (byte, error) {
+	dataDir := d.DataDir()
+	var key byte
+	found := false
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// 只处理缩略图文件
+		if info.IsDir() || !strings.HasSuffix(info.Name(), "_t.dat") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		if len(data) < 15 || (!bytes.Equal(data[:4], V4Format1.Header) && !bytes.Equal(data[:4], V4Format2.Header)) {
+			return nil
+		}
+
+		xorEncryptLen := binary.LittleEndian.Uint32(data[10:14])
+		fileData := data[15:]
+
+		// 没有 XOR 加密的部分
+		if xorEncryptLen == 0 || uint32(len(fileData)) <= uint32(len(fileData))-xorEncryptLen {
+			return nil
+		}
+
+		xorData := fileData[uint32(len(fileData))-xorEncryptLen:]
+		if key, err = calculateXorKeyV4(xorData); err != nil {
+			return nil
+		}
+		found = true
+		return filepath.SkipAll
+	})
+
+	if err != nil && err != filepath.SkipAll {
+		return d.XorKey(), fmt.Errorf("error scanning directory: %v", err)
+	}
+	if found {
+		d.setKey(dataDir, func() { d.xorKey = key })
+	}
+	return d.XorKey(), nil
+}
+
+// setKey 在数据目录没有切换时更新密钥，扫描期间切换了目录时丢弃旧目录的结果
+func (d *Decoder) setKey(dataDir string, set func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dataDir == dataDir {
+		set()
+	}
+}
+
+// Decode 解码 dat 文件，返回图片数据和扩展名
+func (d *Decoder) Decode(data []byte) ([]byte, string, error) {
+	d.mu.RLock()
+	aesKey, xorKey := d.aesKey, d.xorKey
+	d.mu.RUnlock()
+
+	if len(data) >= 6 {
+		switch {
+		case bytes.Equal(data[:4], V4Format1.Header):
+			return decodeV4(data, V4Format1.AesKey, xorKey)
+		case bytes.Equal(data[:4], V4Format2.Header):
+			return decodeV4(data, aesKey, xorKey)
+		}
+	}
+	return decodeXor(data)
+}
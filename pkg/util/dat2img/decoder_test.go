@@ -0,0 +1,168 @@
+package dat2img
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testAesKey = []byte("0123456789abcdef")
+
+// testJPG 以 JPEG 文件头开始、以 JPEG 文件尾结束的测试数据
+func testJPG() []byte {
+	data := append([]byte{}, JPG.Header...)
+	for i := 0; len(data) < 198; i++ {
+		data = append(data, byte(i))
+	}
+	return append(data, JpgTail...)
+}
+
+// encodeV4 按微信 v4 的格式加密：开头 aesLen 字节 AES-ECB 加密，末尾 xorLen 字节异或加密
+func encodeV4(t *testing.T, plain []byte, aesKey []byte, xorKey byte, aesLen, xorLen int) []byte {
+	t.Helper()
+	header := make([]byte, 15)
+	copy(header, V4Format2.Header)
+	binary.LittleEndian.PutUint32(header[6:10], uint32(aesLen))
+	binary.LittleEndian.PutUint32(header[10:14], uint32(xorLen))
+	header[14] = 1
+
+	// PKCS#7 填充后的长度与解码时计算的长度一致
+	padding := aes.BlockSize - aesLen%aes.BlockSize
+	block := append(bytes.Clone(plain[:aesLen]), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher, err := aes.NewCipher(aesKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(block); i += aes.BlockSize {
+		cipher.Encrypt(block[i:i+aes.BlockSize], block[i:i+aes.BlockSize])
+	}
+
+	data := append(header, block...)
+	data = append(data, plain[aesLen:len(plain)-xorLen]...)
+	for _, b := range plain[len(plain)-xorLen:] {
+		data = append(data, b^xorKey)
+	}
+	return data
+}
+
+// writeDat 在数据目录下写入图片和缩略图
+func writeDat(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	for _, name := range []string{"img.dat", "img_t.dat"} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDecoderDecode(t *testing.T) {
+	dir := t.TempDir()
+	plain := testJPG()
+	data := encodeV4(t, plain, testAesKey, 0x5c, 64, 32)
+	writeDat(t, dir, data)
+
+	d := NewDecoder(dir)
+	if d.XorKey() != V4XorKey {
+		t.Errorf("default xor key = %#x", d.XorKey())
+	}
+	if out, _, err := d.Decode(data); err == nil && bytes.Equal(out, plain) {
+		t.Fatal("decoded with the default keys")
+	}
+
+	if key, err := d.ScanXorKey(); err != nil || key != 0x5c {
+		t.Fatalf("ScanXorKey = %#x, %v", key, err)
+	}
+	if err := d.SetAesKey(hex.EncodeToString(testAesKey)); err != nil {
+		t.Fatal(err)
+	}
+	out, ext, err := d.Decode(data)
+	if err != nil || ext != "jpg" || !bytes.Equal(out, plain) {
+		t.Fatalf("Decode = %s, %v", ext, err)
+	}
+
+	// 旧版本的异或加密不依赖密钥
+	xored := make([]byte, len(plain))
+	for i, b := range plain {
+		xored[i] = b ^ 0x21
+	}
+	if out, ext, err := d.Decode(xored); err != nil || ext != "jpg" || !bytes.Equal(out, plain) {
+		t.Errorf("Decode xor = %s, %v", ext, err)
+	}
+}
+
+func TestDecoderSetAesKey(t *testing.T) {
+	d := NewDecoder("")
+	for _, key := range []string{"zz", "0011"} {
+		if err := d.SetAesKey(key); err == nil {
+			t.Errorf("SetAesKey(%q) accepted", key)
+		}
+	}
+	if err := d.SetAesKey(""); err != nil {
+		t.Errorf("empty key: %v", err)
+	}
+	if !bytes.Equal(d.aesKey, V4Format2.AesKey) {
+		t.Errorf("aes key changed to %x", d.aesKey)
+	}
+}
+
+func TestDecoderDetectAesKey(t *testing.T) {
+	d := NewDecoder(t.TempDir())
+	if _, ok := d.DetectAesKey(hex.EncodeToString(testAesKey)); ok {
+		t.Fatal("key detected without images")
+	}
+
+	// 目录中出现图片后重新扫描
+	writeDat(t, d.DataDir(), encodeV4(t, testJPG(), testAesKey, 0x5c, 64, 32))
+	wrong := hex.EncodeToString([]byte("fedcba9876543210"))
+	right := hex.EncodeToString(testAesKey)
+	if key, ok := d.DetectAesKey("not hex", wrong, right); !ok || key != right {
+		t.Fatalf("DetectAesKey = %s, %v", key, ok)
+	}
+	if !bytes.Equal(d.aesKey, testAesKey) {
+		t.Errorf("aes key = %x", d.aesKey)
+	}
+}
+
+func TestDecoderSetDataDir(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	writeDat(t, a, encodeV4(t, testJPG(), testAesKey, 0x5c, 64, 32))
+
+	d := NewDecoder(a)
+	if _, err := d.ScanXorKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetAesKey(hex.EncodeToString(testAesKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 目录不变时保留密钥
+	d.SetDataDir(a + string(filepath.Separator))
+	if d.XorKey() != 0x5c || !bytes.Equal(d.aesKey, testAesKey) {
+		t.Fatalf("keys reset for the same dir: %#x, %x", d.XorKey(), d.aesKey)
+	}
+
+	// 切换目录后恢复默认密钥，验证数据重新扫描
+	d.SetDataDir(b)
+	if d.DataDir() != b || d.XorKey() != V4XorKey || !bytes.Equal(d.aesKey, V4Format2.AesKey) {
+		t.Fatalf("keys kept after switch: %#x, %x", d.XorKey(), d.aesKey)
+	}
+	if v := d.Validator(); v.Path != b || len(v.EncryptedData) != 0 {
+		t.Errorf("validator of %s", v.Path)
+	}
+
+	// 旧目录的扫描结果在切换后丢弃
+	d.setKey(a, func() { d.xorKey = 0x5c })
+	if d.XorKey() != V4XorKey {
+		t.Errorf("stale xor key applied: %#x", d.XorKey())
+	}
+
+	// 不同目录的解码器互不影响
+	other := NewDecoder(a)
+	if _, err := other.ScanXorKey(); err != nil || other.XorKey() != 0x5c || d.XorKey() != V4XorKey {
+		t.Errorf("xor keys = %#x, %#x", other.XorKey(), d.XorKey())
+	}
+}
@@ -36,7 +36,8 @@ func init() {
 	}
 }
 
-func Wxam2pic(data []byte) ([]byte, string, error) {
+func Wxam2pic(data []byte) (_ []byte, _ string, err error) {
+	defer recoverDecode(&err)
 
 	if len(data) < 15 || !bytes.Equal(data[0:4], WXGF.Header) {
 		return nil, "", fmt.Errorf("invalid wxgf")
@@ -48,7 +49,6 @@ func Wxam2pic(data []byte) ([]byte, string, error) {
 	}
 
 	if partitions.LikeAnime() {
-		// FIXME mask frame not work
 		animeFrames := make([][]byte, 0)
 		maskFrames := make([][]byte, 0)
 		for i, partition := range partitions.Partitions {
@@ -65,6 +65,9 @@ func Wxam2pic(data []byte) ([]byte, string, error) {
 			}
 			return mp4Data, "gif", nil
 		}
+		if imgData, ext, err := DecodeAnime2GIF(animeFrames, maskFrames); err == nil {
+			return imgData, ext, nil
+		}
 		mp4Data, err := TransmuxAnime2MP4(animeFrames, maskFrames)
 		if err != nil {
 			return nil, "", err
@@ -83,6 +86,10 @@ func Wxam2pic(data []byte) ([]byte, string, error) {
 		return jpgData, JPG.Ext, nil
 	}
 
+	if jpgData, err := Decode2JPG(data[offset : offset+size]); err == nil {
+		return jpgData, JPG.Ext, nil
+	}
+
 	mp4Data, err := Transmux2MP4(data[offset : offset+size])
 	if err != nil {
 		return nil, "", err
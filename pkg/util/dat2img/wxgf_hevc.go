@@ -0,0 +1,153 @@
+package dat2img
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/sjzar/chatlog/pkg/util/h265"
+)
+
+const (
+	JPGQuality = 90
+
+	// GIFDelay 动图每帧的停留时间，单位为 1/100 秒
+	GIFDelay = 4
+)
+
+// Decode2JPG 使用内置的 HEVC 帧内解码器将静态图转换为 JPG
+func Decode2JPG(data []byte) (_ []byte, err error) {
+	defer recoverDecode(&err)
+
+	pic, err := h265.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode hevc failed: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, pic.Image(nil), &jpeg.Options{Quality: JPGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeAnime2GIF 使用内置的 HEVC 帧内解码器将动图转换为带透明度的 GIF
+// 内置解码器不支持帧间预测，动图包含帧间编码的帧时只输出第一帧的 PNG
+func DecodeAnime2GIF(animeFrames [][]byte, maskFrames [][]byte) (_ []byte, _ string, err error) {
+	defer recoverDecode(&err)
+
+	if len(maskFrames) != len(animeFrames) {
+		return nil, "", fmt.Errorf("mask frame num (%d) not equal to anime frame num (%d)", len(maskFrames), len(animeFrames))
+	}
+
+	anime, err := decodeFrames(animeFrames)
+	if len(anime) == 0 {
+		return nil, "", fmt.Errorf("decode anime frame failed: %w", err)
+	}
+	mask, _ := decodeFrames(maskFrames)
+
+	// 遮罩帧为灰度图，分区顺序与预期相反时交换
+	if len(mask) > 0 && !isGray(mask[0]) && isGray(anime[0]) {
+		anime, mask = mask, anime
+	}
+
+	images := make([]*image.NRGBA, 0, len(anime))
+	for i, pic := range anime {
+		var alpha *image.Gray
+		if i < len(mask) && mask[i].Width == pic.Width && mask[i].Height == pic.Height {
+			alpha = mask[i].Gray()
+		}
+		images = append(images, pic.Image(alpha))
+	}
+
+	var buf bytes.Buffer
+	if err != nil || len(images) < len(animeFrames) {
+		if err := png.Encode(&buf, images[0]); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), PNG.Ext, nil
+	}
+
+	g := &gif.GIF{}
+	for _, img := range images {
+		g.Image = append(g.Image, toPaletted(img))
+		g.Delay = append(g.Delay, GIFDelay)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), GIF.Ext, nil
+}
+
+// recoverDecode 损坏的图片数据可能使解码器越界，将 panic 转换为错误返回
+func recoverDecode(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("decode wxgf failed: %v", r)
+	}
+}
+
+// decodeFrames 依次解码每一帧，参数集在帧之间共享
+// 遇到错误时返回已解码的帧
+func decodeFrames(frames [][]byte) ([]*h265.Picture, error) {
+	dec := h265.NewDecoder()
+	ret := make([]*h265.Picture, 0, len(frames))
+	for _, frame := range frames {
+		pics, err := dec.Decode(frame)
+		if len(pics) == 0 && err == nil {
+			err = fmt.Errorf("no picture found")
+		}
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, pics[0])
+	}
+	return ret, nil
+}
+
+// isGray 判断图像的色度是否接近中性
+func isGray(pic *h265.Picture) bool {
+	if pic.ChromaFormat == 0 {
+		return true
+	}
+	mid := 1 << (pic.BitDepthC - 1)
+	tolerance := 4 << (pic.BitDepthC - 8)
+	for _, plane := range pic.Planes[1:] {
+		for _, v := range plane {
+			if d := int(v) - mid; d > tolerance || d < -tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toPaletted 使用 Web 安全色加一个透明色量化图像
+func toPaletted(img *image.NRGBA) *image.Paletted {
+	pal := make(color.Palette, 0, len(palette.WebSafe)+1)
+	pal = append(pal, color.Transparent)
+	pal = append(pal, palette.WebSafe...)
+
+	opaque := image.NewNRGBA(img.Bounds())
+	copy(opaque.Pix, img.Pix)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xff
+	}
+
+	dst := image.NewPaletted(img.Bounds(), pal)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), opaque, image.Point{})
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			if img.Pix[y*img.Stride+x*4+3] < 0x80 {
+				dst.Pix[y*dst.Stride+x] = 0
+			}
+		}
+	}
+	return dst
+}
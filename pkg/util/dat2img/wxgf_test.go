@@ -0,0 +1,116 @@
+package dat2img
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWxam2picWithoutFFmpeg(t *testing.T) {
+	ffmpegMode := FFmpegMode
+	FFmpegMode = false
+	defer func() { FFmpegMode = ffmpegMode }()
+
+	tests := []struct {
+		file   string
+		ext    string
+		frames int
+		alpha  bool
+	}{
+		{"still.wxgf", "jpg", 1, false},
+		{"anime.wxgf", "gif", 3, true},
+		// 帧间编码的动图只输出第一帧
+		{"anime_inter.wxgf", "png", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, ext, err := Wxam2pic(data)
+			if err != nil {
+				t.Fatalf("Wxam2pic() error = %v", err)
+			}
+			if ext != tt.ext {
+				t.Fatalf("ext = %s, want %s", ext, tt.ext)
+			}
+
+			var images []image.Image
+			switch ext {
+			case "jpg":
+				img, err := jpeg.Decode(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				images = append(images, img)
+			case "png":
+				img, err := png.Decode(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				images = append(images, img)
+			case "gif":
+				g, err := gif.DecodeAll(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, img := range g.Image {
+					images = append(images, img)
+				}
+			}
+			if len(images) != tt.frames {
+				t.Fatalf("frames = %d, want %d", len(images), tt.frames)
+			}
+
+			for _, img := range images {
+				if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 48 {
+					t.Fatalf("size = %dx%d, want 64x48", b.Dx(), b.Dy())
+				}
+				// 遮罩为居中的椭圆，角落透明
+				_, _, _, corner := img.At(0, 0).RGBA()
+				_, _, _, center := img.At(32, 24).RGBA()
+				if center != 0xffff {
+					t.Errorf("center alpha = %#x, want opaque", center)
+				}
+				if tt.alpha && corner > 0x0800 {
+					t.Errorf("corner alpha = %#x, want transparent", corner)
+				}
+			}
+		})
+	}
+}
+
+// 损坏的图片返回错误或降级的结果，不能 panic
+func TestWxam2picCorrupt(t *testing.T) {
+	ffmpegMode := FFmpegMode
+	FFmpegMode = false
+	defer func() { FFmpegMode = ffmpegMode }()
+
+	for _, file := range []string{"still.wxgf", "anime.wxgf"} {
+		data, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 5; i < len(data); i += 37 {
+			corrupt := append([]byte(nil), data...)
+			corrupt[i] ^= 0xff
+			Wxam2pic(corrupt)
+			Wxam2pic(data[:i])
+		}
+	}
+
+	// 解码器内部的 panic 转换为错误
+	if _, err := Decode2JPG(nil); err == nil {
+		t.Error("Decode2JPG(nil) should fail")
+	}
+	if _, _, err := DecodeAnime2GIF([][]byte{{0, 0, 1}}, [][]byte{{0, 0, 1}}); err == nil {
+		t.Error("DecodeAnime2GIF should fail")
+	}
+}
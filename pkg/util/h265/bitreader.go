@@ -0,0 +1,141 @@
+package h265
+
+// bitReader 按位读取 RBSP 数据，读取越界时返回 0 并记录错误
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.data)*8 {
+		r.overrun = true
+		r.pos++
+		return 0
+	}
+	b := uint32(r.data[r.pos>>3]>>(7-uint(r.pos&7))) & 1
+	r.pos++
+	return b
+}
+
+// u 读取 n 位无符号整数，n 不超过 32
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bit() == 1
+}
+
+// ue 读取无符号指数哥伦布编码
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 {
+		zeros++
+		if zeros > 31 || r.overrun {
+			r.overrun = true
+			return 0
+		}
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return (1<<zeros - 1) + r.u(zeros)
+}
+
+// se 读取有符号指数哥伦布编码
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) skip(n int) {
+	r.pos += n
+	if r.pos > len(r.data)*8 {
+		r.overrun = true
+	}
+}
+
+func (r *bitReader) byteAligned() bool {
+	return r.pos&7 == 0
+}
+
+// alignByte 跳到下一个字节边界
+func (r *bitReader) alignByte() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// moreRBSPData 判断 rbsp_trailing_bits 之前是否还有数据
+func (r *bitReader) moreRBSPData() bool {
+	if r.pos >= len(r.data)*8 {
+		return false
+	}
+	// 找到最后一个值为 1 的位，即 rbsp_stop_one_bit
+	last := len(r.data) - 1
+	for last >= 0 && r.data[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		return false
+	}
+	stop := last*8 + 7
+	for b := r.data[last]; b&1 == 0; b >>= 1 {
+		stop--
+	}
+	return r.pos < stop
+}
+
+// unescapeRBSP 去除 NAL 单元中的防竞争字节 0x03
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// splitNALUnits 按起始码拆分 Annex B 字节流
+func splitNALUnits(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// 去掉四字节起始码的前导零以及尾随零
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
@@ -0,0 +1,187 @@
+package h265
+
+// 上下文模型在数组中的偏移，只包含帧内解码用到的语法元素
+const (
+	ctxSaoMerge         = 0
+	ctxSaoType          = ctxSaoMerge + 1
+	ctxSplitCu          = ctxSaoType + 1
+	ctxTransquantBypass = ctxSplitCu + 3
+	ctxPartMode         = ctxTransquantBypass + 1
+	ctxPrevIntraLuma    = ctxPartMode + 1
+	ctxIntraChroma      = ctxPrevIntraLuma + 1
+	ctxSplitTransform   = ctxIntraChroma + 1
+	ctxCbfLuma          = ctxSplitTransform + 3
+	ctxCbfChroma        = ctxCbfLuma + 2
+	ctxCuQpDelta        = ctxCbfChroma + 5
+	ctxTransformSkip    = ctxCuQpDelta + 2
+	ctxLastX            = ctxTransformSkip + 2
+	ctxLastY            = ctxLastX + 18
+	ctxCodedSubBlock    = ctxLastY + 18
+	ctxSig              = ctxCodedSubBlock + 4
+	ctxGreater1         = ctxSig + 44
+	ctxGreater2         = ctxGreater1 + 24
+	numContexts         = ctxGreater2 + 6
+)
+
+// contextInitValues I 条带（initType 0）的上下文初始值
+var contextInitValues = [numContexts]uint8{
+	// sao_merge_left_flag / sao_merge_up_flag
+	153,
+	// sao_type_idx
+	200,
+	// split_cu_flag
+	139, 141, 157,
+	// cu_transquant_bypass_flag
+	154,
+	// part_mode
+	184,
+	// prev_intra_luma_pred_flag
+	184,
+	// intra_chroma_pred_mode
+	63,
+	// split_transform_flag
+	153, 138, 138,
+	// cbf_luma
+	111, 141,
+	// cbf_cb / cbf_cr
+	94, 138, 182, 154, 154,
+	// cu_qp_delta_abs
+	154, 154,
+	// transform_skip_flag
+	139, 139,
+	// last_sig_coeff_x_prefix
+	110, 110, 124, 125, 140, 153, 125, 127, 140, 109, 111, 143, 127, 111, 79, 108, 123, 63,
+	// last_sig_coeff_y_prefix
+	110, 110, 124, 125, 140, 153, 125, 127, 140, 109, 111, 143, 127, 111, 79, 108, 123, 63,
+	// coded_sub_block_flag
+	91, 171, 134, 141,
+	// sig_coeff_flag
+	111, 111, 125, 110, 110, 94, 124, 108, 124, 107, 125, 141, 179, 153, 125, 107,
+	125, 141, 179, 153, 125, 107, 125, 141, 179, 153, 125, 140, 139, 182, 182, 152,
+	136, 152, 136, 153, 136, 139, 111, 136, 139, 111, 141, 111,
+	// coeff_abs_level_greater1_flag
+	140, 92, 137, 138, 140, 152, 138, 139, 153, 74, 149, 92, 139, 107, 122, 152,
+	140, 179, 166, 182, 140, 227, 122, 197,
+	// coeff_abs_level_greater2_flag
+	138, 153, 136, 167, 152, 152,
+}
+
+var rangeTabLps = [64][4]uint8{
+	{128, 176, 208, 240}, {128, 167, 197, 227}, {128, 158, 187, 216}, {123, 150, 178, 205},
+	{116, 142, 169, 195}, {111, 135, 160, 185}, {105, 128, 152, 175}, {100, 122, 144, 166},
+	{95, 116, 137, 158}, {90, 110, 130, 150}, {85, 104, 123, 142}, {81, 99, 117, 135},
+	{77, 94, 111, 128}, {73, 89, 105, 122}, {69, 85, 100, 116}, {66, 80, 95, 110},
+	{62, 76, 90, 104}, {59, 72, 86, 99}, {56, 69, 81, 94}, {53, 65, 77, 89},
+	{51, 62, 73, 85}, {48, 59, 69, 80}, {46, 56, 66, 76}, {43, 53, 63, 72},
+	{41, 50, 59, 69}, {39, 48, 56, 65}, {37, 45, 54, 62}, {35, 43, 51, 59},
+	{33, 41, 48, 56}, {32, 39, 46, 53}, {30, 37, 43, 50}, {29, 35, 41, 48},
+	{27, 33, 39, 45}, {26, 31, 37, 43}, {24, 30, 35, 41}, {23, 28, 33, 39},
+	{22, 27, 32, 37}, {21, 26, 30, 35}, {20, 24, 29, 33}, {19, 23, 27, 31},
+	{18, 22, 26, 30}, {17, 21, 25, 28}, {16, 20, 23, 27}, {15, 19, 22, 25},
+	{14, 18, 21, 24}, {14, 17, 20, 23}, {13, 16, 19, 22}, {12, 15, 18, 21},
+	{12, 14, 17, 20}, {11, 14, 16, 19}, {11, 13, 15, 18}, {10, 12, 15, 17},
+	{10, 12, 14, 16}, {9, 11, 13, 15}, {9, 11, 12, 14}, {8, 10, 12, 14},
+	{8, 9, 11, 13}, {7, 9, 11, 12}, {7, 9, 10, 12}, {7, 8, 10, 11},
+	{6, 8, 9, 11}, {6, 7, 9, 10}, {6, 7, 8, 9}, {2, 2, 2, 2},
+}
+
+var transIdxLps = [64]uint8{
+	0, 0, 1, 2, 2, 4, 4, 5, 6, 7, 8, 9, 9, 11, 11, 12,
+	13, 13, 15, 15, 16, 16, 18, 18, 19, 19, 21, 21, 22, 22, 23, 24,
+	24, 25, 26, 26, 27, 27, 28, 29, 29, 30, 30, 30, 31, 32, 32, 33,
+	33, 33, 34, 34, 35, 35, 35, 36, 36, 36, 37, 37, 37, 38, 38, 63,
+}
+
+// contextModel 上下文模型的概率状态
+type contextModel struct {
+	state uint8
+	mps   uint8
+}
+
+type contextSet [numContexts]contextModel
+
+// init 按条带 QP 初始化上下文
+func (cs *contextSet) init(qp int) {
+	qp = clip3(0, 51, qp)
+	for i, v := range contextInitValues {
+		m := int(v>>4)*5 - 45
+		n := int(v&15)<<3 - 16
+		pre := clip3(1, 126, (m*qp)>>4+n)
+		if pre <= 63 {
+			cs[i] = contextModel{state: uint8(63 - pre), mps: 0}
+		} else {
+			cs[i] = contextModel{state: uint8(pre - 64), mps: 1}
+		}
+	}
+}
+
+// cabac 算术解码引擎，逐位读取以便在 PCM 和子码流边界准确定位
+type cabac struct {
+	r      *bitReader
+	rng    uint32
+	offset uint32
+	ctx    contextSet
+}
+
+// start 从当前字节边界开始初始化算术解码引擎
+func (c *cabac) start() {
+	c.r.alignByte()
+	c.rng = 510
+	c.offset = c.r.u(9)
+}
+
+func (c *cabac) decodeBin(idx int) int {
+	m := &c.ctx[idx]
+	lps := uint32(rangeTabLps[m.state][(c.rng>>6)&3])
+	c.rng -= lps
+	var bin int
+	if c.offset >= c.rng {
+		bin = int(1 - m.mps)
+		c.offset -= c.rng
+		c.rng = lps
+		if m.state == 0 {
+			m.mps = 1 - m.mps
+		}
+		m.state = transIdxLps[m.state]
+	} else {
+		bin = int(m.mps)
+		if m.state < 62 {
+			m.state++
+		}
+	}
+	for c.rng < 256 {
+		c.rng <<= 1
+		c.offset = c.offset<<1 | c.r.bit()
+	}
+	return bin
+}
+
+func (c *cabac) decodeBypass() int {
+	c.offset = c.offset<<1 | c.r.bit()
+	if c.offset >= c.rng {
+		c.offset -= c.rng
+		return 1
+	}
+	return 0
+}
+
+// decodeBypassBits 读取 n 个旁路编码的比特，高位在前
+func (c *cabac) decodeBypassBits(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v = v<<1 | c.decodeBypass()
+	}
+	return v
+}
+
+func (c *cabac) decodeTerminate() int {
+	c.rng -= 2
+	if c.offset >= c.rng {
+		return 1
+	}
+	for c.rng < 256 {
+		c.rng <<= 1
+		c.offset = c.offset<<1 | c.r.bit()
+	}
+	return 0
+}
@@ -0,0 +1,598 @@
+package h265
+
+import "fmt"
+
+// sliceDecoder 解析一个条带片段的数据并重建样点
+type sliceDecoder struct {
+	pic *picture
+	s   *sps
+	p   *pps
+	sh  *sliceHeader
+	idx int16
+	r   *bitReader
+	c   cabac
+
+	ctbAddrRs int
+	ctbAddrTs int
+
+	// 量化参数
+	log2MinCuQpDeltaSize int
+	isCuQpDeltaCoded     bool
+	cuQpDeltaVal         int
+	qpYPred              int
+	qpY                  int
+	qpPrime              [3]int
+
+	// 当前编码单元
+	bypass        bool
+	intraSplit    bool
+	maxTrafoDepth int
+
+	coeffs [32 * 32]int32
+	tmp    [32 * 32]int32
+}
+
+func newSliceDecoder(pic *picture, sh *sliceHeader, idx int16, r *bitReader) *sliceDecoder {
+	d := &sliceDecoder{
+		pic: pic,
+		s:   pic.sps,
+		p:   pic.pps,
+		sh:  sh,
+		idx: idx,
+		r:   r,
+	}
+	d.c.r = r
+	d.log2MinCuQpDeltaSize = d.s.log2CtbSize - d.p.diffCuQpDeltaDepth
+	return d
+}
+
+func (d *sliceDecoder) decode() error {
+	pic, s, p, sh, t := d.pic, d.s, d.p, d.sh, d.pic.tiles
+	total := s.picWidthInCtbs * s.picHeightInCtb
+
+	d.r.skip(1) // alignment_bit_equal_to_one
+	d.c.start()
+
+	d.ctbAddrRs = sh.segmentAddr
+	d.ctbAddrTs = t.ctbAddrRsToTs[d.ctbAddrRs]
+	for {
+		rs, ts := d.ctbAddrRs, d.ctbAddrTs
+		ctbX, ctbY := rs%s.picWidthInCtbs, rs/s.picWidthInCtbs
+		x0, y0 := ctbX<<s.log2CtbSize, ctbY<<s.log2CtbSize
+		fillBlocks(pic, pic.slice, x0, y0, s.ctbSize, d.idx)
+
+		// 上下文初始化或同步
+		rowStart := ctbX == 0 || t.tileID[ts] != t.tileID[t.ctbAddrRsToTs[rs-1]]
+		switch {
+		case ts == 0 || t.tileID[ts] != t.tileID[ts-1]:
+			d.c.ctx.init(sh.qpY)
+			pic.qpPrevY = sh.qpY
+		case p.entropyCodingSync && rowStart:
+			if pic.available(x0, y0, x0+s.ctbSize, y0-s.ctbSize) {
+				d.c.ctx = pic.wppCtx
+			} else {
+				d.c.ctx.init(sh.qpY)
+			}
+			pic.qpPrevY = sh.qpY
+		case rs == sh.segmentAddr && sh.dependent:
+			d.c.ctx = pic.dsCtx
+		case rs == sh.segmentAddr:
+			d.c.ctx.init(sh.qpY)
+			pic.qpPrevY = sh.qpY
+		}
+
+		if sh.saoLuma || sh.saoChroma {
+			d.parseSAO(ctbX, ctbY)
+		}
+		d.codingQuadtree(x0, y0, s.log2CtbSize, 0)
+		end := d.c.decodeTerminate()
+
+		// 每行第二个 CTB 解码后保存上下文，供下一行同步
+		if p.entropyCodingSync && t.colStart[ctbX]+1 == ctbX {
+			pic.wppCtx = d.c.ctx
+		}
+		if d.r.overrun {
+			return fmt.Errorf("slice data truncated")
+		}
+
+		d.ctbAddrTs++
+		if end == 1 {
+			if p.dependentSliceSegments {
+				pic.dsCtx = d.c.ctx
+			}
+			return nil
+		}
+		if d.ctbAddrTs >= total {
+			return fmt.Errorf("slice data overrun")
+		}
+		d.ctbAddrRs = t.ctbAddrTsToRs[d.ctbAddrTs]
+
+		// 子码流结束
+		rs, ts = d.ctbAddrRs, d.ctbAddrTs
+		if (p.tilesEnabled && t.tileID[ts] != t.tileID[ts-1]) ||
+			(p.entropyCodingSync && (rs%s.picWidthInCtbs == 0 || t.tileID[ts] != t.tileID[t.ctbAddrRsToTs[rs-1]])) {
+			d.c.decodeTerminate() // end_of_subset_one_bit
+			d.c.start()
+		}
+	}
+}
+
+func (d *sliceDecoder) parseSAO(ctbX, ctbY int) {
+	pic, s, t := d.pic, d.s, d.pic.tiles
+	rs, ts := d.ctbAddrRs, d.ctbAddrTs
+	w := s.picWidthInCtbs
+
+	if ctbX > 0 && rs-1 >= d.sh.sliceAddr && t.tileID[ts] == t.tileID[t.ctbAddrRsToTs[rs-1]] {
+		if d.c.decodeBin(ctxSaoMerge) == 1 {
+			pic.sao[rs] = pic.sao[rs-1]
+			return
+		}
+	}
+	if ctbY > 0 && rs-w >= d.sh.sliceAddr && t.tileID[ts] == t.tileID[t.ctbAddrRsToTs[rs-w]] {
+		if d.c.decodeBin(ctxSaoMerge) == 1 {
+			pic.sao[rs] = pic.sao[rs-w]
+			return
+		}
+	}
+
+	var sp [3]saoParams
+	nComp := 1
+	if s.chromaArrayType != 0 {
+		nComp = 3
+	}
+	for cIdx := 0; cIdx < nComp; cIdx++ {
+		if (cIdx == 0 && !d.sh.saoLuma) || (cIdx > 0 && !d.sh.saoChroma) {
+			continue
+		}
+		if cIdx == 2 {
+			sp[2].typeIdx, sp[2].eoClass = sp[1].typeIdx, sp[1].eoClass
+		} else if d.c.decodeBin(ctxSaoType) == 1 {
+			sp[cIdx].typeIdx = uint8(1 + d.c.decodeBypass())
+		}
+		if sp[cIdx].typeIdx == 0 {
+			continue
+		}
+
+		bitDepth, scale := s.bitDepthY, d.p.log2SaoOffsetScaleY
+		if cIdx > 0 {
+			bitDepth, scale = s.bitDepthC, d.p.log2SaoOffsetScaleC
+		}
+		cMax := 1<<(min(bitDepth, 10)-5) - 1
+		var offsets [4]int
+		for i := range offsets {
+			for offsets[i] < cMax && d.c.decodeBypass() == 1 {
+				offsets[i]++
+			}
+		}
+		if sp[cIdx].typeIdx == 1 {
+			for i := range offsets {
+				if offsets[i] != 0 && d.c.decodeBypass() == 1 {
+					offsets[i] = -offsets[i]
+				}
+			}
+			sp[cIdx].bandPos = uint8(d.c.decodeBypassBits(5))
+		} else {
+			offsets[2], offsets[3] = -offsets[2], -offsets[3]
+			if cIdx < 2 {
+				sp[cIdx].eoClass = uint8(d.c.decodeBypassBits(2))
+			}
+		}
+		for i, v := range offsets {
+			sp[cIdx].offsets[i+1] = int16(v << scale)
+		}
+	}
+	pic.sao[rs] = sp
+}
+
+func (d *sliceDecoder) codingQuadtree(x0, y0, log2Size, depth int) {
+	pic, s := d.pic, d.s
+	size := 1 << log2Size
+
+	var split bool
+	if x0+size <= s.width && y0+size <= s.height && log2Size > s.log2MinCbSize {
+		inc := 0
+		if pic.available(x0, y0, x0-1, y0) && int(pic.ctDepth[pic.blk(x0-1, y0)]) > depth {
+			inc++
+		}
+		if pic.available(x0, y0, x0, y0-1) && int(pic.ctDepth[pic.blk(x0, y0-1)]) > depth {
+			inc++
+		}
+		split = d.c.decodeBin(ctxSplitCu+inc) == 1
+	} else {
+		split = log2Size > s.log2MinCbSize
+	}
+
+	if log2Size >= d.log2MinCuQpDeltaSize {
+		d.isCuQpDeltaCoded = false
+		d.cuQpDeltaVal = 0
+		d.startQuantGroup(x0, y0)
+	}
+
+	if !split {
+		d.codingUnit(x0, y0, log2Size, depth)
+		return
+	}
+	half := size / 2
+	for i := 0; i < 4; i++ {
+		x, y := x0+(i&1)*half, y0+(i>>1)*half
+		if x < s.width && y < s.height {
+			d.codingQuadtree(x, y, log2Size-1, depth+1)
+		}
+	}
+}
+
+// startQuantGroup 计算量化组的亮度 QP 预测值
+func (d *sliceDecoder) startQuantGroup(xQg, yQg int) {
+	pic, s := d.pic, d.s
+	qpA, qpB := pic.qpPrevY, pic.qpPrevY
+	if (xQg-1)>>s.log2CtbSize == xQg>>s.log2CtbSize {
+		qpA = int(pic.qpY[pic.blk(xQg-1, yQg)])
+	}
+	if (yQg-1)>>s.log2CtbSize == yQg>>s.log2CtbSize {
+		qpB = int(pic.qpY[pic.blk(xQg, yQg-1)])
+	}
+	d.qpYPred = (qpA + qpB + 1) >> 1
+}
+
+var chromaQpTable = [14]int{29, 30, 31, 32, 33, 33, 34, 34, 35, 35, 36, 36, 37, 37}
+
+// setQp 根据预测值和 CuQpDeltaVal 计算当前编码单元的 QP
+func (d *sliceDecoder) setQp() {
+	s, p := d.s, d.p
+	bdOffsetY := 6 * (s.bitDepthY - 8)
+	// 损坏的码流中 CuQpDeltaVal 可能超出范围，限制 QP 以免反量化时下标为负
+	d.qpY = clip3(-bdOffsetY, 51, (d.qpYPred+d.cuQpDeltaVal+52+2*bdOffsetY)%(52+bdOffsetY)-bdOffsetY)
+	d.qpPrime[0] = d.qpY + bdOffsetY
+	if s.chromaArrayType == 0 {
+		return
+	}
+	bdOffsetC := 6 * (s.bitDepthC - 8)
+	for i, offset := range [2]int{p.cbQpOffset + d.sh.cbQpOffset, p.crQpOffset + d.sh.crQpOffset} {
+		qpi := clip3(-bdOffsetC, 57, d.qpY+offset)
+		d.qpPrime[i+1] = chromaQp(s.chromaArrayType, qpi) + bdOffsetC
+	}
+}
+
+func chromaQp(chromaArrayType, qpi int) int {
+	switch {
+	case chromaArrayType != 1:
+		return min(qpi, 51)
+	case qpi < 30:
+		return qpi
+	case qpi > 43:
+		return qpi - 6
+	}
+	return chromaQpTable[qpi-30]
+}
+
+// 4:2:2 色度帧内预测模式的映射
+var chroma422ModeTable = [35]uint8{
+	0, 1, 2, 2, 2, 2, 3, 5, 7, 8, 10, 11, 13, 15, 16, 18, 19, 20,
+	21, 22, 23, 23, 24, 24, 25, 25, 26, 27, 27, 28, 28, 29, 29, 30, 31,
+}
+
+func (d *sliceDecoder) codingUnit(x0, y0, log2Size, depth int) {
+	pic, s, p := d.pic, d.s, d.p
+	size := 1 << log2Size
+
+	fillBlocks(pic, pic.ctDepth, x0, y0, size, uint8(depth))
+	d.bypass = p.transquantBypass && d.c.decodeBin(ctxTransquantBypass) == 1
+	d.intraSplit = log2Size == s.log2MinCbSize && d.c.decodeBin(ctxPartMode) == 0
+	d.setQp()
+
+	var flags uint8
+	if d.bypass {
+		flags |= blockBypass
+	}
+
+	pcm := false
+	if !d.intraSplit && s.pcmEnabled && log2Size >= s.log2MinPcmCbSize && log2Size <= s.log2MaxPcmCbSize {
+		pcm = d.c.decodeTerminate() == 1
+	}
+
+	if pcm {
+		fillBlocks(pic, pic.flags, x0, y0, size, flags|blockPCM)
+		fillBlocks(pic, pic.lumaMode, x0, y0, size, 1)
+		d.decodePCM(x0, y0, size)
+		d.markEdges(x0, y0, size)
+	} else {
+		fillBlocks(pic, pic.flags, x0, y0, size, flags)
+
+		nParts, pb := 1, size
+		if d.intraSplit {
+			nParts, pb = 4, size/2
+		}
+		var prev [4]bool
+		for i := 0; i < nParts; i++ {
+			prev[i] = d.c.decodeBin(ctxPrevIntraLuma) == 1
+		}
+		for i := 0; i < nParts; i++ {
+			xPb, yPb := x0+(i&1)*pb, y0+(i>>1)*pb
+			mpmIdx, rem := 0, 0
+			if prev[i] {
+				for mpmIdx < 2 && d.c.decodeBypass() == 1 {
+					mpmIdx++
+				}
+			} else {
+				rem = d.c.decodeBypassBits(5)
+			}
+			mode := d.lumaIntraMode(xPb, yPb, prev[i], mpmIdx, rem)
+			fillBlocks(pic, pic.lumaMode, xPb, yPb, pb, uint8(mode))
+		}
+
+		switch s.chromaArrayType {
+		case 3:
+			for i := 0; i < nParts; i++ {
+				xPb, yPb := x0+(i&1)*pb, y0+(i>>1)*pb
+				mode := d.chromaIntraMode(int(pic.lumaMode[pic.blk(xPb, yPb)]))
+				fillBlocks(pic, pic.chromaMode, xPb, yPb, pb, uint8(mode))
+			}
+		case 1, 2:
+			mode := d.chromaIntraMode(int(pic.lumaMode[pic.blk(x0, y0)]))
+			if s.chromaArrayType == 2 {
+				mode = int(chroma422ModeTable[mode])
+			}
+			fillBlocks(pic, pic.chromaMode, x0, y0, size, uint8(mode))
+		}
+
+		d.maxTrafoDepth = s.maxTrafoDepth
+		if d.intraSplit {
+			d.maxTrafoDepth++
+		}
+		d.transformTree(x0, y0, x0, y0, log2Size, 0, 0, [2]bool{}, [2]bool{})
+	}
+
+	fillBlocks(pic, pic.qpY, x0, y0, size, int8(d.qpY))
+	pic.qpPrevY = d.qpY
+}
+
+// lumaIntraMode 根据最可能模式列表推导亮度帧内预测模式
+func (d *sliceDecoder) lumaIntraMode(xPb, yPb int, prev bool, mpmIdx, rem int) int {
+	pic, s := d.pic, d.s
+	candA, candB := 1, 1
+	if pic.available(xPb, yPb, xPb-1, yPb) {
+		candA = int(pic.lumaMode[pic.blk(xPb-1, yPb)])
+	}
+	// 上方不在同一 CTB 时不使用
+	if yPb-1 >= (yPb>>s.log2CtbSize)<<s.log2CtbSize && pic.available(xPb, yPb, xPb, yPb-1) {
+		candB = int(pic.lumaMode[pic.blk(xPb, yPb-1)])
+	}
+
+	var list [3]int
+	switch {
+	case candA == candB && candA < 2:
+		list = [3]int{0, 1, 26}
+	case candA == candB:
+		list = [3]int{candA, 2 + (candA+29)%32, 2 + (candA-2+1)%32}
+	default:
+		list[0], list[1] = candA, candB
+		switch {
+		case candA != 0 && candB != 0:
+			list[2] = 0
+		case candA != 1 && candB != 1:
+			list[2] = 1
+		default:
+			list[2] = 26
+		}
+	}
+	if prev {
+		return list[mpmIdx]
+	}
+
+	if list[0] > list[1] {
+		list[0], list[1] = list[1], list[0]
+	}
+	if list[0] > list[2] {
+		list[0], list[2] = list[2], list[0]
+	}
+	if list[1] > list[2] {
+		list[1], list[2] = list[2], list[1]
+	}
+	mode := rem
+	for _, c := range list {
+		if mode >= c {
+			mode++
+		}
+	}
+	return mode
+}
+
+// chromaIntraMode 解析 intra_chroma_pred_mode 并推导色度预测模式
+func (d *sliceDecoder) chromaIntraMode(lumaMode int) int {
+	if d.c.decodeBin(ctxIntraChroma) == 0 {
+		return lumaMode
+	}
+	mode := [4]int{0, 26, 10, 1}[d.c.decodeBypassBits(2)]
+	if mode == lumaMode {
+		return 34
+	}
+	return mode
+}
+
+// decodePCM 读取 PCM 样点，之后重新初始化算术解码引擎
+func (d *sliceDecoder) decodePCM(x0, y0, size int) {
+	pic, s, r := d.pic, d.s, d.r
+	r.alignByte()
+	for y := 0; y < size; y++ {
+		row := pic.planes[0][(y0+y)*pic.width[0]+x0:]
+		for x := 0; x < size; x++ {
+			row[x] = uint16(r.u(s.pcmBitDepthY) << (s.bitDepthY - s.pcmBitDepthY))
+		}
+	}
+	if s.chromaArrayType != 0 {
+		w, h := size/s.subWidthC, size/s.subHeightC
+		xc, yc := x0/s.subWidthC, y0/s.subHeightC
+		for c := 1; c < 3; c++ {
+			for y := 0; y < h; y++ {
+				row := pic.planes[c][(yc+y)*pic.width[c]+xc:]
+				for x := 0; x < w; x++ {
+					row[x] = uint16(r.u(s.pcmBitDepthC) << (s.bitDepthC - s.pcmBitDepthC))
+				}
+			}
+		}
+	}
+	d.c.start()
+}
+
+func (d *sliceDecoder) transformTree(x0, y0, xBase, yBase, log2Size, depth, blkIdx int, parentCb, parentCr [2]bool) {
+	s := d.s
+	cat := s.chromaArrayType
+
+	var split bool
+	if log2Size <= s.log2MaxTbSize && log2Size > s.log2MinTbSize && depth < d.maxTrafoDepth && !(d.intraSplit && depth == 0) {
+		split = d.c.decodeBin(ctxSplitTransform+5-log2Size) == 1
+	} else {
+		split = log2Size > s.log2MaxTbSize || (d.intraSplit && depth == 0)
+	}
+
+	var cbfCb, cbfCr [2]bool
+	if (log2Size > 2 && cat != 0) || cat == 3 {
+		second := cat == 2 && (!split || log2Size == 3)
+		for _, cbf := range []*[2]bool{&cbfCb, &cbfCr} {
+			parent := parentCb
+			if cbf == &cbfCr {
+				parent = parentCr
+			}
+			if depth == 0 || parent[0] {
+				cbf[0] = d.c.decodeBin(ctxCbfChroma+depth) == 1
+				if second {
+					cbf[1] = d.c.decodeBin(ctxCbfChroma+depth) == 1
+				}
+			}
+		}
+	}
+
+	if split {
+		half := 1 << (log2Size - 1)
+		for i := 0; i < 4; i++ {
+			d.transformTree(x0+(i&1)*half, y0+(i>>1)*half, x0, y0, log2Size-1, depth+1, i, cbfCb, cbfCr)
+		}
+		return
+	}
+
+	inc := 0
+	if depth == 0 {
+		inc = 1
+	}
+	cbfLuma := d.c.decodeBin(ctxCbfLuma+inc) == 1
+	d.transformUnit(x0, y0, xBase, yBase, log2Size, blkIdx, cbfLuma, cbfCb, cbfCr, parentCb, parentCr)
+	d.markEdges(x0, y0, 1<<log2Size)
+}
+
+func (d *sliceDecoder) transformUnit(x0, y0, xBase, yBase, log2Size, blkIdx int, cbfLuma bool, cbfCb, cbfCr, parentCb, parentCr [2]bool) {
+	pic, s, p := d.pic, d.s, d.p
+	cat := s.chromaArrayType
+
+	log2SizeC := log2Size
+	if cat != 3 {
+		log2SizeC = max(2, log2Size-1)
+	}
+	chromaHere := cat != 0 && (log2Size > 2 || cat == 3)
+	chromaDeferred := cat != 0 && !chromaHere
+	if chromaDeferred {
+		cbfCb, cbfCr = parentCb, parentCr
+	}
+	cbfChroma := cbfCb[0] || cbfCr[0] || cbfCb[1] || cbfCr[1]
+
+	if (cbfLuma || cbfChroma) && p.cuQpDeltaEnabled && !d.isCuQpDeltaCoded {
+		v := 0
+		for v < 5 && d.c.decodeBin(ctxCuQpDelta+min(v, 1)) == 1 {
+			v++
+		}
+		if v == 5 {
+			k := 0
+			for d.c.decodeBypass() == 1 && k < 32 {
+				v += 1 << k
+				k++
+			}
+			v += d.c.decodeBypassBits(k)
+		}
+		if v > 0 && d.c.decodeBypass() == 1 {
+			v = -v
+		}
+		d.isCuQpDeltaCoded = true
+		d.cuQpDeltaVal = v
+		d.setQp()
+	}
+
+	size := 1 << log2Size
+	lumaMode := int(pic.lumaMode[pic.blk(x0, y0)])
+	d.predictIntra(0, x0, y0, size, lumaMode)
+	if cbfLuma {
+		d.residual(0, x0, y0, log2Size, lumaMode)
+	}
+
+	if !chromaHere && !(chromaDeferred && blkIdx == 3) {
+		return
+	}
+	xL, yL := x0, y0
+	if chromaDeferred {
+		xL, yL = xBase, yBase
+	}
+	chromaMode := int(pic.chromaMode[pic.blk(xL, yL)])
+	xC, yC := xL/s.subWidthC, yL/s.subHeightC
+	sizeC := 1 << log2SizeC
+	n := 1
+	if cat == 2 {
+		n = 2
+	}
+	for cIdx := 1; cIdx < 3; cIdx++ {
+		cbf := cbfCb
+		if cIdx == 2 {
+			cbf = cbfCr
+		}
+		for t := 0; t < n; t++ {
+			d.predictIntra(cIdx, xC, yC+t*sizeC, sizeC, chromaMode)
+			if cbf[t] {
+				d.residual(cIdx, xC, yC+t*sizeC, log2SizeC, chromaMode)
+			}
+		}
+	}
+}
+
+// markEdges 标记变换块左边界和上边界的去块滤波边界强度
+func (d *sliceDecoder) markEdges(x0, y0, size int) {
+	pic := d.pic
+	if d.sh.deblockingDisabled {
+		return
+	}
+	if x0&7 == 0 && d.filterEdge(x0, y0, x0-1, y0) {
+		for y := y0; y < y0+size; y += 4 {
+			pic.edgeV[pic.blk(x0, y)] = 2
+		}
+	}
+	if y0&7 == 0 && d.filterEdge(x0, y0, x0, y0-1) {
+		for x := x0; x < x0+size; x += 4 {
+			pic.edgeH[pic.blk(x, y0)] = 2
+		}
+	}
+}
+
+// filterEdge 判断与相邻块之间的边界是否需要滤波
+func (d *sliceDecoder) filterEdge(x, y, xN, yN int) bool {
+	pic := d.pic
+	if xN < 0 || yN < 0 {
+		return false
+	}
+	t := pic.tiles
+	if !d.p.loopFilterAcrossTiles && t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(x, y)]] != t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(xN, yN)]] {
+		return false
+	}
+	if !d.sh.loopFilterAcrossSlices {
+		if n := pic.slice[pic.blk(xN, yN)]; n < 0 || pic.slices[n].sliceAddr != d.sh.sliceAddr {
+			return false
+		}
+	}
+	return true
+}
+
+// fillBlocks 设置亮度区域内所有 4x4 块的值
+func fillBlocks[T any](pic *picture, m []T, x0, y0, size int, v T) {
+	x1, y1 := min(x0+size, pic.width[0]), min(y0+size, pic.height[0])
+	for y := y0; y < y1; y += 4 {
+		row := (y >> 2) * pic.minW
+		for x := x0; x < x1; x += 4 {
+			m[row+x>>2] = v
+		}
+	}
+}
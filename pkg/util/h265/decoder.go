@@ -0,0 +1,133 @@
+// Package h265 实现 H.265/HEVC 帧内图像的纯 Go 解码
+//
+// 只支持 I 条带，覆盖 Main、Main Still Picture 以及 4:0:0/4:2:2/4:4:4 的
+// 帧内编码工具：分块、波前并行、多条带、PCM、无损、变换跳过、量化矩阵、
+// 去块滤波和样点自适应补偿。帧间条带和范围扩展中的编码工具返回 ErrUnsupported。
+package h265
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported 码流使用了不支持的编码工具
+var ErrUnsupported = errors.New("h265: unsupported stream")
+
+func unsupported(what string) error {
+	return fmt.Errorf("%w: %s", ErrUnsupported, what)
+}
+
+// Decoder 帧内解码器，参数集在多次 Decode 调用之间保留
+type Decoder struct {
+	sps [16]*sps
+	pps [64]*pps
+
+	pic       *picture
+	lastSlice *sliceHeader
+}
+
+// NewDecoder 创建解码器
+func NewDecoder() *Decoder {
+	return &Decoder{}
+}
+
+// Decode 解码一段 Annex B 字节流，返回其中完整的图像
+// 数据末尾的图像视为完整，遇到帧间条带时返回已解码的图像和 ErrUnsupported
+func (d *Decoder) Decode(data []byte) ([]*Picture, error) {
+	var pics []*Picture
+	for _, nal := range splitNALUnits(data) {
+		if len(nal) < 2 || nal[0]&0x80 != 0 {
+			continue
+		}
+		nalType := int(nal[0] >> 1 & 0x3f)
+		// 只解码基本层
+		if layerID := int(nal[0]&1)<<5 | int(nal[1]>>3); layerID != 0 {
+			continue
+		}
+		rbsp := unescapeRBSP(nal[2:])
+
+		switch {
+		case nalType == nalSPS:
+			s, err := parseSPS(rbsp)
+			if err != nil {
+				return pics, err
+			}
+			d.sps[s.id] = s
+		case nalType == nalPPS:
+			p, err := parsePPS(rbsp)
+			if err != nil {
+				return pics, err
+			}
+			d.pps[p.id] = p
+		case nalType <= nalRsvIRAP23 && (nalType < 10 || nalType >= nalBLAWLP):
+			r := newBitReader(rbsp)
+			if r.flag() && d.pic != nil {
+				// 新图像的第一个条带，输出上一幅图像
+				pics = append(pics, d.finish())
+			}
+			r.pos = 0
+			if err := d.decodeSlice(r, nalType); err != nil {
+				d.pic = nil
+				return pics, err
+			}
+		}
+	}
+	if d.pic != nil {
+		pics = append(pics, d.finish())
+	}
+	return pics, nil
+}
+
+// Decode 解码字节流中的第一幅图像
+func Decode(data []byte) (*Picture, error) {
+	pics, err := NewDecoder().Decode(data)
+	if len(pics) > 0 {
+		return pics[0], nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no picture found")
+	}
+	return nil, err
+}
+
+func (d *Decoder) decodeSlice(r *bitReader, nalType int) error {
+	sh, err := d.parseSliceHeader(r, nalType, d.lastSlice)
+	if err != nil {
+		return err
+	}
+	p := d.pps[sh.ppsID]
+	s := d.sps[p.spsID]
+
+	if sh.firstInPic {
+		pic, err := newPicture(s, p)
+		if err != nil {
+			return err
+		}
+		d.pic = pic
+	} else if d.pic == nil || d.pic.sps != s {
+		return fmt.Errorf("slice without picture")
+	}
+	if d.pic.pps != p {
+		// 同一图像的条带可以引用不同的 PPS，分块结构必须一致
+		tiles, err := newTileLayout(s, p)
+		if err != nil {
+			return err
+		}
+		d.pic.pps, d.pic.tiles = p, tiles
+	}
+	d.lastSlice = sh
+
+	d.pic.slices = append(d.pic.slices, sh)
+	sd := newSliceDecoder(d.pic, sh, int16(len(d.pic.slices)-1), r)
+	return sd.decode()
+}
+
+// finish 对当前图像进行环路滤波并输出
+func (d *Decoder) finish() *Picture {
+	pic := d.pic
+	d.pic = nil
+	d.lastSlice = nil
+	pic.deblock()
+	pic.applySAO()
+	return pic.output()
+}
@@ -0,0 +1,89 @@
+package h265
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 期望值为参考解码器 libde265 输出的各分量样点（小端 16 位）的 SHA-256
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		file          string
+		width, height int
+		sha256        string
+	}{
+		{"i420_wpp_slices.265", 72, 56, "aa09033a10de1162fe30d1a01e9c51dd081d36b112bd4e97e812123c2fcc846b"},
+		{"i420_tskip_scaling.265", 64, 48, "c2a6c5a88e41a0588c47654b286803e812b879f4365e1f85b56edbf0987cf4fd"},
+		{"i444_culossless.265", 40, 36, "8cf3ce59c46c69e40dbd7d8ac71b7eac8c5f05cd26f3610b06fd21a854af7132"},
+		{"i422_ctu32.265", 66, 50, "757bf7f0005871a6536787779a58919f2b55d01abd195d323d185177914712c8"},
+		{"i400.265", 48, 40, "234f21149d7c001f8532234715908e87df336d2c90663926aeb81c10dab7ca72"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pic, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if pic.Width != tt.width || pic.Height != tt.height {
+				t.Fatalf("size = %dx%d, want %dx%d", pic.Width, pic.Height, tt.width, tt.height)
+			}
+
+			h := sha256.New()
+			for _, plane := range pic.Planes {
+				buf := make([]byte, 2*len(plane))
+				for i, v := range plane {
+					binary.LittleEndian.PutUint16(buf[2*i:], v)
+				}
+				h.Write(buf)
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != tt.sha256 {
+				t.Errorf("sha256 = %s, want %s", got, tt.sha256)
+			}
+		})
+	}
+}
+
+// 截断或改写码流后解码只能返回错误，不能 panic
+func TestDecodeCorrupt(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.265"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no test streams")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i += 7 {
+			for _, corrupt := range [][]byte{
+				data[:i],
+				flip(data, i, 0xff),
+				flip(data, i, 0x10),
+			} {
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Fatalf("%s: corrupt at %d: %v", file, i, r)
+						}
+					}()
+					Decode(corrupt)
+				}()
+			}
+		}
+	}
+}
+
+func flip(data []byte, i int, mask byte) []byte {
+	c := append([]byte(nil), data...)
+	c[i] ^= mask
+	return c
+}
@@ -0,0 +1,300 @@
+package h265
+
+var betaTable = [52]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 20, 22, 24,
+	26, 28, 30, 32, 34, 36, 38, 40, 42, 44, 46, 48, 50, 52, 54, 56, 58, 60, 62, 64,
+}
+
+var tcTable = [54]int{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 3,
+	3, 3, 3, 4, 4, 4, 5, 5, 6, 6, 7, 8, 9, 10, 11, 13, 14, 16, 18, 20, 22, 24,
+}
+
+// edgeSamples 沿边界方向访问样点，p(i, k) 为边界一侧第 k 行（列）距边界 i 的样点
+type edgeSamples struct {
+	plane  []uint16
+	base   int // q0 在第 0 行的下标
+	step   int // 垂直于边界的步长
+	stride int // 沿边界的步长
+}
+
+func (e edgeSamples) p(i, k int) int { return int(e.plane[e.base+k*e.stride-(i+1)*e.step]) }
+func (e edgeSamples) q(i, k int) int { return int(e.plane[e.base+k*e.stride+i*e.step]) }
+func (e edgeSamples) setP(i, k, v int) {
+	e.plane[e.base+k*e.stride-(i+1)*e.step] = uint16(v)
+}
+func (e edgeSamples) setQ(i, k, v int) {
+	e.plane[e.base+k*e.stride+i*e.step] = uint16(v)
+}
+
+// noFilter 判断 4x4 块中的样点是否不受环路滤波影响
+func (pic *picture) noFilter(blk int) bool {
+	f := pic.flags[blk]
+	return f&blockBypass != 0 || (f&blockPCM != 0 && pic.sps.pcmLoopFilterOff)
+}
+
+// deblock 去块滤波，先处理整幅图像的垂直边界，再处理水平边界
+func (pic *picture) deblock() {
+	for _, vertical := range []bool{true, false} {
+		edges := pic.edgeH
+		if vertical {
+			edges = pic.edgeV
+		}
+		for by := 0; by < pic.minH; by++ {
+			for bx := 0; bx < pic.minW; bx++ {
+				blk := by*pic.minW + bx
+				if edges[blk] == 0 {
+					continue
+				}
+				pblk := blk - pic.minW
+				if vertical {
+					pblk = blk - 1
+				}
+				pic.deblockLuma(bx<<2, by<<2, vertical, blk, pblk)
+				if pic.sps.chromaArrayType != 0 {
+					pic.deblockChroma(bx<<2, by<<2, vertical, blk, pblk)
+				}
+			}
+		}
+	}
+}
+
+func (pic *picture) edge(cIdx, x, y int, vertical bool) edgeSamples {
+	stride := pic.width[cIdx]
+	e := edgeSamples{plane: pic.planes[cIdx], base: y*stride + x, step: stride, stride: 1}
+	if vertical {
+		e.step, e.stride = 1, stride
+	}
+	return e
+}
+
+func (pic *picture) deblockLuma(x, y int, vertical bool, blk, pblk int) {
+	s := pic.sps
+	sh := pic.slices[pic.slice[blk]]
+	qp := (int(pic.qpY[blk]) + int(pic.qpY[pblk]) + 1) >> 1
+	beta := betaTable[clip3(0, 51, qp+sh.betaOffsetDiv2*2)] << (s.bitDepthY - 8)
+	tc := tcTable[clip3(0, 53, qp+2+sh.tcOffsetDiv2*2)] << (s.bitDepthY - 8)
+	if tc == 0 && beta == 0 {
+		return
+	}
+
+	e := pic.edge(0, x, y, vertical)
+	dp0 := abs(e.p(2, 0) - 2*e.p(1, 0) + e.p(0, 0))
+	dp3 := abs(e.p(2, 3) - 2*e.p(1, 3) + e.p(0, 3))
+	dq0 := abs(e.q(2, 0) - 2*e.q(1, 0) + e.q(0, 0))
+	dq3 := abs(e.q(2, 3) - 2*e.q(1, 3) + e.q(0, 3))
+	if dp0+dq0+dp3+dq3 >= beta {
+		return
+	}
+
+	strong := func(k, dpq int) bool {
+		return 2*dpq < beta>>2 &&
+			abs(e.p(3, k)-e.p(0, k))+abs(e.q(0, k)-e.q(3, k)) < beta>>3 &&
+			abs(e.p(0, k)-e.q(0, k)) < (5*tc+1)>>1
+	}
+	strongFilter := strong(0, dp0+dq0) && strong(3, dp3+dq3)
+	side := (beta + beta>>1) >> 3
+	filterP1, filterQ1 := dp0+dp3 < side, dq0+dq3 < side
+	filterP, filterQ := !pic.noFilter(pblk), !pic.noFilter(blk)
+	maxVal := 1<<s.bitDepthY - 1
+
+	for k := 0; k < 4; k++ {
+		p0, p1, p2, p3 := e.p(0, k), e.p(1, k), e.p(2, k), e.p(3, k)
+		q0, q1, q2, q3 := e.q(0, k), e.q(1, k), e.q(2, k), e.q(3, k)
+		if strongFilter {
+			if filterP {
+				e.setP(0, k, clip3(p0-2*tc, p0+2*tc, (p2+2*p1+2*p0+2*q0+q1+4)>>3))
+				e.setP(1, k, clip3(p1-2*tc, p1+2*tc, (p2+p1+p0+q0+2)>>2))
+				e.setP(2, k, clip3(p2-2*tc, p2+2*tc, (2*p3+3*p2+p1+p0+q0+4)>>3))
+			}
+			if filterQ {
+				e.setQ(0, k, clip3(q0-2*tc, q0+2*tc, (p1+2*p0+2*q0+2*q1+q2+4)>>3))
+				e.setQ(1, k, clip3(q1-2*tc, q1+2*tc, (p0+q0+q1+q2+2)>>2))
+				e.setQ(2, k, clip3(q2-2*tc, q2+2*tc, (p0+q0+q1+3*q2+2*q3+4)>>3))
+			}
+			continue
+		}
+
+		delta := (9*(q0-p0) - 3*(q1-p1) + 8) >> 4
+		if abs(delta) >= tc*10 {
+			continue
+		}
+		delta = clip3(-tc, tc, delta)
+		if filterP {
+			e.setP(0, k, clip3(0, maxVal, p0+delta))
+			if filterP1 {
+				dp := clip3(-(tc >> 1), tc>>1, (((p2+p0+1)>>1)-p1+delta)>>1)
+				e.setP(1, k, clip3(0, maxVal, p1+dp))
+			}
+		}
+		if filterQ {
+			e.setQ(0, k, clip3(0, maxVal, q0-delta))
+			if filterQ1 {
+				dq := clip3(-(tc >> 1), tc>>1, (((q2+q0+1)>>1)-q1-delta)>>1)
+				e.setQ(1, k, clip3(0, maxVal, q1+dq))
+			}
+		}
+	}
+}
+
+// deblockChroma 色度只滤波位于 8x8 色度样点网格上的边界
+func (pic *picture) deblockChroma(x, y int, vertical bool, blk, pblk int) {
+	s, p := pic.sps, pic.pps
+	xc, yc, n := x/s.subWidthC, y/s.subHeightC, 4/s.subHeightC
+	if vertical {
+		if xc&7 != 0 {
+			return
+		}
+	} else {
+		n = 4 / s.subWidthC
+		if yc&7 != 0 {
+			return
+		}
+	}
+
+	sh := pic.slices[pic.slice[blk]]
+	qpi := (int(pic.qpY[blk]) + int(pic.qpY[pblk]) + 1) >> 1
+	filterP, filterQ := !pic.noFilter(pblk), !pic.noFilter(blk)
+	maxVal := 1<<s.bitDepthC - 1
+
+	for cIdx, offset := range [3]int{0, p.cbQpOffset, p.crQpOffset} {
+		if cIdx == 0 {
+			continue
+		}
+		qpc := chromaQp(s.chromaArrayType, qpi+offset)
+		tc := tcTable[clip3(0, 53, qpc+2+sh.tcOffsetDiv2*2)] << (s.bitDepthC - 8)
+		if tc == 0 {
+			continue
+		}
+		e := pic.edge(cIdx, xc, yc, vertical)
+		for k := 0; k < n; k++ {
+			p0, p1, q0, q1 := e.p(0, k), e.p(1, k), e.q(0, k), e.q(1, k)
+			delta := clip3(-tc, tc, ((((q0 - p0) << 2) + p1 - q1 + 4) >> 3))
+			if filterP {
+				e.setP(0, k, clip3(0, maxVal, p0+delta))
+			}
+			if filterQ {
+				e.setQ(0, k, clip3(0, maxVal, q0-delta))
+			}
+		}
+	}
+}
+
+// applySAO 样点自适应补偿，以去块后的图像为输入逐 CTB 处理
+func (pic *picture) applySAO() {
+	s := pic.sps
+	if !s.saoEnabled {
+		return
+	}
+	used := false
+	for _, sh := range pic.slices {
+		if sh.saoLuma || sh.saoChroma {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return
+	}
+
+	nComp := 1
+	if s.chromaArrayType != 0 {
+		nComp = 3
+	}
+	for cIdx := 0; cIdx < nComp; cIdx++ {
+		src := make([]uint16, len(pic.planes[cIdx]))
+		copy(src, pic.planes[cIdx])
+		for rs := range pic.sao {
+			sp := &pic.sao[rs][cIdx]
+			if sp.typeIdx == 0 {
+				continue
+			}
+			pic.saoCTB(cIdx, rs, sp, src)
+		}
+	}
+}
+
+var saoEdgeOffsets = [4][2][2]int{
+	{{-1, 0}, {1, 0}},
+	{{0, -1}, {0, 1}},
+	{{-1, -1}, {1, 1}},
+	{{1, -1}, {-1, 1}},
+}
+
+func (pic *picture) saoCTB(cIdx, rs int, sp *saoParams, src []uint16) {
+	s, t := pic.sps, pic.tiles
+	subW, subH, bitDepth := 1, 1, s.bitDepthY
+	if cIdx > 0 {
+		subW, subH, bitDepth = s.subWidthC, s.subHeightC, s.bitDepthC
+	}
+	w, h := s.ctbSize/subW, s.ctbSize/subH
+	x0, y0 := rs%s.picWidthInCtbs*w, rs/s.picWidthInCtbs*h
+	width, height := pic.width[cIdx], pic.height[cIdx]
+	plane := pic.planes[cIdx]
+	maxVal := 1<<bitDepth - 1
+
+	var bandTable [32]int
+	if sp.typeIdx == 1 {
+		for k := 0; k < 4; k++ {
+			bandTable[(k+int(sp.bandPos))&31] = k + 1
+		}
+	}
+	edgeIdxMap := [5]int{1, 2, 0, 3, 4}
+	dirs := saoEdgeOffsets[sp.eoClass]
+
+	for y := y0; y < min(y0+h, height); y++ {
+		for x := x0; x < min(x0+w, width); x++ {
+			blk := pic.blk(x*subW, y*subH)
+			// 损坏的码流中条带可能没有覆盖整幅图像，未解码的块不做补偿
+			if pic.slice[blk] < 0 || pic.noFilter(blk) {
+				continue
+			}
+			v := int(src[y*width+x])
+			if sp.typeIdx == 1 {
+				plane[y*width+x] = uint16(clip3(0, maxVal, v+int(sp.offsets[bandTable[v>>(bitDepth-5)]])))
+				continue
+			}
+
+			edgeIdx := 2
+			skip := false
+			for _, dir := range dirs {
+				xN, yN := x+dir[0], y+dir[1]
+				if xN < 0 || yN < 0 || xN >= width || yN >= height {
+					skip = true
+					break
+				}
+				nblk := pic.blk(xN*subW, yN*subH)
+				if pic.slice[nblk] < 0 {
+					skip = true
+					break
+				}
+				if pic.slice[nblk] != pic.slice[blk] {
+					cur, nb := pic.slices[pic.slice[blk]], pic.slices[pic.slice[nblk]]
+					if cur.sliceAddr != nb.sliceAddr {
+						if (pic.zscan[nblk] < pic.zscan[blk] && !cur.loopFilterAcrossSlices) ||
+							(pic.zscan[blk] < pic.zscan[nblk] && !nb.loopFilterAcrossSlices) {
+							skip = true
+							break
+						}
+					}
+				}
+				if !pic.pps.loopFilterAcrossTiles &&
+					t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(xN*subW, yN*subH)]] != t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(x*subW, y*subH)]] {
+					skip = true
+					break
+				}
+				n := int(src[yN*width+xN])
+				switch {
+				case v < n:
+					edgeIdx--
+				case v > n:
+					edgeIdx++
+				}
+			}
+			if skip {
+				continue
+			}
+			plane[y*width+x] = uint16(clip3(0, maxVal, v+int(sp.offsets[edgeIdxMap[edgeIdx]])))
+		}
+	}
+}
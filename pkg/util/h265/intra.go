@@ -0,0 +1,194 @@
+package h265
+
+var intraPredAngle = [35]int{
+	0, 0, 32, 26, 21, 17, 13, 9, 5, 2, 0, -2, -5, -9, -13, -17, -21, -26,
+	-32, -26, -21, -17, -13, -9, -5, -2, 0, 2, 5, 9, 13, 17, 21, 26, 32,
+}
+
+// invAngle 模式 11 到 25 的反向角度
+var invAngle = [15]int{-4096, -1638, -910, -630, -482, -390, -315, -256, -315, -390, -482, -630, -910, -1638, -4096}
+
+func log2Size(n int) int {
+	l := 0
+	for 1<<l < n {
+		l++
+	}
+	return l
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// predictIntra 生成帧内预测样点并写入重建图像，坐标和尺寸以分量样点为单位
+func (d *sliceDecoder) predictIntra(cIdx, x0, y0, n, mode int) {
+	pic, s := d.pic, d.s
+	plane, stride := pic.planes[cIdx], pic.width[cIdx]
+	subW, subH, bitDepth := 1, 1, s.bitDepthY
+	if cIdx > 0 {
+		subW, subH, bitDepth = s.subWidthC, s.subHeightC, s.bitDepthC
+	}
+	maxVal := 1<<bitDepth - 1
+
+	// 参考样点按左下到左上再到右上的顺序排列：
+	// lin[2n-1-y] = p[-1][y]，lin[2n] = p[-1][-1]，lin[2n+1+x] = p[x][-1]
+	var linBuf, filtBuf [4*32 + 1]int
+	var availBuf [4*32 + 1]bool
+	total := 4*n + 1
+	lin, avail := linBuf[:total], availBuf[:total]
+	xCurr, yCurr := x0*subW, y0*subH
+	count := 0
+	for i := 0; i < total; i++ {
+		xN, yN := x0-1, y0-1
+		switch {
+		case i < 2*n:
+			yN = y0 + 2*n - 1 - i
+		case i > 2*n:
+			xN = x0 + i - 2*n - 1
+		}
+		if pic.available(xCurr, yCurr, xN*subW, yN*subH) {
+			lin[i] = int(plane[yN*stride+xN])
+			avail[i] = true
+			count++
+		}
+	}
+	if count == 0 {
+		for i := range lin {
+			lin[i] = 1 << (bitDepth - 1)
+		}
+	} else {
+		if !avail[0] {
+			for i := 1; i < total; i++ {
+				if avail[i] {
+					lin[0] = lin[i]
+					break
+				}
+			}
+		}
+		for i := 1; i < total; i++ {
+			if !avail[i] {
+				lin[i] = lin[i-1]
+			}
+		}
+	}
+
+	// 参考样点滤波
+	if (cIdx == 0 || s.chromaArrayType == 3) && mode != 1 && n != 4 {
+		thres := 0
+		switch n {
+		case 8:
+			thres = 7
+		case 16:
+			thres = 1
+		}
+		if min(abs(mode-26), abs(mode-10)) > thres {
+			filt := filtBuf[:total]
+			corner, left, top := lin[2*n], lin[0], lin[total-1]
+			if s.strongSmoothing && cIdx == 0 && n == 32 &&
+				abs(corner+top-2*lin[3*n]) < 1<<(bitDepth-5) &&
+				abs(corner+left-2*lin[n]) < 1<<(bitDepth-5) {
+				filt[2*n] = corner
+				for i := 0; i < 2*n-1; i++ {
+					filt[2*n-1-i] = ((63-i)*corner + (i+1)*left + 32) >> 6
+					filt[2*n+1+i] = ((63-i)*corner + (i+1)*top + 32) >> 6
+				}
+				filt[0], filt[total-1] = left, top
+			} else {
+				filt[0], filt[total-1] = lin[0], lin[total-1]
+				for i := 1; i < total-1; i++ {
+					filt[i] = (lin[i-1] + 2*lin[i] + lin[i+1] + 2) >> 2
+				}
+			}
+			lin = filt
+		}
+	}
+
+	left := func(y int) int { return lin[2*n-1-y] }
+	top := func(x int) int { return lin[2*n+1+x] }
+	set := func(x, y, v int) { plane[(y0+y)*stride+x0+x] = uint16(v) }
+	boundaryFilter := cIdx == 0 && n < 32
+
+	switch {
+	case mode == 0:
+		shift := log2Size(n) + 1
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				set(x, y, ((n-1-x)*left(y)+(x+1)*top(n)+(n-1-y)*top(x)+(y+1)*left(n)+n)>>shift)
+			}
+		}
+
+	case mode == 1:
+		sum := n
+		for i := 0; i < n; i++ {
+			sum += top(i) + left(i)
+		}
+		dc := sum >> (log2Size(n) + 1)
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				set(x, y, dc)
+			}
+		}
+		if boundaryFilter {
+			set(0, 0, (left(0)+2*dc+top(0)+2)>>2)
+			for i := 1; i < n; i++ {
+				set(i, 0, (top(i)+3*dc+2)>>2)
+				set(0, i, (left(i)+3*dc+2)>>2)
+			}
+		}
+
+	default:
+		angle := intraPredAngle[mode]
+		vertical := mode >= 18
+		// main 为主参考方向，side 为另一方向
+		main, side := top, left
+		if !vertical {
+			main, side = left, top
+		}
+		var refBuf [3*32 + 1]int
+		ref := func(i int) *int { return &refBuf[i+n] }
+		for i := 0; i <= n; i++ {
+			*ref(i) = main(i - 1)
+		}
+		if angle < 0 {
+			if last := (n * angle) >> 5; last < -1 {
+				inv := invAngle[mode-11]
+				for i := last; i <= -1; i++ {
+					*ref(i) = side(-1 + ((i*inv + 128) >> 8))
+				}
+			}
+		} else {
+			for i := n + 1; i <= 2*n; i++ {
+				*ref(i) = main(i - 1)
+			}
+		}
+
+		for j := 0; j < n; j++ {
+			iIdx, iFact := ((j+1)*angle)>>5, ((j+1)*angle)&31
+			for i := 0; i < n; i++ {
+				v := *ref(i + iIdx + 1)
+				if iFact != 0 {
+					v = ((32-iFact)*v + iFact*(*ref(i + iIdx + 2)) + 16) >> 5
+				}
+				if vertical {
+					set(i, j, v)
+				} else {
+					set(j, i, v)
+				}
+			}
+		}
+
+		if boundaryFilter && (mode == 26 || mode == 10) {
+			for j := 0; j < n; j++ {
+				v := clip3(0, maxVal, main(0)+((side(j)-side(-1))>>1))
+				if vertical {
+					set(0, j, v)
+				} else {
+					set(j, 0, v)
+				}
+			}
+		}
+	}
+}
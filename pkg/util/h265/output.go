@@ -0,0 +1,121 @@
+package h265
+
+import (
+	"image"
+	"image/color"
+)
+
+// Picture 解码后的图像，已按一致性窗口裁剪
+type Picture struct {
+	Width, Height int
+
+	// ChromaFormat 0 为 4:0:0，1 为 4:2:0，2 为 4:2:2，3 为 4:4:4
+	ChromaFormat int
+	BitDepthY    int
+	BitDepthC    int
+
+	// FullRange 和 MatrixCoeffs 取自 VUI，未指定时为有限范围 BT.601
+	FullRange    bool
+	MatrixCoeffs int
+
+	// Planes 依次为 Y、Cb、Cr，4:0:0 时只有 Y
+	Planes  [3][]uint16
+	Strides [3]int
+
+	subW, subH int
+}
+
+func (pic *picture) output() *Picture {
+	s := pic.sps
+	out := &Picture{
+		Width:        s.width - s.confWin[0] - s.confWin[1],
+		Height:       s.height - s.confWin[2] - s.confWin[3],
+		ChromaFormat: s.chromaFormatIdc,
+		BitDepthY:    s.bitDepthY,
+		BitDepthC:    s.bitDepthC,
+		FullRange:    s.fullRange,
+		MatrixCoeffs: s.matrixCoeffs,
+		subW:         s.subWidthC,
+		subH:         s.subHeightC,
+	}
+	nComp := 1
+	if s.chromaArrayType != 0 {
+		nComp = 3
+	}
+	for c := 0; c < nComp; c++ {
+		subW, subH := 1, 1
+		if c > 0 {
+			subW, subH = s.subWidthC, s.subHeightC
+		}
+		w, h := out.Width/subW, out.Height/subH
+		x0, y0 := s.confWin[0]/subW, s.confWin[2]/subH
+		plane := make([]uint16, w*h)
+		for y := 0; y < h; y++ {
+			copy(plane[y*w:(y+1)*w], pic.planes[c][(y0+y)*pic.width[c]+x0:])
+		}
+		out.Planes[c], out.Strides[c] = plane, w
+	}
+	return out
+}
+
+// Gray 返回亮度分量的 8 位灰度图，不做范围转换，适合作为透明度遮罩
+func (p *Picture) Gray() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, p.Width, p.Height))
+	shift := p.BitDepthY - 8
+	for y := 0; y < p.Height; y++ {
+		src := p.Planes[0][y*p.Strides[0]:]
+		dst := img.Pix[y*img.Stride:]
+		for x := 0; x < p.Width; x++ {
+			dst[x] = uint8(src[x] >> shift)
+		}
+	}
+	return img
+}
+
+// Image 转换为 8 位 RGB 图像，alpha 不为 nil 时作为透明度通道
+func (p *Picture) Image(alpha *image.Gray) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+
+	// 系数为 Kr、Kb
+	kr, kb := 0.299, 0.114
+	switch p.MatrixCoeffs {
+	case 1:
+		kr, kb = 0.2126, 0.0722
+	case 9, 10:
+		kr, kb = 0.2627, 0.0593
+	}
+	kg := 1 - kr - kb
+
+	maxY, maxC := float64(int(1)<<p.BitDepthY-1), float64(int(1)<<p.BitDepthC-1)
+	yOff, yScale := 16*float64(int(1)<<(p.BitDepthY-8)), 219*float64(int(1)<<(p.BitDepthY-8))
+	cScale := 224 * float64(int(1)<<(p.BitDepthC-8))
+	if p.FullRange {
+		yOff, yScale, cScale = 0, maxY, maxC
+	}
+	cOff := float64(int(1) << (p.BitDepthC - 1))
+
+	toByte := func(v float64) uint8 {
+		return uint8(clip3(0, 255, int(v*255+0.5)))
+	}
+
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			luma := (float64(p.Planes[0][y*p.Strides[0]+x]) - yOff) / yScale
+			r, g, b := luma, luma, luma
+			if p.ChromaFormat != 0 {
+				i := y/p.subH*p.Strides[1] + x/p.subW
+				cb := (float64(p.Planes[1][i]) - cOff) / cScale
+				cr := (float64(p.Planes[2][i]) - cOff) / cScale
+				r = luma + 2*(1-kr)*cr
+				b = luma + 2*(1-kb)*cb
+				g = (luma - kr*r - kb*b) / kg
+			}
+			a := uint8(255)
+			if alpha != nil {
+				a = alpha.GrayAt(x, y).Y
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: toByte(r), G: toByte(g), B: toByte(b), A: a})
+		}
+	}
+	return img
+}
@@ -0,0 +1,586 @@
+package h265
+
+import (
+	"fmt"
+)
+
+// sps 序列参数集，只保留帧内解码需要的字段
+type sps struct {
+	id int
+
+	chromaFormatIdc  int
+	chromaArrayType  int
+	subWidthC        int
+	subHeightC       int
+	width, height    int
+	confWin          [4]int // left, right, top, bottom，单位为亮度样本
+	bitDepthY        int
+	bitDepthC        int
+	log2MaxPocLsb    int
+	log2MinCbSize    int
+	log2CtbSize      int
+	log2MinTbSize    int
+	log2MaxTbSize    int
+	maxTrafoDepth    int // max_transform_hierarchy_depth_intra
+	scalingEnabled   bool
+	scaling          *scalingList
+	saoEnabled       bool
+	pcmEnabled       bool
+	pcmBitDepthY     int
+	pcmBitDepthC     int
+	log2MinPcmCbSize int
+	log2MaxPcmCbSize int
+	pcmLoopFilterOff bool
+	strongSmoothing  bool
+
+	numShortTermRefPicSets int
+	stRpsNumDeltaPocs      []int
+	longTermRefPicsPresent bool
+	numLongTermRefPicsSps  int
+	temporalMvpEnabled     bool
+
+	// VUI 中的颜色信息
+	fullRange    bool
+	matrixCoeffs int
+
+	ctbSize        int
+	picWidthInCtbs int
+	picHeightInCtb int
+	picWidthInMin  int // 以 4x4 块为单位
+	picHeightInMin int
+}
+
+// pps 图像参数集
+type pps struct {
+	id    int
+	spsID int
+
+	dependentSliceSegments bool
+	outputFlagPresent      bool
+	numExtraSliceHeaderBit int
+	signDataHiding         bool
+	cabacInitPresent       bool
+	initQp                 int
+	constrainedIntraPred   bool
+	transformSkipEnabled   bool
+	log2MaxTransformSkip   int
+	cuQpDeltaEnabled       bool
+	diffCuQpDeltaDepth     int
+	cbQpOffset             int
+	crQpOffset             int
+	sliceChromaQpOffsets   bool
+	transquantBypass       bool
+	tilesEnabled           bool
+	entropyCodingSync      bool
+	uniformSpacing         bool
+	colWidths              []int
+	rowHeights             []int
+	loopFilterAcrossTiles  bool
+	loopFilterAcrossSlices bool
+	deblockingOverride     bool
+	deblockingDisabled     bool
+	betaOffsetDiv2         int
+	tcOffsetDiv2           int
+	scaling                *scalingList
+	sliceHeaderExtension   bool
+	log2SaoOffsetScaleY    int
+	log2SaoOffsetScaleC    int
+}
+
+const (
+	profileSpaceBits = 88
+	maxSubLayers     = 7
+)
+
+func parseSPS(rbsp []byte) (*sps, error) {
+	r := newBitReader(rbsp)
+	s := &sps{matrixCoeffs: 2}
+
+	r.skip(4) // sps_video_parameter_set_id
+	maxSubLayersMinus1 := int(r.u(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+	skipProfileTierLevel(r, maxSubLayersMinus1)
+
+	s.id = int(r.ue())
+	if s.id > 15 {
+		return nil, fmt.Errorf("invalid sps id %d", s.id)
+	}
+	s.chromaFormatIdc = int(r.ue())
+	if s.chromaFormatIdc > 3 {
+		return nil, fmt.Errorf("invalid chroma format %d", s.chromaFormatIdc)
+	}
+	s.chromaArrayType = s.chromaFormatIdc
+	if s.chromaFormatIdc == 3 && r.flag() {
+		return nil, unsupported("separate colour planes")
+	}
+	s.subWidthC, s.subHeightC = 1, 1
+	switch s.chromaFormatIdc {
+	case 1:
+		s.subWidthC, s.subHeightC = 2, 2
+	case 2:
+		s.subWidthC = 2
+	}
+
+	s.width = int(r.ue())
+	s.height = int(r.ue())
+	if r.flag() {
+		for i := range s.confWin {
+			s.confWin[i] = int(r.ue())
+		}
+		s.confWin[0] *= s.subWidthC
+		s.confWin[1] *= s.subWidthC
+		s.confWin[2] *= s.subHeightC
+		s.confWin[3] *= s.subHeightC
+	}
+	s.bitDepthY = int(r.ue()) + 8
+	s.bitDepthC = int(r.ue()) + 8
+	if s.bitDepthY > 14 || s.bitDepthC > 14 {
+		return nil, unsupported("bit depth")
+	}
+	s.log2MaxPocLsb = int(r.ue()) + 4
+
+	subLayerOrdering := r.flag()
+	start := maxSubLayersMinus1
+	if subLayerOrdering {
+		start = 0
+	}
+	for i := start; i <= maxSubLayersMinus1; i++ {
+		r.ue() // sps_max_dec_pic_buffering_minus1
+		r.ue() // sps_max_num_reorder_pics
+		r.ue() // sps_max_latency_increase_plus1
+	}
+
+	s.log2MinCbSize = int(r.ue()) + 3
+	s.log2CtbSize = s.log2MinCbSize + int(r.ue())
+	s.log2MinTbSize = int(r.ue()) + 2
+	s.log2MaxTbSize = s.log2MinTbSize + int(r.ue())
+	r.ue() // max_transform_hierarchy_depth_inter
+	s.maxTrafoDepth = int(r.ue())
+	if s.log2CtbSize > 6 || s.log2CtbSize < 4 || s.log2MaxTbSize > 5 || s.log2MaxTbSize > s.log2CtbSize {
+		return nil, fmt.Errorf("invalid block sizes")
+	}
+
+	s.scalingEnabled = r.flag()
+	if s.scalingEnabled {
+		s.scaling = defaultScalingList()
+		if r.flag() {
+			if err := s.scaling.parse(r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r.skip(1) // amp_enabled_flag
+	s.saoEnabled = r.flag()
+	s.pcmEnabled = r.flag()
+	if s.pcmEnabled {
+		s.pcmBitDepthY = int(r.u(4)) + 1
+		s.pcmBitDepthC = int(r.u(4)) + 1
+		s.log2MinPcmCbSize = int(r.ue()) + 3
+		s.log2MaxPcmCbSize = s.log2MinPcmCbSize + int(r.ue())
+		s.pcmLoopFilterOff = r.flag()
+	}
+
+	s.numShortTermRefPicSets = int(r.ue())
+	if s.numShortTermRefPicSets > 64 {
+		return nil, fmt.Errorf("invalid short term ref pic set count")
+	}
+	s.stRpsNumDeltaPocs = make([]int, s.numShortTermRefPicSets)
+	for i := 0; i < s.numShortTermRefPicSets; i++ {
+		n, err := parseShortTermRefPicSet(r, i, s.numShortTermRefPicSets, s.stRpsNumDeltaPocs)
+		if err != nil {
+			return nil, err
+		}
+		s.stRpsNumDeltaPocs[i] = n
+	}
+
+	s.longTermRefPicsPresent = r.flag()
+	if s.longTermRefPicsPresent {
+		s.numLongTermRefPicsSps = int(r.ue())
+		for i := 0; i < s.numLongTermRefPicsSps; i++ {
+			r.skip(s.log2MaxPocLsb) // lt_ref_pic_poc_lsb_sps
+			r.skip(1)               // used_by_curr_pic_lt_sps_flag
+		}
+	}
+	s.temporalMvpEnabled = r.flag()
+	s.strongSmoothing = r.flag()
+
+	if r.flag() {
+		s.parseVUI(r, maxSubLayersMinus1)
+	}
+
+	if r.flag() {
+		rangeExt := r.flag()
+		r.skip(7) // 其他扩展
+		if rangeExt {
+			// 范围扩展的编码工具都不支持
+			for i := 0; i < 9; i++ {
+				if r.flag() {
+					return nil, unsupported("sps range extension")
+				}
+			}
+		}
+	}
+
+	if r.overrun {
+		return nil, fmt.Errorf("sps truncated")
+	}
+
+	s.ctbSize = 1 << s.log2CtbSize
+	s.picWidthInCtbs = (s.width + s.ctbSize - 1) / s.ctbSize
+	s.picHeightInCtb = (s.height + s.ctbSize - 1) / s.ctbSize
+	s.picWidthInMin = (s.width + 3) / 4
+	s.picHeightInMin = (s.height + 3) / 4
+	if s.width == 0 || s.height == 0 || s.width%(1<<s.log2MinCbSize) != 0 || s.height%(1<<s.log2MinCbSize) != 0 {
+		return nil, fmt.Errorf("invalid picture size %dx%d", s.width, s.height)
+	}
+
+	return s, nil
+}
+
+// skipProfileTierLevel 跳过 profile_tier_level
+func skipProfileTierLevel(r *bitReader, maxSubLayersMinus1 int) {
+	r.skip(profileSpaceBits + 8)
+	var profilePresent, levelPresent [maxSubLayers]bool
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			r.skip(2)
+		}
+	}
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.skip(profileSpaceBits)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+}
+
+// parseShortTermRefPicSet 解析 st_ref_pic_set 并返回其中的参考图像数量
+func parseShortTermRefPicSet(r *bitReader, idx, num int, numDeltaPocs []int) (int, error) {
+	if idx != 0 && r.flag() {
+		deltaIdx := 1
+		if idx == num {
+			deltaIdx = int(r.ue()) + 1
+		}
+		if deltaIdx > idx {
+			return 0, fmt.Errorf("invalid delta_idx")
+		}
+		r.skip(1) // delta_rps_sign
+		r.ue()    // abs_delta_rps_minus1
+		n := 0
+		for j := 0; j <= numDeltaPocs[idx-deltaIdx]; j++ {
+			used := r.flag()
+			if used || r.flag() {
+				n++
+			}
+		}
+		return n, nil
+	}
+
+	neg := int(r.ue())
+	pos := int(r.ue())
+	if neg > 16 || pos > 16 {
+		return 0, fmt.Errorf("invalid short term ref pic set")
+	}
+	for i := 0; i < neg+pos; i++ {
+		r.ue()    // delta_poc_minus1
+		r.skip(1) // used_by_curr_pic_flag
+	}
+	return neg + pos, nil
+}
+
+func (s *sps) parseVUI(r *bitReader, maxSubLayersMinus1 int) {
+	if r.flag() {
+		if r.u(8) == 255 {
+			r.skip(32)
+		}
+	}
+	if r.flag() {
+		r.skip(1)
+	}
+	if r.flag() {
+		r.skip(3) // video_format
+		s.fullRange = r.flag()
+		if r.flag() {
+			r.skip(16)
+			s.matrixCoeffs = int(r.u(8))
+		}
+	}
+	if r.flag() {
+		r.ue()
+		r.ue()
+	}
+	r.skip(3) // neutral_chroma_indication_flag, field_seq_flag, frame_field_info_present_flag
+	if r.flag() {
+		for i := 0; i < 4; i++ {
+			r.ue()
+		}
+	}
+	if r.flag() {
+		r.skip(64)
+		if r.flag() {
+			r.ue()
+		}
+		if r.flag() {
+			skipHRDParameters(r, true, maxSubLayersMinus1)
+		}
+	}
+	if r.flag() {
+		r.skip(3)
+		for i := 0; i < 5; i++ {
+			r.ue()
+		}
+	}
+}
+
+func skipHRDParameters(r *bitReader, common bool, maxSubLayersMinus1 int) {
+	nal, vcl, subPic := false, false, false
+	if common {
+		nal = r.flag()
+		vcl = r.flag()
+		if nal || vcl {
+			subPic = r.flag()
+			if subPic {
+				r.skip(8 + 5 + 1 + 5)
+			}
+			r.skip(8)
+			if subPic {
+				r.skip(4)
+			}
+			r.skip(15)
+		}
+	}
+	for i := 0; i <= maxSubLayersMinus1; i++ {
+		fixedWithinCvs := true
+		if !r.flag() {
+			fixedWithinCvs = r.flag()
+		}
+		lowDelay := false
+		if fixedWithinCvs {
+			r.ue()
+		} else {
+			lowDelay = r.flag()
+		}
+		cpbCnt := 1
+		if !lowDelay {
+			cpbCnt = int(r.ue()) + 1
+		}
+		for k := 0; k < 2; k++ {
+			if (k == 0 && !nal) || (k == 1 && !vcl) {
+				continue
+			}
+			for j := 0; j < cpbCnt; j++ {
+				r.ue()
+				r.ue()
+				if subPic {
+					r.ue()
+					r.ue()
+				}
+				r.skip(1)
+			}
+		}
+	}
+}
+
+func parsePPS(rbsp []byte) (*pps, error) {
+	r := newBitReader(rbsp)
+	p := &pps{log2MaxTransformSkip: 2, loopFilterAcrossTiles: true}
+
+	p.id = int(r.ue())
+	p.spsID = int(r.ue())
+	if p.id > 63 || p.spsID > 15 {
+		return nil, fmt.Errorf("invalid pps id %d", p.id)
+	}
+	p.dependentSliceSegments = r.flag()
+	p.outputFlagPresent = r.flag()
+	p.numExtraSliceHeaderBit = int(r.u(3))
+	p.signDataHiding = r.flag()
+	p.cabacInitPresent = r.flag()
+	r.ue() // num_ref_idx_l0_default_active_minus1
+	r.ue() // num_ref_idx_l1_default_active_minus1
+	p.initQp = 26 + int(r.se())
+	p.constrainedIntraPred = r.flag()
+	p.transformSkipEnabled = r.flag()
+	p.cuQpDeltaEnabled = r.flag()
+	if p.cuQpDeltaEnabled {
+		p.diffCuQpDeltaDepth = int(r.ue())
+	}
+	p.cbQpOffset = int(r.se())
+	p.crQpOffset = int(r.se())
+	p.sliceChromaQpOffsets = r.flag()
+	r.skip(2) // weighted_pred_flag, weighted_bipred_flag
+	p.transquantBypass = r.flag()
+	p.tilesEnabled = r.flag()
+	p.entropyCodingSync = r.flag()
+	if p.tilesEnabled {
+		cols := int(r.ue()) + 1
+		rows := int(r.ue()) + 1
+		if cols > 20 || rows > 22 {
+			return nil, fmt.Errorf("invalid tile count")
+		}
+		p.uniformSpacing = r.flag()
+		p.colWidths = make([]int, cols)
+		p.rowHeights = make([]int, rows)
+		if !p.uniformSpacing {
+			for i := 0; i < cols-1; i++ {
+				p.colWidths[i] = int(r.ue()) + 1
+			}
+			for i := 0; i < rows-1; i++ {
+				p.rowHeights[i] = int(r.ue()) + 1
+			}
+		}
+		p.loopFilterAcrossTiles = r.flag()
+	}
+	p.loopFilterAcrossSlices = r.flag()
+	if r.flag() {
+		p.deblockingOverride = r.flag()
+		p.deblockingDisabled = r.flag()
+		if !p.deblockingDisabled {
+			p.betaOffsetDiv2 = int(r.se())
+			p.tcOffsetDiv2 = int(r.se())
+		}
+	}
+	if r.flag() {
+		p.scaling = defaultScalingList()
+		if err := p.scaling.parse(r); err != nil {
+			return nil, err
+		}
+	}
+	r.skip(1) // lists_modification_present_flag
+	r.ue()    // log2_parallel_merge_level_minus2
+	p.sliceHeaderExtension = r.flag()
+
+	if r.flag() {
+		rangeExt := r.flag()
+		r.skip(7)
+		if rangeExt {
+			if p.transformSkipEnabled {
+				p.log2MaxTransformSkip = int(r.ue()) + 2
+			}
+			if r.flag() {
+				return nil, unsupported("cross component prediction")
+			}
+			if r.flag() {
+				return nil, unsupported("chroma qp offset list")
+			}
+			p.log2SaoOffsetScaleY = int(r.ue())
+			p.log2SaoOffsetScaleC = int(r.ue())
+		}
+	}
+
+	if r.overrun {
+		return nil, fmt.Errorf("pps truncated")
+	}
+	return p, nil
+}
+
+// tileLayout 根据 SPS 计算分块边界以及 CTB 的光栅扫描与分块扫描地址映射
+type tileLayout struct {
+	colBd         []int
+	rowBd         []int
+	colStart      []int // 每列 CTB 所在分块的起始列
+	ctbAddrRsToTs []int
+	ctbAddrTsToRs []int
+	tileID        []int // 按分块扫描地址索引
+}
+
+func newTileLayout(s *sps, p *pps) (*tileLayout, error) {
+	w, h := s.picWidthInCtbs, s.picHeightInCtb
+	cols, rows := []int{w}, []int{h}
+	if p.tilesEnabled {
+		cols = make([]int, len(p.colWidths))
+		rows = make([]int, len(p.rowHeights))
+		if p.uniformSpacing {
+			for i := range cols {
+				cols[i] = (i+1)*w/len(cols) - i*w/len(cols)
+			}
+			for i := range rows {
+				rows[i] = (i+1)*h/len(rows) - i*h/len(rows)
+			}
+		} else {
+			copy(cols, p.colWidths)
+			copy(rows, p.rowHeights)
+			cols[len(cols)-1], rows[len(rows)-1] = w, h
+			for i := 0; i < len(cols)-1; i++ {
+				cols[len(cols)-1] -= cols[i]
+			}
+			for i := 0; i < len(rows)-1; i++ {
+				rows[len(rows)-1] -= rows[i]
+			}
+		}
+		for _, c := range cols {
+			if c <= 0 {
+				return nil, fmt.Errorf("invalid tile columns")
+			}
+		}
+		for _, r := range rows {
+			if r <= 0 {
+				return nil, fmt.Errorf("invalid tile rows")
+			}
+		}
+	}
+
+	t := &tileLayout{
+		colBd:         make([]int, len(cols)+1),
+		rowBd:         make([]int, len(rows)+1),
+		ctbAddrRsToTs: make([]int, w*h),
+		ctbAddrTsToRs: make([]int, w*h),
+		tileID:        make([]int, w*h),
+	}
+	for i, c := range cols {
+		t.colBd[i+1] = t.colBd[i] + c
+	}
+	t.colStart = make([]int, w)
+	for i := range cols {
+		for x := t.colBd[i]; x < t.colBd[i+1]; x++ {
+			t.colStart[x] = t.colBd[i]
+		}
+	}
+	for i, r := range rows {
+		t.rowBd[i+1] = t.rowBd[i] + r
+	}
+
+	for rs := 0; rs < w*h; rs++ {
+		tbX, tbY := rs%w, rs/w
+		tileX, tileY := 0, 0
+		for i := range cols {
+			if tbX >= t.colBd[i] {
+				tileX = i
+			}
+		}
+		for j := range rows {
+			if tbY >= t.rowBd[j] {
+				tileY = j
+			}
+		}
+		ts := 0
+		for i := 0; i < tileX; i++ {
+			ts += rows[tileY] * cols[i]
+		}
+		for j := 0; j < tileY; j++ {
+			ts += w * rows[j]
+		}
+		ts += (tbY-t.rowBd[tileY])*cols[tileX] + tbX - t.colBd[tileX]
+		t.ctbAddrRsToTs[rs] = ts
+		t.ctbAddrTsToRs[ts] = rs
+	}
+
+	tile := 0
+	for j := range rows {
+		for i := range cols {
+			for y := t.rowBd[j]; y < t.rowBd[j+1]; y++ {
+				for x := t.colBd[i]; x < t.colBd[i+1]; x++ {
+					t.tileID[t.ctbAddrRsToTs[y*w+x]] = tile
+				}
+			}
+			tile++
+		}
+	}
+	return t, nil
+}
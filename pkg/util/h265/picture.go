@@ -0,0 +1,139 @@
+package h265
+
+// 4x4 块的标志位
+const (
+	blockPCM    = 1 << iota // pcm_flag
+	blockBypass             // cu_transquant_bypass_flag
+)
+
+// saoParams 一个 CTB 中某个颜色分量的 SAO 参数
+type saoParams struct {
+	typeIdx  uint8 // 0 关闭，1 带偏移，2 边缘偏移
+	eoClass  uint8
+	bandPos  uint8
+	offsets  [5]int16 // offsets[0] 恒为 0
+	disabled bool
+}
+
+// picture 解码中的图像，块级信息以 4x4 亮度块为单位保存
+type picture struct {
+	sps   *sps
+	pps   *pps
+	tiles *tileLayout
+
+	planes [3][]uint16
+	width  [3]int
+	height [3]int
+
+	minW, minH int
+	zscan      []int32 // MinTbAddrZs
+	slice      []int16 // 所属条带在 slices 中的下标，-1 表示尚未解码
+	ctDepth    []uint8
+	lumaMode   []uint8
+	chromaMode []uint8
+	qpY        []int8
+	flags      []uint8
+	edgeV      []uint8 // 块左边界的边界强度
+	edgeH      []uint8 // 块上边界的边界强度
+
+	sao    [][3]saoParams
+	slices []*sliceHeader
+
+	// 跨条带片段保存的上下文和量化参数
+	dsCtx   contextSet
+	wppCtx  contextSet
+	qpPrevY int
+}
+
+func newPicture(s *sps, p *pps) (*picture, error) {
+	tiles, err := newTileLayout(s, p)
+	if err != nil {
+		return nil, err
+	}
+	pic := &picture{
+		sps:   s,
+		pps:   p,
+		tiles: tiles,
+		minW:  s.picWidthInMin,
+		minH:  s.picHeightInMin,
+	}
+
+	pic.width[0], pic.height[0] = s.width, s.height
+	pic.planes[0] = make([]uint16, s.width*s.height)
+	if s.chromaArrayType != 0 {
+		for c := 1; c < 3; c++ {
+			pic.width[c], pic.height[c] = s.width/s.subWidthC, s.height/s.subHeightC
+			pic.planes[c] = make([]uint16, pic.width[c]*pic.height[c])
+		}
+	}
+
+	n := pic.minW * pic.minH
+	pic.zscan = make([]int32, n)
+	pic.slice = make([]int16, n)
+	pic.ctDepth = make([]uint8, n)
+	pic.lumaMode = make([]uint8, n)
+	pic.chromaMode = make([]uint8, n)
+	pic.qpY = make([]int8, n)
+	pic.flags = make([]uint8, n)
+	pic.edgeV = make([]uint8, n)
+	pic.edgeH = make([]uint8, n)
+	pic.sao = make([][3]saoParams, s.picWidthInCtbs*s.picHeightInCtb)
+
+	// 按 z 扫描顺序计算 4x4 块的地址，CTB 之间按分块扫描顺序排列
+	shift := s.log2CtbSize - 2
+	for y := 0; y < pic.minH; y++ {
+		for x := 0; x < pic.minW; x++ {
+			ctbAddrRs := (y>>shift)*s.picWidthInCtbs + x>>shift
+			addr := tiles.ctbAddrRsToTs[ctbAddrRs] << (shift * 2)
+			for i := 0; i < shift; i++ {
+				m := 1 << i
+				if x&m != 0 {
+					addr += m * m
+				}
+				if y&m != 0 {
+					addr += 2 * m * m
+				}
+			}
+			pic.zscan[y*pic.minW+x] = int32(addr)
+			pic.slice[y*pic.minW+x] = -1
+		}
+	}
+	return pic, nil
+}
+
+// blk 返回亮度位置所在 4x4 块的下标
+func (pic *picture) blk(x, y int) int {
+	return (y>>2)*pic.minW + x>>2
+}
+
+// ctbAddr 返回亮度位置所在 CTB 的光栅扫描地址
+func (pic *picture) ctbAddr(x, y int) int {
+	s := pic.sps
+	return (y>>s.log2CtbSize)*s.picWidthInCtbs + x>>s.log2CtbSize
+}
+
+// available 按 z 扫描顺序判断相邻位置是否可用于当前位置的预测
+func (pic *picture) available(xCurr, yCurr, xN, yN int) bool {
+	if xN < 0 || yN < 0 || xN >= pic.width[0] || yN >= pic.height[0] {
+		return false
+	}
+	n, cur := pic.blk(xN, yN), pic.blk(xCurr, yCurr)
+	if pic.zscan[n] > pic.zscan[cur] || pic.slice[n] < 0 {
+		return false
+	}
+	if pic.slices[pic.slice[n]].sliceAddr != pic.slices[pic.slice[cur]].sliceAddr {
+		return false
+	}
+	t := pic.tiles
+	return t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(xN, yN)]] == t.tileID[t.ctbAddrRsToTs[pic.ctbAddr(xCurr, yCurr)]]
+}
+
+func clip3(lo, hi, v int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,286 @@
+package h265
+
+// ctxIdxMap 4x4 变换块中 sig_coeff_flag 的上下文
+var ctxIdxMap = [16]int{0, 1, 4, 5, 2, 3, 4, 5, 6, 6, 8, 8, 7, 7, 8, 8}
+
+// residual 解析 residual_coding 并把残差叠加到预测样点上
+func (d *sliceDecoder) residual(cIdx, x0, y0, log2Size, predMode int) {
+	s, p := d.s, d.p
+	size := 1 << log2Size
+	coeffs := d.coeffs[:size*size]
+	clear(coeffs)
+
+	transformSkip := false
+	if p.transformSkipEnabled && !d.bypass && log2Size <= p.log2MaxTransformSkip {
+		inc := 0
+		if cIdx > 0 {
+			inc = 1
+		}
+		transformSkip = d.c.decodeBin(ctxTransformSkip+inc) == 1
+	}
+
+	// 最后一个非零系数的位置
+	lastX := d.lastSigCoeffPrefix(ctxLastX, log2Size, cIdx)
+	lastY := d.lastSigCoeffPrefix(ctxLastY, log2Size, cIdx)
+	if lastX > 3 {
+		n := lastX>>1 - 1
+		lastX = (1<<n)*(2+lastX&1) + d.c.decodeBypassBits(n)
+	}
+	if lastY > 3 {
+		n := lastY>>1 - 1
+		lastY = (1<<n)*(2+lastY&1) + d.c.decodeBypassBits(n)
+	}
+
+	scanIdx := 0
+	if log2Size == 2 || (log2Size == 3 && (cIdx == 0 || s.chromaArrayType == 3)) {
+		switch {
+		case predMode >= 6 && predMode <= 14:
+			scanIdx = 2
+		case predMode >= 22 && predMode <= 30:
+			scanIdx = 1
+		}
+	}
+	if scanIdx == 2 {
+		lastX, lastY = lastY, lastX
+	}
+
+	log2Sb := log2Size - 2
+	sbWidth := 1 << log2Sb
+	sbScan := scanOrder[log2Sb][scanIdx]
+	posScan := scanOrder[2][scanIdx]
+
+	// 定位最后一个系数所在的子块和扫描位置
+	lastSubBlock := len(sbScan) - 1
+	lastScanPos := 16
+	for {
+		if lastScanPos == 0 {
+			lastScanPos = 16
+			lastSubBlock--
+		}
+		lastScanPos--
+		sb, pos := sbScan[lastSubBlock], posScan[lastScanPos]
+		if int(sb[0])<<2+int(pos[0]) == lastX && int(sb[1])<<2+int(pos[1]) == lastY {
+			break
+		}
+	}
+
+	var codedSubBlock [64]bool
+	greater1Ctx := 1
+	signHidingEnabled := p.signDataHiding && !d.bypass
+
+	for i := lastSubBlock; i >= 0; i-- {
+		xS, yS := int(sbScan[i][0]), int(sbScan[i][1])
+
+		inferSbDcSig := false
+		if i < lastSubBlock && i > 0 {
+			csbf := 0
+			if xS < sbWidth-1 && codedSubBlock[yS*sbWidth+xS+1] {
+				csbf = 1
+			}
+			if yS < sbWidth-1 && codedSubBlock[(yS+1)*sbWidth+xS] {
+				csbf = 1
+			}
+			if cIdx > 0 {
+				csbf += 2
+			}
+			codedSubBlock[yS*sbWidth+xS] = d.c.decodeBin(ctxCodedSubBlock+csbf) == 1
+			inferSbDcSig = true
+		} else {
+			codedSubBlock[yS*sbWidth+xS] = true
+		}
+
+		// sig_coeff_flag
+		var sig [16]bool
+		var sigPos [16]int
+		nSig := 0
+		start := 15
+		if i == lastSubBlock {
+			start = lastScanPos - 1
+			sig[lastScanPos] = true
+			sigPos[nSig] = lastScanPos
+			nSig++
+		}
+		if codedSubBlock[yS*sbWidth+xS] {
+			prevCsbf := 0
+			if xS < sbWidth-1 && codedSubBlock[yS*sbWidth+xS+1] {
+				prevCsbf |= 1
+			}
+			if yS < sbWidth-1 && codedSubBlock[(yS+1)*sbWidth+xS] {
+				prevCsbf |= 2
+			}
+			for n := start; n >= 0; n-- {
+				xP, yP := int(posScan[n][0]), int(posScan[n][1])
+				if n == 0 && inferSbDcSig {
+					sig[0] = true
+				} else {
+					sig[n] = d.c.decodeBin(ctxSig+d.sigCtx(cIdx, log2Size, scanIdx, xS, yS, xP, yP, prevCsbf)) == 1
+					if sig[n] {
+						inferSbDcSig = false
+					}
+				}
+				if sig[n] {
+					sigPos[nSig] = n
+					nSig++
+				}
+			}
+		}
+		if nSig == 0 {
+			continue
+		}
+
+		// coeff_abs_level_greater1_flag / greater2_flag
+		ctxSet := 0
+		if i > 0 && cIdx == 0 {
+			ctxSet = 2
+		}
+		if i != lastSubBlock && greater1Ctx == 0 {
+			ctxSet++
+		}
+		greater1Ctx = 1
+		var greater1 [16]bool
+		lastGreater1 := -1
+		for k := 0; k < nSig && k < 8; k++ {
+			inc := ctxSet*4 + min(3, greater1Ctx)
+			if cIdx > 0 {
+				inc += 16
+			}
+			greater1[k] = d.c.decodeBin(ctxGreater1+inc) == 1
+			if greater1[k] {
+				greater1Ctx = 0
+				if lastGreater1 < 0 {
+					lastGreater1 = k
+				}
+			} else if greater1Ctx > 0 && greater1Ctx < 3 {
+				greater1Ctx++
+			}
+		}
+		greater2 := false
+		if lastGreater1 >= 0 {
+			inc := ctxSet
+			if cIdx > 0 {
+				inc += 4
+			}
+			greater2 = d.c.decodeBin(ctxGreater2+inc) == 1
+		}
+
+		signHidden := signHidingEnabled && sigPos[0]-sigPos[nSig-1] > 3
+		var signs [16]bool
+		for k := 0; k < nSig; k++ {
+			if k == nSig-1 && signHidden {
+				continue
+			}
+			signs[k] = d.c.decodeBypass() == 1
+		}
+
+		// coeff_abs_level_remaining
+		riceParam := 0
+		sumAbs := 0
+		for k := 0; k < nSig; k++ {
+			base := 1
+			if k < 8 && greater1[k] {
+				base++
+				if k == lastGreater1 && greater2 {
+					base++
+				}
+			}
+			level := base
+			threshold := 1
+			if k < 8 {
+				threshold = 2
+				if k == lastGreater1 {
+					threshold = 3
+				}
+			}
+			if base == threshold {
+				level += d.coeffAbsLevelRemaining(riceParam)
+				if level > 3<<riceParam {
+					riceParam = min(riceParam+1, 4)
+				}
+			}
+			sumAbs += level
+			if signs[k] {
+				level = -level
+			}
+			if k == nSig-1 && signHidden && sumAbs&1 == 1 {
+				level = -level
+			}
+			pos := posScan[sigPos[k]]
+			x, y := xS<<2+int(pos[0]), yS<<2+int(pos[1])
+			coeffs[y*size+x] = int32(level)
+		}
+	}
+
+	d.reconstruct(cIdx, x0, y0, log2Size, transformSkip)
+}
+
+func (d *sliceDecoder) lastSigCoeffPrefix(base, log2Size, cIdx int) int {
+	offset, shift := 15, log2Size-2
+	if cIdx == 0 {
+		offset, shift = 3*(log2Size-2)+(log2Size-1)>>2, (log2Size+1)>>2
+	}
+	cMax := log2Size<<1 - 1
+	v := 0
+	for v < cMax && d.c.decodeBin(base+offset+v>>shift) == 1 {
+		v++
+	}
+	return v
+}
+
+func (d *sliceDecoder) sigCtx(cIdx, log2Size, scanIdx, xS, yS, xP, yP, prevCsbf int) int {
+	var sigCtx int
+	switch {
+	case log2Size == 2:
+		sigCtx = ctxIdxMap[yP<<2+xP]
+	case xS == 0 && yS == 0 && xP == 0 && yP == 0:
+		sigCtx = 0
+	default:
+		switch prevCsbf {
+		case 0:
+			switch {
+			case xP+yP == 0:
+				sigCtx = 2
+			case xP+yP < 3:
+				sigCtx = 1
+			}
+		case 1:
+			sigCtx = max(0, 2-yP)
+		case 2:
+			sigCtx = max(0, 2-xP)
+		default:
+			sigCtx = 2
+		}
+		if cIdx == 0 {
+			if xS > 0 || yS > 0 {
+				sigCtx += 3
+			}
+			if log2Size == 3 {
+				if scanIdx == 0 {
+					sigCtx += 9
+				} else {
+					sigCtx += 15
+				}
+			} else {
+				sigCtx += 21
+			}
+		} else if log2Size == 3 {
+			sigCtx += 9
+		} else {
+			sigCtx += 12
+		}
+	}
+	if cIdx > 0 {
+		return 27 + sigCtx
+	}
+	return sigCtx
+}
+
+func (d *sliceDecoder) coeffAbsLevelRemaining(riceParam int) int {
+	prefix := 0
+	for prefix < 32 && d.c.decodeBypass() == 1 {
+		prefix++
+	}
+	if prefix < 3 {
+		return prefix<<riceParam + d.c.decodeBypassBits(riceParam)
+	}
+	return ((1<<(prefix-3))+2)<<riceParam + d.c.decodeBypassBits(prefix-3+riceParam)
+}
@@ -0,0 +1,165 @@
+package h265
+
+import "fmt"
+
+// 默认的 8x8 量化矩阵，按对角扫描顺序排列
+var (
+	defaultScalingIntra = [64]uint8{
+		16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 17, 16, 17, 16, 17, 18,
+		17, 18, 18, 17, 18, 21, 19, 20, 21, 20, 19, 21, 24, 22, 22, 24,
+		24, 22, 22, 24, 25, 25, 27, 30, 27, 25, 25, 29, 31, 35, 35, 31,
+		29, 36, 41, 44, 41, 36, 47, 54, 54, 47, 65, 70, 65, 88, 88, 115,
+	}
+	defaultScalingInter = [64]uint8{
+		16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 17, 17, 17, 17, 17, 18,
+		18, 18, 18, 18, 18, 20, 20, 20, 20, 20, 20, 20, 24, 24, 24, 24,
+		24, 24, 24, 24, 25, 25, 25, 25, 25, 25, 25, 28, 28, 28, 28, 28,
+		28, 33, 33, 33, 33, 33, 41, 41, 41, 41, 54, 54, 54, 71, 71, 91,
+	}
+)
+
+// scalingList 量化矩阵，lists 按扫描顺序保存，factors 为展开后的缩放因子
+type scalingList struct {
+	lists   [4][6][64]uint8
+	dc      [4][6]uint8
+	factors [4][6][]uint8 // 按 y*size+x 索引
+}
+
+func defaultScalingList() *scalingList {
+	sl := &scalingList{}
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		for matrixID := 0; matrixID < 6; matrixID++ {
+			sl.setDefault(sizeID, matrixID)
+		}
+	}
+	sl.derive()
+	return sl
+}
+
+func (sl *scalingList) setDefault(sizeID, matrixID int) {
+	switch {
+	case sizeID == 0:
+		for i := range sl.lists[0][matrixID] {
+			sl.lists[0][matrixID][i] = 16
+		}
+	case matrixID < 3:
+		sl.lists[sizeID][matrixID] = defaultScalingIntra
+	default:
+		sl.lists[sizeID][matrixID] = defaultScalingInter
+	}
+	sl.dc[sizeID][matrixID] = 16
+}
+
+// parse 解析 scaling_list_data
+func (sl *scalingList) parse(r *bitReader) error {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !r.flag() {
+				delta := int(r.ue()) * step
+				if delta == 0 {
+					sl.setDefault(sizeID, matrixID)
+					continue
+				}
+				if delta > matrixID {
+					return fmt.Errorf("invalid scaling list reference")
+				}
+				sl.lists[sizeID][matrixID] = sl.lists[sizeID][matrixID-delta]
+				sl.dc[sizeID][matrixID] = sl.dc[sizeID][matrixID-delta]
+				continue
+			}
+
+			next := 8
+			coefNum := min(64, 1<<(4+sizeID<<1))
+			if sizeID > 1 {
+				next = int(r.se()) + 8
+				sl.dc[sizeID][matrixID] = uint8(next)
+			}
+			for i := 0; i < coefNum; i++ {
+				next = (next + int(r.se()) + 256) % 256
+				sl.lists[sizeID][matrixID][i] = uint8(next)
+			}
+			if sizeID <= 1 {
+				sl.dc[sizeID][matrixID] = sl.lists[sizeID][matrixID][0]
+			}
+		}
+	}
+	// 32x32 的色度矩阵只在 4:4:4 中使用，沿用 16x16 的矩阵
+	for _, matrixID := range []int{1, 2, 4, 5} {
+		sl.lists[3][matrixID] = sl.lists[2][matrixID]
+		sl.dc[3][matrixID] = sl.dc[2][matrixID]
+	}
+	sl.derive()
+	return nil
+}
+
+// derive 把扫描顺序的量化矩阵展开为各尺寸的缩放因子
+func (sl *scalingList) derive() {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		size := 4 << sizeID
+		for matrixID := 0; matrixID < 6; matrixID++ {
+			f := make([]uint8, size*size)
+			if sizeID == 0 {
+				for i, pos := range scanDiag4x4 {
+					f[int(pos[1])*4+int(pos[0])] = sl.lists[0][matrixID][i]
+				}
+			} else {
+				ratio := size / 8
+				for i, pos := range scanDiag8x8 {
+					v := sl.lists[sizeID][matrixID][i]
+					for dy := 0; dy < ratio; dy++ {
+						for dx := 0; dx < ratio; dx++ {
+							f[(int(pos[1])*ratio+dy)*size+int(pos[0])*ratio+dx] = v
+						}
+					}
+				}
+				if sizeID > 1 {
+					f[0] = sl.dc[sizeID][matrixID]
+				}
+			}
+			sl.factors[sizeID][matrixID] = f
+		}
+	}
+}
+
+// 扫描顺序，scanOrder[log2Size][scanIdx] 为 (x, y) 序列
+var (
+	scanOrder   [4][3][][2]uint8
+	scanDiag4x4 [][2]uint8
+	scanDiag8x8 [][2]uint8
+)
+
+func init() {
+	for log2 := 0; log2 < 4; log2++ {
+		size := 1 << log2
+		scanOrder[log2][0] = diagScan(size)
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				scanOrder[log2][1] = append(scanOrder[log2][1], [2]uint8{uint8(x), uint8(y)})
+				scanOrder[log2][2] = append(scanOrder[log2][2], [2]uint8{uint8(y), uint8(x)})
+			}
+		}
+	}
+	scanDiag4x4 = scanOrder[2][0]
+	scanDiag8x8 = scanOrder[3][0]
+}
+
+// diagScan 生成右上对角扫描顺序
+func diagScan(size int) [][2]uint8 {
+	scan := make([][2]uint8, 0, size*size)
+	x, y := 0, 0
+	for len(scan) < size*size {
+		for y >= 0 {
+			if x < size && y < size {
+				scan = append(scan, [2]uint8{uint8(x), uint8(y)})
+			}
+			y--
+			x++
+		}
+		y, x = x, 0
+	}
+	return scan
+}
@@ -0,0 +1,177 @@
+package h265
+
+import "fmt"
+
+const (
+	sliceTypeB = 0
+	sliceTypeP = 1
+	sliceTypeI = 2
+)
+
+// NAL 单元类型
+const (
+	nalBLAWLP    = 16
+	nalIDRWRADL  = 19
+	nalIDRNLP    = 20
+	nalRsvIRAP23 = 23
+	nalVPS       = 32
+	nalSPS       = 33
+	nalPPS       = 34
+)
+
+// sliceHeader 条带片段头，依赖条带片段沿用所属条带的字段
+type sliceHeader struct {
+	firstInPic  bool
+	ppsID       int
+	dependent   bool
+	segmentAddr int
+	sliceAddr   int // 所属独立条带片段的地址，即 SliceAddrRs
+
+	sliceType              int
+	saoLuma, saoChroma     bool
+	qpY                    int
+	cbQpOffset, crQpOffset int
+	deblockingDisabled     bool
+	betaOffsetDiv2         int
+	tcOffsetDiv2           int
+	loopFilterAcrossSlices bool
+}
+
+func ceilLog2(v int) int {
+	n := 0
+	for 1<<n < v {
+		n++
+	}
+	return n
+}
+
+// parseSliceHeader 解析条带片段头，返回后 r 位于 slice_segment_data 的起始字节
+func (d *Decoder) parseSliceHeader(r *bitReader, nalType int, prev *sliceHeader) (*sliceHeader, error) {
+	sh := &sliceHeader{}
+	sh.firstInPic = r.flag()
+	if nalType >= nalBLAWLP && nalType <= nalRsvIRAP23 {
+		r.skip(1) // no_output_of_prior_pics_flag
+	}
+	sh.ppsID = int(r.ue())
+	if sh.ppsID > 63 || d.pps[sh.ppsID] == nil {
+		return nil, fmt.Errorf("missing pps %d", sh.ppsID)
+	}
+	p := d.pps[sh.ppsID]
+	s := d.sps[p.spsID]
+	if s == nil {
+		return nil, fmt.Errorf("missing sps %d", p.spsID)
+	}
+
+	if !sh.firstInPic {
+		if p.dependentSliceSegments {
+			sh.dependent = r.flag()
+		}
+		sh.segmentAddr = int(r.u(ceilLog2(s.picWidthInCtbs * s.picHeightInCtb)))
+		if sh.segmentAddr >= s.picWidthInCtbs*s.picHeightInCtb {
+			return nil, fmt.Errorf("invalid slice segment address %d", sh.segmentAddr)
+		}
+	}
+
+	if sh.dependent {
+		if prev == nil {
+			return nil, fmt.Errorf("dependent slice segment without slice")
+		}
+		first, addr := sh.firstInPic, sh.segmentAddr
+		*sh = *prev
+		sh.firstInPic, sh.dependent, sh.segmentAddr = first, true, addr
+	} else {
+		sh.sliceAddr = sh.segmentAddr
+		r.skip(p.numExtraSliceHeaderBit)
+		sh.sliceType = int(r.ue())
+		if sh.sliceType != sliceTypeI {
+			return nil, unsupported("inter slice")
+		}
+		if p.outputFlagPresent {
+			r.skip(1) // pic_output_flag
+		}
+		if nalType != nalIDRWRADL && nalType != nalIDRNLP {
+			r.skip(s.log2MaxPocLsb) // slice_pic_order_cnt_lsb
+			if !r.flag() {
+				if _, err := parseShortTermRefPicSet(r, s.numShortTermRefPicSets, s.numShortTermRefPicSets, s.stRpsNumDeltaPocs); err != nil {
+					return nil, err
+				}
+			} else if s.numShortTermRefPicSets > 1 {
+				r.skip(ceilLog2(s.numShortTermRefPicSets))
+			}
+			if s.longTermRefPicsPresent {
+				numLtSps := 0
+				if s.numLongTermRefPicsSps > 0 {
+					numLtSps = int(r.ue())
+				}
+				numLt := numLtSps + int(r.ue())
+				for i := 0; i < numLt; i++ {
+					if i < numLtSps {
+						if s.numLongTermRefPicsSps > 1 {
+							r.skip(ceilLog2(s.numLongTermRefPicsSps))
+						}
+					} else {
+						r.skip(s.log2MaxPocLsb + 1)
+					}
+					if r.flag() {
+						r.ue() // delta_poc_msb_cycle_lt
+					}
+				}
+			}
+			if s.temporalMvpEnabled {
+				r.skip(1)
+			}
+		}
+		if s.saoEnabled {
+			sh.saoLuma = r.flag()
+			if s.chromaArrayType != 0 {
+				sh.saoChroma = r.flag()
+			}
+		}
+		sh.qpY = p.initQp + int(r.se())
+		if sh.qpY < -6*(s.bitDepthY-8) || sh.qpY > 51 {
+			return nil, fmt.Errorf("invalid slice qp %d", sh.qpY)
+		}
+		if p.sliceChromaQpOffsets {
+			sh.cbQpOffset = int(r.se())
+			sh.crQpOffset = int(r.se())
+		}
+		if abs(sh.cbQpOffset) > 12 || abs(sh.crQpOffset) > 12 ||
+			abs(p.cbQpOffset+sh.cbQpOffset) > 12 || abs(p.crQpOffset+sh.crQpOffset) > 12 {
+			return nil, fmt.Errorf("invalid chroma qp offset")
+		}
+		if p.diffCuQpDeltaDepth > s.log2CtbSize-s.log2MinCbSize {
+			return nil, fmt.Errorf("invalid cu qp delta depth %d", p.diffCuQpDeltaDepth)
+		}
+		sh.deblockingDisabled = p.deblockingDisabled
+		sh.betaOffsetDiv2, sh.tcOffsetDiv2 = p.betaOffsetDiv2, p.tcOffsetDiv2
+		if p.deblockingOverride && r.flag() {
+			sh.deblockingDisabled = r.flag()
+			if !sh.deblockingDisabled {
+				sh.betaOffsetDiv2 = int(r.se())
+				sh.tcOffsetDiv2 = int(r.se())
+			}
+		}
+		sh.loopFilterAcrossSlices = p.loopFilterAcrossSlices
+		if p.loopFilterAcrossSlices && (sh.saoLuma || sh.saoChroma || !sh.deblockingDisabled) {
+			sh.loopFilterAcrossSlices = r.flag()
+		}
+	}
+
+	// 子码流按顺序连续存放，不需要入口点偏移
+	if p.tilesEnabled || p.entropyCodingSync {
+		if n := int(r.ue()); n > 0 {
+			bits := int(r.ue()) + 1
+			if bits > 32 {
+				return nil, fmt.Errorf("invalid entry point offset length")
+			}
+			r.skip(n * bits)
+		}
+	}
+	if p.sliceHeaderExtension {
+		r.skip(int(r.ue()) * 8)
+	}
+	if r.overrun {
+		return nil, fmt.Errorf("slice header truncated")
+	}
+	return sh, nil
+}
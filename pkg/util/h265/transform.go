@@ -0,0 +1,164 @@
+package h265
+
+var levelScale = [6]int64{40, 45, 51, 57, 64, 72}
+
+// transMatrix 32 点 DCT 变换矩阵，较小的变换取其中的部分行
+var transMatrix [32][32]int32
+
+var dstMatrix = [4][4]int32{
+	{29, 55, 74, 84},
+	{74, 74, 0, -74},
+	{84, -29, -74, 55},
+	{55, -84, 74, -29},
+}
+
+func init() {
+	// cosTable[j] 为 cos(j*π/64) 的整数近似，按 j 的 2 进制因子取自不同尺寸的变换
+	var cosTable [33]int32
+	odd := []int32{90, 90, 88, 85, 82, 78, 73, 67, 61, 54, 46, 38, 31, 22, 13, 4}
+	for i, v := range odd {
+		cosTable[2*i+1] = v
+	}
+	for i, v := range []int32{90, 87, 80, 70, 57, 43, 25, 9} {
+		cosTable[4*i+2] = v
+	}
+	for i, v := range []int32{89, 75, 50, 18} {
+		cosTable[8*i+4] = v
+	}
+	cosTable[8], cosTable[24] = 83, 36
+	cosTable[16] = 64
+	cosTable[0] = 64
+
+	for k := 0; k < 32; k++ {
+		for n := 0; n < 32; n++ {
+			a := (2*n + 1) * k % 128
+			sign := int32(1)
+			if a > 64 {
+				a = 128 - a
+			}
+			if a > 32 {
+				a = 64 - a
+				sign = -1
+			}
+			transMatrix[k][n] = sign * cosTable[a]
+		}
+	}
+}
+
+// reconstruct 反量化、反变换并把残差叠加到预测样点
+func (d *sliceDecoder) reconstruct(cIdx, x0, y0, log2Size int, transformSkip bool) {
+	pic, s := d.pic, d.s
+	size := 1 << log2Size
+	coeffs := d.coeffs[:size*size]
+	bitDepth := s.bitDepthY
+	if cIdx > 0 {
+		bitDepth = s.bitDepthC
+	}
+
+	if !d.bypass {
+		qp := d.qpPrime[cIdx]
+		scale := levelScale[qp%6] << (qp / 6)
+		bdShift := bitDepth + log2Size - 5
+		add := int64(1) << (bdShift - 1)
+
+		var factors []uint8
+		if sl := d.scalingList(); sl != nil && !(transformSkip && size > 4) {
+			factors = sl.factors[log2Size-2][cIdx]
+		}
+		for i, c := range coeffs {
+			if c == 0 {
+				continue
+			}
+			m := int64(16)
+			if factors != nil {
+				m = int64(factors[i])
+			}
+			coeffs[i] = int32(clip3(-32768, 32767, int((int64(c)*m*scale+add)>>bdShift)))
+		}
+
+		bdShift = max(20-bitDepth, 0)
+		if transformSkip {
+			tsShift := 5 + log2Size
+			for i, c := range coeffs {
+				coeffs[i] = (c<<tsShift + 1<<(bdShift-1)) >> bdShift
+			}
+		} else {
+			d.inverseTransform(coeffs, log2Size, cIdx == 0 && size == 4, bdShift)
+		}
+	}
+
+	plane, stride := pic.planes[cIdx], pic.width[cIdx]
+	maxVal := int32(1)<<bitDepth - 1
+	for y := 0; y < size; y++ {
+		row := plane[(y0+y)*stride+x0:]
+		for x := 0; x < size; x++ {
+			v := int32(row[x]) + coeffs[y*size+x]
+			if v < 0 {
+				v = 0
+			} else if v > maxVal {
+				v = maxVal
+			}
+			row[x] = uint16(v)
+		}
+	}
+}
+
+func (d *sliceDecoder) scalingList() *scalingList {
+	if !d.s.scalingEnabled {
+		return nil
+	}
+	if d.p.scaling != nil {
+		return d.p.scaling
+	}
+	return d.s.scaling
+}
+
+// inverseTransform 二维反变换，先按列再按行，结果写回 coeffs
+func (d *sliceDecoder) inverseTransform(coeffs []int32, log2Size int, dst bool, bdShift int) {
+	size := 1 << log2Size
+	tmp := d.tmp[:size*size]
+
+	basis := func(k, n int) int32 {
+		if dst {
+			return dstMatrix[k][n]
+		}
+		return transMatrix[k<<(5-log2Size)][n]
+	}
+
+	// 只计算到最后一个非零的行和列
+	maxRow, maxCol := -1, -1
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if coeffs[y*size+x] != 0 {
+				maxRow = max(maxRow, y)
+				maxCol = max(maxCol, x)
+			}
+		}
+	}
+	if maxRow < 0 {
+		return
+	}
+
+	// 列变换
+	for x := 0; x <= maxCol; x++ {
+		for y := 0; y < size; y++ {
+			var sum int64
+			for k := 0; k <= maxRow; k++ {
+				sum += int64(basis(k, y)) * int64(coeffs[k*size+x])
+			}
+			tmp[y*size+x] = int32(clip3(-32768, 32767, int((sum+64)>>7)))
+		}
+	}
+
+	// 行变换
+	add := int64(1) << (bdShift - 1)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sum int64
+			for k := 0; k <= maxCol; k++ {
+				sum += int64(basis(k, x)) * int64(tmp[y*size+k])
+			}
+			coeffs[y*size+x] = int32((sum + add) >> bdShift)
+		}
+	}
+}
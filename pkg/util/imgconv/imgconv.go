@@ -0,0 +1,230 @@
+package imgconv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp"
+
+	// DefaultJPEGQuality JPEG 编码质量
+	DefaultJPEGQuality = 85
+
+	// MaxSize 缩放目标的最大边长
+	MaxSize = 4096
+
+	// MaxPixels 可解码的源图片最大像素数，避免超大图片占用过多内存
+	MaxPixels = 8192 * 8192
+)
+
+// ErrTooLarge 源图片像素数超过 MaxPixels
+var ErrTooLarge = errors.New("image too large")
+
+// Options 图片转换参数
+type Options struct {
+	// Width, Height 目标尺寸，按比例缩放到不超过该尺寸，为 0 表示不限制，不会放大图片
+	Width  int
+	Height int
+
+	// Format 输出格式，为空时保持原格式
+	Format string
+}
+
+// ParseFormat 规范化格式名称，不支持的格式返回错误
+func ParseFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+		return "", nil
+	case "jpg", "jpeg":
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "webp":
+		return FormatWebP, nil
+	}
+	return "", fmt.Errorf("unsupported image format: %s", format)
+}
+
+// ContentType 返回输出格式对应的 MIME 类型
+func ContentType(format string) string {
+	switch format {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatPNG:
+		return "image/png"
+	case FormatWebP:
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// Convert 解码图片，按参数缩放并重新编码，返回编码后的数据和格式
+// 支持解码 JPEG、PNG、GIF（仅第一帧），像素数超过 MaxPixels 时返回 ErrTooLarge
+func Convert(data []byte, opts Options) ([]byte, string, error) {
+	// 解码前先读取尺寸，避免为超大图片分配内存
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	img, srcFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = srcFormat
+		if format != FormatPNG {
+			format = FormatJPEG
+		}
+	}
+
+	img = Resize(img, opts.Width, opts.Height)
+
+	var buf bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: DefaultJPEGQuality})
+	case FormatPNG:
+		err = png.Encode(&buf, img)
+	case FormatWebP:
+		err = EncodeWebP(&buf, img)
+	default:
+		err = fmt.Errorf("unsupported image format: %s", format)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), format, nil
+}
+
+// FitSize 计算按比例缩放到不超过 width x height 后的尺寸，不会放大
+func FitSize(srcW, srcH, width, height int) (int, int) {
+	if srcW <= 0 || srcH <= 0 {
+		return srcW, srcH
+	}
+	scale := 1.0
+	if width > 0 {
+		scale = math.Min(scale, float64(width)/float64(srcW))
+	}
+	if height > 0 {
+		scale = math.Min(scale, float64(height)/float64(srcH))
+	}
+	if scale >= 1 {
+		return srcW, srcH
+	}
+	return max(int(math.Round(float64(srcW)*scale)), 1), max(int(math.Round(float64(srcH)*scale)), 1)
+}
+
+// Resize 按比例缩小图片到不超过 width x height，使用区域平均采样
+// 逐行处理源图片，除输出图片外只占用几行像素的内存
+func Resize(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := FitSize(srcW, srcH, width, height)
+	if dstW == srcW && dstH == srcH {
+		return img
+	}
+
+	// 非 RGBA 图片逐行转换，不复制整张图片
+	src, ok := img.(*image.RGBA)
+	var line *image.RGBA
+	if !ok {
+		line = image.NewRGBA(image.Rect(0, 0, srcW, 1))
+	}
+	sourceRow := func(y int) []uint8 {
+		if line == nil {
+			return src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		}
+		draw.Draw(line, line.Rect, img, image.Pt(bounds.Min.X, bounds.Min.Y+y), draw.Src)
+		return line.Pix
+	}
+
+	// 先水平缩放再垂直缩放，在预乘 alpha 的 RGBA 空间中求平均
+	xWeights := boxWeights(srcW, dstW)
+	yWeights := boxWeights(srcH, dstH)
+	scaled := make([]float64, dstW*4)
+	acc := make([]float64, dstW*4)
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	// 相邻的目标行最多共用一个源行，缓存上一次水平缩放的结果
+	lastRow := -1
+	for y, weights := range yWeights {
+		clear(acc)
+		for _, wy := range weights {
+			if wy.index != lastRow {
+				row := sourceRow(wy.index)
+				for x, weights := range xWeights {
+					var r, g, b, a float64
+					for _, w := range weights {
+						p := row[w.index*4:]
+						r += float64(p[0]) * w.weight
+						g += float64(p[1]) * w.weight
+						b += float64(p[2]) * w.weight
+						a += float64(p[3]) * w.weight
+					}
+					t := scaled[x*4:]
+					t[0], t[1], t[2], t[3] = r, g, b, a
+				}
+				lastRow = wy.index
+			}
+			for i, v := range scaled {
+				acc[i] += v * wy.weight
+			}
+		}
+		p := dst.Pix[y*dst.Stride:]
+		for i, v := range acc {
+			p[i] = clamp8(v)
+		}
+	}
+
+	return dst
+}
+
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// boxWeights 计算每个目标像素覆盖的源像素及其权重
+func boxWeights(src, dst int) [][]contribution {
+	scale := float64(src) / float64(dst)
+	weights := make([][]contribution, dst)
+	for i := range weights {
+		start := float64(i) * scale
+		end := start + scale
+		for j := int(start); j < src && float64(j) < end; j++ {
+			w := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if w > 0 {
+				weights[i] = append(weights[i], contribution{index: j, weight: w / scale})
+			}
+		}
+	}
+	return weights
+}
+
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,256 @@
+package imgconv
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	for _, tc := range []struct {
+		srcW, srcH, width, height int
+		w, h                      int
+	}{
+		{1000, 500, 0, 0, 1000, 500},
+		{1000, 500, 200, 0, 200, 100},
+		{1000, 500, 0, 100, 200, 100},
+		{1000, 500, 200, 200, 200, 100},
+		{1000, 500, 2000, 2000, 1000, 500},
+		{1000, 1, 10, 0, 10, 1},
+	} {
+		if w, h := FitSize(tc.srcW, tc.srcH, tc.width, tc.height); w != tc.w || h != tc.h {
+			t.Errorf("FitSize(%d, %d, %d, %d) = %d, %d, want %d, %d", tc.srcW, tc.srcH, tc.width, tc.height, w, h, tc.w, tc.h)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	// 左半红右半蓝，缩小后中间列是两者的平均
+	src := image.NewNRGBA(image.Rect(10, 20, 10+40, 20+30))
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x-src.Rect.Min.X >= 20 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+
+	dst := Resize(src, 3, 0)
+	if b := dst.Bounds(); b.Dx() != 3 || b.Dy() != 2 {
+		t.Fatalf("bounds = %v", b)
+	}
+	for y := 0; y < 2; y++ {
+		for x, want := range []color.RGBA{{R: 255, A: 255}, {R: 128, B: 128, A: 255}, {B: 255, A: 255}} {
+			if got := color.RGBAModel.Convert(dst.At(x, y)).(color.RGBA); !near(got, want) {
+				t.Errorf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	if Resize(src, 100, 100) != image.Image(src) {
+		t.Error("image enlarged")
+	}
+
+	// RGBA 图片的子图直接按行读取
+	rgba := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = 0xff
+	}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			rgba.SetRGBA(x+4, y+4, color.RGBA{A: 255})
+		}
+	}
+	sub := rgba.SubImage(image.Rect(4, 4, 8, 8))
+	if got := color.RGBAModel.Convert(Resize(sub, 1, 1).At(0, 0)).(color.RGBA); got != (color.RGBA{A: 255}) {
+		t.Errorf("sub image pixel = %v", got)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"", FormatPNG},
+		{FormatJPEG, FormatJPEG},
+		{FormatWebP, FormatWebP},
+	} {
+		out, format, err := Convert(buf.Bytes(), Options{Width: 16, Format: tc.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tc.want {
+			t.Errorf("format = %s, want %s", format, tc.want)
+		}
+		var w, h int
+		switch format {
+		case FormatWebP:
+			img, err := decodeVP8L(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, h = img.Bounds().Dx(), img.Bounds().Dy()
+		default:
+			config, _, err := image.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, h = config.Width, config.Height
+		}
+		if w != 16 || h != 8 {
+			t.Errorf("%s size = %dx%d", format, w, h)
+		}
+	}
+
+	// GIF 默认转换为 JPEG
+	buf.Reset()
+	if err := gif.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, format, err := Convert(buf.Bytes(), Options{})
+	if err != nil || format != FormatJPEG {
+		t.Fatalf("gif: %s, %v", format, err)
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(out)); err != nil {
+		t.Errorf("gif output: %v", err)
+	}
+}
+
+func TestConvertTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}), nil); err != nil {
+		t.Fatal(err)
+	}
+	// 把逻辑屏幕尺寸改为 65535x65535，解码前就应拒绝
+	data := buf.Bytes()
+	copy(data[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+	if _, _, err := Convert(data, Options{Width: 100}); err != ErrTooLarge {
+		t.Errorf("Convert = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"gradient", gradient(37, 23, 255)},
+		{"alpha", gradient(16, 16, 128)},
+		{"solid", solid(7, 3, color.NRGBA{R: 10, G: 20, B: 30, A: 255})},
+		{"two colors", checker(9, 5)},
+		{"single pixel", gradient(1, 1, 255)},
+	} {
+		img := tc.img
+		var buf bytes.Buffer
+		if err := EncodeWebP(&buf, img); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, err := decodeVP8L(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.Bounds().Size() != img.Bounds().Size() {
+			t.Fatalf("%s: size %v, want %v", tc.name, got.Bounds().Size(), img.Bounds().Size())
+		}
+		b := img.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				want := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y))
+				if c := got.NRGBAAt(x, y); c != want {
+					t.Fatalf("%s: pixel (%d, %d) = %v, want %v", tc.name, x, y, c, want)
+				}
+			}
+		}
+	}
+
+	if err := EncodeWebP(&bytes.Buffer{}, image.NewRGBA(image.Rect(0, 0, vp8lMaxSize+1, 1))); err == nil {
+		t.Error("oversized image encoded")
+	}
+}
+
+func TestHuffmanLengths(t *testing.T) {
+	// 斐波那契分布的频率会产生很长的码，需要限制在最大码长内
+	freqs := make([]int, 30)
+	a, b := 1, 1
+	for i := range freqs {
+		freqs[i] = a
+		a, b = b, a+b
+	}
+	lengths := huffmanLengths(freqs, vp8lMaxCodeLength)
+	kraft := 0.0
+	for i, n := range lengths {
+		if n == 0 || n > vp8lMaxCodeLength {
+			t.Fatalf("symbol %d: length %d", i, n)
+		}
+		kraft += 1 / float64(uint(1)<<n)
+	}
+	if kraft != 1 {
+		t.Errorf("incomplete code: kraft sum %v", kraft)
+	}
+
+	// 只有一个符号时补充一个符号
+	lengths = huffmanLengths([]int{0, 0, 5}, vp8lMaxCodeLength)
+	if lengths[0] != 1 || lengths[2] != 1 {
+		t.Errorf("single symbol lengths = %v", lengths)
+	}
+}
+
+// near 比较颜色，允许舍入带来的误差
+func near(a, b color.RGBA) bool {
+	for _, d := range []int{int(a.R) - int(b.R), int(a.G) - int(b.G), int(a.B) - int(b.B), int(a.A) - int(b.A)} {
+		if d < -1 || d > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+func gradient(w, h int, alpha uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 11), B: uint8(x*y + 3), A: alpha})
+		}
+	}
+	return img
+}
+
+func solid(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func checker(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{A: 255}
+			if (x+y)%2 == 0 {
+				c = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
@@ -0,0 +1,349 @@
+package imgconv
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// WebP 无损（VP8L）编码
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+//
+// 只使用减绿变换和前缀编码，不使用反向引用和颜色缓存，
+// 压缩率低于 libwebp，但足以满足缩略图的需要，且无需 cgo
+
+const (
+	vp8lSignature     = 0x2f
+	vp8lMaxSize       = 1 << 14
+	vp8lSubtractGreen = 2
+
+	// 绿色通道的字母表包含 256 个字面量和 24 个长度前缀
+	vp8lGreenAlphabet = 256 + 24
+	vp8lMaxCodeLength = 15
+	vp8lMaxCodeLenLen = 7
+)
+
+// vp8lCodeLengthOrder 代码长度编码的写入顺序
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP 将图片编码为无损 WebP
+func EncodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return fmt.Errorf("invalid webp image size: %dx%d", width, height)
+	}
+
+	// 转换为 ARGB 并应用减绿变换
+	pixels := make([][4]uint8, 0, width*height)
+	hasAlpha := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			// 顺序与前缀编码一致：绿、红、蓝、透明
+			pixels = append(pixels, [4]uint8{c.G, c.R - c.G, c.B - c.G, c.A})
+		}
+	}
+
+	var freqs [4][]int
+	freqs[0] = make([]int, vp8lGreenAlphabet)
+	for i := 1; i < 4; i++ {
+		freqs[i] = make([]int, 256)
+	}
+	for _, p := range pixels {
+		for i, v := range p {
+			freqs[i][v]++
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.writeBool(hasAlpha)
+	bw.write(0, 3)
+
+	// 变换：减绿
+	bw.write(1, 1)
+	bw.write(vp8lSubtractGreen, 2)
+	bw.write(0, 1)
+
+	// 不使用颜色缓存和元前缀编码
+	bw.write(0, 1)
+	bw.write(0, 1)
+
+	var codes [4]prefixCode
+	for i := range freqs {
+		codes[i] = writePrefixCode(bw, freqs[i])
+	}
+	// 距离编码，没有反向引用时只需占位
+	writePrefixCode(bw, make([]int, 40))
+
+	for _, p := range pixels {
+		for i, v := range p {
+			codes[i].write(bw, int(v))
+		}
+	}
+
+	data := bw.bytes()
+	chunkSize := len(data)
+	padding := chunkSize & 1
+
+	header := make([]byte, 20)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+8+chunkSize+padding))
+	copy(header[8:12], "WEBP")
+	copy(header[12:16], "VP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(chunkSize))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padding != 0 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixCode 规范前缀编码，codes 已按写入顺序反转
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+}
+
+func (c prefixCode) write(bw *bitWriter, symbol int) {
+	if n := c.lengths[symbol]; n > 0 {
+		bw.write(uint32(c.codes[symbol]), uint(n))
+	}
+}
+
+// writePrefixCode 写入前缀编码并返回用于编码数据的码表
+func writePrefixCode(bw *bitWriter, freqs []int) prefixCode {
+	var used []int
+	for symbol, f := range freqs {
+		if f > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	// 不超过两个符号且都小于 256 时使用简单编码
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		lengths := make([]uint8, len(freqs))
+		bw.write(1, 1)
+		switch len(used) {
+		case 0:
+			bw.write(0, 1)
+			bw.write(0, 1)
+			bw.write(0, 1)
+		case 1:
+			bw.write(0, 1)
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+		case 2:
+			bw.write(1, 1)
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+			bw.write(uint32(used[1]), 8)
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+		return newPrefixCode(lengths)
+	}
+
+	lengths := huffmanLengths(freqs, vp8lMaxCodeLength)
+
+	// 代码长度本身也使用前缀编码，只使用 0-15 的字面量
+	lenFreqs := make([]int, 19)
+	for _, n := range lengths {
+		lenFreqs[n]++
+	}
+	lenLengths := huffmanLengths(lenFreqs, vp8lMaxCodeLenLen)
+
+	numCodes := 4
+	for i := len(vp8lCodeLengthOrder) - 1; i >= 4; i-- {
+		if lenLengths[vp8lCodeLengthOrder[i]] != 0 {
+			numCodes = i + 1
+			break
+		}
+	}
+
+	bw.write(0, 1)
+	bw.write(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		bw.write(uint32(lenLengths[vp8lCodeLengthOrder[i]]), 3)
+	}
+
+	// max_symbol 使用字母表大小
+	bw.write(0, 1)
+	lenCode := newPrefixCode(lenLengths)
+	for _, n := range lengths {
+		lenCode.write(bw, int(n))
+	}
+
+	return newPrefixCode(lengths)
+}
+
+// newPrefixCode 根据码长生成规范前缀编码
+func newPrefixCode(lengths []uint8) prefixCode {
+	var count [vp8lMaxCodeLength + 1]int
+	for _, n := range lengths {
+		count[n]++
+	}
+	count[0] = 0
+
+	var next [vp8lMaxCodeLength + 1]int
+	code := 0
+	for n := 1; n <= vp8lMaxCodeLength; n++ {
+		code = (code + count[n-1]) << 1
+		next[n] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+	for symbol, n := range lengths {
+		if n == 0 {
+			continue
+		}
+		codes[symbol] = reverseBits(uint16(next[n]), n)
+		next[n]++
+	}
+	return prefixCode{lengths: lengths, codes: codes}
+}
+
+func reverseBits(code uint16, n uint8) uint16 {
+	var r uint16
+	for i := uint8(0); i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+// huffmanLengths 计算码长不超过 maxLength 的哈夫曼码长
+// 使用的符号少于两个时补充一个符号，保证编码是完整的
+func huffmanLengths(freqs []int, maxLength int) []uint8 {
+	freqs = append([]int(nil), freqs...)
+	used := 0
+	for _, f := range freqs {
+		if f > 0 {
+			used++
+		}
+	}
+	for i := 0; used < 2 && i < len(freqs); i++ {
+		if freqs[i] == 0 {
+			freqs[i] = 1
+			used++
+		}
+	}
+
+	for {
+		lengths := buildHuffman(freqs)
+		longest := uint8(0)
+		for _, n := range lengths {
+			longest = max(longest, n)
+		}
+		if int(longest) <= maxLength {
+			return lengths
+		}
+		// 码长超出限制时压缩频率分布后重新计算
+		for i, f := range freqs {
+			if f > 0 {
+				freqs[i] = f>>1 | 1
+			}
+		}
+	}
+}
+
+type huffmanNode struct {
+	freq        int
+	symbol      int
+	left, right *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].symbol < h[j].symbol
+}
+func (h huffmanHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x any)   { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() any {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+func buildHuffman(freqs []int) []uint8 {
+	h := &huffmanHeap{}
+	for symbol, f := range freqs {
+		if f > 0 {
+			*h = append(*h, &huffmanNode{freq: f, symbol: symbol})
+		}
+	}
+	heap.Init(h)
+	for next := len(freqs); h.Len() > 1; next++ {
+		a := heap.Pop(h).(*huffmanNode)
+		b := heap.Pop(h).(*huffmanNode)
+		heap.Push(h, &huffmanNode{freq: a.freq + b.freq, symbol: next, left: a, right: b})
+	}
+
+	lengths := make([]uint8, len(freqs))
+	var walk func(n *huffmanNode, depth uint8)
+	walk = func(n *huffmanNode, depth uint8) {
+		if n.left == nil {
+			lengths[n.symbol] = depth
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(heap.Pop(h).(*huffmanNode), 0)
+	return lengths
+}
+
+// bitWriter 按 VP8L 的方式从低位开始写入比特
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) writeBool(b bool) {
+	if b {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
@@ -0,0 +1,208 @@
+package imgconv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// decodeVP8L 解码 EncodeWebP 输出的无损 WebP，只支持编码器使用的功能：
+// 减绿变换、简单和普通前缀编码，不支持反向引用、颜色缓存和元前缀编码
+func decodeVP8L(data []byte) (*image.NRGBA, error) {
+	if len(data) < 21 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" || string(data[12:16]) != "VP8L" {
+		return nil, errors.New("not a lossless webp")
+	}
+	if int(binary.LittleEndian.Uint32(data[4:8])) != len(data)-8 {
+		return nil, errors.New("bad riff size")
+	}
+	chunkSize := int(binary.LittleEndian.Uint32(data[16:20]))
+	if 20+chunkSize > len(data) {
+		return nil, errors.New("bad chunk size")
+	}
+
+	br := &bitReader{data: data[20 : 20+chunkSize]}
+	if br.read(8) != vp8lSignature {
+		return nil, errors.New("bad signature")
+	}
+	width, height := int(br.read(14))+1, int(br.read(14))+1
+	br.read(1)
+	if br.read(3) != 0 {
+		return nil, errors.New("bad version")
+	}
+
+	subtractGreen := false
+	for br.read(1) == 1 {
+		if br.read(2) != vp8lSubtractGreen {
+			return nil, errors.New("unsupported transform")
+		}
+		subtractGreen = true
+	}
+	if br.read(1) != 0 {
+		return nil, errors.New("color cache not supported")
+	}
+	if br.read(1) != 0 {
+		return nil, errors.New("meta prefix codes not supported")
+	}
+
+	var codes [5]*prefixDecoder
+	for i, size := range []int{vp8lGreenAlphabet, 256, 256, 256, 40} {
+		code, err := readPrefixCode(br, size)
+		if err != nil {
+			return nil, fmt.Errorf("prefix code %d: %w", i, err)
+		}
+		codes[i] = code
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		g := codes[0].decode(br)
+		if g >= 256 {
+			return nil, errors.New("backward references not supported")
+		}
+		r, b, a := codes[1].decode(br), codes[2].decode(br), codes[3].decode(br)
+		if subtractGreen {
+			r, b = (r+g)&0xff, (b+g)&0xff
+		}
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = uint8(r), uint8(g), uint8(b), uint8(a)
+	}
+	if br.overflow {
+		return nil, errors.New("unexpected end of data")
+	}
+	return img, nil
+}
+
+func readPrefixCode(br *bitReader, size int) (*prefixDecoder, error) {
+	lengths := make([]uint8, size)
+	if br.read(1) == 1 {
+		n := br.read(1) + 1
+		first := br.read(1)
+		symbols := []int{int(br.read(1 + 7*int(first)))}
+		if n == 2 {
+			symbols = append(symbols, int(br.read(8)))
+		}
+		// 只有一个符号时码长为 0，解码时不读取比特
+		if len(symbols) == 1 {
+			return &prefixDecoder{single: symbols[0]}, nil
+		}
+		for _, s := range symbols {
+			lengths[s] = 1
+		}
+		return newPrefixDecoder(lengths)
+	}
+
+	numCodes := int(br.read(4)) + 4
+	lenLengths := make([]uint8, 19)
+	for i := 0; i < numCodes; i++ {
+		lenLengths[vp8lCodeLengthOrder[i]] = uint8(br.read(3))
+	}
+	lenCode, err := newPrefixDecoder(lenLengths)
+	if err != nil {
+		return nil, err
+	}
+	if br.read(1) != 0 {
+		return nil, errors.New("max_symbol not supported")
+	}
+
+	prev := uint8(8)
+	for i := 0; i < size; {
+		n := lenCode.decode(br)
+		switch {
+		case n < 16:
+			lengths[i] = uint8(n)
+			if n != 0 {
+				prev = uint8(n)
+			}
+			i++
+		case n == 16:
+			for repeat := 3 + int(br.read(2)); repeat > 0 && i < size; repeat-- {
+				lengths[i] = prev
+				i++
+			}
+		default:
+			repeat := 3 + int(br.read(3))
+			if n == 18 {
+				repeat = 11 + int(br.read(7))
+			}
+			i += repeat
+		}
+	}
+	return newPrefixDecoder(lengths)
+}
+
+// prefixDecoder 按规范前缀编码逐比特解码
+type prefixDecoder struct {
+	single  int
+	count   [vp8lMaxCodeLength + 1]int
+	symbols []int
+}
+
+func newPrefixDecoder(lengths []uint8) (*prefixDecoder, error) {
+	d := &prefixDecoder{single: -1}
+	for n := uint8(1); n <= vp8lMaxCodeLength; n++ {
+		for symbol, l := range lengths {
+			if l == n {
+				d.count[n]++
+				d.symbols = append(d.symbols, symbol)
+			}
+		}
+	}
+	switch len(d.symbols) {
+	case 0:
+		return nil, errors.New("empty prefix code")
+	case 1:
+		d.single = d.symbols[0]
+		return d, nil
+	}
+
+	// 完整的编码才能被解码器接受
+	left := 1
+	for n := 1; n <= vp8lMaxCodeLength; n++ {
+		left = left<<1 - d.count[n]
+		if left < 0 {
+			return nil, errors.New("over-subscribed prefix code")
+		}
+	}
+	if left != 0 {
+		return nil, errors.New("incomplete prefix code")
+	}
+	return d, nil
+}
+
+func (d *prefixDecoder) decode(br *bitReader) int {
+	if d.single >= 0 {
+		return d.single
+	}
+	code, first, index := 0, 0, 0
+	for n := 1; n <= vp8lMaxCodeLength; n++ {
+		code |= int(br.read(1))
+		if code-first < d.count[n] {
+			return d.symbols[index+code-first]
+		}
+		index += d.count[n]
+		first = (first + d.count[n]) << 1
+		code <<= 1
+	}
+	br.overflow = true
+	return 0
+}
+
+// bitReader 从低位开始读取比特
+type bitReader struct {
+	data     []byte
+	pos      int
+	overflow bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos>>3 >= len(r.data) {
+			r.overflow = true
+			return 0
+		}
+		v |= uint32(r.data[r.pos>>3]>>(r.pos&7)&1) << i
+		r.pos++
+	}
+	return v
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// LinkCount returns the number of hard links to the file at path.
+func LinkCount(path string) (uint64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("link count of %s unavailable", path)
+	}
+	return uint64(sys.Nlink), nil
+}
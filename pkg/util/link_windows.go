@@ -0,0 +1,21 @@
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// LinkCount returns the number of hard links to the file at path.
+func LinkCount(path string) (uint64, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(fp.Fd()), &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.NumberOfLinks), nil
+}
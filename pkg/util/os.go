@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -133,3 +134,38 @@ func PrepareDir(path string) error {
 	}
 	return nil
 }
+
+// CopyFile copies the contents of src to dst, creating or truncating dst.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ReplaceFile copies src to dst.tmp and renames it over dst, so the previous dst
+// inode, and any hard link to it, keeps its old contents.
+func ReplaceFile(src, dst string) error {
+	tmp := dst + ".tmp"
+	if err := CopyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -1,36 +1,264 @@
 package silk
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sjzar/go-lame"
 	"github.com/sjzar/go-silk"
+
+	"github.com/sjzar/chatlog/pkg/util/vorbis"
 )
 
-func Silk2MP3(data []byte) ([]byte, error) {
+const Header = "#!SILK_V3"
+
+// 支持转换的音频格式
+const (
+	FormatMP3 = "mp3"
+	FormatWAV = "wav"
+	FormatOgg = "ogg"
+)
+
+// sampleRates 与 SILK 数据包开头的采样率符号对应，单位为 kHz
+var sampleRates = [4]int{8, 12, 16, 24}
+
+// sampleRateCDF 采样率符号的累积分布，用于在不解码的情况下读取第一个符号
+var sampleRateCDF = [5]uint32{0, 16000, 32000, 48000, 65535}
+
+// StreamSampleRate 读取文件头和第一个数据包，返回编码时使用的采样率
+func StreamSampleRate(data []byte) (int, error) {
+	payload, err := skipHeader(data)
+	if err != nil {
+		return 0, err
+	}
+	for len(payload) >= 2 {
+		n := int(int16(binary.LittleEndian.Uint16(payload)))
+		payload = payload[2:]
+		if n <= 0 {
+			continue
+		}
+		if n > len(payload) {
+			break
+		}
+		return packetSampleRate(payload[:n]), nil
+	}
+	return 0, fmt.Errorf("no silk frame found")
+}
+
+// skipHeader 跳过文件头，微信的语音在文件头前多一个 0x02
+func skipHeader(data []byte) ([]byte, error) {
+	if len(data) > 0 && data[0] == 0x02 {
+		data = data[1:]
+	}
+	if !bytes.HasPrefix(data, []byte(Header)) {
+		return nil, fmt.Errorf("silk header not found")
+	}
+	return data[len(Header):], nil
+}
+
+// packetSampleRate 读取数据包中第一个区间编码符号，即编码时的内部采样率
+func packetSampleRate(packet []byte) int {
+	var buf [4]byte
+	copy(buf[:], packet)
+	base := binary.BigEndian.Uint32(buf[:])
+
+	// 区间编码器初始区间为 0xFFFF，符号为满足 range*cdf[i] <= base 的最大 i
+	const rangeQ16 = 0xFFFF
+	i := 0
+	for i < len(sampleRates)-1 && rangeQ16*sampleRateCDF[i+1] <= base {
+		i++
+	}
+	return sampleRates[i] * 1000
+}
+
+// Audio 解码后的 16 位小端单声道 PCM
+type Audio struct {
+	PCM        []byte
+	SampleRate int
+}
+
+// Decode 按数据流本身的采样率解码
+func Decode(data []byte) (*Audio, error) {
+	sampleRate, err := StreamSampleRate(data)
+	if err != nil {
+		return nil, err
+	}
 
 	sd := silk.SilkInit()
 	defer sd.Close()
+	sd.SetSampleRate(sampleRate)
 
 	pcmdata := sd.Decode(data)
 	if len(pcmdata) == 0 {
 		return nil, fmt.Errorf("silk decode failed")
 	}
+	return &Audio{PCM: pcmdata, SampleRate: sampleRate}, nil
+}
+
+// Duration 根据采样数计算时长
+func (a *Audio) Duration() time.Duration {
+	samples := len(a.PCM) / 2
+	return time.Duration(samples) * time.Second / time.Duration(a.SampleRate)
+}
 
+// Encode 编码为指定格式，格式为 FormatMP3、FormatWAV 或 FormatOgg
+func (a *Audio) Encode(format string) ([]byte, error) {
+	switch format {
+	case FormatMP3:
+		return a.MP3()
+	case FormatWAV:
+		return a.WAV(), nil
+	case FormatOgg:
+		return vorbis.Encode(a.PCM, a.SampleRate)
+	default:
+		return nil, fmt.Errorf("unsupported audio format %s", format)
+	}
+}
+
+// MP3 编码为 CBR MP3，并在 ID3v2 标签的 TLEN 帧中记录时长
+func (a *Audio) MP3() ([]byte, error) {
 	le := lame.Init()
 	defer le.Close()
 
-	le.SetInSamplerate(24000)
-	le.SetOutSamplerate(24000)
+	le.SetInSamplerate(a.SampleRate)
+	le.SetOutSamplerate(a.SampleRate)
 	le.SetNumChannels(1)
-	le.SetBitrate(16)
+	le.SetBitrate(mp3Bitrate(a.SampleRate))
 	// IMPORTANT!
-	le.InitParams()
+	if le.InitParams() < 0 {
+		return nil, fmt.Errorf("mp3 encoder init failed")
+	}
 
-	mp3data := le.Encode(pcmdata)
+	mp3data := le.Encode(a.PCM)
+	mp3data = append(mp3data, le.Flush()...)
 	if len(mp3data) == 0 {
 		return nil, fmt.Errorf("mp3 encode failed")
 	}
 
-	return mp3data, nil
+	return append(id3Duration(a.Duration()), mp3data...), nil
+}
+
+// id3Duration 生成只包含 TLEN 帧的 ID3v2.3 标签，时长单位为毫秒
+func id3Duration(d time.Duration) []byte {
+	text := append([]byte{0}, strconv.FormatInt(d.Milliseconds(), 10)...)
+
+	var frame bytes.Buffer
+	frame.WriteString("TLEN")
+	binary.Write(&frame, binary.BigEndian, uint32(len(text)))
+	frame.Write([]byte{0, 0})
+	frame.Write(text)
+
+	// 标签大小为 4 个 7 位的字节
+	size := frame.Len()
+	tag := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, frame.Bytes()...)
+}
+
+// mp3Bitrate 按采样率选择码率，单位为 kbps
+func mp3Bitrate(sampleRate int) int {
+	switch {
+	case sampleRate <= 8000:
+		return 16
+	case sampleRate <= 12000:
+		return 24
+	default:
+		return 32
+	}
+}
+
+// WAV 添加 WAV 文件头，时长由数据长度和采样率决定
+func (a *Audio) WAV() []byte {
+	return PCM2WAV(a.PCM, a.SampleRate)
+}
+
+func Silk2MP3(data []byte) ([]byte, error) {
+	audio, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return audio.MP3()
+}
+
+// Silk2WAV 解码并封装为 WAV，供语音识别等只接受常见格式的场景使用
+func Silk2WAV(data []byte) ([]byte, error) {
+	audio, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return audio.WAV(), nil
+}
+
+// ContentType 返回格式对应的 MIME 类型
+func ContentType(format string) string {
+	switch format {
+	case FormatMP3:
+		return "audio/mpeg"
+	case FormatWAV:
+		return "audio/wav"
+	case FormatOgg:
+		return "audio/ogg"
+	default:
+		return "audio/silk"
+	}
+}
+
+// NegotiateFormat 根据 Accept 请求头选择格式，没有匹配时返回 FormatMP3
+func NegotiateFormat(accept string) string {
+	best, bestQ := FormatMP3, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				fmt.Sscanf(param[2:], "%g", &q)
+			}
+		}
+
+		var format string
+		switch mime {
+		case "audio/mpeg", "audio/mp3":
+			format = FormatMP3
+		case "audio/wav", "audio/wave", "audio/x-wav", "audio/vnd.wave":
+			format = FormatWAV
+		case "audio/ogg", "application/ogg", "audio/vorbis":
+			format = FormatOgg
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// PCM2WAV 为 16 位单声道 PCM 添加 WAV 文件头
+func PCM2WAV(pcm []byte, sampleRate int) []byte {
+	var buf bytes.Buffer
+	buf.Grow(44 + len(pcm))
+
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVE")
+
+	buf.WriteString("fmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // 单声道
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*2))
+	binary.Write(&buf, binary.LittleEndian, uint16(2))
+	binary.Write(&buf, binary.LittleEndian, uint16(16))
+
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
 }
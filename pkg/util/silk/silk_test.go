@@ -0,0 +1,79 @@
+package silk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		file       string
+		sampleRate int
+		duration   time.Duration
+	}{
+		{"8k.silk", 8000, 1500 * time.Millisecond},
+		{"24k.silk", 24000, 1500 * time.Millisecond},
+		// 每个数据包包含两帧，时长不能按数据包数量计算
+		{"16k_2frames.silk", 16000, 1480 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rate, err := StreamSampleRate(data)
+			if err != nil {
+				t.Fatalf("StreamSampleRate() error = %v", err)
+			}
+			if rate != tt.sampleRate {
+				t.Errorf("StreamSampleRate() = %d, want %d", rate, tt.sampleRate)
+			}
+
+			audio, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if audio.SampleRate != tt.sampleRate {
+				t.Errorf("SampleRate = %d, want %d", audio.SampleRate, tt.sampleRate)
+			}
+			if d := audio.Duration(); d != tt.duration {
+				t.Errorf("Duration() = %v, want %v", d, tt.duration)
+			}
+
+			magic := map[string]string{FormatMP3: "ID3", FormatWAV: "RIFF", FormatOgg: "OggS"}
+			for format, prefix := range magic {
+				out, err := audio.Encode(format)
+				if err != nil {
+					t.Fatalf("Encode(%s) error = %v", format, err)
+				}
+				if !bytes.HasPrefix(out, []byte(prefix)) {
+					t.Errorf("Encode(%s) missing %s header", format, prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", FormatMP3},
+		{"*/*", FormatMP3},
+		{"audio/ogg", FormatOgg},
+		{"audio/wav;q=0.5, audio/ogg;q=0.8", FormatOgg},
+		{"audio/webm, audio/x-wav;q=0.9", FormatWAV},
+		{"audio/ogg;q=0.2, audio/mpeg", FormatMP3},
+	}
+	for _, tt := range tests {
+		if got := NegotiateFormat(tt.accept); got != tt.want {
+			t.Errorf("NegotiateFormat(%q) = %s, want %s", tt.accept, got, tt.want)
+		}
+	}
+}
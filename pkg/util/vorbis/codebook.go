@@ -0,0 +1,200 @@
+package vorbis
+
+import (
+	"container/heap"
+	"math"
+	"math/bits"
+)
+
+// codebook 霍夫曼码本，lookup 为 true 时按 lookup type 1 映射为向量
+type codebook struct {
+	dim     int
+	lengths []int
+	codes   []uint32
+
+	lookup    bool
+	minValue  int
+	delta     int
+	valueBits int
+	quantVals int
+}
+
+// newScalarBook 创建只用于标量读取的码本，残差的类别码本用 dim 表示每个条目包含的类别数
+func newScalarBook(dim int, weights []float64) *codebook {
+	b := &codebook{dim: dim}
+	b.build(weights)
+	return b
+}
+
+// newVectorBook 创建 dim 维向量码本，每一维的取值为 minValue + i*delta，i 小于 quantVals
+// 条目的权重为各维权重的乘积
+func newVectorBook(dim, quantVals, minValue, delta int, weight func(v int) float64) *codebook {
+	b := &codebook{
+		dim:       dim,
+		lookup:    true,
+		minValue:  minValue,
+		delta:     delta,
+		valueBits: ilog(quantVals - 1),
+		quantVals: quantVals,
+	}
+	entries := 1
+	for i := 0; i < dim; i++ {
+		entries *= quantVals
+	}
+	weights := make([]float64, entries)
+	for e := range weights {
+		w, rest := 1.0, e
+		for i := 0; i < dim; i++ {
+			w *= weight(minValue + rest%quantVals*delta)
+			rest /= quantVals
+		}
+		weights[e] = w
+	}
+	b.build(weights)
+	return b
+}
+
+// build 按权重生成码长，再按规范中的规则分配码字
+func (b *codebook) build(weights []float64) {
+	b.lengths = huffmanLengths(weights)
+	b.codes = make([]uint32, len(b.lengths))
+
+	// 与解码器一致：每个条目取对应长度下最小的可用码字
+	var marker [33]uint32
+	for i, l := range b.lengths {
+		entry := marker[l]
+		b.codes[i] = entry
+		for j := l; j > 0; j-- {
+			if marker[j]&1 != 0 {
+				if j == 1 {
+					marker[1]++
+				} else {
+					marker[j] = marker[j-1] << 1
+				}
+				break
+			}
+			marker[j]++
+		}
+		for j := l + 1; j < 33; j++ {
+			if marker[j]>>1 != entry {
+				break
+			}
+			entry = marker[j]
+			marker[j] = marker[j-1] << 1
+		}
+	}
+}
+
+// writeHeader 写入 setup 头中的码本配置
+func (b *codebook) writeHeader(w *bitWriter) {
+	w.write(0x564342, 24)
+	w.write(uint32(b.dim), 16)
+	w.write(uint32(len(b.lengths)), 24)
+	w.writeBool(false) // ordered
+	w.writeBool(false) // sparse
+	for _, l := range b.lengths {
+		w.write(uint32(l-1), 5)
+	}
+	if !b.lookup {
+		w.write(0, 4)
+		return
+	}
+	w.write(1, 4)
+	w.write(packFloat(b.minValue), 32)
+	w.write(packFloat(b.delta), 32)
+	w.write(uint32(b.valueBits-1), 4)
+	w.writeBool(false) // sequence_p
+	for i := 0; i < b.quantVals; i++ {
+		w.write(uint32(i), b.valueBits)
+	}
+}
+
+// encode 写入条目的码字，解码器从码字的最高位开始读取
+func (b *codebook) encode(w *bitWriter, entry int) {
+	l := b.lengths[entry]
+	w.write(bits.Reverse32(b.codes[entry])>>(32-l), l)
+}
+
+// encodeVector 写入由各维下标组成的向量
+func (b *codebook) encodeVector(w *bitWriter, idx []int) {
+	entry := 0
+	for i := len(idx) - 1; i >= 0; i-- {
+		entry = entry*b.quantVals + idx[i]
+	}
+	b.encode(w, entry)
+}
+
+// packFloat 按 Vorbis 的 32 位浮点格式打包整数
+func packFloat(v int) uint32 {
+	var sign uint32
+	if v < 0 {
+		sign, v = 1<<31, -v
+	}
+	exp := uint32(788)
+	for v >= 1<<21 {
+		v >>= 1
+		exp++
+	}
+	return sign | exp<<21 | uint32(v)
+}
+
+// huffmanLengths 计算霍夫曼码长，权重过小时抬高以限制最大码长
+func huffmanLengths(weights []float64) []int {
+	n := len(weights)
+	lengths := make([]int, n)
+	if n == 1 {
+		lengths[0] = 1
+		return lengths
+	}
+
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	floor := total / math.Pow(2, 16)
+
+	h := make(nodeHeap, 0, n)
+	parent := make([]int, 2*n-1)
+	for i, w := range weights {
+		h = append(h, node{weight: math.Max(w, floor), id: i})
+	}
+	heap.Init(&h)
+	next := n
+	for h.Len() > 1 {
+		a := heap.Pop(&h).(node)
+		b := heap.Pop(&h).(node)
+		parent[a.id], parent[b.id] = next, next
+		heap.Push(&h, node{weight: a.weight + b.weight, id: next})
+		next++
+	}
+	root := next - 1
+	for i := range lengths {
+		for p := i; p != root; p = parent[p] {
+			lengths[i]++
+		}
+	}
+	return lengths
+}
+
+type node struct {
+	weight float64
+	id     int
+}
+
+type nodeHeap []node
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].weight != h[j].weight {
+		return h[i].weight < h[j].weight
+	}
+	return h[i].id < h[j].id
+}
+func (h nodeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x any)   { *h = append(*h, x.(node)) }
+func (h *nodeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
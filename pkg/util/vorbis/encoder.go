@@ -0,0 +1,587 @@
+// Package vorbis 实现一个面向语音的单声道 Ogg Vorbis 编码器
+//
+// 编码器只使用一种 512 点的短块，底噪曲线为 floor type 1，残差为 residue type 1，
+// 残差按底噪归一化后用整数量化，码本在 setup 头中给出
+package vorbis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// BlockSize MDCT 块大小，相邻块重叠一半
+	BlockSize = 512
+
+	// Vendor 写入 comment 头的编码器名称
+	Vendor = "chatlog"
+
+	bins = BlockSize / 2
+
+	// floorMultiplier 底噪 Y 值的倍率，取值范围为 [0, floorRange)
+	floorMultiplier = 2
+	floorRange      = 128
+
+	// partitionSize 残差分区大小，每个分区选择一个类别，classDim 个类别合为一个码字
+	partitionSize = 16
+	classDim      = 2
+
+	// coarseStep 粗码本的量化步长，residueMax 为残差绝对值的上限
+	coarseStep = 15
+	residueMax = 7*coarseStep + 7
+
+	// noiseRatio 底噪相对于频带峰值的比例，决定量化精度
+	// maskRatio 底噪相对于整块峰值的下限，远低于峰值的频带只粗略编码
+	noiseRatio = 1.0 / 4
+	maskRatio  = 0.04
+
+	// silenceLevel 整块的 MDCT 系数都低于该值时按静音编码
+	silenceLevel = 1e-5
+)
+
+// 码本编号，与 setup 头中的顺序一致
+const (
+	bookFloor = iota
+	bookClass
+	bookCoarse
+	book7
+	book3
+	book1
+	numBooks
+)
+
+// residueClass 残差类别，按分区内残差绝对值的最大值选择
+// books 为两轮编码分别使用的码本，-1 表示该轮不编码
+type residueClass struct {
+	peak  int
+	prob  float64
+	books [2]int
+}
+
+var residueClasses = []residueClass{
+	{peak: 0, prob: 0.3, books: [2]int{-1, -1}},
+	{peak: 1, prob: 0.3, books: [2]int{-1, book1}},
+	{peak: 3, prob: 0.2, books: [2]int{-1, book3}},
+	{peak: 7, prob: 0.15, books: [2]int{-1, book7}},
+	{peak: residueMax, prob: 0.05, books: [2]int{bookCoarse, book7}},
+}
+
+// floorX 除 0 和 256 外的底噪控制点，按对数间隔分布，每个分区 8 个点
+var floorX = []int{
+	1, 2, 3, 4, 6, 8, 10, 12, 17, 20, 24, 28,
+	33, 39, 46, 54, 64, 76, 90, 107, 128, 160, 192, 224,
+}
+
+const floorPartitionDim = 8
+
+// inverseDB floor type 1 的 Y 值到幅度的映射，与规范中的表一致
+var inverseDB [256]float64
+
+type setup struct {
+	books     []*codebook
+	header    []byte
+	xList     []int
+	order     []int
+	low, high []int
+	window    []float64
+	mdctBasis []float64
+	bandLo    []int
+	bandHi    []int
+}
+
+var (
+	shared     *setup
+	sharedOnce sync.Once
+)
+
+func init() {
+	for i := range inverseDB {
+		inverseDB[i] = 1.0649863e-07 * math.Pow(1.0649863, float64(i))
+	}
+}
+
+func getSetup() *setup {
+	sharedOnce.Do(func() {
+		shared = newSetup()
+	})
+	return shared
+}
+
+func newSetup() *setup {
+	s := &setup{}
+
+	s.books = make([]*codebook, numBooks)
+
+	// 底噪的差值以小值为主
+	floorWeights := make([]float64, floorRange)
+	for i := range floorWeights {
+		floorWeights[i] = math.Exp(-float64(i) / 8)
+	}
+	s.books[bookFloor] = newScalarBook(1, floorWeights)
+
+	entries := 1
+	for i := 0; i < classDim; i++ {
+		entries *= len(residueClasses)
+	}
+	classWeights := make([]float64, entries)
+	for e := range classWeights {
+		w, rest := 1.0, e
+		for i := 0; i < classDim; i++ {
+			w *= residueClasses[rest%len(residueClasses)].prob
+			rest /= len(residueClasses)
+		}
+		classWeights[e] = w
+	}
+	s.books[bookClass] = newScalarBook(classDim, classWeights)
+
+	laplace := func(scale float64) func(v int) float64 {
+		return func(v int) float64 {
+			return math.Exp(-math.Abs(float64(v)) / scale)
+		}
+	}
+	s.books[bookCoarse] = newVectorBook(2, 15, -7*coarseStep, coarseStep, laplace(coarseStep))
+	s.books[book7] = newVectorBook(2, 15, -7, 1, laplace(2))
+	s.books[book3] = newVectorBook(2, 7, -3, 1, laplace(1))
+	s.books[book1] = newVectorBook(4, 3, -1, 1, laplace(0.5))
+
+	// 底噪控制点及其在解码时的前后邻点
+	s.xList = append([]int{0, bins}, floorX...)
+	s.low = make([]int, len(s.xList))
+	s.high = make([]int, len(s.xList))
+	for i := 2; i < len(s.xList); i++ {
+		lo, hi := 0, 1
+		for j := 0; j < i; j++ {
+			x := s.xList[j]
+			if x < s.xList[i] && x > s.xList[lo] {
+				lo = j
+			}
+			if x > s.xList[i] && x < s.xList[hi] {
+				hi = j
+			}
+		}
+		s.low[i], s.high[i] = lo, hi
+	}
+	s.order = make([]int, len(s.xList))
+	for i := range s.order {
+		s.order[i] = i
+	}
+	sort.Slice(s.order, func(a, b int) bool { return s.xList[s.order[a]] < s.xList[s.order[b]] })
+
+	// 每个控制点负责的频带为与相邻控制点的中点之间
+	s.bandLo = make([]int, len(s.xList))
+	s.bandHi = make([]int, len(s.xList))
+	for k, i := range s.order {
+		lo, hi := 0, bins
+		if k > 0 {
+			lo = (s.xList[s.order[k-1]] + s.xList[i] + 1) / 2
+		}
+		if k < len(s.order)-1 {
+			hi = (s.xList[i] + s.xList[s.order[k+1]] + 1) / 2
+		}
+		s.bandLo[i], s.bandHi[i] = lo, max(hi, lo+1)
+	}
+
+	s.window = make([]float64, BlockSize)
+	for i := range s.window {
+		v := math.Sin((float64(i) + 0.5) / BlockSize * math.Pi)
+		s.window[i] = math.Sin(math.Pi / 2 * v * v)
+	}
+	s.mdctBasis = make([]float64, bins*BlockSize)
+	for k := 0; k < bins; k++ {
+		for i := 0; i < BlockSize; i++ {
+			s.mdctBasis[k*BlockSize+i] = math.Cos(math.Pi / bins * (float64(i) + 0.5 + bins/2) * (float64(k) + 0.5))
+		}
+	}
+
+	s.header = s.setupHeader()
+	return s
+}
+
+// setupHeader 生成第三个头数据包
+func (s *setup) setupHeader() []byte {
+	w := &bitWriter{}
+	w.write(5, 8)
+	w.writeBytes([]byte("vorbis"))
+
+	w.write(uint32(len(s.books)-1), 8)
+	for _, b := range s.books {
+		b.writeHeader(w)
+	}
+
+	// 时域变换占位
+	w.write(0, 6)
+	w.write(0, 16)
+
+	// floor type 1
+	w.write(0, 6)
+	w.write(1, 16)
+	partitions := len(floorX) / floorPartitionDim
+	w.write(uint32(partitions), 5)
+	for i := 0; i < partitions; i++ {
+		w.write(0, 4)
+	}
+	w.write(floorPartitionDim-1, 3)
+	w.write(0, 2) // subclasses
+	w.write(bookFloor+1, 8)
+	w.write(floorMultiplier-1, 2)
+	w.write(uint32(ilog(bins-1)), 4)
+	for _, x := range floorX {
+		w.write(uint32(x), ilog(bins-1))
+	}
+
+	// residue type 1
+	w.write(0, 6)
+	w.write(1, 16)
+	w.write(0, 24)
+	w.write(bins, 24)
+	w.write(partitionSize-1, 24)
+	w.write(uint32(len(residueClasses)-1), 6)
+	w.write(bookClass, 8)
+	for _, c := range residueClasses {
+		var cascade uint32
+		for pass, b := range c.books {
+			if b >= 0 {
+				cascade |= 1 << pass
+			}
+		}
+		w.write(cascade, 3)
+		w.writeBool(false)
+	}
+	for _, c := range residueClasses {
+		for _, b := range c.books {
+			if b >= 0 {
+				w.write(uint32(b), 8)
+			}
+		}
+	}
+
+	// mapping type 0，单个子映射，无声道耦合
+	w.write(0, 6)
+	w.write(0, 16)
+	w.writeBool(false)
+	w.writeBool(false)
+	w.write(0, 2)
+	w.write(0, 8)
+	w.write(0, 8)
+	w.write(0, 8)
+
+	// 单个模式，短块
+	w.write(0, 6)
+	w.writeBool(false)
+	w.write(0, 16)
+	w.write(0, 16)
+	w.write(0, 8)
+
+	w.writeBool(true)
+	return w.bytes()
+}
+
+// Encode 把 16 位小端单声道 PCM 编码为 Ogg Vorbis
+func Encode(pcm []byte, sampleRate int) ([]byte, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+	n := len(pcm) / 2
+	if n == 0 {
+		return nil, fmt.Errorf("empty pcm data")
+	}
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(pcm[2*i:]))) / 32768
+	}
+
+	s := getSetup()
+	o := &oggWriter{serial: serialOf(pcm)}
+
+	// 头数据包：identification 单独一页，comment 和 setup 另起一页
+	o.writePacket(identificationHeader(sampleRate), 0)
+	o.flush()
+	o.writePacket(commentHeader(), 0)
+	o.writePacket(s.header, 0)
+	o.flush()
+
+	// 第 k 个块覆盖 [(k-1)*hop, (k+1)*hop)，从第 1 个块起每块输出 hop 个采样
+	const hop = BlockSize / 2
+	blocks := (n + hop - 1) / hop
+	block := make([]float64, BlockSize)
+	for k := 0; k <= blocks; k++ {
+		start := (k - 1) * hop
+		for i := range block {
+			j := start + i
+			if j >= 0 && j < n {
+				block[i] = samples[j]
+			} else {
+				block[i] = 0
+			}
+		}
+		granule := int64(min(k*hop, n))
+		o.writePacket(s.encodeBlock(block), granule)
+	}
+	return o.close(), nil
+}
+
+// encodeBlock 编码一个音频数据包
+func (s *setup) encodeBlock(block []float64) []byte {
+	w := &bitWriter{}
+	w.write(0, 1) // 音频包，只有一个模式因此不写模式号
+
+	coeffs := s.mdct(block)
+	peak := 0.0
+	for _, c := range coeffs {
+		peak = math.Max(peak, math.Abs(c))
+	}
+	if peak < silenceLevel {
+		w.write(0, 1) // 底噪未使用，整块为零
+		return w.bytes()
+	}
+	w.write(1, 1)
+
+	floor := s.encodeFloor(w, coeffs)
+	s.encodeResidue(w, coeffs, floor)
+	return w.bytes()
+}
+
+// mdct 加窗后做正向 MDCT，缩放与解码器的反变换相匹配
+func (s *setup) mdct(block []float64) []float64 {
+	windowed := make([]float64, BlockSize)
+	for i, v := range block {
+		windowed[i] = v * s.window[i]
+	}
+	out := make([]float64, bins)
+	for k := range out {
+		basis := s.mdctBasis[k*BlockSize : (k+1)*BlockSize]
+		var sum float64
+		for i, v := range windowed {
+			sum += v * basis[i]
+		}
+		out[k] = sum * 2 / bins
+	}
+	return out
+}
+
+// encodeFloor 选取各控制点的 Y 值并写入，返回解码器将得到的底噪曲线
+func (s *setup) encodeFloor(w *bitWriter, coeffs []float64) []float64 {
+	count := len(s.xList)
+	blockPeak := 0.0
+	for _, c := range coeffs {
+		blockPeak = math.Max(blockPeak, math.Abs(c))
+	}
+	target := make([]int, count)
+	for i := range s.xList {
+		peak := 0.0
+		for _, c := range coeffs[s.bandLo[i]:s.bandHi[i]] {
+			peak = math.Max(peak, math.Abs(c))
+		}
+		target[i] = floorY(math.Max(peak*noiseRatio, blockPeak*maskRatio))
+	}
+
+	// 按解码器的预测规则把目标值转换为码字
+	finalY := make([]int, count)
+	used := make([]bool, count)
+	vals := make([]int, count)
+	finalY[0], finalY[1] = target[0], target[1]
+	used[0], used[1] = true, true
+	for i := 2; i < count; i++ {
+		lo, hi := s.low[i], s.high[i]
+		predicted := renderPoint(s.xList[lo], finalY[lo], s.xList[hi], finalY[hi], s.xList[i])
+		vals[i] = floorVal(target[i], predicted)
+		if vals[i] != 0 {
+			used[lo], used[hi], used[i] = true, true, true
+			finalY[i] = target[i]
+		} else {
+			finalY[i] = predicted
+		}
+	}
+
+	yBits := ilog(floorRange - 1)
+	w.write(uint32(target[0]), yBits)
+	w.write(uint32(target[1]), yBits)
+	for i := 2; i < count; i++ {
+		s.books[bookFloor].encode(w, vals[i])
+	}
+
+	// 与解码器相同的折线绘制
+	curve := make([]int, bins)
+	lx, ly := 0, finalY[0]*floorMultiplier
+	hx, hy := 0, 0
+	for _, i := range s.order[1:] {
+		if !used[i] {
+			continue
+		}
+		hx, hy = s.xList[i], finalY[i]*floorMultiplier
+		renderLine(lx, ly, hx, hy, curve)
+		lx, ly = hx, hy
+	}
+	if hx < bins {
+		renderLine(hx, hy, bins, hy, curve)
+	}
+
+	floor := make([]float64, bins)
+	for i, y := range curve {
+		floor[i] = inverseDB[y]
+	}
+	return floor
+}
+
+// encodeResidue 按底噪归一化并量化残差
+func (s *setup) encodeResidue(w *bitWriter, coeffs, floor []float64) {
+	q := make([]int, bins)
+	for i, c := range coeffs {
+		v := int(math.Round(c / floor[i]))
+		q[i] = max(-residueMax, min(residueMax, v))
+	}
+
+	partitions := bins / partitionSize
+	classes := make([]int, partitions)
+	for p := range classes {
+		peak := 0
+		for _, v := range q[p*partitionSize : (p+1)*partitionSize] {
+			peak = max(peak, v, -v)
+		}
+		for peak > residueClasses[classes[p]].peak {
+			classes[p]++
+		}
+	}
+
+	// 每一轮把剩余的残差量化到码本上最接近的向量，第二轮编码第一轮的余量
+	var idx [4]int
+	encodePartition := func(b *codebook, values []int) {
+		for i := 0; i < len(values); i += b.dim {
+			for d := 0; d < b.dim; d++ {
+				j := int(math.Round(float64(values[i+d]-b.minValue) / float64(b.delta)))
+				j = max(0, min(b.quantVals-1, j))
+				idx[d] = j
+				values[i+d] -= b.minValue + j*b.delta
+			}
+			b.encodeVector(w, idx[:b.dim])
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		for p := 0; p < partitions; p += classDim {
+			if pass == 0 {
+				entry := 0
+				for i := 0; i < classDim; i++ {
+					c := 0
+					if p+i < partitions {
+						c = classes[p+i]
+					}
+					entry = entry*len(residueClasses) + c
+				}
+				s.books[bookClass].encode(w, entry)
+			}
+			for i := p; i < p+classDim && i < partitions; i++ {
+				if b := residueClasses[classes[i]].books[pass]; b >= 0 {
+					encodePartition(s.books[b], q[i*partitionSize:(i+1)*partitionSize])
+				}
+			}
+		}
+	}
+}
+
+// floorY 返回幅度对应的 Y 值
+func floorY(amp float64) int {
+	if amp <= inverseDB[0] {
+		return 0
+	}
+	y := math.Log(amp/inverseDB[0]) / math.Log(1.0649863) / floorMultiplier
+	return max(0, min(floorRange-1, int(math.Round(y))))
+}
+
+// floorVal 把目标 Y 值编码为相对预测值的码字，0 表示直接使用预测值
+func floorVal(target, predicted int) int {
+	highroom := floorRange - predicted
+	lowroom := predicted
+	room := min(highroom, lowroom) * 2
+	diff := target - predicted
+	switch {
+	case diff == 0:
+		return 0
+	case diff > 0 && 2*diff < room:
+		return 2 * diff
+	case diff < 0 && -2*diff-1 < room:
+		return -2*diff - 1
+	case highroom > lowroom:
+		return diff + lowroom
+	default:
+		return -diff + highroom - 1
+	}
+}
+
+func renderPoint(x0, y0, x1, y1, x int) int {
+	dy := y1 - y0
+	adx := x1 - x0
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+	off := ady * (x - x0) / adx
+	if dy < 0 {
+		return y0 - off
+	}
+	return y0 + off
+}
+
+func renderLine(x0, y0, x1, y1 int, v []int) {
+	dy := y1 - y0
+	adx := x1 - x0
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+	base := dy / adx
+	sy := base + 1
+	if dy < 0 {
+		sy = base - 1
+	}
+	absBase := base
+	if absBase < 0 {
+		absBase = -absBase
+	}
+	ady -= absBase * adx
+	x, y, err := x0, y0, 0
+	if x < len(v) {
+		v[x] = y
+	}
+	for x = x0 + 1; x < x1 && x < len(v); x++ {
+		err += ady
+		if err >= adx {
+			err -= adx
+			y += sy
+		} else {
+			y += base
+		}
+		v[x] = y
+	}
+}
+
+func identificationHeader(sampleRate int) []byte {
+	b := make([]byte, 30)
+	b[0] = 1
+	copy(b[1:], "vorbis")
+	binary.LittleEndian.PutUint32(b[7:], 0)
+	b[11] = 1 // 单声道
+	binary.LittleEndian.PutUint32(b[12:], uint32(sampleRate))
+	exp := byte(ilog(BlockSize - 1))
+	b[28] = exp<<4 | exp
+	b[29] = 1
+	return b
+}
+
+func commentHeader() []byte {
+	w := &bitWriter{}
+	w.write(3, 8)
+	w.writeBytes([]byte("vorbis"))
+	w.write(uint32(len(Vendor)), 32)
+	w.writeBytes([]byte(Vendor))
+	w.write(0, 32)
+	w.writeBool(true)
+	return w.bytes()
+}
+
+// serialOf 由内容生成流序列号，相同输入得到相同输出
+func serialOf(data []byte) uint32 {
+	return checksum(0, data[:min(len(data), 4096)])
+}
@@ -0,0 +1,60 @@
+package vorbis
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestEncodeOggPages(t *testing.T) {
+	const sampleRate, samples = 16000, 16000
+	pcm := make([]byte, samples*2)
+	for i := 0; i < samples; i++ {
+		v := 8000 * math.Sin(2*math.Pi*440*float64(i)/sampleRate)
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(int16(v)))
+	}
+
+	out, err := Encode(pcm, sampleRate)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	var pages int
+	var granule int64
+	var flags byte
+	for len(out) > 0 {
+		if len(out) < 27 || string(out[:4]) != "OggS" {
+			t.Fatalf("page %d: bad capture pattern", pages)
+		}
+		n := int(out[26])
+		size := 27 + n
+		for _, s := range out[27 : 27+n] {
+			size += int(s)
+		}
+		page := append([]byte(nil), out[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if got := checksum(0, page); got != crc {
+			t.Fatalf("page %d: crc = %08x, want %08x", pages, got, crc)
+		}
+		if pages == 0 {
+			if page[5]&pageFlagBOS == 0 {
+				t.Error("first page is not BOS")
+			}
+			if string(page[28+n:34+n]) != "vorbis" {
+				t.Error("first packet is not the identification header")
+			}
+		}
+		flags = page[5]
+		granule = int64(binary.LittleEndian.Uint64(page[6:]))
+		out = out[size:]
+		pages++
+	}
+
+	if flags&pageFlagEOS == 0 {
+		t.Error("last page is not EOS")
+	}
+	if granule != samples {
+		t.Errorf("final granule = %d, want %d", granule, samples)
+	}
+}
@@ -0,0 +1,99 @@
+package vorbis
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	pageFlagBOS = 0x02
+	pageFlagEOS = 0x04
+
+	// maxPageSize 超过后开始新的页
+	maxPageSize = 4096
+)
+
+var crcTable [256]uint32
+
+func init() {
+	for i := range crcTable {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		crcTable[i] = r
+	}
+}
+
+// oggWriter 把数据包封装为单个逻辑流的 Ogg 页，数据包不跨页
+type oggWriter struct {
+	buf    bytes.Buffer
+	serial uint32
+	seq    uint32
+
+	segments []byte
+	body     []byte
+	granule  int64
+	flags    byte
+}
+
+// writePacket 追加数据包，granule 为该数据包结束时的采样位置
+func (o *oggWriter) writePacket(p []byte, granule int64) {
+	n := len(p)/255 + 1
+	if len(o.segments)+n > 255 || len(o.body)+len(p) > maxPageSize {
+		o.flush()
+	}
+	for i := 0; i < n-1; i++ {
+		o.segments = append(o.segments, 255)
+	}
+	o.segments = append(o.segments, byte(len(p)%255))
+	o.body = append(o.body, p...)
+	o.granule = granule
+}
+
+// flush 输出当前页
+func (o *oggWriter) flush() {
+	if len(o.segments) == 0 {
+		return
+	}
+	flags := o.flags
+	if o.seq == 0 {
+		flags |= pageFlagBOS
+	}
+
+	header := make([]byte, 27, 27+len(o.segments))
+	copy(header, "OggS")
+	header[5] = flags
+	binary.LittleEndian.PutUint64(header[6:], uint64(o.granule))
+	binary.LittleEndian.PutUint32(header[14:], o.serial)
+	binary.LittleEndian.PutUint32(header[18:], o.seq)
+	header[26] = byte(len(o.segments))
+	header = append(header, o.segments...)
+
+	crc := checksum(0, header)
+	crc = checksum(crc, o.body)
+	binary.LittleEndian.PutUint32(header[22:], crc)
+
+	o.buf.Write(header)
+	o.buf.Write(o.body)
+	o.seq++
+	o.segments, o.body, o.flags = o.segments[:0], o.body[:0], 0
+}
+
+// close 输出最后一页并标记流结束
+func (o *oggWriter) close() []byte {
+	o.flags |= pageFlagEOS
+	o.flush()
+	return o.buf.Bytes()
+}
+
+func checksum(crc uint32, data []byte) uint32 {
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}